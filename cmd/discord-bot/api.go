@@ -0,0 +1,149 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/maruel/sillybot/huggingface"
+	"github.com/maruel/sillybot/llm"
+)
+
+// apiModel is a known LLM as served by /models.
+type apiModel struct {
+	Source   string `json:"source"`
+	Upstream string `json:"upstream,omitempty"`
+	// Current is set on the model in use.
+	Current       bool              `json:"current"`
+	License       string            `json:"license,omitempty"`
+	Quantizations []apiQuantization `json:"quantizations,omitempty"`
+}
+
+// apiQuantization is a quantization of a known LLM.
+type apiQuantization struct {
+	Name string `json:"name"`
+	// Size is the file size in bytes.
+	Size int64 `json:"size,omitempty"`
+	// VRAM is the estimated VRAM needed in bytes.
+	VRAM int64 `json:"vram,omitempty"`
+}
+
+// apiStatus is the bot's status as served by /status.
+type apiStatus struct {
+	Uptime      string `json:"uptime"`
+	Model       string `json:"model,omitempty"`
+	LLM         string `json:"llm,omitempty"`
+	ImageGen    string `json:"image_gen,omitempty"`
+	QueueChat   int    `json:"queue_chat"`
+	QueueImages int    `json:"queue_images"`
+}
+
+// apiConversations is the number of conversations as served by
+// /conversations.
+type apiConversations struct {
+	// Active is the number of conversations active in the last hour.
+	Active int `json:"active"`
+	Total  int `json:"total"`
+}
+
+// api serves the models and the bot's status as JSON.
+type api struct {
+	d     *discordBot
+	token string
+}
+
+// newAPI returns the handler of the API. When token is not empty, it is
+// required as "Authorization: Bearer <token>".
+func newAPI(d *discordBot, token string) http.Handler {
+	a := &api{d: d, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /models", a.onModels)
+	mux.HandleFunc("GET /status", a.onStatus)
+	mux.HandleFunc("GET /conversations", a.onConversations)
+	return a.authenticate(mux)
+}
+
+// authenticate rejects the requests without the token.
+func (a *api) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) onModels(w http.ResponseWriter, r *http.Request) {
+	out := make([]apiModel, 0, len(a.d.knownLLMs))
+	for i := range a.d.knownLLMs {
+		k := &a.d.knownLLMs[i]
+		m := apiModel{Source: string(k.Source), Upstream: string(k.Upstream)}
+		if a.d.l == nil {
+			out = append(out, m)
+			continue
+		}
+		m.Current = string(a.d.l.CurrentModel()) != "python" && strings.HasPrefix(string(a.d.l.CurrentModel()), string(k.Source))
+		// The model information is cached by the client, so scripts polling
+		// /models don't hammer HuggingFace.
+		info := huggingface.Model{ModelRef: k.Source.ModelRef()}
+		if err := a.d.l.HF.GetModelInfo(r.Context(), &info); err != nil {
+			slog.Error("api", "message", "failed getting model info", "model", k.Source, "error", err)
+			out = append(out, m)
+			continue
+		}
+		m.License = info.License
+		for _, f := range k.QuantizationFiles(info.Files) {
+			q := apiQuantization{Name: k.QuantizationName(f), Size: info.FileSizes[f]}
+			if q.Size != 0 {
+				q.VRAM = llm.EstimateVRAM(q.Size)
+			}
+			m.Quantizations = append(m.Quantizations, q)
+		}
+		out = append(out, m)
+	}
+	writeJSON(w, out)
+}
+
+func (a *api) onStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	s := apiStatus{Uptime: time.Since(a.d.started).Round(time.Second).String()}
+	a.d.mu.Lock()
+	s.QueueChat, s.QueueImages = a.d.loadLocked()
+	a.d.mu.Unlock()
+	if a.d.l != nil {
+		s.Model = string(a.d.l.CurrentModel())
+		s.LLM = backendStatus(a.d.l.GetHealth(ctx))
+	}
+	if a.d.ig != nil {
+		s.ImageGen = backendStatus(a.d.ig.GetHealth(ctx))
+	}
+	writeJSON(w, &s)
+}
+
+func (a *api) onConversations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &apiConversations{
+		Active: a.d.mem.Count(time.Now().Add(-time.Hour)),
+		Total:  a.d.mem.Count(time.Time{}),
+	})
+}
+
+// writeJSON replies with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("api", "message", "failed writing reply", "error", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maruel/sillybot/llm"
+)
+
+func TestAPI(t *testing.T) {
+	d := &discordBot{
+		mem:       &llm.Memory{},
+		knownLLMs: []llm.KnownLLM{{Source: "hf:author/repo/model"}},
+		started:   time.Now().Add(-time.Minute),
+	}
+	d.mem.Get("u", "c")
+	srv := httptest.NewServer(newAPI(d, "secret"))
+	defer srv.Close()
+	get := func(path, token string, out interface{}) int {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	for i, token := range []string{"", "wrong"} {
+		if code := get("/status", token, nil); code != http.StatusUnauthorized {
+			t.Fatalf("#%d: want 401, got %d", i, code)
+		}
+	}
+	var models []apiModel
+	if code := get("/models", "secret", &models); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if len(models) != 1 || models[0].Source != "hf:author/repo/model" || models[0].Current {
+		t.Fatalf("%+v", models)
+	}
+	s := apiStatus{}
+	if code := get("/status", "secret", &s); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if s.Uptime != "1m0s" || s.Model != "" {
+		t.Fatalf("%+v", s)
+	}
+	c := apiConversations{}
+	if code := get("/conversations", "secret", &c); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if c.Active != 1 || c.Total != 1 {
+		t.Fatalf("%+v", c)
+	}
+	if code := get("/unknown", "secret", nil); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+}
@@ -8,21 +8,32 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"log/slog"
+	"math"
 	"math/big"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/maruel/sillybot"
@@ -30,6 +41,7 @@ import (
 	"github.com/maruel/sillybot/imagegen"
 	"github.com/maruel/sillybot/llm"
 	"github.com/maruel/sillybot/llm/tools"
+	_ "golang.org/x/image/webp"
 	"google.golang.org/api/customsearch/v1"
 	"google.golang.org/api/option"
 )
@@ -38,6 +50,23 @@ import (
 // that. There's a 4000 limit in some case (embeds?), investigate.
 const maxMessage = 2000
 
+// maxUpload is the maximum total size of the files attached to a message on a
+// non-boosted server and in direct messages.
+const maxUpload = 10 * 1024 * 1024
+
+// uploadLimit returns the maximum total size of the files attached to a
+// message in a guild with the boost level.
+func uploadLimit(tier discordgo.PremiumTier) int {
+	switch tier {
+	case discordgo.PremiumTier2:
+		return 50 * 1024 * 1024
+	case discordgo.PremiumTier3:
+		return 100 * 1024 * 1024
+	default:
+		return maxUpload
+	}
+}
+
 // discordBot is the live instance of the bot talking to the Discord API.
 //
 // Throughout the code, a Discord Server is called a "Guild". See
@@ -51,51 +80,145 @@ type discordBot struct {
 	ig        *imagegen.Session
 	settings  sillybot.Settings
 	memDir    string
-	toolsMsg  llm.Message
+	// promptLog is nil when disabled.
+	promptLog *sillybot.PromptLog
 	chat      chan msgReq
 	image     chan intReq
 	gcptoken  string
 	cxtoken   string
 	wg        sync.WaitGroup
+	// shutdownTimeout is the maximum time to wait in Close for the pending
+	// requests to complete. 0 means no limit.
+	shutdownTimeout time.Duration
+	// webhook mirrors the chat replies. It is nil when disabled.
+	webhook *webhookSink
+	// started is when the bot started, for /stats.
+	started time.Time
+	// limiter limits the requests of each user. It is nil when disabled.
+	limiter *rateLimiter
+
+	// mu protects the fields below. They track the state across gateway
+	// reconnects.
+	mu sync.Mutex
+	// registered is set once the commands were registered successfully.
+	registered bool
+	// cmds are the registered commands, listed by /help.
+	cmds []*discordgo.ApplicationCommand
+	// toolsMsg lists the tools for the prompt encodings supporting them. It
+	// changes with the model.
+	toolsMsg llm.Message
+	// chatTools are the tools the LLM can call while chatting. nil when
+	// disabled or unsupported by the model.
+	chatTools []llm.Tool
+	// guilds are the guilds already seen, so they are not welcomed again.
+	guilds map[string]struct{}
+	// locales are the users' Discord locale, as seen in their last
+	// interaction. Messages do not include the locale.
+	locales map[string]seenLocale
+	// localesSwept is when the stale locales were last forgotten.
+	localesSwept time.Time
+	// active are the requests being processed by chatRoutine and imageRoutine,
+	// to be able to report them if they are abandoned on shutdown.
+	active map[string]string
+	// pendingImages is the number of images requested in the image queue,
+	// including the one being processed.
+	pendingImages int
+	// waitingChat and waitingImages are the requests waiting for room in the
+	// queues, in order, when the overflow behavior is "wait".
+	waitingChat   []msgReq
+	waitingImages []intReq
+	// presence is the presence text last set.
+	presence string
+	// cancels are the streamed replies in progress that can be cancelled,
+	// keyed by the ID of the message with the cancel button.
+	cancels map[string]pendingReply
+	// previews are the enhanced image requests waiting for the user to click
+	// the generate button, keyed by the ID of the interaction that asked.
+	previews map[string]pendingPreview
+	// upscales are the last image of each image message, for its upscale
+	// button, keyed by the message ID.
+	upscales map[string]pendingUpscale
+	// noUpscale is set once the image server reported it doesn't support
+	// upscaling, to stop offering it.
+	noUpscale bool
+	// lastRequests are the last request of each user in each channel, for
+	// /regenerate.
+	lastRequests lastRequests
+	// channels are when each channel was last used, to post the goodbye
+	// message.
+	channels map[string]time.Time
+	// channelsSwept is when the idle channels were last forgotten.
+	channelsSwept time.Time
+	// chatLatency and imageLatency are the processing time of the requests,
+	// for /stats.
+	chatLatency  latency
+	imageLatency latency
+	// metrics serves the Prometheus metrics, when enabled.
+	metrics *httpServer
+	// api serves the models and the bot's status as JSON, when enabled.
+	api *httpServer
+}
+
+// latency accumulates the processing time of requests.
+type latency struct {
+	count int
+	total time.Duration
+}
+
+func (l *latency) add(d time.Duration) {
+	l.count++
+	l.total += d
+}
+
+// String returns the average latency, e.g. "2.5s over 4 requests".
+func (l *latency) String() string {
+	if l.count == 0 {
+		return "no request yet"
+	}
+	avg := (l.total / time.Duration(l.count)).Round(100 * time.Millisecond)
+	if l.count == 1 {
+		return avg.String() + " over 1 request"
+	}
+	return fmt.Sprintf("%s over %d requests", avg, l.count)
+}
+
+// pendingPreview is an enhanced image request waiting to be generated.
+type pendingPreview struct {
+	// authorID is the user who asked, the only one allowed to generate.
+	authorID string
+	created  time.Time
+	// last is the original request along the labels and the image prompt
+	// generated by the LLM.
+	last lastRequest
+	seed int
+}
+
+// pendingReply is a streamed reply in progress.
+type pendingReply struct {
+	// authorID is the user who asked, the only one allowed to cancel.
+	authorID string
+	cancel   context.CancelFunc
+	// queued is set when the request is still waiting in line.
+	queued bool
 }
 
 // newDiscordBot opens a websocket connection to Discord and begin listening.
-func newDiscordBot(ctx context.Context, bottoken, gcptoken, cxtoken string, verbose bool, l *llm.Session, mem *llm.Memory, knownLLMs []llm.KnownLLM, ig *imagegen.Session, settings sillybot.Settings, memDir string) (*discordBot, error) {
-	toolsMsg := llm.Message{}
-	if l.Encoding != nil && strings.Contains(strings.ToLower(string(l.Model)), "mistral") {
-		slog.Info("discord", "message", "tools are enabled", "encoding", l.Encoding)
-		// HACK: Also an hack.
-		availtools := []tools.MistralTool{
-			/*
-				{
-					Type: "function",
-					Function: tools.MistralFunction{
-						Name:        "web_search",
-						Description: "Search the web for information",
-						Parameters: &tools.MistralFunctionParams{
-							Type: "object",
-							Properties: map[string]tools.MistralProperty{
-								"query": {
-									Type:        "string",
-									Description: "Query to use to search on the internet",
-								},
-							},
-							Required: []string{"query"},
-						},
-					},
-				},
-			*/
-			tools.CalculateMistralTool,
-			tools.GetTodayClockTimeMistralTool,
+func newDiscordBot(ctx context.Context, bottoken, gcptoken, cxtoken string, verbose bool, l *llm.Session, mem *llm.Memory, knownLLMs []llm.KnownLLM, ig *imagegen.Session, settings sillybot.Settings, memDir string, shutdownTimeout time.Duration) (*discordBot, error) {
+	toolsMsg, chatTools, err := newTools(l, ig, settings.ChatTools)
+	if err != nil {
+		return nil, err
+	}
+
+	var promptLog *sillybot.PromptLog
+	if settings.PromptLog.Path != "" {
+		opts := settings.PromptLog
+		if !filepath.IsAbs(opts.Path) {
+			opts.Path = filepath.Join(memDir, opts.Path)
 		}
-		b, err := json.Marshal(availtools)
-		if err != nil {
+		var err error
+		if promptLog, err = sillybot.NewPromptLog(&opts); err != nil {
 			return nil, err
 		}
-		toolsMsg = llm.Message{
-			Role:    llm.AvailableTools,
-			Content: string(b),
-		}
 	}
 
 	discordgo.Logger = func(msgL, caller int, format string, a ...interface{}) {
@@ -113,6 +236,9 @@ func newDiscordBot(ctx context.Context, bottoken, gcptoken, cxtoken string, verb
 	}
 	dg, err := discordgo.New("Bot " + bottoken)
 	if err != nil {
+		if promptLog != nil {
+			_ = promptLog.Close()
+		}
 		return nil, err
 	}
 	if verbose {
@@ -122,6 +248,14 @@ func newDiscordBot(ctx context.Context, bottoken, gcptoken, cxtoken string, verb
 	}
 	// We want to receive as few messages as possible.
 	dg.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentDirectMessages
+	chatQueue := settings.Queue.Chat
+	if chatQueue == 0 {
+		chatQueue = 5
+	}
+	imageQueue := settings.Queue.Image
+	if imageQueue == 0 {
+		imageQueue = 3
+	}
 	d := &discordBot{
 		ctx:       ctx,
 		dg:        dg,
@@ -131,24 +265,85 @@ func newDiscordBot(ctx context.Context, bottoken, gcptoken, cxtoken string, verb
 		ig:        ig,
 		settings:  settings,
 		memDir:    memDir,
+		promptLog: promptLog,
 		toolsMsg:  toolsMsg,
-		chat:      make(chan msgReq, 5),
-		image:     make(chan intReq, 3),
+		chatTools: chatTools,
+		chat:      make(chan msgReq, chatQueue),
+		image:     make(chan intReq, imageQueue),
 		gcptoken:  gcptoken,
 		cxtoken:   cxtoken,
+		started:   time.Now(),
+		limiter:   newRateLimiter(&settings.RateLimit),
+
+		shutdownTimeout: shutdownTimeout,
+		guilds:          map[string]struct{}{},
+		locales:         map[string]seenLocale{},
+		active:          map[string]string{},
+		cancels:         map[string]pendingReply{},
+		previews:        map[string]pendingPreview{},
+		upscales:        map[string]pendingUpscale{},
+		channels:        map[string]time.Time{},
+	}
+	if settings.ChatWebhook.URL != "" {
+		d.webhook = newWebhookSink(ctx, &settings.ChatWebhook)
+	}
+	if settings.Metrics.Listen != "" {
+		if d.metrics, err = newMetricsServer(settings.Metrics.Listen, d); err != nil {
+			if promptLog != nil {
+				_ = promptLog.Close()
+			}
+			return nil, fmt.Errorf("failed to serve the metrics: %w", err)
+		}
+	}
+	if settings.API.Listen != "" {
+		if d.api, err = serveHTTP("api", settings.API.Listen, "/status", newAPI(d, settings.API.Token)); err != nil {
+			if d.metrics != nil {
+				_ = d.metrics.Close()
+			}
+			if promptLog != nil {
+				_ = promptLog.Close()
+			}
+			return nil, fmt.Errorf("failed to serve the api: %w", err)
+		}
 	}
 	// The events are listed at
 	// https://discord.com/developers/docs/topics/gateway-events#receive-events
 	// Note that all messages are called asynchronously.
 	_ = dg.AddHandler(d.onReady)
+	_ = dg.AddHandler(d.onResumed)
 	_ = dg.AddHandler(d.onGuildCreate)
 	_ = dg.AddHandler(d.onMessageCreate)
+	if settings.ReactionTrigger != "" {
+		// The content of the reacted message is only returned with the message
+		// content intent, a privileged intent that must be enabled in the
+		// developer portal.
+		dg.Identify.Intents |= discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions | discordgo.IntentMessageContent
+		_ = dg.AddHandler(d.onMessageReactionAdd)
+	}
 	_ = dg.AddHandler(d.onInteractionCreate)
-	d.wg.Add(2)
+	d.wg.Add(1 + d.imageWorkers())
 	go d.chatRoutine()
-	go d.imageRoutine()
+	for i := 0; i < d.imageWorkers(); i++ {
+		name := "image"
+		if i > 0 {
+			name += strconv.Itoa(i + 1)
+		}
+		go d.imageRoutine(name)
+	}
+	if settings.Presence.ShowLoad {
+		go d.presenceRoutine()
+	}
 	if err = dg.Open(); err != nil {
 		_ = d.dg.Close()
+		if d.api != nil {
+			_ = d.api.Close()
+		}
+		if d.metrics != nil {
+			_ = d.metrics.Close()
+		}
+		if promptLog != nil {
+			_ = promptLog.Close()
+		}
 		return nil, err
 	}
 	slog.Info("discord", "state", "running", "info", "Press CTRL-C to exit.")
@@ -157,28 +352,214 @@ func newDiscordBot(ctx context.Context, bottoken, gcptoken, cxtoken string, verb
 
 func (d *discordBot) Close() error {
 	slog.Info("discord", "state", "terminating")
-	// TODO: Send a bye bye before closing.
-	// TODO: Set presence to "away". It's already the case for channels but not
-	// for direct messages.
+	d.sayGoodbye()
 	err := d.dg.Close()
-	d.chat <- msgReq{}
-	d.image <- intReq{}
-	d.wg.Wait()
+	d.dropWaiting()
+	// Let the pending requests complete, up to shutdownTimeout. A backend may
+	// hang, make sure the process still exits.
+	done := make(chan struct{})
+	go func() {
+		d.chat <- msgReq{}
+		for i := 0; i < d.imageWorkers(); i++ {
+			d.image <- intReq{}
+		}
+		d.wg.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if d.shutdownTimeout > 0 {
+		timeout = time.After(d.shutdownTimeout)
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		d.mu.Lock()
+		for routine, req := range d.active {
+			slog.Error("discord", "message", "abandoned request", "routine", routine, "request", req)
+		}
+		d.mu.Unlock()
+		slog.Error("discord", "message", "timed out waiting for requests", "timeout", d.shutdownTimeout, "pending_chat", len(d.chat), "pending_image", len(d.image))
+	}
+	// The abandoned requests may still be streaming, the webhook drops their
+	// chunks once closed.
+	if d.webhook != nil {
+		_ = d.webhook.Close()
+	}
+	if d.promptLog != nil {
+		if err2 := d.promptLog.Close(); err == nil {
+			err = err2
+		}
+	}
+	if d.metrics != nil {
+		if err2 := d.metrics.Close(); err == nil {
+			err = err2
+		}
+	}
+	if d.api != nil {
+		if err2 := d.api.Close(); err == nil {
+			err = err2
+		}
+	}
 	return err
 }
 
+// dropWaiting tells the users whose requests are still waiting for room in
+// the queues that they won't be processed.
+func (d *discordBot) dropWaiting() {
+	d.mu.Lock()
+	chat, images := d.waitingChat, d.waitingImages
+	d.waitingChat, d.waitingImages = nil, nil
+	d.mu.Unlock()
+	if len(chat) == 0 && len(images) == 0 {
+		return
+	}
+	slog.Warn("discord", "message", "dropping waiting requests", "chat", len(chat), "image", len(images))
+	for _, req := range chat {
+		if _, err := d.channelMessageSendComplex(req.replyToID, req.channelID, req.guildID, tr(d.userLocale(req.authorID), msgShuttingDown)); err != nil {
+			slog.Error("discord", "message", "failed posting message", "error", err)
+		}
+	}
+	for _, req := range images {
+		if req.int == nil {
+			// Requested by the chat tools, there's no interaction to reply to.
+			continue
+		}
+		content := tr(req.int.Locale, msgShuttingDown)
+		if _, err := d.dg.InteractionResponseEdit(req.int, &discordgo.WebhookEdit{Content: &content}); err != nil {
+			slog.Error("discord", "message", "failed reply", "error", err)
+		}
+	}
+}
+
+// sayGoodbye sets the presence to idle and posts the goodbye message to the
+// channels used recently, if configured.
+func (d *discordBot) sayGoodbye() {
+	g := &d.settings.Goodbye
+	u := presenceData("", "")
+	u.Status = string(discordgo.StatusIdle)
+	idle := int(time.Now().UnixMilli())
+	u.IdleSince = &idle
+	if err := d.dg.UpdateStatusComplex(u); err != nil {
+		slog.Error("discord", "message", "failed to update presence", "error", err)
+	}
+	if g.Message == "" {
+		return
+	}
+	recent := d.goodbyeRecent()
+	timeout := g.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	d.mu.Lock()
+	channels := recentChannels(d.channels, time.Now().Add(-recent), maxGoodbyeChannels)
+	d.mu.Unlock()
+	// Use a new context since d.ctx is likely already cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, c := range channels {
+		if _, err := d.dg.ChannelMessageSend(c, g.Message, discordgo.WithContext(ctx)); err != nil {
+			slog.Error("discord", "message", "failed posting goodbye", "channel", c, "error", err)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// maxGoodbyeChannels is the maximum number of channels the goodbye message is
+// posted to, to stay clear of Discord's rate limit.
+const maxGoodbyeChannels = 20
+
+// recentChannels returns the channels used since the specified time, most
+// recent first, up to max.
+func recentChannels(channels map[string]time.Time, since time.Time, max int) []string {
+	var out []string
+	for c, t := range channels {
+		if !t.Before(since) {
+			out = append(out, c)
+		}
+	}
+	slices.SortFunc(out, func(a, b string) int { return channels[b].Compare(channels[a]) })
+	if len(out) > max {
+		out = out[:max]
+	}
+	return out
+}
+
+// goodbyeRecent returns how recently a channel must have been used to
+// receive the goodbye message.
+func (d *discordBot) goodbyeRecent() time.Duration {
+	if r := d.settings.Goodbye.Recent; r != 0 {
+		return r
+	}
+	return time.Hour
+}
+
+// touchChannel records that a channel was used.
+func (d *discordBot) touchChannel(channelID string) {
+	d.mu.Lock()
+	d.touchChannelLocked(channelID, time.Now())
+	d.mu.Unlock()
+}
+
+// touchChannelLocked records that a channel was used. It forgets the channels
+// too idle to receive the goodbye message, at most once per hour, so the map
+// doesn't grow with every channel ever used.
+func (d *discordBot) touchChannelLocked(channelID string, now time.Time) {
+	d.channels[channelID] = now
+	if now.Sub(d.channelsSwept) < time.Hour {
+		return
+	}
+	d.channelsSwept = now
+	recent := d.goodbyeRecent()
+	for id, t := range d.channels {
+		if now.Sub(t) > recent {
+			delete(d.channels, id)
+		}
+	}
+}
+
+// setActive records the request being processed by a routine. Use an empty
+// req when done.
+func (d *discordBot) setActive(routine, req string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if req == "" {
+		delete(d.active, routine)
+	} else {
+		d.active[routine] = req
+	}
+}
+
 // Handlers
 
 // onReady is received right after the initial handshake.
 //
 // It's the very first message. At this point, guilds are not yet available.
+// It is received again when discordgo reconnects with a new session, in which
+// case the commands are not registered again.
 // See https://discord.com/developers/docs/topics/gateway-events#ready
 func (d *discordBot) onReady(dg *discordgo.Session, r *discordgo.Ready) {
 	//slog.Debug("discord", "event", "ready", "session", dg, "event", r)
+	// The presence is reset on each new session.
+	d.mu.Lock()
+	registered := d.registered
+	d.presence = ""
+	d.mu.Unlock()
+	d.updatePresence()
+	if registered {
+		slog.Info("discord", "event", "ready", "user", r.User.String(), "message", "reconnected")
+		return
+	}
 	slog.Info("discord", "event", "ready", "user", r.User.String())
 
 	// TODO: Get list of DMs and tell users "I'm back up!"
 
+	var loras, samplers []string
+	if d.ig != nil {
+		loras = d.ig.LoRAs()
+		samplers = d.ig.Samplers()
+	}
 	// See https://discord.com/developers/docs/interactions/application-commands
 	cmds := []*discordgo.ApplicationCommand{
 		// meme_*
@@ -186,25 +567,35 @@ func (d *discordBot) onReady(dg *discordgo.Session, r *discordgo.Ready) {
 			Name:        "meme_auto",
 			Type:        discordgo.ChatApplicationCommand,
 			Description: "Generate a meme in full automatic mode. Create both the image and labels by leveraging the LLM.",
-			Options: []*discordgo.ApplicationCommandOption{
+			Options: slices.Concat([]*discordgo.ApplicationCommandOption{
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "description",
 					Description: "Description used to generate both the meme labels and background image. The LLM will enhance both.",
 					Required:    true,
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "preview",
+					Description: "Only show the enhanced prompt, with a button to generate the image once you approve it.",
+				},
 				{
 					Type:        discordgo.ApplicationCommandOptionInteger,
 					Name:        "seed",
-					Description: "Seed to use to enable (or disable with 0) deterministic image generation. Defaults to 1",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
 				},
-			},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "no_watermark",
+					Description: "Do not add the watermark, unless it is required on this server.",
+				},
+			}, imageSizeOptions(), samplingOptions()),
 		},
 		{
 			Name:        "meme_manual",
 			Type:        discordgo.ChatApplicationCommand,
 			Description: "Generate a meme in full manual mode. Specify both the image and the labels yourself.",
-			Options: []*discordgo.ApplicationCommandOption{
+			Options: slices.Concat([]*discordgo.ApplicationCommandOption{
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "image_prompt",
@@ -220,15 +611,32 @@ func (d *discordBot) onReady(dg *discordgo.Session, r *discordgo.Ready) {
 				{
 					Type:        discordgo.ApplicationCommandOptionInteger,
 					Name:        "seed",
-					Description: "Seed to use to enable (or disable with 0) deterministic image generation. Defaults to 1",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
 				},
-			},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "no_watermark",
+					Description: "Do not add the watermark, unless it is required on this server.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "outline_color",
+					Description: "Color of the outline around the labels as #RRGGBB. Defaults to black.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "outline_radius",
+					Description: "Thickness of the outline around the labels in pixels. Defaults to 5.",
+					MinValue:    &minOutlineRadius,
+					MaxValue:    maxOutlineRadius,
+				},
+			}, imageSizeOptions(), stepsOptions()),
 		},
 		{
 			Name:        "meme_labels_auto",
 			Type:        discordgo.ChatApplicationCommand,
 			Description: "Generate meme labels in automatic mode. Create the text by leveraging the LLM.",
-			Options: []*discordgo.ApplicationCommandOption{
+			Options: append([]*discordgo.ApplicationCommandOption{
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "description",
@@ -238,9 +646,9 @@ func (d *discordBot) onReady(dg *discordgo.Session, r *discordgo.Ready) {
 				{
 					Type:        discordgo.ApplicationCommandOptionInteger,
 					Name:        "seed",
-					Description: "Seed to use to enable (or disable with 0) deterministic image generation. Defaults to 1",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
 				},
-			},
+			}, samplingOptions()...),
 		},
 
 		// image_*
@@ -248,25 +656,42 @@ func (d *discordBot) onReady(dg *discordgo.Session, r *discordgo.Ready) {
 			Name:        "image_auto",
 			Type:        discordgo.ChatApplicationCommand,
 			Description: "Generate an image in automatic mode. It automatically uses the LLM to enhance the prompt.",
-			Options: []*discordgo.ApplicationCommandOption{
+			Options: slices.Concat([]*discordgo.ApplicationCommandOption{
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "description",
 					Description: "Description to use to generate the image. The LLM will enhance it.",
 					Required:    true,
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "preview",
+					Description: "Only show the enhanced prompt, with a button to generate the image once you approve it.",
+				},
 				{
 					Type:        discordgo.ApplicationCommandOptionInteger,
 					Name:        "seed",
-					Description: "Seed to use to enable (or disable with 0) deterministic image generation. Defaults to 1",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
 				},
-			},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "no_watermark",
+					Description: "Do not add the watermark, unless it is required on this server.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "count",
+					Description: "Number of variations to generate, each with a different seed.",
+					MinValue:    &minImageCount,
+					MaxValue:    imageBatch,
+				},
+			}, imageSizeOptions(), samplingOptions(), loraOptions(loras), samplerOptions(samplers)),
 		},
 		{
 			Name:        "image_manual",
 			Type:        discordgo.ChatApplicationCommand,
 			Description: "Generate an image in manual mode.",
-			Options: []*discordgo.ApplicationCommandOption{
+			Options: slices.Concat([]*discordgo.ApplicationCommandOption{
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "image_prompt",
@@ -276,105 +701,499 @@ func (d *discordBot) onReady(dg *discordgo.Session, r *discordgo.Ready) {
 				{
 					Type:        discordgo.ApplicationCommandOptionInteger,
 					Name:        "seed",
-					Description: "Seed to use to enable (or disable with 0) deterministic image generation. Defaults to 1",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
 				},
-			},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "no_watermark",
+					Description: "Do not add the watermark, unless it is required on this server.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "count",
+					Description: "Number of variations to generate, each with a different seed.",
+					MinValue:    &minImageCount,
+					MaxValue:    imageBatch,
+				},
+			}, imageSizeOptions(), stepsOptions(), loraOptions(loras), samplerOptions(samplers)),
 		},
-
-		// Various
 		{
-			Name:        "close_thread",
+			Name:        "image_remix",
 			Type:        discordgo.ChatApplicationCommand,
-			Description: "Close the thread that was created.",
+			Description: "Generate an image based on one you upload.",
+			Options: slices.Concat([]*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "image_prompt",
+					Description: "Exact Stable Diffusion style prompt to use to transform the image.",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "image",
+					Description: "Image to remix, PNG, JPEG, GIF or WebP up to 10MiB.",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "strength",
+					Description: "How much to transform the image, from 0.1 (barely) to 1 (completely). Defaults to 0.6.",
+					MinValue:    &minStrength,
+					MaxValue:    1,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "seed",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "no_watermark",
+					Description: "Do not add the watermark, unless it is required on this server.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "count",
+					Description: "Number of variations to generate, each with a different seed.",
+					MinValue:    &minImageCount,
+					MaxValue:    imageBatch,
+				},
+			}, loraOptions(loras), samplerOptions(samplers)),
 		},
 		{
-			Name:        "list_models",
+			Name:        "seed_from_image",
 			Type:        discordgo.ChatApplicationCommand,
-			Description: "List available LLM models and the one currently used.",
+			Description: "Show the prompt, seed and parameters of an image I generated, to generate it again.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "image",
+					Description: "PNG image generated by the bot, as downloaded from Discord.",
+					Required:    true,
+				},
+			},
 		},
 		{
-			Name:        "metrics",
+			Name:        "regenerate",
 			Type:        discordgo.ChatApplicationCommand,
-			Description: "Displays the current performance metrics.",
+			Description: "Redo your last image or chat request in this channel with a new seed.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "enhance",
+					Description: "Use the LLM again to enhance the description. By default, the previous labels and image prompt are reused.",
+				},
+			},
 		},
 
-		// forget
+		// prefs
 		{
-			Name:        "forget",
+			Name:        "prefs",
 			Type:        discordgo.ChatApplicationCommand,
-			Description: "Forget our past conversation. Optionally overrides the system prompt.",
+			Description: "View or set your personal image generation defaults. Without options, shows them.",
 			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "steps",
+					Description: "Number of inference steps.",
+					MinValue:    &minSteps,
+					MaxValue:    maxSteps,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "width",
+					Description: "Image width in pixels. Must be a multiple of 64. Requires height.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "height",
+					Description: "Image height in pixels. Must be a multiple of 64. Requires width.",
+				},
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
-					Name:        "system_prompt",
-					Description: "New system prompt to use.",
+					Name:        "negative_prompt",
+					Description: "What you do not want to see in your images.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "style",
+					Description: "Style appended to all your image prompts, e.g. \"watercolor\".",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "keep_background",
+					Description: "Also attach the image without the labels when generating memes.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "reset",
+					Description: "Reset all your preferences to the defaults.",
 				},
 			},
 		},
+
+		// prompt_templates
 		{
-			Name: "forget",
-			Type: discordgo.UserApplicationCommand,
+			Name:        "prompt_templates",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "List the prompt templates or apply one by name. Without options, lists them.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "Name of the template to apply.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "params",
+					Description: "Parameters to substitute in the form \"key=value; key2=value2\".",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "seed",
+					Description: "Seed to reproduce a previous image. Random when omitted or 0; the seed used is shown in the reply.",
+				},
+			},
 		},
-	}
-	if strings.Contains(dg.State.User.Username, "(dev)") {
-		for _, c := range cmds {
-			c.Name += "_dev"
-		}
-	}
-	if _, err := dg.ApplicationCommandBulkOverwrite(r.Application.ID, "", cmds); err != nil {
-		// TODO: Make this a hard fail.
-		slog.Error("discord", "message", "failed to register commands", "error", err)
-		return
-	}
-	slog.Info("discord", "message", "registered commands", "number", len(cmds))
-}
 
-// onGuildCreate is received when new guild (server) is joined or becomes
-// available right after connecting.
-//
-// https://discord.com/developers/docs/topics/gateway-events#guild-create
-func (d *discordBot) onGuildCreate(dg *discordgo.Session, event *discordgo.GuildCreate) {
+		// Various
+		{
+			Name:        "ask",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Ask a one-off question, without our conversation's memory.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "prompt",
+					Description: "Question to ask.",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "describe",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Describe an image you upload, without our conversation's memory.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "image",
+					Description: "Image to describe, PNG, JPEG, GIF or WebP up to 10MiB.",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "detailed",
+					Description: "Describe the image in details instead of a one sentence caption.",
+				},
+			},
+		},
+		{
+			Name:        "help",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "List the commands and how to chat with the bot.",
+		},
+		{
+			Name:        "close_thread",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Close the thread that was created.",
+		},
+		{
+			Name:        "list_models",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "List available LLM models and the one currently used.",
+		},
+		{
+			Name:        "model_info",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Show detailed information about one LLM model.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "model",
+					Description:  "Name of the model as listed by /list_models.",
+					Required:     true,
+					Autocomplete: true,
+				},
+			},
+		},
+		{
+			Name:                     "switch_model",
+			Type:                     discordgo.ChatApplicationCommand,
+			Description:              "Switch the LLM model. It is downloaded first if needed.",
+			DefaultMemberPermissions: &adminPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "model",
+					Description:  "Name of the model as listed by /list_models.",
+					Required:     true,
+					Autocomplete: true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "quantization",
+					Description: "Quantization to use, e.g. \"Q5_K_M\". Defaults to the largest that fits or the current one.",
+				},
+			},
+		},
+		{
+			Name:        "metrics",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Displays the current performance metrics.",
+		},
+		{
+			Name:        "stats",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Displays the bot's uptime, load and models.",
+		},
+
+		// forget
+		{
+			Name:        "forget",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Forget our past conversation. Optionally overrides the system prompt.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "system_prompt",
+					Description: "New system prompt to use.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "language",
+					Description: "Language to reply in, e.g. \"French\". Defaults to your Discord language when enabled.",
+				},
+			},
+		},
+		{
+			Name: "forget",
+			Type: discordgo.UserApplicationCommand,
+		},
+		{
+			Name:        "persona",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Switch the persona of our conversation. Without options, lists them.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "name",
+					Description:  "Name of the persona. Use \"default\" for the default system prompt.",
+					Autocomplete: true,
+				},
+			},
+		},
+		{
+			Name:        "export",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Download our conversation as a file.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "format",
+					Description: "File format. Defaults to markdown.",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "markdown", Value: "markdown"},
+						{Name: "json", Value: "json"},
+					},
+				},
+			},
+		},
+		{
+			Name:                     "forget_server",
+			Type:                     discordgo.ChatApplicationCommand,
+			Description:              "Forget all the conversations on this server, e.g. after changing the system prompt.",
+			DefaultMemberPermissions: &adminPermission,
+		},
+		{
+			Name:        "set_context_length",
+			Type:        discordgo.ChatApplicationCommand,
+			Description: "Set how many recent turns of our conversation to remember. Older ones are forgotten.",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "turns",
+					Description: "Number of recent turns to remember. Use 0 to remove the limit.",
+					MinValue:    &minTurns,
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:                     "system_prompt",
+			Type:                     discordgo.ChatApplicationCommand,
+			Description:              "View or override the system prompt for this server or channel.",
+			DefaultMemberPermissions: &adminPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "prompt",
+					Description: "New system prompt to use for the new conversations.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "scope",
+					Description: "Apply to the whole server or only this channel. Defaults to the server.",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "server", Value: "server"},
+						{Name: "channel", Value: "channel"},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "reset",
+					Description: "Remove the override, reverting to the default system prompt.",
+				},
+			},
+		},
+	}
+	if d.settings.DebugCommands {
+		cmds = append(cmds, &discordgo.ApplicationCommand{
+			Name:                     "debug_meme",
+			Type:                     discordgo.ChatApplicationCommand,
+			Description:              "Render labels on a blank image to tune the meme renderer.",
+			DefaultMemberPermissions: &adminPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "labels",
+					Description: "Labels to draw, separated by commas.",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "background",
+					Description: "Background color as #RRGGBB. Defaults to gray.",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "font_scale",
+					Description: "Multiplier of the automatically selected font size. Defaults to 1.",
+					MinValue:    &minFontScale,
+					MaxValue:    maxFontScale,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "outline_radius",
+					Description: "Radius of the text outline in pixels. Defaults to 5.",
+					MinValue:    &minOutlineRadius,
+					MaxValue:    maxOutlineRadius,
+				},
+			},
+		})
+	}
+	if strings.Contains(dg.State.User.Username, "(dev)") {
+		for _, c := range cmds {
+			c.Name += "_dev"
+		}
+	}
+	if _, err := dg.ApplicationCommandBulkOverwrite(r.Application.ID, "", cmds); err != nil {
+		// TODO: Make this a hard fail.
+		slog.Error("discord", "message", "failed to register commands", "error", err)
+		return
+	}
+	d.mu.Lock()
+	d.registered = true
+	d.cmds = cmds
+	d.mu.Unlock()
+	slog.Info("discord", "message", "registered commands", "number", len(cmds))
+}
+
+// onResumed is received when discordgo reconnected and resumed the previous
+// session. No event was lost so there's nothing to do.
+//
+// See https://discord.com/developers/docs/topics/gateway-events#resumed
+func (d *discordBot) onResumed(dg *discordgo.Session, r *discordgo.Resumed) {
+	slog.Info("discord", "event", "resumed")
+}
+
+// onGuildCreate is received when new guild (server) is joined or becomes
+// available right after connecting.
+//
+// https://discord.com/developers/docs/topics/gateway-events#guild-create
+func (d *discordBot) onGuildCreate(dg *discordgo.Session, event *discordgo.GuildCreate) {
 	//slog.Debug("discord", "event", "guildCreate", "event", event.Guild)
 	slog.Info("discord", "event", "guildCreate", "name", event.Guild.Name)
 	if event.Guild.Unavailable {
 		return
 	}
-	// This is too spammy.
-	if false {
-		const welcome = "I'm back up! 👋 I can do many things!\n" +
-			"- Tag me in channels to chat with me. Start a DM to talk alone, then no need to tag me at every messages.\n" +
-			"- Check out my commands by typing the '/' slash key:\n" +
-			"  * I can generate images and memes 🖼️. Try `/image_auto flowers garden gorgeous realistic`, or `/meme_auto AI overlord` or `/meme_auto flowers garden fun`\n" +
-			"  * Get information about me. Try `/list_models`, `/metrics`\n" +
-			"  * I sometimes get stuck! Reset my memory 🧠 and optionally change my system prompt with `/forget`\n" +
-			"I'm a work in progress! Please submit fixes and improvements at https://github.com/maruel/sillybot !\n" +
-			"**Warning**: I have no privacy protection yet. I do not listen unless you tag me directly.\n" +
-			"**Important**: Keep it civil otherwise I'll have to be turned down.\n"
-		for _, channel := range event.Guild.Channels {
-			if t := channel.Type; t == discordgo.ChannelTypeGuildVoice || t == discordgo.ChannelTypeGuildCategory {
-				continue
-			}
-			// Don't alert again if the last connection was recent, to not spam the
-			// channel.
-			msgs, err := dg.ChannelMessages(channel.ID, 5, "", "", "")
-			if err != nil {
-				slog.Error("discord", "error", err)
-			}
-			skip := false
-			for _, msg := range msgs {
-				//  && msg.Content == welcome
-				if msg.Author.ID == dg.State.User.ID {
-					slog.Info("discord", "message", "skipping welcome to not spam", "channel", channel.Name)
-					skip = true
-					break
-				}
-			}
-			if !skip {
-				slog.Info("discord", "message", "welcome", "channel", channel.Name)
-				_, _ = dg.ChannelMessageSend(channel.ID, welcome)
-			}
+	if d.seenGuild(event.Guild.ID) {
+		// It's a reconnect, don't welcome again.
+		slog.Info("discord", "event", "guildCreate", "name", event.Guild.Name, "message", "already seen")
+		return
+	}
+	welcome := d.settings.Welcome.Message
+	if d.settings.Welcome.Builtin {
+		welcome = tr(discordgo.Locale(event.Guild.PreferredLocale), msgWelcome)
+	}
+	if welcome == "" || slices.Contains(d.settings.Welcome.Disabled, event.Guild.ID) || !d.settings.Access.Guilds.Allowed(event.Guild.ID) {
+		return
+	}
+	const canSend = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages
+	channelID := welcomeChannel(event.Guild, func(id string) bool {
+		if !d.settings.Access.Channels.Allowed(id) {
+			return false
+		}
+		p, err := dg.State.UserChannelPermissions(dg.State.User.ID, id)
+		if err != nil {
+			slog.Warn("discord", "message", "failed to get the channel permissions", "channel", id, "error", err)
+			return false
+		}
+		return p&canSend == canSend
+	})
+	if channelID == "" {
+		slog.Info("discord", "message", "no channel to welcome in", "guild", event.Guild.Name)
+		return
+	}
+	// Don't alert again if the last connection was recent, to not spam the
+	// channel.
+	msgs, err := dg.ChannelMessages(channelID, 5, "", "", "")
+	if err != nil {
+		slog.Error("discord", "error", err)
+	}
+	for _, msg := range msgs {
+		if msg.Author.ID == dg.State.User.ID {
+			slog.Info("discord", "message", "skipping welcome to not spam", "channel", channelID)
+			return
+		}
+	}
+	slog.Info("discord", "message", "welcome", "guild", event.Guild.Name, "channel", channelID)
+	if _, err = dg.ChannelMessageSend(channelID, welcome); err != nil {
+		slog.Error("discord", "message", "failed posting welcome", "channel", channelID, "error", err)
+	}
+}
+
+// welcomeChannel returns the channel to post the welcome message in: the
+// system channel if the bot can post there, otherwise the first text channel
+// it can post to. Returns "" when there is none.
+func welcomeChannel(g *discordgo.Guild, canSend func(channelID string) bool) string {
+	if g.SystemChannelID != "" && canSend(g.SystemChannelID) {
+		return g.SystemChannelID
+	}
+	channels := make([]*discordgo.Channel, 0, len(g.Channels))
+	for _, ch := range g.Channels {
+		if ch.Type == discordgo.ChannelTypeGuildText {
+			channels = append(channels, ch)
 		}
 	}
+	slices.SortStableFunc(channels, func(a, b *discordgo.Channel) int {
+		return a.Position - b.Position
+	})
+	for _, ch := range channels {
+		if ch.ID != g.SystemChannelID && canSend(ch.ID) {
+			return ch.ID
+		}
+	}
+	return ""
+}
+
+// seenGuild returns true if the guild was already seen and marks it as seen.
+func (d *discordBot) seenGuild(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.guilds[id]
+	d.guilds[id] = struct{}{}
+	return ok
 }
 
 // onMessageCreate is received when new message is created on any channel that
@@ -387,6 +1206,10 @@ func (d *discordBot) onMessageCreate(dg *discordgo.Session, m *discordgo.Message
 	if m.Author.ID == botid || m.Pinned {
 		return
 	}
+	if !d.allowed(m.GuildID, m.ChannelID, m.Author.ID) {
+		slog.Debug("discord", "event", "messageCreate", "author", m.Author.Username, "server", m.GuildID, "channel", m.ChannelID, "message", "not allowed")
+		return
+	}
 
 	// A DM doesn't have a GuildID (server) associated. If it's a DM, it's a
 	// message directly for us.
@@ -402,12 +1225,83 @@ func (d *discordBot) onMessageCreate(dg *discordgo.Session, m *discordgo.Message
 		}
 		isThread = ch.OwnerID == botid
 	}
-	user := fmt.Sprintf("<@%s>", botid)
-	// Ignore if not DM, threads we created, and not tagged in a public channel.
-	if !isDM && !isThread && !strings.Contains(m.Content, user) {
+	if !addressedToBot(m.Content, botid, isDM, isThread) {
 		slog.Debug("discord", "event", "messageCreate", "author", m.Author.Username, "server", m.GuildID, "channel", m.ChannelID, "message", "ignored")
 		return
 	}
+	d.replyToMessage(dg, m.Message, m.Author, isDM, isThread)
+}
+
+// addressedToBot returns true if the message is for the bot: every message in
+// a DM, since there's no one else to talk to, and in the threads it created.
+// Elsewhere the bot has to be mentioned.
+func addressedToBot(content, botID string, isDM, isThread bool) bool {
+	return isDM || isThread || strings.Contains(content, "<@"+botID+">")
+}
+
+// cannotDM returns true if the error is Discord refusing the message because
+// the user blocked the bot or doesn't accept DMs.
+func cannotDM(err error) bool {
+	var r *discordgo.RESTError
+	return errors.As(err, &r) && r.Message != nil && r.Message.Code == discordgo.ErrCodeCannotSendMessagesToThisUser
+}
+
+// onMessageReactionAdd is received when a reaction is added to a message.
+//
+// When the reaction is the configured trigger, the message is handled as if
+// the user who reacted had sent it mentioning the bot.
+//
+// See https://discord.com/developers/docs/topics/gateway-events#message-reaction-add
+func (d *discordBot) onMessageReactionAdd(dg *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.UserID == dg.State.User.ID || !isReactionTrigger(d.settings.ReactionTrigger, &r.Emoji) {
+		return
+	}
+	if !d.allowed(r.GuildID, r.ChannelID, r.UserID) {
+		slog.Debug("discord", "event", "messageReactionAdd", "user", r.UserID, "server", r.GuildID, "channel", r.ChannelID, "message", "not allowed")
+		return
+	}
+	m, err := dg.ChannelMessage(r.ChannelID, r.MessageID)
+	if err != nil {
+		slog.Error("discord", "message", "failed getting reacted message", "error", err)
+		return
+	}
+	if m.Author == nil || m.Author.ID == dg.State.User.ID {
+		return
+	}
+	if strings.TrimSpace(m.Content) == "" {
+		// Either an attachment only message or the message content intent is not
+		// enabled in the developer portal.
+		slog.Warn("discord", "event", "messageReactionAdd", "message", "reacted message has no content; is MESSAGE CONTENT INTENT enabled?", "channel", r.ChannelID, "id", r.MessageID)
+		return
+	}
+	// The message doesn't have the guild when fetched with the REST API.
+	m.GuildID = r.GuildID
+	author := &discordgo.User{ID: r.UserID}
+	if r.Member != nil && r.Member.User != nil {
+		author = r.Member.User
+	}
+	isDM := r.GuildID == ""
+	isThread := false
+	if !isDM {
+		ch, err := dg.State.Channel(r.ChannelID)
+		if err != nil {
+			slog.Error("discord", "message", "failed getting channel", "error", err)
+			return
+		}
+		isThread = ch.OwnerID == dg.State.User.ID
+	}
+	d.replyToMessage(dg, m, author, isDM, isThread)
+}
+
+// isReactionTrigger returns true if the emoji is the configured trigger, either
+// an unicode emoji or the name of a custom one.
+func isReactionTrigger(trigger string, e *discordgo.Emoji) bool {
+	return trigger != "" && (e.Name == trigger || e.APIName() == trigger)
+}
+
+// replyToMessage queues a chat request for the message on behalf of author.
+func (d *discordBot) replyToMessage(dg *discordgo.Session, m *discordgo.Message, author *discordgo.User, isDM, isThread bool) {
+	user := fmt.Sprintf("<@%s>", dg.State.User.ID)
 	if d.l == nil {
 		if _, err := dg.ChannelMessageSend(m.ChannelID, "LLM is not enabled."); err != nil {
 			slog.Error("discord", "message", "failed posting message", "error", err)
@@ -415,75 +1309,497 @@ func (d *discordBot) onMessageCreate(dg *discordgo.Session, m *discordgo.Message
 		return
 	}
 
+	if wait := d.limiter.take(author.ID, time.Now()); wait != 0 {
+		slog.Info("discord", "event", "messageCreate", "author", author.Username, "message", "rate limited", "wait", wait)
+		if _, err := d.channelMessageSendComplex(m.ID, m.ChannelID, m.GuildID, tr(d.userLocale(author.ID), msgRateLimited, cooldown(wait))); err != nil {
+			slog.Error("discord", "message", "failed posting message", "error", err)
+		}
+		return
+	}
+
+	img := ""
+	if a := imageAttachment(m.Attachments); a != nil {
+		text := ""
+		if !d.l.SupportsVision() {
+			text = "Sorry! The model I'm using can't look at images. Please describe it with words instead."
+		} else if b, err := d.downloadAttachment(a); err != nil {
+			slog.Error("discord", "message", "failed downloading attachment", "url", a.URL, "error", err)
+			text = "Sorry! I failed to download the image. Please retry in a moment."
+		} else {
+			img = imageDataURL(b)
+		}
+		if text != "" {
+			if _, err := d.channelMessageSendComplex(m.ID, m.ChannelID, m.GuildID, text); err != nil {
+				slog.Error("discord", "message", "failed posting message", "error", err)
+			}
+			return
+		}
+	}
+
 	channel := m.ChannelID
 	msg := strings.TrimSpace(strings.ReplaceAll(m.Content, user, ""))
 	replyToID := m.ID
-	if !isDM && !isThread {
+	if !isDM && !isThread && !d.settings.InlineReplies {
 		// Create thread.
-		title := msg
-		if len(title) > 95 {
-			title = title[:95] + "..."
+		title := truncate(msg, 95)
+		if title == "" {
+			title = "Chat"
 		}
 		slog.Info("discord", "event", "messageCreate", "message", "created thread", "title", title)
-		thread, err := dg.MessageThreadStart(m.ChannelID, m.ID, title, 4320)
-		if err != nil {
-			slog.Error("discord", "message", "failed starting thread", "error", err)
-			return
+		if thread, err := dg.MessageThreadStart(m.ChannelID, m.ID, title, 4320); err != nil {
+			// Threads may be disabled in this channel or the bot lacks the
+			// permission. Reply inline instead.
+			slog.Warn("discord", "message", "failed starting thread, replying inline", "error", err)
+		} else {
+			channel = thread.ID
+			// When creating a thread, there's no initial message to reply to yet.
+			replyToID = ""
 		}
-		channel = thread.ID
-		// When creating a thread, there's no initial message to reply to yet.
-		replyToID = ""
 	}
-	slog.Info("discord", "event", "messageCreate", "author", m.Author.Username, "server", m.GuildID, "channel", channel, "isdm", isDM, "isthread", isThread, "message", msg)
+	slog.Info("discord", "event", "messageCreate", "author", author.Username, "server", m.GuildID, "channel", channel, "isdm", isDM, "isthread", isThread, "message", msg)
+	d.touchChannel(channel)
 	// Immediately signal the user that the bot is preparing a reply.
 	if err := dg.ChannelTyping(channel); err != nil {
+		if cannotDM(err) {
+			// Don't waste the LLM on a reply that can't be delivered.
+			slog.Warn("discord", "event", "messageCreate", "author", author.Username, "message", "cannot send messages to the user")
+			return
+		}
 		slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
 		// Continue anyway.
 	}
 	req := msgReq{
-		msg:       msg,
-		authorID:  m.Author.ID,
-		channelID: channel,
-		guildID:   m.GuildID,
-		replyToID: replyToID,
+		msg:        msg,
+		authorID:   author.ID,
+		channelID:  channel,
+		authorName: displayName(author),
+		guildID:    m.GuildID,
+		replyToID:  replyToID,
+		language:   d.userLanguage(author.ID),
+		image:      img,
+		sampling:   newSamplingParams(&d.settings.Sampling.Chat, d.modelSampling(), nil, nil),
+		// The request may wait in the queue or for the model to load.
+		stopTyping: d.keepTyping(channel),
 	}
-	select {
-	case d.chat <- req:
-	default:
-		if _, err := d.channelMessageSendComplex(req.replyToID, req.channelID, req.guildID, "Sorry! I have too many pending chat requests. Please retry in a moment."); err != nil {
-			slog.Error("discord", "message", "failed posting message", "error", err)
-		}
+	if d.sendChat(req) {
+		d.rememberRequest(req.authorID, req.channelID, lastRequest{chat: &req})
 	}
 }
 
-func (d *discordBot) onInteractionCreate(dg *discordgo.Session, event *discordgo.InteractionCreate) {
-	slog.Info("discord", "event", "interactionCreate", "name", event.Data)
-	if t := event.Data.Type(); t != discordgo.InteractionApplicationCommand {
-		slog.Warn("discord", "message", "surprising interaction", "type", t.String())
-		return
-	}
-	data, ok := event.Data.(discordgo.ApplicationCommandInteractionData)
-	if !ok {
-		slog.Warn("discord", "message", "invalid type", "type", event.Data)
-		return
+// defaultTypingInterval is how often the typing indicator is refreshed when
+// not configured.
+const defaultTypingInterval = 8 * time.Second
+
+// keepTyping refreshes the typing indicator in the channel until the returned
+// function is called, since Discord clears it after about 10 seconds.
+func (d *discordBot) keepTyping(channelID string) context.CancelFunc {
+	interval := d.settings.TypingInterval
+	if interval == 0 {
+		interval = defaultTypingInterval
 	}
-	data.Name = strings.TrimSuffix(data.Name, "_dev")
-	switch data.Name {
-	case "close_thread":
-		d.onCloseThread(event, data)
-	case "forget":
+	// Not tracked in d.wg, a request still waiting in the queue on shutdown
+	// shouldn't delay it.
+	ctx, cancel := context.WithCancel(d.ctx)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := d.dg.ChannelTyping(channelID); err != nil {
+					slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+// sendChat queues a chat request and tells the user if it was rejected or
+// their position in line if they have to wait. It returns false if the
+// request was rejected.
+//
+// The position in line message has a button to cancel the request.
+func (d *discordBot) sendChat(req msgReq) bool {
+	l := d.userLocale(req.authorID)
+	q := &queuedChat{}
+	req.queued = q
+	pos := d.enqueueChat(req)
+	if pos == 0 {
+		req.typingDone()
+		if _, err := d.channelMessageSendComplex(req.replyToID, req.channelID, req.guildID, tr(l, msgChatQueueFull)); err != nil {
+			slog.Error("discord", "message", "failed posting message", "error", err)
+		}
+		return false
+	}
+	msg := d.queuePosition(l, pos)
+	if msg == "" {
+		return true
+	}
+	m, err := d.channelMessageSendWithCancel(req.replyToID, req.channelID, req.guildID, msg)
+	if err != nil {
+		slog.Error("discord", "message", "failed posting message", "error", err)
+		return true
+	}
+	d.mu.Lock()
+	started := q.started
+	if !started {
+		q.messageID = m.ID
+		d.cancels[m.ID] = pendingReply{authorID: req.authorID, cancel: func() { d.dropQueuedChat(q) }, queued: true}
+	}
+	d.mu.Unlock()
+	if started {
+		// Too late, it was already picked up.
+		d.removeComponents(req.channelID, m.ID)
+	}
+	return true
+}
+
+// dropQueuedChat removes a cancelled chat request from the requests waiting
+// for room in the queue. If it is already in the queue, it is skipped by
+// chatRoutine instead.
+func (d *discordBot) dropQueuedChat(q *queuedChat) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.waitingChat {
+		if d.waitingChat[i].queued == q {
+			d.waitingChat[i].typingDone()
+			d.waitingChat = slices.Delete(d.waitingChat, i, i+1)
+			return
+		}
+	}
+}
+
+// startChat marks the chat request as started and removes the cancel button
+// of its position in line message. It returns false if the request was
+// cancelled while waiting in line.
+func (d *discordBot) startChat(req msgReq) bool {
+	q := req.queued
+	if q == nil {
+		return true
+	}
+	d.mu.Lock()
+	q.started = true
+	id := q.messageID
+	_, ok := d.cancels[id]
+	delete(d.cancels, id)
+	d.mu.Unlock()
+	if id == "" {
+		return true
+	}
+	if !ok {
+		// The cancel button was clicked.
+		req.typingDone()
+		return false
+	}
+	d.removeComponents(req.channelID, id)
+	return true
+}
+
+func (d *discordBot) onInteractionCreate(dg *discordgo.Session, event *discordgo.InteractionCreate) {
+	slog.Info("discord", "event", "interactionCreate", "name", event.Data)
+	if user := interactionUser(event.Interaction); user == nil || !d.allowed(event.GuildID, event.ChannelID, user.ID) {
+		slog.Debug("discord", "event", "interactionCreate", "server", event.GuildID, "channel", event.ChannelID, "message", "not allowed")
+		return
+	}
+	if event.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		d.onAutocomplete(event)
+		return
+	}
+	if event.Type == discordgo.InteractionMessageComponent {
+		d.onMessageComponent(event)
+		return
+	}
+	if t := event.Data.Type(); t != discordgo.InteractionApplicationCommand {
+		slog.Warn("discord", "message", "surprising interaction", "type", t.String())
+		return
+	}
+	data, ok := event.Data.(discordgo.ApplicationCommandInteractionData)
+	if !ok {
+		slog.Warn("discord", "message", "invalid type", "type", event.Data)
+		return
+	}
+	data.Name = strings.TrimSuffix(data.Name, "_dev")
+	d.touchChannel(event.ChannelID)
+	if user := interactionUser(event.Interaction); user != nil && event.Locale != discordgo.Unknown {
+		d.mu.Lock()
+		d.setLocaleLocked(user.ID, event.Locale, time.Now())
+		d.mu.Unlock()
+	}
+	switch data.Name {
+	case "ask":
+		d.onAsk(event, data)
+	case "describe":
+		d.onDescribe(event, data)
+	case "help":
+		d.onHelp(event, data)
+	case "close_thread":
+		d.onCloseThread(event, data)
+	case "export":
+		d.onExport(event, data)
+	case "forget":
 		d.onForget(event, data)
+	case "persona":
+		d.onPersona(event, data)
+	case "forget_server":
+		d.onForgetServer(event, data)
+	case "set_context_length":
+		d.onSetContextLength(event, data)
+	case "system_prompt":
+		d.onSystemPrompt(event, data)
 	case "list_models":
 		d.onListModels(event, data)
+	case "model_info":
+		d.onModelInfo(event, data)
+	case "switch_model":
+		d.onSwitchModel(event, data)
 	case "metrics":
 		d.onMetrics(event, data)
-	case "meme_auto", "meme_manual", "meme_labels_auto", "image_auto", "image_manual":
+	case "stats":
+		d.onStats(event, data)
+	case "meme_auto", "meme_manual", "meme_labels_auto", "image_auto", "image_manual", "image_remix":
 		d.onImage(event, data)
+	case "regenerate":
+		d.onRegenerate(event, data)
+	case "seed_from_image":
+		d.onSeedFromImage(event, data)
+	case "prefs":
+		d.onPrefs(event, data)
+	case "prompt_templates":
+		d.onPromptTemplates(event, data)
+	case "debug_meme":
+		d.onDebugMeme(event, data)
 	default:
 		slog.Warn("discord", "unexpected command", data.Name, "data", event.Interaction)
 	}
 }
 
+func (d *discordBot) onHelp(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	d.mu.Lock()
+	cmds := d.cmds
+	d.mu.Unlock()
+	embed := helpEmbed(d.dg.State.User.Username, d.settings.InlineReplies, cmds)
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseChannelMessageWithSource, Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}, Flags: discordgo.MessageFlagsEphemeral}}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// Discord limits, see
+// https://discord.com/developers/docs/resources/message#embed-object-embed-limits
+const (
+	maxEmbedField = 1024
+	maxEmbedTotal = 6000
+)
+
+// helpEmbed describes how to chat with the bot and lists the slash commands
+// grouped by category. The options are omitted when the embed would be too
+// large.
+func helpEmbed(botName string, inlineReplies bool, cmds []*discordgo.ApplicationCommand) *discordgo.MessageEmbed {
+	thread := "I reply in a thread, continue the conversation there without mentioning me. "
+	if inlineReplies {
+		thread = "I reply in the channel, mention me again to continue the conversation. "
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: "Help",
+		Description: "Mention me to chat, e.g. `@" + botName + " tell me a joke about cats`. " +
+			thread +
+			"In a direct message, no need to mention me at all.\n" +
+			"Attach an image to your message to ask about it. Use `/forget` to start over.",
+	}
+	for _, withOptions := range []bool{true, false} {
+		embed.Fields = nil
+		total := len(embed.Title) + len(embed.Description)
+		for _, category := range []string{"Memes", "Images", "Admin", "Other"} {
+			var lines []string
+			for _, c := range cmds {
+				// The context menu commands have no description.
+				if c.Type != discordgo.ChatApplicationCommand || commandCategory(c) != category {
+					continue
+				}
+				l := "`/" + c.Name
+				if withOptions {
+					for _, o := range c.Options {
+						l += " <" + o.Name + ">"
+					}
+				}
+				lines = append(lines, l+"`: "+c.Description)
+			}
+			// Pack the lines in as few fields as possible.
+			name := category
+			value := ""
+			for _, l := range lines {
+				if value != "" && len(value)+1+len(l) > maxEmbedField {
+					embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value})
+					total += len(name) + len(value)
+					name = category + " (continued)"
+					value = ""
+				}
+				if value != "" {
+					value += "\n"
+				}
+				value += truncate(l, maxEmbedField-3)
+			}
+			if value != "" {
+				embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value})
+				total += len(name) + len(value)
+			}
+		}
+		if total <= maxEmbedTotal {
+			break
+		}
+	}
+	return embed
+}
+
+// commandCategory returns the category of a command shown in /help.
+func commandCategory(c *discordgo.ApplicationCommand) string {
+	name := strings.TrimSuffix(c.Name, "_dev")
+	switch {
+	case strings.HasPrefix(name, "meme_"):
+		return "Memes"
+	case strings.HasPrefix(name, "image_"), name == "regenerate":
+		return "Images"
+	case c.DefaultMemberPermissions != nil:
+		return "Admin"
+	default:
+		return "Other"
+	}
+}
+
+// onAsk replies to a one-off question with only the system prompt, leaving
+// the conversation's memory untouched.
+func (d *discordBot) onAsk(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Prompt string `json:"prompt"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	user := interactionUser(event.Interaction)
+	req := msgReq{
+		msg:        strings.TrimSpace(opts.Prompt),
+		authorID:   user.ID,
+		authorName: displayName(user),
+		channelID:  event.ChannelID,
+		guildID:    event.GuildID,
+		language:   d.userLanguage(user.ID),
+		sampling:   newSamplingParams(&d.settings.Sampling.Chat, d.modelSampling(), nil, nil),
+		stateless:  true,
+	}
+	reply := ""
+	if req.msg == "" {
+		reply = "Please ask a question."
+	} else if s := d.rateLimited(event, data.Name); s != "" {
+		reply = s
+	} else if pos := d.enqueueChat(req); pos == 0 {
+		reply = tr(event.Locale, msgChatQueueFull)
+	} else {
+		reply = "*Question*: " + escapeMarkdown(truncate(req.msg, 200))
+		if s := d.queuePosition(event.Locale, pos); s != "" {
+			reply += "\n" + s
+		}
+	}
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// describePrompt is the system prompt used by /describe.
+const describePrompt = "You describe images for people who can't see them. Only describe what is visible, do not guess nor add commentary."
+
+func (d *discordBot) onDescribe(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Image    string `json:"image"`
+		Detailed bool   `json:"detailed"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	// Reply through the deferred response once it was sent.
+	deferred := false
+	reply := func(s string) {
+		var err error
+		if deferred {
+			_, err = d.dg.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{Content: &s})
+		} else {
+			err = d.interactionRespond(event.Interaction, s)
+		}
+		if err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+	}
+	if d.l == nil {
+		reply("LLM is not enabled. Restart with bot.llm.model set in config.yml.")
+		return
+	}
+	if !d.l.SupportsVision() {
+		reply("Sorry! The model I'm using can't look at images.")
+		return
+	}
+	var a *discordgo.MessageAttachment
+	if data.Resolved != nil {
+		if a = data.Resolved.Attachments[opts.Image]; a != nil {
+			a = imageAttachment([]*discordgo.MessageAttachment{a})
+		}
+	}
+	if a == nil {
+		reply("Please attach a PNG, JPEG, GIF or WebP image.")
+		return
+	}
+	if a.Size > maxAttachmentSize {
+		reply(fmt.Sprintf("The image is too large, the limit is %dMiB.", maxAttachmentSize>>20))
+		return
+	}
+	if s := d.rateLimited(event, data.Name); s != "" {
+		reply(s)
+		return
+	}
+	// Downloading can take longer than the 3 seconds Discord gives to reply.
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply update", "error", err)
+		return
+	}
+	deferred = true
+	b, err := d.downloadAttachment(a)
+	if err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed downloading attachment", "error", err)
+		reply("Failed to retrieve the image: " + escapeMarkdown(err.Error()))
+		return
+	}
+	msg := "Write a one sentence caption for this image."
+	if opts.Detailed {
+		msg = "Describe this image in details: the subjects, the setting, the colors and any visible text."
+	}
+	user := interactionUser(event.Interaction)
+	req := msgReq{
+		msg:        msg,
+		authorID:   user.ID,
+		authorName: displayName(user),
+		channelID:  event.ChannelID,
+		guildID:    event.GuildID,
+		language:   d.userLanguage(user.ID),
+		image:      imageDataURL(b),
+		sampling:   newSamplingParams(&d.settings.Sampling.Chat, d.modelSampling(), nil, nil),
+		stateless:  true,
+		system:     describePrompt,
+	}
+	if pos := d.enqueueChat(req); pos == 0 {
+		reply(tr(event.Locale, msgChatQueueFull))
+	} else {
+		s := "*Describing*: " + escapeMarkdown(a.Filename)
+		if q := d.queuePosition(event.Locale, pos); q != "" {
+			s += "\n" + q
+		}
+		reply(s)
+	}
+}
+
 func (d *discordBot) onCloseThread(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
 	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseChannelMessageWithSource, Data: &discordgo.InteractionResponseData{Content: "_Archived_."}}
 	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
@@ -495,39 +1811,299 @@ func (d *discordBot) onCloseThread(event *discordgo.InteractionCreate, data disc
 	}
 }
 
+func (d *discordBot) onExport(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Format string `json:"format"`
+	}{Format: "markdown"}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	c := d.mem.Get("", event.ChannelID)
+	b, name, err := exportConversation(c, opts.Format)
+	if err != nil {
+		if err = d.interactionRespond(event.Interaction, escapeMarkdown(err.Error())); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	if b == nil {
+		if err = d.interactionRespond(event.Interaction, "There's nothing to export yet. Mention me to start a conversation!"); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	contentType := "text/markdown"
+	if opts.Format == "json" {
+		contentType = "application/json"
+	}
+	r := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "*Conversation*: " + strconv.Itoa(len(c.Messages)) + " messages",
+			Files:   []*discordgo.File{{Name: name, ContentType: contentType, Reader: bytes.NewReader(b)}},
+		},
+	}
+	if err = d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// exportedMessage is a message in the JSON export of a conversation.
+type exportedMessage struct {
+	Role       llm.Role              `json:"role"`
+	Content    string                `json:"content"`
+	HasImage   bool                  `json:"has_image,omitempty"`
+	ToolCalls  []llm.ToolCallRequest `json:"tool_calls,omitempty"`
+	ToolCallID string                `json:"tool_call_id,omitempty"`
+}
+
+// exportConversation serializes the conversation as "markdown" or "json" and
+// returns the content along its file name. The attached images are not
+// included. It returns nil when the conversation has nothing but the system
+// prompt.
+func exportConversation(c *llm.Conversation, format string) ([]byte, string, error) {
+	msgs := slices.Clone(c.Messages)
+	if !slices.ContainsFunc(msgs, func(m llm.Message) bool { return m.Role != llm.System && m.Role != llm.AvailableTools }) {
+		return nil, "", nil
+	}
+	name := "conversation-" + c.Started.UTC().Format("20060102-150405")
+	switch format {
+	case "", "markdown":
+		b := bytes.Buffer{}
+		b.WriteString("# Conversation\n\n")
+		if !c.Started.IsZero() {
+			fmt.Fprintf(&b, "- Started: %s\n", c.Started.UTC().Format(time.RFC3339))
+		}
+		if !c.LastUpdate.IsZero() {
+			fmt.Fprintf(&b, "- Last update: %s\n", c.LastUpdate.UTC().Format(time.RFC3339))
+		}
+		for _, m := range msgs {
+			title := ""
+			switch m.Role {
+			case llm.System:
+				title = "System prompt"
+			case llm.User:
+				title = "User"
+			case llm.Assistant:
+				title = "Assistant"
+			case llm.ToolCall:
+				title = "Tool call"
+			case llm.ToolCallResult, llm.ToolResult:
+				title = "Tool result"
+			default:
+				continue
+			}
+			fmt.Fprintf(&b, "\n## %s\n\n", title)
+			if m.Content != "" {
+				b.WriteString(strings.TrimSpace(m.Content) + "\n")
+			}
+			if m.Image != "" {
+				b.WriteString("\n*[image]*\n")
+			}
+			for _, t := range m.ToolCalls {
+				fmt.Fprintf(&b, "\n*Called* `%s` *with* `%s`\n", t.Function.Name, t.Function.Arguments)
+			}
+		}
+		return b.Bytes(), name + ".md", nil
+	case "json":
+		out := struct {
+			Started    time.Time         `json:"started"`
+			LastUpdate time.Time         `json:"last_update"`
+			Messages   []exportedMessage `json:"messages"`
+		}{Started: c.Started, LastUpdate: c.LastUpdate}
+		for _, m := range msgs {
+			if m.Role == llm.AvailableTools {
+				continue
+			}
+			out.Messages = append(out.Messages, exportedMessage{Role: m.Role, Content: m.Content, HasImage: m.Image != "", ToolCalls: m.ToolCalls, ToolCallID: m.ToolCallID})
+		}
+		b, err := json.MarshalIndent(&out, "", "  ")
+		if err != nil {
+			return nil, "", err
+		}
+		return append(b, '\n'), name + ".json", nil
+	default:
+		return nil, "", fmt.Errorf("unknown format %q; use markdown or json", format)
+	}
+}
+
 func (d *discordBot) onForget(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
 	opts := struct {
 		SystemPrompt string `json:"system_prompt"`
-	}{SystemPrompt: d.settings.PromptSystem}
+		Language     string `json:"language"`
+	}{}
 	if err := optionsToStruct(data.Options, &opts); err != nil {
 		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
 		return
 	}
-	reply := "I don't know you. I can't wait to start our discussion so I can get to know you better!"
-	c := d.getMemory(event.ChannelID)
+	user := interactionUser(event.Interaction)
+	if opts.Language = strings.TrimSpace(opts.Language); opts.Language == "" {
+		opts.Language = d.userLanguage(user.ID)
+	}
+	v := d.promptVars(event.GuildID, displayName(user))
+	c := d.getMemory(event.GuildID, event.ChannelID, "", v)
+	persona := c.Persona
+	if opts.SystemPrompt == "" {
+		// Keep the persona, if any.
+		opts.SystemPrompt = d.conversationPrompt(c)
+	} else {
+		persona = ""
+	}
+	if _, err := sillybot.RenderSystemPrompt(opts.SystemPrompt, v); err != nil {
+		if err = d.interactionRespond(event.Interaction, "Invalid system prompt: "+escapeMarkdown(err.Error())); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	reply := tr(event.Locale, msgForgetUnknown)
 	if len(c.Messages) >= 1 && c.Messages[len(c.Messages)-1].Role != llm.System {
-		reply = "The memory of our past conversations just got zapped."
+		reply = tr(event.Locale, msgForgetZapped)
 	}
-	c.Messages = nil
-	c = d.getMemory(event.ChannelID)
-	// Either update, remove or add, depending.
-	if (opts.SystemPrompt == "") != (d.settings.PromptSystem == "") {
-		if opts.SystemPrompt != "" {
-			c.Messages = append(c.Messages, llm.Message{Role: llm.System, Content: opts.SystemPrompt})
-		} else if len(c.Messages) != 0 {
-			c.Messages = c.Messages[:len(c.Messages)-1]
+	c.Persona = persona
+	system := d.resetMemory(c, opts.SystemPrompt, opts.Language, v)
+	reply += "\n" + tr(event.Locale, msgSystemPrompt) + escapeMarkdown(system)
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+func (d *discordBot) onPersona(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Name string `json:"name"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	user := interactionUser(event.Interaction)
+	language := d.userLanguage(user.ID)
+	v := d.promptVars(event.GuildID, displayName(user))
+	c := d.getMemory(event.GuildID, event.ChannelID, language, v)
+	reply := ""
+	name := strings.TrimSpace(opts.Name)
+	p := findPersona(d.settings.Personas, name)
+	switch {
+	case name == "":
+		reply = listPersonas(d.settings.Personas, c.Persona)
+	case p == nil && name != "default":
+		reply = "Unknown persona " + escapeMarkdown(name) + ". Use `/persona` without options to list them."
+	default:
+		c.Persona = ""
+		system := d.systemPrompt(event.GuildID, event.ChannelID)
+		if p != nil {
+			c.Persona = p.Name
+			system = p.Prompt
+		}
+		system = d.resetMemory(c, system, language, v)
+		reply = "Switched to the persona `" + name + "` and forgot our past conversation.\n" + tr(event.Locale, msgSystemPrompt) + escapeMarkdown(system)
+	}
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+func (d *discordBot) onForgetServer(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	reply := ""
+	switch {
+	case event.GuildID == "":
+		reply = "This command can only be used on a server. Use `/forget` to forget our conversation."
+	case !isAdmin(event.Member):
+		reply = "Only the server administrators can forget all the conversations."
+	default:
+		n := d.mem.ForgetGuild(event.GuildID)
+		slog.Info("discord", "command", data.Name, "server", event.GuildID, "forgotten", n)
+		switch n {
+		case 0:
+			reply = "There was no conversation to forget on this server."
+		case 1:
+			reply = "Forgot 1 conversation on this server."
+		default:
+			reply = fmt.Sprintf("Forgot %d conversations on this server.", n)
+		}
+	}
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// isAdmin returns true if the guild member has the administrator permission
+// in the channel of the interaction.
+func isAdmin(m *discordgo.Member) bool {
+	return m != nil && m.Permissions&discordgo.PermissionAdministrator != 0
+}
+
+func (d *discordBot) onSystemPrompt(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Prompt string `json:"prompt"`
+		Scope  string `json:"scope"`
+		Reset  bool   `json:"reset"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	reply := ""
+	owner := "guild:" + event.GuildID
+	where := "this server"
+	if opts.Scope == "channel" {
+		owner = "channel:" + event.ChannelID
+		where = "this channel"
+	}
+	opts.Prompt = strings.TrimSpace(opts.Prompt)
+	switch {
+	case event.GuildID == "":
+		reply = "The system prompt can only be overridden on a server. Use `/forget` to change it in this conversation."
+	case opts.Reset && opts.Prompt != "":
+		reply = "Use either prompt or reset, not both."
+	case opts.Reset:
+		d.mem.SetPreferences(owner, nil)
+		reply = "The system prompt override for " + where + " was removed. New conversations use:\n*System prompt*: " + escapeMarkdown(d.systemPrompt(event.GuildID, event.ChannelID))
+	case opts.Prompt != "":
+		if _, err := sillybot.RenderSystemPrompt(opts.Prompt, &sillybot.PromptVars{}); err != nil {
+			reply = "Invalid system prompt: " + escapeMarkdown(err.Error())
+			break
 		}
-	} else if opts.SystemPrompt != "" {
-		c.Messages[len(c.Messages)-1].Content = opts.SystemPrompt
+		d.mem.SetPreferences(owner, map[string]string{systemPromptKey: opts.Prompt})
+		reply = "New conversations in " + where + " will use this system prompt. Use `/forget` to apply it to the current one.\n*System prompt*: " + escapeMarkdown(opts.Prompt)
+	default:
+		reply = "*System prompt*: " + escapeMarkdown(d.systemPrompt(event.GuildID, event.ChannelID))
+	}
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
 	}
+}
 
-	reply += "\n*System prompt*: " + escapeMarkdown(opts.SystemPrompt)
+func (d *discordBot) onSetContextLength(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Turns int `json:"turns"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	user := interactionUser(event.Interaction)
+	c := d.getMemory(event.GuildID, event.ChannelID, d.userLanguage(user.ID), d.promptVars(event.GuildID, displayName(user)))
+	c.MaxTurns = opts.Turns
+	reply := "I'll remember our whole conversation."
+	if c.MaxTurns > 0 {
+		reply = fmt.Sprintf("I'll remember the last %d turns of our conversation.", c.MaxTurns)
+		if n := c.Trim(); n != 0 {
+			reply += fmt.Sprintf(" I just forgot %d older messages.", n)
+		}
+	}
 	if err := d.interactionRespond(event.Interaction, reply); err != nil {
 		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
 	}
 }
 
 func (d *discordBot) onListModels(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	if len(d.knownLLMs) == 0 {
+		if err := d.interactionRespond(event.Interaction, "No model is configured. Add some in `knownllms` in `config.yml`."); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
 	lines := []string{"Known models:"}
 	for _, k := range d.knownLLMs {
 		line := "- [`" + k.Source.Basename() + "`](" + k.Source.RepoURL() + ") "
@@ -537,26 +2113,11 @@ func (d *discordBot) onListModels(event *discordgo.InteractionCreate, data disco
 			slog.Error("discord", "command", data.Name, "error", err)
 		} else {
 			line += " Quantizations: "
-			added := false
-			for _, f := range info.Files {
-				// TODO: Move this into a common function.
-				if !strings.HasPrefix(f, k.Source.Basename()) {
-					continue
-				}
-				if strings.Contains(f, "/") {
-					// Skip files in subdirectories for now.
-					continue
-				}
-				if strings.HasPrefix(filepath.Ext(f), ".cat") {
-					// TODO: Support split files. For now just hide them. They are large
-					// anyway so it's only for power users.
-					continue
-				}
-				if added {
+			for i, f := range k.QuantizationFiles(info.Files) {
+				if i != 0 {
 					line += ", "
 				}
-				line += strings.TrimSuffix(f[len(k.Source.Basename()):], ".gguf")
-				added = true
+				line += k.QuantizationName(f)
 			}
 			if info.Upstream.Author == "" && info.Upstream.Repo == "" {
 				// Some forks are not setting up upstream properly. What a shame.
@@ -581,20 +2142,9 @@ func (d *discordBot) onListModels(event *discordgo.InteractionCreate, data disco
 		}
 		lines = append(lines, line)
 	}
-	var toSend []string
-	buf := ""
-	for _, line := range lines {
-		if len(buf)+len(line) >= maxMessage {
-			toSend = append(toSend, buf)
-			buf = ""
-		}
-		if buf != "" {
-			buf += "\n"
-		}
-		buf += line
-	}
-	if buf != "" {
-		toSend = append(toSend, buf)
+	toSend := chunkLines(lines)
+	if len(toSend) == 0 {
+		return
 	}
 	if err := d.interactionRespond(event.Interaction, toSend[0]); err != nil {
 		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
@@ -607,6 +2157,331 @@ func (d *discordBot) onListModels(event *discordgo.InteractionCreate, data disco
 	}
 }
 
+// onMessageComponent handles a click on the cancel button of a streamed
+// reply, on the generate button of a preview or on the upscale button of an
+// image.
+func (d *discordBot) onMessageComponent(event *discordgo.InteractionCreate) {
+	data := event.MessageComponentData()
+	if id, ok := strings.CutPrefix(data.CustomID, previewButtonPrefix); ok {
+		d.onPreviewGenerate(event, id)
+		return
+	}
+	if data.CustomID == upscaleButtonID {
+		d.onUpscale(event)
+		return
+	}
+	if data.CustomID != cancelButtonID {
+		slog.Warn("discord", "message", "unexpected component", "custom_id", data.CustomID)
+		return
+	}
+	userID := ""
+	if user := interactionUser(event.Interaction); user != nil {
+		userID = user.ID
+	}
+	d.mu.Lock()
+	p, ok := d.cancels[event.Message.ID]
+	if ok && p.authorID == userID {
+		delete(d.cancels, event.Message.ID)
+	}
+	d.mu.Unlock()
+	if ok && p.authorID != userID {
+		r := discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: "Only the person who asked can cancel this reply.", Flags: discordgo.MessageFlagsEphemeral},
+		}
+		if err := d.dg.InteractionRespond(event.Interaction, &r); err != nil {
+			slog.Error("discord", "message", "failed reply", "error", err)
+		}
+		return
+	}
+	content := event.Message.Content
+	if ok {
+		slog.Info("discord", "message", "reply cancelled", "message_id", event.Message.ID, "queued", p.queued)
+		p.cancel()
+		if p.queued {
+			content = tr(event.Locale, msgQueueCancelled)
+		}
+	}
+	// Remove the button. It is also the case when the reply already completed.
+	// The content is not optional, keep it as is.
+	r := discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Content: content, Components: []discordgo.MessageComponent{}},
+	}
+	if err := d.dg.InteractionRespond(event.Interaction, &r); err != nil {
+		slog.Error("discord", "message", "failed reply", "error", err)
+	}
+}
+
+// onAutocomplete suggests values for the option being typed.
+func (d *discordBot) onAutocomplete(event *discordgo.InteractionCreate) {
+	data := event.ApplicationCommandData()
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, o := range data.Options {
+		if !o.Focused {
+			continue
+		}
+		switch name := strings.TrimSuffix(data.Name, "_dev"); {
+		case o.Name == "model" && (name == "switch_model" || name == "model_info"):
+			choices = modelChoices(d.knownLLMs, o.StringValue())
+		case o.Name == "name" && name == "persona":
+			choices = personaChoices(d.settings.Personas, o.StringValue())
+		}
+	}
+	r := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed autocomplete", "error", err)
+	}
+}
+
+func (d *discordBot) onSwitchModel(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Model        string `json:"model"`
+		Quantization string `json:"quantization"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	if d.l == nil {
+		if err := d.interactionRespond(event.Interaction, "LLM is not enabled. Restart with bot.llm.model set in config.yml."); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply to enable", "error", err)
+		}
+		return
+	}
+	k := findKnownLLM(d.knownLLMs, opts.Model)
+	if k == nil {
+		if err := d.interactionRespond(event.Interaction, "Unknown model "+escapeMarkdown(opts.Model)+". Use `/list_models` to list them."); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	quant := strings.TrimSpace(opts.Quantization)
+	// Loading a model can take minutes, especially if it needs to be
+	// downloaded.
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		return
+	}
+	model := huggingface.PackedFileRef(string(k.Source) + quant)
+	if quant == "" {
+		// Use the largest quantization that fits in the VRAM budget, if
+		// configured, otherwise keep the current one.
+		content := ""
+		var err error
+		if model, err = d.l.SelectQuantization(d.ctx, k); err != nil {
+			slog.Error("discord", "command", data.Name, "error", err)
+			content = "Failed to select the quantization: " + escapeMarkdown(err.Error())
+		} else if model == "" {
+			if quant = currentQuantization(d.knownLLMs, d.l.CurrentModel()); quant == "" {
+				content = "Please specify the quantization. Use `/model_info` to list them."
+			}
+			model = huggingface.PackedFileRef(string(k.Source) + quant)
+		}
+		if content != "" {
+			if _, err = d.dg.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+				slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+			}
+			return
+		}
+	}
+	slog.Info("discord", "command", data.Name, "model", model)
+	// The reply can't be edited once the interaction token expired. Stop
+	// showing the progress then and post the result in the channel instead.
+	expires := time.Now().Add(interactionEditTTL)
+	// Show the download progress, if the model needs to be downloaded. Discord
+	// rate limits edits so don't update too often.
+	var last time.Time
+	ctx := huggingface.WithProgress(d.ctx, func(p huggingface.Progress) {
+		if now := time.Now(); now.Before(expires) && (now.Sub(last) >= 5*time.Second || p.Downloaded == p.Total) {
+			last = now
+			c := downloadProgressText(model.Basename(), p)
+			if _, err := d.dg.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{Content: &c}); err != nil {
+				slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+			}
+		}
+	})
+	content := "Now using `" + model.Basename() + "`."
+	if err := d.l.SwitchModel(ctx, model); err != nil {
+		slog.Error("discord", "command", data.Name, "model", model, "error", err)
+		content = "Failed to switch model: " + escapeMarkdown(err.Error()) + "\nStill using `" + d.l.CurrentModel().Basename() + "`."
+	}
+	d.updateTools()
+	if time.Now().After(expires) {
+		if _, err := d.dg.ChannelMessageSend(event.ChannelID, content); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed posting", "error", err)
+		}
+		return
+	}
+	if _, err := d.dg.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// interactionEditTTL is how long the reply to an interaction can be edited.
+// Discord expires the interaction token after 15 minutes; keep a margin for
+// the clock skew and the request latency.
+const interactionEditTTL = 14 * time.Minute
+
+// newTools returns the tools message for the prompt encodings supporting
+// tools, and the chat tools when enabled. Both depend on the model in use.
+func newTools(l *llm.Session, ig *imagegen.Session, enabled bool) (toolsMsg llm.Message, chatTools []llm.Tool, err error) {
+	encoding := l.CurrentEncoding()
+	if encoding != nil && strings.Contains(strings.ToLower(string(l.CurrentModel())), "mistral") {
+		slog.Info("discord", "message", "tools are enabled", "encoding", encoding)
+		// HACK: Also an hack.
+		availtools := []tools.MistralTool{
+			/*
+				{
+					Type: "function",
+					Function: tools.MistralFunction{
+						Name:        "web_search",
+						Description: "Search the web for information",
+						Parameters: &tools.MistralFunctionParams{
+							Type: "object",
+							Properties: map[string]tools.MistralProperty{
+								"query": {
+									Type:        "string",
+									Description: "Query to use to search on the internet",
+								},
+							},
+							Required: []string{"query"},
+						},
+					},
+				},
+			*/
+			tools.CalculateMistralTool,
+			tools.GetTodayClockTimeMistralTool,
+		}
+		b, err := json.Marshal(availtools)
+		if err != nil {
+			return toolsMsg, nil, err
+		}
+		toolsMsg = llm.Message{
+			Role:    llm.AvailableTools,
+			Content: string(b),
+		}
+	}
+	if enabled {
+		if !l.SupportsTools() {
+			slog.Warn("discord", "message", "chat_tools requires a remote LLM supporting function calling; ignoring", "model", l.CurrentModel())
+		} else {
+			chatTools = append(chatTools, getCurrentTimeTool)
+			if ig != nil {
+				chatTools = append(chatTools, generateImageTool)
+			}
+		}
+	}
+	return toolsMsg, chatTools, nil
+}
+
+// updateTools recomputes the tools after the model changed.
+func (d *discordBot) updateTools() {
+	toolsMsg, chatTools, err := newTools(d.l, d.ig, d.settings.ChatTools)
+	if err != nil {
+		slog.Error("discord", "message", "failed to update the tools", "error", err)
+		return
+	}
+	d.mu.Lock()
+	d.toolsMsg = toolsMsg
+	d.chatTools = chatTools
+	d.mu.Unlock()
+}
+
+// tools returns the tools of the model in use.
+func (d *discordBot) tools() (llm.Message, []llm.Tool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.toolsMsg, d.chatTools
+}
+
+// downloadProgressText returns the text to show while a file is being
+// downloaded.
+func downloadProgressText(name string, p huggingface.Progress) string {
+	out := fmt.Sprintf("Downloading `%s`: %.1fGiB", name, float64(p.Downloaded)/(1<<30))
+	if pct := p.Percent(); pct >= 0 {
+		out += fmt.Sprintf("/%.1fGiB (%d%%)", float64(p.Total)/(1<<30), pct)
+	}
+	return out
+}
+
+func (d *discordBot) onModelInfo(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Model string `json:"model"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	k := findKnownLLM(d.knownLLMs, opts.Model)
+	if k == nil {
+		if err := d.interactionRespond(event.Interaction, "Unknown model "+escapeMarkdown(opts.Model)+". Use `/list_models` to list them."); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	info := huggingface.Model{ModelRef: k.Source.ModelRef()}
+	if err := d.l.HF.GetModelInfo(d.ctx, &info); err != nil {
+		slog.Error("discord", "command", data.Name, "error", err)
+		if err = d.interactionRespond(event.Interaction, "Oh no, we failed to query: "+escapeMarkdown(err.Error())); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	if info.Upstream.Author == "" && info.Upstream.Repo == "" {
+		// Some forks are not setting up upstream properly. What a shame.
+		info.Upstream = k.Upstream.ModelRef()
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: k.Source.Basename(),
+		URL:   k.Source.RepoURL(),
+	}
+	if string(d.l.CurrentModel()) != "python" && strings.HasPrefix(string(d.l.CurrentModel()), string(k.Source)) {
+		embed.Description = "Currently used: `" + k.QuantizationName(d.l.CurrentModel().Basename()) + "`\n"
+	}
+	embed.Description += "*Quantizations* (file size, estimated VRAM):"
+	for _, f := range k.QuantizationFiles(info.Files) {
+		line := "\n- `" + k.QuantizationName(f) + "`"
+		if size := info.FileSizes[f]; size != 0 {
+			line += fmt.Sprintf(": %.1fGiB, ~%.1fGiB", float64(size)/(1<<30), float64(llm.EstimateVRAM(size))/(1<<30))
+		}
+		// Embed descriptions are limited to 4096 characters.
+		if len(embed.Description)+len(line) > 4000 {
+			embed.Description += "\n…"
+			break
+		}
+		embed.Description += line
+	}
+	if info.Upstream.Author != "" && info.Upstream.Repo != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Upstream", Value: "[" + info.Upstream.RepoID() + "](" + info.Upstream.URL() + ")"})
+		infoUpstream := huggingface.Model{ModelRef: info.Upstream}
+		if err := d.l.HF.GetModelInfo(d.ctx, &infoUpstream); err != nil {
+			slog.Error("discord", "command", data.Name, "error", err)
+		} else {
+			if infoUpstream.NumWeights != 0 {
+				embed.Fields = append(embed.Fields,
+					&discordgo.MessageEmbedField{Name: "Tensor type", Value: infoUpstream.TensorType, Inline: true},
+					&discordgo.MessageEmbedField{Name: "Weights", Value: fmt.Sprintf("%.1fB", float64(infoUpstream.NumWeights)*0.000000001), Inline: true})
+			}
+			info.License = infoUpstream.License
+			info.LicenseURL = infoUpstream.LicenseURL
+		}
+	}
+	if info.LicenseURL != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "License", Value: "[" + info.License + "](" + info.LicenseURL + ")", Inline: true})
+	} else if info.License != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "License", Value: info.License, Inline: true})
+	}
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseChannelMessageWithSource, Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}}}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
 func (d *discordBot) onMetrics(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
 	m := llm.Metrics{}
 	if err := d.l.GetMetrics(d.ctx, &m); err != nil {
@@ -619,7 +2494,7 @@ func (d *discordBot) onMetrics(event *discordgo.InteractionCreate, data discordg
 		"LLM server metrics running %s:\n"+
 			"- Prompt: **%4d** tokens; **% 8.2f** tok/s\n"+
 			"- Generated: **%4d** tokens; **% 8.2f** tok/s",
-		d.l.Model,
+		d.l.CurrentModel(),
 		m.Prompt.Count, m.Prompt.Rate(),
 		m.Generated.Count, m.Generated.Rate())
 	if err := d.interactionRespond(event.Interaction, s); err != nil {
@@ -627,6 +2502,49 @@ func (d *discordBot) onMetrics(event *discordgo.InteractionCreate, data discordg
 	}
 }
 
+func (d *discordBot) onStats(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	// Discord expects a reply within 3 seconds.
+	ctx, cancel := context.WithTimeout(d.ctx, 2*time.Second)
+	defer cancel()
+	d.mu.Lock()
+	chat, images := d.loadLocked()
+	chatLatency := d.chatLatency.String()
+	imageLatency := d.imageLatency.String()
+	d.mu.Unlock()
+
+	embed := &discordgo.MessageEmbed{Title: "Stats"}
+	add := func(name, value string) {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value, Inline: true})
+	}
+	add("Uptime", time.Since(d.started).Round(time.Second).String())
+	add("Conversations", fmt.Sprintf("%d active in the last hour, %d total", d.mem.Count(time.Now().Add(-time.Hour)), d.mem.Count(time.Time{})))
+	add("Queues", fmt.Sprintf("%d chat, %d images", chat, images))
+	if d.l != nil {
+		add("LLM", "`"+string(d.l.CurrentModel())+"`: "+backendStatus(d.l.GetHealth(ctx)))
+		add("Chat latency", chatLatency)
+	}
+	if d.ig != nil {
+		dev := d.ig.Device()
+		add("Image generation", backendStatus(d.ig.GetHealth(ctx))+" on "+dev.String())
+		add("Image latency", imageLatency)
+	}
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseChannelMessageWithSource, Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}}}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// backendStatus formats the health of a backend server.
+func backendStatus(status string, err error) string {
+	if err != nil {
+		return "unreachable: " + err.Error()
+	}
+	if status == "" {
+		return "unknown"
+	}
+	return status
+}
+
 func (d *discordBot) onImage(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
 	opts := struct {
 		// meme_auto, meme_labels_auto, image_auto
@@ -634,15 +2552,38 @@ func (d *discordBot) onImage(event *discordgo.InteractionCreate, data discordgo.
 		// meme_manual, image_manual
 		ImagePrompt string `json:"image_prompt"`
 		// meme_manual
-		LabelsContent string `json:"labels_content"`
+		LabelsContent string  `json:"labels_content"`
+		OutlineColor  string  `json:"outline_color"`
+		OutlineRadius float64 `json:"outline_radius"`
+		// meme_auto, meme_manual, image_auto, image_manual
+		Seed        int  `json:"seed"`
+		NoWatermark bool `json:"no_watermark"`
+		// image_auto, image_manual
+		Count int `json:"count"`
+		// meme_manual, image_manual
+		Steps int `json:"steps"`
 		// meme_auto, meme_manual, image_auto, image_manual
-		Seed int `json:"seed"`
+		Width       int    `json:"width"`
+		Height      int    `json:"height"`
+		AspectRatio string `json:"aspect_ratio"`
+		// image_remix
+		Image    string  `json:"image"`
+		Strength float64 `json:"strength"`
+		// image_auto, image_manual, image_remix
+		LoRA       string   `json:"lora"`
+		LoRAWeight *float64 `json:"lora_weight"`
+		Sampler    string   `json:"sampler"`
+		// meme_auto, meme_labels_auto, image_auto
+		Temperature *float64 `json:"temperature"`
+		TopP        *float64 `json:"top_p"`
+		// meme_auto, image_auto
+		Preview bool `json:"preview"`
 	}{}
 	if err := optionsToStruct(data.Options, &opts); err != nil {
 		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
 		return
 	}
-	if d.ig == nil && strings.HasSuffix(data.Name, "_auto") && data.Name != "meme_labels_auto" {
+	if d.ig == nil && ((strings.HasSuffix(data.Name, "_auto") && data.Name != "meme_labels_auto") || data.Name == "image_remix") {
 		if err := d.interactionRespond(event.Interaction, "Image generation is not enabled. Restart with bot.image_gen.model set in config.yml."); err != nil {
 			slog.Error("discord", "command", data.Name, "message", "failed reply to enable", "error", err)
 		}
@@ -662,20 +2603,126 @@ func (d *discordBot) onImage(event *discordgo.InteractionCreate, data discordgo.
 			return
 		}
 	}
-	req := intReq{
-		description:   opts.Description,
-		imagePrompt:   opts.ImagePrompt,
-		labelsContent: opts.LabelsContent,
-		seed:          opts.Seed,
-		cmdName:       data.Name,
-		int:           event.Interaction,
+	width, height, err := imageSize(opts.AspectRatio, opts.Width, opts.Height)
+	if err != nil {
+		if err = d.interactionRespond(event.Interaction, "Invalid image size: "+err.Error()); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
 	}
-	select {
-	case d.image <- req:
-	default:
-		if err := d.interactionRespond(event.Interaction, "Sorry! I have too many pending image requests. Please retry in a moment."); err != nil {
-			slog.Error("discord", "command", data.Name, "message", "failed reply rate limit", "error", err)
+	if opts.OutlineColor != "" {
+		if _, err = imagegen.ParseHexColor(opts.OutlineColor); err != nil {
+			if err = d.interactionRespond(event.Interaction, escapeMarkdown(err.Error())); err != nil {
+				slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+			}
+			return
+		}
+	}
+	if s := d.rateLimited(event, data.Name); s != "" {
+		if err = d.interactionRespond(event.Interaction, s); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	// The user's preferences are used as defaults.
+	p := imagePrefs{}
+	p.from(d.mem.GetPreferences(interactionUser(event.Interaction).ID))
+	if width != 0 {
+		p.Width = width
+		p.Height = height
+	}
+	if opts.Steps != 0 {
+		p.Steps = clampSteps(opts.Steps)
+	}
+	// Reply through the deferred response once it was sent.
+	deferred := false
+	reply := func(s string) {
+		var err error
+		if deferred {
+			_, err = d.dg.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{Content: &s})
+		} else {
+			err = d.interactionRespond(event.Interaction, s)
+		}
+		if err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+	}
+	var baseImage []byte
+	if data.Name == "image_remix" {
+		var a *discordgo.MessageAttachment
+		if data.Resolved != nil {
+			if a = data.Resolved.Attachments[opts.Image]; a != nil {
+				a = imageAttachment([]*discordgo.MessageAttachment{a})
+			}
+		}
+		if a == nil {
+			reply("Please attach a PNG, JPEG, GIF or WebP image.")
+			return
+		}
+		if a.Size > maxAttachmentSize {
+			reply(fmt.Sprintf("The image is too large, the limit is %dMiB.", maxAttachmentSize>>20))
+			return
+		}
+		// Downloading can take longer than the 3 seconds Discord gives to reply.
+		r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+		if err = d.dg.InteractionRespond(event.Interaction, r); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply update", "error", err)
+			return
+		}
+		deferred = true
+		if baseImage, err = d.downloadAttachment(a); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed downloading attachment", "error", err)
+			reply("Failed to retrieve the image: " + escapeMarkdown(err.Error()))
+			return
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(baseImage))
+		if err != nil {
+			reply("The attachment is not a valid image: " + escapeMarkdown(err.Error()))
+			return
 		}
+		// Keep the shape of the original image.
+		p.Width, p.Height = remixSize(cfg.Width, cfg.Height)
+	}
+	req := intReq{
+		description:    opts.Description,
+		imagePrompt:    opts.ImagePrompt,
+		labelsContent:  opts.LabelsContent,
+		outlineColor:   opts.OutlineColor,
+		outlineRadius:  opts.OutlineRadius,
+		seed:           opts.Seed,
+		steps:          p.Steps,
+		width:          p.Width,
+		height:         p.Height,
+		negativePrompt: p.NegativePrompt,
+		style:          p.Style,
+		keepBackground: p.KeepBackground,
+		noWatermark:    opts.NoWatermark,
+		count:          opts.Count,
+		baseImage:      baseImage,
+		strength:       opts.Strength,
+		lora:           opts.LoRA,
+		loraWeight:     opts.LoRAWeight,
+		sampler:        opts.Sampler,
+		labelsSampling: newSamplingParams(&d.settings.Sampling.Labels, d.modelSampling(), opts.Temperature, opts.TopP),
+		promptSampling: newSamplingParams(&d.settings.Sampling.ImagePrompt, d.modelSampling(), opts.Temperature, opts.TopP),
+		cmdName:        data.Name,
+		int:            event.Interaction,
+	}
+	if opts.Preview && (data.Name == "meme_auto" || data.Name == "image_auto") {
+		d.onPreview(req)
+		return
+	}
+	pos := d.enqueueImage(req)
+	if pos == 0 {
+		reply(tr(event.Locale, msgImageQueueFull))
+		return
+	}
+	d.rememberRequest(interactionUser(req.int).ID, req.int.ChannelID, lastRequest{image: &req})
+	if s := d.queuePosition(event.Locale, pos); s != "" {
+		reply(s)
+		return
+	}
+	if deferred {
 		return
 	}
 	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
@@ -684,795 +2731,3792 @@ func (d *discordBot) onImage(event *discordgo.InteractionCreate, data discordgo.
 	}
 }
 
-func (d *discordBot) interactionRespond(int *discordgo.Interaction, s string) error {
-	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseChannelMessageWithSource, Data: &discordgo.InteractionResponseData{Content: s}}
-	return d.dg.InteractionRespond(int, r)
-}
-
-// Internal
-
-// chatRoutine serializes the chat requests.
-func (d *discordBot) chatRoutine() {
-	// Prewarm the system prompt, clearing previous memory.
-	if d.settings.PromptSystem != "" {
-		c := d.getMemory("")
-		c.Messages = nil
-		c = d.getMemory("")
-		if _, err := d.l.Prompt(d.ctx, c.Messages, 100, 0, 1.0); err != nil {
-			slog.Error("discord", "error", err)
-		}
+func (d *discordBot) onRegenerate(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Enhance bool `json:"enhance"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
 	}
-	for req := range d.chat {
-		if req.authorID == "" {
-			d.wg.Done()
-			return
+	userID := interactionUser(event.Interaction).ID
+	d.mu.Lock()
+	last, ok := d.lastRequests.get(lastRequestKey(userID, event.ChannelID))
+	d.mu.Unlock()
+	limited := ""
+	if ok {
+		limited = d.rateLimited(event, data.Name)
+	}
+	reply := ""
+	switch {
+	case !ok:
+		reply = "I don't remember any request from you in this channel."
+	case limited != "":
+		reply = limited
+	case last.chat != nil:
+		req := *last.chat
+		req.regenerate = true
+		// The original message may be far up, reply in the channel.
+		req.replyToID = ""
+		if pos := d.enqueueChat(req); pos == 0 {
+			reply = tr(event.Locale, msgChatQueueFull)
+		} else {
+			reply = "*Regenerating*: " + escapeMarkdown(truncate(req.msg, 200))
+			if s := d.queuePosition(event.Locale, pos); s != "" {
+				reply += "\n" + s
+			}
 		}
-		d.handlePrompt(req)
+	default:
+		req := last.imageRequest(opts.Enhance)
+		req.int = event.Interaction
+		pos := d.enqueueImage(req)
+		if pos == 0 {
+			reply = tr(event.Locale, msgImageQueueFull)
+			break
+		}
+		// Keep the original request so it can be enhanced again later.
+		next := *last.image
+		next.int = event.Interaction
+		last.image = &next
+		if opts.Enhance {
+			last.labelsContent = ""
+			last.imagePrompt = ""
+		}
+		d.rememberRequest(userID, event.ChannelID, last)
+		if reply = d.queuePosition(event.Locale, pos); reply != "" {
+			break
+		}
+		r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+		if err := d.dg.InteractionRespond(req.int, r); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply update", "error", err)
+		}
+		return
+	}
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
 	}
 }
 
-// imageRoutine serializes the chat requests.
-func (d *discordBot) imageRoutine() {
-	for req := range d.image {
-		if req.int == nil {
-			d.wg.Done()
-			return
-		}
-		d.handleImage(req)
+// previewButtonPrefix is the prefix of the custom ID of the button to
+// generate a previewed image request. It is followed by the preview's key.
+const previewButtonPrefix = "preview_generate:"
+
+// previewTTL is how long a preview can be generated.
+const previewTTL = time.Hour
+
+// maxPreviews is the maximum number of previews waiting to be generated.
+const maxPreviews = 100
+
+// onPreview enhances the description of a meme_auto or image_auto request
+// and shows the result with a button to generate the image, to save the GPU
+// time when the enhanced prompt is not what the user wants.
+func (d *discordBot) onPreview(req intReq) {
+	// The LLM takes longer than the 3 seconds Discord gives to reply.
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+	if err := d.dg.InteractionRespond(req.int, r); err != nil {
+		slog.Error("discord", "command", req.cmdName, "message", "failed reply update", "error", err)
+		return
 	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		content, components := d.genPreview(req)
+		edit := &discordgo.WebhookEdit{Content: &content}
+		if components != nil {
+			edit.Components = &components
+		}
+		if _, err := d.dg.InteractionResponseEdit(req.int, edit); err != nil {
+			slog.Error("discord", "command", req.cmdName, "message", "failed reply", "error", err)
+		}
+	}()
 }
 
-func (d *discordBot) toolWebSearch(ctx context.Context, query string) (*customsearch.Search, error) {
-	// - https://developers.google.com/custom-search/v1/using_rest
-	// - https://console.cloud.google.com/apis/credentials
-	// - https://console.cloud.google.com/apis/library/customsearch.googleapis.com
-	// - https://console.cloud.google.com/apis/api/customsearch.googleapis.com/metrics
-	// - http://www.google.com/cse/manage/all
-	// - https://developers.google.com/custom-search/v1/introduction
-	s, err := customsearch.NewService(ctx, option.WithAPIKey(d.gcptoken))
+// genPreview enhances the request and records it as a preview. It returns
+// the reply and its generate button, or the error message and no button.
+func (d *discordBot) genPreview(req intReq) (string, []discordgo.MessageComponent) {
+	seed := req.seed
+	if seed == 0 {
+		var err error
+		if seed, err = randomSeed(); err != nil {
+			return "Failed to preview: " + escapeMarkdown(err.Error()), nil
+		}
+	}
+	labels, imagePrompt, _, err := d.enhance(d.ctx, &req, seed, 0)
 	if err != nil {
-		return nil, err
+		slog.Error("discord", "command", req.cmdName, "message", "failed preview", "error", err)
+		return "Failed to preview: " + escapeMarkdown(err.Error()), nil
+	}
+	p := pendingPreview{
+		authorID: interactionUser(req.int).ID,
+		created:  time.Now(),
+		last:     lastRequest{image: &req, labelsContent: labels, imagePrompt: imagePrompt},
+		seed:     seed,
+	}
+	d.mu.Lock()
+	d.addPreviewLocked(req.int.ID, p)
+	d.mu.Unlock()
+	return previewText(req.description, labels, imagePrompt, seed), []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Generate", Style: discordgo.PrimaryButton, CustomID: previewButtonPrefix + req.int.ID},
+		}},
 	}
-	//return s.Cse.List().Cx(d.cxtoken).Context(ctx).Q(query).Num(5).Do()
-	return s.Cse.List().Cx(d.cxtoken).Q(query).Do()
-	// TODO: Doesn't seem to work at the moment. :(
-	// Note that the free quota is minimal:
-	// - Google: 100 queries per day
-	// - Bing: 1000 queries per month, 2.5¢ after
-	// Investigate:
-	// - https://learn.microsoft.com/en-us/bing/search-apis/bing-web-search/overview
-	// - https://learn.microsoft.com/en-us/bing/search-apis/bing-web-search/quickstarts/rest/go
-	// - https://portal.azure.com/#view/Microsoft_Azure_ProjectOxford/CognitiveServicesHub/~/CognitiveSearch
 }
 
-func (d *discordBot) getMemory(channelID string) *llm.Conversation {
-	// TODO: Send a warning or forget when one of Model, Prompt, Tools changed.
-	c := d.mem.Get("", channelID)
-	if len(c.Messages) == 0 {
-		if d.toolsMsg.Content != "" {
-			c.Messages = []llm.Message{d.toolsMsg}
-		}
-		if d.settings.PromptSystem != "" {
-			c.Messages = append(c.Messages, llm.Message{Role: llm.System, Content: d.settings.PromptSystem})
-		}
+// previewText describes the enhanced request.
+func previewText(description, labels, imagePrompt string, seed int) string {
+	out := "*Description*: " + escapeMarkdown(description) + "\n"
+	if labels != "" {
+		out += "*Labels*: " + escapeMarkdown(labels) + "\n"
 	}
-	return c
+	out += "*Image prompt*: " + escapeMarkdown(imagePrompt) + "\n"
+	out += "*Seed*: " + strconv.Itoa(seed) + "\n"
+	out += "Click **Generate** to create the image."
+	return truncate(out, maxMessage-3)
 }
 
-// handlePrompt uses the LLM to generate a response.
-func (d *discordBot) handlePrompt(req msgReq) {
-	if true {
-		d.handlePromptStreaming(req)
-	} else {
-		d.handlePromptBlocking(req)
+// addPreviewLocked records the preview, forgetting the expired ones and the
+// oldest one if there are too many.
+func (d *discordBot) addPreviewLocked(id string, p pendingPreview) {
+	oldest := ""
+	for k, v := range d.previews {
+		if p.created.Sub(v.created) > previewTTL {
+			delete(d.previews, k)
+		} else if oldest == "" || v.created.Before(d.previews[oldest].created) {
+			oldest = k
+		}
+	}
+	if len(d.previews) >= maxPreviews {
+		delete(d.previews, oldest)
 	}
+	d.previews[id] = p
 }
 
-// handlePromptBlocking asks the LLM to reply back, wait for the whole answer,
-// then process it. This function exists for testing.
-func (d *discordBot) handlePromptBlocking(req msgReq) {
-	c := d.getMemory(req.channelID)
-	c.Messages = append(c.Messages, llm.Message{Role: llm.User, Content: req.msg})
-	replyToID := req.replyToID
-	for {
-		// 32768
-		reply, err := d.l.Prompt(d.ctx, c.Messages, 0, 0, 1.0)
-		if err != nil {
-			if _, err = d.dg.ChannelMessageSend(req.channelID, "Prompt generation failed: "+err.Error()+"\nTry `/forget` to reset the internal state"); err != nil {
-				slog.Error("discord", "message", "failed posting message", "error", err)
-			}
-			return
-		}
-		// Remember our own answer.
-		c.Messages = append(c.Messages, llm.Message{Role: llm.Assistant, Content: reply})
-		gotToolCall := false
-		for reply != "" {
-			if d.l.Encoding != nil && !gotToolCall {
-				if called := d.handleMistralToolCall(reply, c); called != "" {
-					// TODO: Tell the user a function is being used, not after it was used.
-					gotToolCall = true
-					if msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*"); err != nil {
-						slog.Error("discord", "message", "failed posting message", "error", err, "content", "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
-					} else {
-						replyToID = msg.ID
-					}
-					if err := d.dg.ChannelTyping(req.channelID); err != nil {
-						slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
-					}
-					// We need to do a new loop.
-					break
-				}
-			}
-			// Only split the response if it is too large.
-			t := reply
-			rest := ""
-			if len(reply) > maxMessage {
-				if t, rest = splitResponse(reply, false); t == "" {
-					if t, rest = splitResponse(reply, true); t == "" {
-						t = rest[:maxMessage]
-						rest = rest[maxMessage:]
-					}
-				}
-			}
-			msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, t)
-			if err != nil {
-				slog.Error("discord", "message", "failed posting message", "error", err, "content", t)
-			} else {
-				replyToID = msg.ID
-			}
-			reply = rest
+// onPreviewGenerate handles a click on the generate button of a preview. The
+// image is generated with the previewed labels and image prompt.
+func (d *discordBot) onPreviewGenerate(event *discordgo.InteractionCreate, id string) {
+	userID := ""
+	if user := interactionUser(event.Interaction); user != nil {
+		userID = user.ID
+	}
+	d.mu.Lock()
+	p, ok := d.previews[id]
+	if ok && time.Since(p.created) > previewTTL {
+		delete(d.previews, id)
+		ok = false
+	}
+	if ok && p.authorID == userID {
+		delete(d.previews, id)
+	}
+	d.mu.Unlock()
+	ephemeral := func(s string) {
+		r := discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: s, Flags: discordgo.MessageFlagsEphemeral},
 		}
-		if !gotToolCall {
-			return
+		if err := d.dg.InteractionRespond(event.Interaction, &r); err != nil {
+			slog.Error("discord", "message", "failed reply", "error", err)
 		}
 	}
+	if !ok {
+		ephemeral("This preview expired. Please run the command again.")
+		return
+	}
+	if p.authorID != userID {
+		ephemeral("Only the person who asked can generate this image.")
+		return
+	}
+	if s := d.rateLimited(event, "preview"); s != "" {
+		// Keep it so the user can retry.
+		d.mu.Lock()
+		d.previews[id] = p
+		d.mu.Unlock()
+		ephemeral(s)
+		return
+	}
+	req := p.last.imageRequest(false)
+	req.seed = p.seed
+	req.int = event.Interaction
+	pos := d.enqueueImage(req)
+	if pos == 0 {
+		// Keep it so the user can retry.
+		d.mu.Lock()
+		d.previews[id] = p
+		d.mu.Unlock()
+		ephemeral(tr(event.Locale, msgImageQueueFull))
+		return
+	}
+	// Remember the original request so /regenerate can enhance it again.
+	last := p.last
+	orig := *last.image
+	orig.int = event.Interaction
+	last.image = &orig
+	d.rememberRequest(userID, event.ChannelID, last)
+	// The image routine then edits the preview message, as the response to
+	// the click.
+	content := event.Message.Content
+	if s := d.queuePosition(event.Locale, pos); s != "" {
+		content = s
+	}
+	r := discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Content: content, Components: []discordgo.MessageComponent{}},
+	}
+	if err := d.dg.InteractionRespond(event.Interaction, &r); err != nil {
+		slog.Error("discord", "message", "failed reply", "error", err)
+	}
 }
 
-// handlePromptStreaming request a reply from the LLM and streams replies back.
-func (d *discordBot) handlePromptStreaming(req msgReq) {
-	c := d.getMemory(req.channelID)
-	c.Messages = append(c.Messages, llm.Message{Role: llm.User, Content: req.msg})
-	wg := sync.WaitGroup{}
-	for {
-		ctx, cancel := context.WithCancel(d.ctx)
-		gotToolCall := false
-		// Make it blocking to force a goroutine context switch when a word is
-		// received. When it's buffered, there can be significant delay when LLM is
-		// running on the CPU.
-		words := make(chan string)
-		wg.Add(1)
-		go func() {
-			const rate = 2000 * time.Millisecond
-			t := time.NewTicker(rate)
-			last := time.Now()
-			replyToID := req.replyToID
-			text := ""
-			pending := ""
-			for {
-				select {
-				case w, ok := <-words:
-					//slog.Debug("discord", "w", w, "ok", ok)
-					if !ok {
-						if d.l.Encoding != nil && !gotToolCall {
-							if called := d.handleMistralToolCall(pending, c); called != "" {
-								// TODO: Tell the user a function is being used, not after it was used.
-								gotToolCall = true
-								// No need to wait for additional content.
-								// TODO: investigate why it's not taking effect faster.
-								cancel()
-								if msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*"); err != nil {
-									slog.Error("discord", "message", "failed posting message", "error", err, "content", "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
-								} else {
-									replyToID = msg.ID
-								}
-								if err := d.dg.ChannelTyping(req.channelID); err != nil {
-									slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
-								}
-							}
-						}
-						if !gotToolCall {
-							// That's the end, flush all the remaining content.
-							if pending != "" {
-								text += pending
-								// When a model is asked to do a large program, it's frequent
-								// that it will buffer the whole response and send it back in
-								// one shot. In this case, the content received can be very
-								// large.
-								// TODO: It could be a function call!! Handle it.
-								for len(pending) > maxMessage {
-									t, rest := splitResponse(pending, true)
-									if t == "" {
-										t = rest[:maxMessage]
-										rest = rest[maxMessage:]
-									}
-									msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, t)
-									if err != nil {
-										slog.Error("discord", "message", "failed posting message", "error", err, "content", t)
-									} else {
-										replyToID = msg.ID
-									}
-									pending = rest
-								}
-								if _, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, pending); err != nil {
-									slog.Error("discord", "message", "failed posting message", "error", err, "content", pending)
-								}
-							}
-							// Remember our own answer.
-							c.Messages = append(c.Messages, llm.Message{Role: llm.Assistant, Content: text})
-						}
-						t.Stop()
-						wg.Done()
-						return
-					}
-					pending += w
-				case now := <-t.C:
-					// TODO: Handle when the model replies with more than maxMessage per
-					// rate.
-					// It becomes urgent when it's twice the period.
-					if t, rest := splitResponse(pending, now.Sub(last) >= 2*rate); t != "" {
-						if d.l.Encoding != nil && !gotToolCall {
-							// TODO: function call is when a line, any line, starts with "[".
-							// Sometimes the last "]" is not followed by a \n, which breaks json
-							// parsing.
-							if called := d.handleMistralToolCall(t, c); called != "" {
-								// TODO: Tell the user a function is being used, not after it was used.
-								gotToolCall = true
-								// No need to wait for additional content.
-								// TODO: investigate why it's not taking effect faster.
-								cancel()
-								msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
-								if err != nil {
-									slog.Error("discord", "message", "failed posting message", "error", err, "content", "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
-								} else {
-									replyToID = msg.ID
-								}
-							}
-						}
-						if !gotToolCall {
-							msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, t)
-							if err != nil {
-								slog.Error("discord", "message", "failed posting message", "error", err, "content", t)
-							} else {
-								replyToID = msg.ID
-							}
-							last = now
-						}
-						text += t
-						pending = rest
-					}
-				}
-				if err := d.dg.ChannelTyping(req.channelID); err != nil {
-					slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
-				}
-			}
-		}()
-		// We're chatting, we don't want too much content.
-		// 32768
-		err := d.l.PromptStreaming(ctx, c.Messages, 0, 0, 1.0, words)
-		close(words)
-		wg.Wait()
-		cancel()
-		if errors.Is(err, context.Canceled) {
-			err = nil
+// onSeedFromImage shows the parameters embedded in an image generated by the
+// bot, with a button to generate it again.
+func (d *discordBot) onSeedFromImage(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Image string `json:"image"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	var a *discordgo.MessageAttachment
+	if data.Resolved != nil {
+		a = data.Resolved.Attachments[opts.Image]
+	}
+	if a == nil || a.ContentType != "image/png" {
+		if err := d.interactionRespond(event.Interaction, "Please attach a PNG image generated by me."); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
 		}
-		if err != nil {
-			if _, err = d.dg.ChannelMessageSend(req.channelID, "Prompt generation failed: "+err.Error()+"\nTry `/forget` to reset the internal state"); err != nil {
-				slog.Error("discord", "message", "failed posting message", "error", err)
+		return
+	}
+	// Downloading can take longer than the 3 seconds Discord gives to reply.
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply update", "error", err)
+		return
+	}
+	edit := &discordgo.WebhookEdit{}
+	content := ""
+	if b, err := d.downloadAttachment(a); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed downloading attachment", "error", err)
+		content = "Failed to retrieve the image: " + escapeMarkdown(err.Error())
+	} else if p, err := imagegen.ReadParams(b); errors.Is(err, imagegen.ErrNoParams) {
+		content = "This image has no generation parameters. Only the PNG images I generated have them, and editing or converting the image removes them."
+	} else if err != nil {
+		content = "Failed to read the generation parameters: " + escapeMarkdown(err.Error())
+	} else {
+		content = paramsText(p)
+		req, err := paramsRequest(p)
+		switch {
+		case err != nil:
+			content += "*Can't generate it again*: " + escapeMarkdown(err.Error())
+		case d.ig == nil:
+			content += "Image generation is not enabled, so I can't generate it again."
+		default:
+			req.int = event.Interaction
+			pp := pendingPreview{
+				authorID: interactionUser(event.Interaction).ID,
+				created:  time.Now(),
+				last:     lastRequest{image: &req},
+				seed:     p.Seed,
+			}
+			d.mu.Lock()
+			d.addPreviewLocked(event.ID, pp)
+			d.mu.Unlock()
+			content += "Click **Generate** to create the image again."
+			edit.Components = &[]discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.Button{Label: "Generate", Style: discordgo.PrimaryButton, CustomID: previewButtonPrefix + event.ID},
+				}},
 			}
 		}
-		if !gotToolCall {
-			break
+	}
+	content = truncate(content, maxMessage-3)
+	edit.Content = &content
+	if _, err := d.dg.InteractionResponseEdit(event.Interaction, edit); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+// paramsText describes the generation parameters embedded in an image.
+func paramsText(p *imagegen.Params) string {
+	out := "*Image prompt*: " + escapeMarkdown(p.Prompt) + "\n"
+	if p.NegativePrompt != "" {
+		out += "*Negative prompt*: " + escapeMarkdown(p.NegativePrompt) + "\n"
+	}
+	if p.Labels != "" {
+		out += "*Labels*: " + escapeMarkdown(p.Labels) + "\n"
+	}
+	out += "*Seed*: " + strconv.Itoa(p.Seed) + "\n"
+	if p.Steps != 0 {
+		out += "*Steps*: " + strconv.Itoa(p.Steps) + "\n"
+	}
+	if p.Width != 0 {
+		out += fmt.Sprintf("*Size*: %dx%d\n", p.Width, p.Height)
+	}
+	if p.Sampler != "" {
+		out += "*Sampler*: " + escapeMarkdown(p.Sampler) + "\n"
+	}
+	if p.LoRA != "" {
+		out += "*LoRA*: " + escapeMarkdown(p.LoRA)
+		if p.LoRAWeight != nil {
+			out += " (" + strconv.FormatFloat(*p.LoRAWeight, 'f', -1, 64) + ")"
 		}
+		out += "\n"
 	}
+	return out
 }
 
-func (d *discordBot) channelMessageSendComplex(replyToID, channelID, guildID, content string) (st *discordgo.Message, err error) {
-	msgSend := discordgo.MessageSend{Content: content}
-	if replyToID != "" {
-		msgSend.Reference = &discordgo.MessageReference{MessageID: replyToID, ChannelID: channelID, GuildID: guildID}
+// paramsRequest returns the request to generate the image again with the
+// embedded parameters. The parameters come from an uploaded file, so they are
+// validated like the command options.
+func paramsRequest(p *imagegen.Params) (intReq, error) {
+	prefs := imagePrefs{Steps: p.Steps, Width: p.Width, Height: p.Height}
+	if err := prefs.validate(); err != nil {
+		return intReq{}, err
 	}
-	return d.dg.ChannelMessageSendComplex(channelID, &msgSend)
+	if p.Prompt == "" {
+		return intReq{}, errors.New("the image prompt is missing")
+	}
+	req := intReq{
+		cmdName:        "image_manual",
+		imagePrompt:    p.Prompt,
+		negativePrompt: p.NegativePrompt,
+		steps:          p.Steps,
+		width:          p.Width,
+		height:         p.Height,
+		sampler:        p.Sampler,
+		lora:           p.LoRA,
+		loraWeight:     p.LoRAWeight,
+		count:          1,
+	}
+	if p.Labels != "" {
+		req.cmdName = "meme_manual"
+		req.labelsContent = p.Labels
+	}
+	return req, nil
 }
 
-// handleMistralToolCall check if the pending string and returns its name if so.
-//
-// TODO: This shouldn't receive the whole conversation. It should return the
-// name before calling so it can alert the user, especially for tools that take
-// a long time to run.
+// upscaleButtonID is the custom ID of the button to upscale the last image
+// of a message.
+const upscaleButtonID = "upscale"
+
+// upscaleTTL is how long an image can be upscaled.
+const upscaleTTL = time.Hour
+
+// maxUpscales is the maximum number of images kept in memory to be upscaled.
+const maxUpscales = 50
+
+// pendingUpscale is the last image of a message, kept for its upscale button.
+type pendingUpscale struct {
+	// img is the image as sent to the user.
+	img []byte
+	// prompt is the image prompt used to generate it, to guide the upscaler.
+	prompt string
+	// n is the number of the image in the message, starting at 1.
+	n       int
+	created time.Time
+}
+
+// canUpscale returns true if the upscale button should be offered.
+func (d *discordBot) canUpscale() bool {
+	if d.ig == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.noUpscale
+}
+
+// addUpscaleLocked records the last image of the message, forgetting the
+// expired ones and the oldest one if there are too many.
+func (d *discordBot) addUpscaleLocked(id string, p pendingUpscale) {
+	oldest := ""
+	for k, v := range d.upscales {
+		if p.created.Sub(v.created) > upscaleTTL {
+			delete(d.upscales, k)
+		} else if k != id && (oldest == "" || v.created.Before(d.upscales[oldest].created)) {
+			oldest = k
+		}
+	}
+	if _, ok := d.upscales[id]; !ok && len(d.upscales) >= maxUpscales {
+		delete(d.upscales, oldest)
+	}
+	d.upscales[id] = p
+}
+
+// onUpscale handles a click on the upscale button of an image message. The
+// upscaled image is sent as a new message.
+func (d *discordBot) onUpscale(event *discordgo.InteractionCreate) {
+	d.mu.Lock()
+	p, ok := d.upscales[event.Message.ID]
+	if ok && time.Since(p.created) > upscaleTTL {
+		delete(d.upscales, event.Message.ID)
+		ok = false
+	}
+	d.mu.Unlock()
+	ephemeral := func(s string) {
+		r := discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: s, Flags: discordgo.MessageFlagsEphemeral},
+		}
+		if err := d.dg.InteractionRespond(event.Interaction, &r); err != nil {
+			slog.Error("discord", "message", "failed reply", "error", err)
+		}
+	}
+	if !ok {
+		ephemeral("This image expired. Please generate it again.")
+		return
+	}
+	if s := d.rateLimited(event, "upscale"); s != "" {
+		ephemeral(s)
+		return
+	}
+	// Upscaling takes longer than the 3 seconds Discord gives to reply.
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+	if err := d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "message", "failed reply", "error", err)
+		return
+	}
+	// Go through the image queue like the image commands, the upscaler uses
+	// the GPU too.
+	job := intReq{cmdName: "upscale", description: p.prompt, job: func() {
+		d.upscale(event, p)
+	}}
+	content := ""
+	if pos := d.enqueueImage(job); pos == 0 {
+		content = tr(event.Locale, msgImageQueueFull)
+	} else {
+		content = d.queuePosition(event.Locale, pos)
+	}
+	if content != "" {
+		if _, err := d.dg.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+			slog.Error("discord", "message", "failed reply", "error", err)
+		}
+	}
+}
+
+// upscale upscales the image and posts it as the reply to the interaction.
+func (d *discordBot) upscale(event *discordgo.InteractionCreate, p pendingUpscale) {
+	content := "*Upscaled image #" + strconv.Itoa(p.n) + "*: "
+	edit := &discordgo.WebhookEdit{Content: &content}
+	img, err := d.ig.Upscale(d.ctx, p.img, p.prompt)
+	// The upscaler is guided by the prompt and can add details, check it
+	// again.
+	filtered := false
+	if err == nil {
+		img, filtered = d.filterImage(d.ctx, img)
+	}
+	var b []byte
+	if err == nil {
+		b, err = d.ig.Output().EncodeWithin(img, d.uploadLimit(event.GuildID))
+	}
+	switch {
+	case errors.Is(err, imagegen.ErrUpscaleUnavailable):
+		d.mu.Lock()
+		d.noUpscale = true
+		d.mu.Unlock()
+		content += "the image server doesn't support upscaling."
+	case err != nil:
+		requestErrors.IncWith("upscale")
+		slog.Error("discord", "message", "failed upscale", "error", err)
+		content += "\n*Error*: " + imageErrorText(err)
+	default:
+		imagesGenerated.Inc()
+		bounds := img.Bounds()
+		content += strconv.Itoa(bounds.Dx()) + "x" + strconv.Itoa(bounds.Dy())
+		if filtered {
+			content += "\n" + filteredNote
+		}
+		output := d.ig.Output()
+		edit.Files = []*discordgo.File{{Name: "upscaled" + output.Ext(), ContentType: output.ContentType(), Reader: bytes.NewReader(b)}}
+	}
+	if _, err := d.dg.InteractionResponseEdit(event.Interaction, edit); err != nil {
+		slog.Error("discord", "message", "failed reply", "error", err)
+	}
+}
+
+func (d *discordBot) onPrefs(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Steps          int    `json:"steps"`
+		Width          int    `json:"width"`
+		Height         int    `json:"height"`
+		NegativePrompt string `json:"negative_prompt"`
+		Style          string `json:"style"`
+		KeepBackground *bool  `json:"keep_background"`
+		Reset          bool   `json:"reset"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	user := interactionUser(event.Interaction).ID
+	p := imagePrefs{}
+	reply := ""
+	if opts.Reset {
+		d.mem.SetPreferences(user, nil)
+		reply = "Your preferences were reset.\n"
+	} else {
+		p.from(d.mem.GetPreferences(user))
+		changed := false
+		if opts.Steps != 0 {
+			p.Steps = opts.Steps
+			changed = true
+		}
+		if opts.Width != 0 || opts.Height != 0 {
+			p.Width = opts.Width
+			p.Height = opts.Height
+			changed = true
+		}
+		if opts.NegativePrompt != "" {
+			p.NegativePrompt = opts.NegativePrompt
+			changed = true
+		}
+		if opts.Style != "" {
+			p.Style = opts.Style
+			changed = true
+		}
+		if opts.KeepBackground != nil {
+			p.KeepBackground = *opts.KeepBackground
+			changed = true
+		}
+		if changed {
+			if err := p.validate(); err != nil {
+				if err = d.interactionRespond(event.Interaction, "Invalid preferences: "+err.Error()); err != nil {
+					slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+				}
+				return
+			}
+			d.mem.SetPreferences(user, p.to())
+			reply = "Your preferences were updated.\n"
+		}
+	}
+	reply += p.String()
+	if err := d.interactionRespond(event.Interaction, reply); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+func (d *discordBot) onPromptTemplates(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Name   string `json:"name"`
+		Params string `json:"params"`
+		Seed   int    `json:"seed"`
+	}{}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	if opts.Name = strings.TrimSpace(opts.Name); opts.Name == "" {
+		if err := d.interactionRespond(event.Interaction, listPromptTemplates(d.settings.PromptTemplates)); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	var p *sillybot.PromptTemplate
+	for i := range d.settings.PromptTemplates {
+		if d.settings.PromptTemplates[i].Name == opts.Name {
+			p = &d.settings.PromptTemplates[i]
+			break
+		}
+	}
+	prompt := ""
+	params, err := sillybot.ParsePromptParams(opts.Params)
+	if p == nil {
+		err = fmt.Errorf("unknown template %q; use /prompt_templates without options to list them", opts.Name)
+	} else if err == nil {
+		prompt, err = p.Apply(params)
+	}
+	if err == nil && p.Kind == "image" && d.ig == nil {
+		err = errors.New("image generation is not enabled. Restart with bot.image_gen.model set in config.yml")
+	}
+	if err == nil && p.Kind == "chat" && d.l == nil {
+		err = errors.New("LLM is not enabled. Restart with bot.llm.model set in config.yml")
+	}
+	if err != nil {
+		if err = d.interactionRespond(event.Interaction, "Failed to apply template: "+escapeMarkdown(err.Error())); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	if s := d.rateLimited(event, data.Name); s != "" {
+		if err = d.interactionRespond(event.Interaction, s); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	user := interactionUser(event.Interaction)
+	slog.Info("discord", "command", data.Name, "template", p.Name, "prompt", prompt)
+
+	if p.Kind == "chat" {
+		// Reply with the prompt so the LLM reply is threaded to it.
+		if err = d.interactionRespond(event.Interaction, "*Template*: "+escapeMarkdown(p.Name)+"\n"+escapeMarkdown(prompt)); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+			return
+		}
+		replyToID := ""
+		if msg, err := d.dg.InteractionResponse(event.Interaction); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed getting reply", "error", err)
+		} else {
+			replyToID = msg.ID
+		}
+		req := msgReq{
+			msg:        prompt,
+			authorID:   user.ID,
+			authorName: displayName(user),
+			channelID:  event.ChannelID,
+			guildID:    event.GuildID,
+			replyToID:  replyToID,
+			language:   d.userLanguage(user.ID),
+			sampling:   newSamplingParams(&d.settings.Sampling.Chat, d.modelSampling(), nil, nil),
+		}
+		d.sendChat(req)
+		return
+	}
+
+	// The user's preferences are used as defaults.
+	prefs := imagePrefs{}
+	prefs.from(d.mem.GetPreferences(user.ID))
+	req := intReq{
+		imagePrompt:    prompt,
+		seed:           opts.Seed,
+		steps:          prefs.Steps,
+		width:          prefs.Width,
+		height:         prefs.Height,
+		negativePrompt: prefs.NegativePrompt,
+		style:          prefs.Style,
+		cmdName:        data.Name,
+		int:            event.Interaction,
+	}
+	pos := d.enqueueImage(req)
+	if pos == 0 {
+		if err := d.interactionRespond(event.Interaction, tr(event.Locale, msgImageQueueFull)); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply rate limit", "error", err)
+		}
+		return
+	}
+	if s := d.queuePosition(event.Locale, pos); s != "" {
+		if err := d.interactionRespond(event.Interaction, s); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredChannelMessageWithSource}
+	if err := d.dg.InteractionRespond(req.int, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply update", "error", err)
+	}
+}
+
+func (d *discordBot) onDebugMeme(event *discordgo.InteractionCreate, data discordgo.ApplicationCommandInteractionData) {
+	opts := struct {
+		Labels        string  `json:"labels"`
+		Background    string  `json:"background"`
+		FontScale     float64 `json:"font_scale"`
+		OutlineRadius float64 `json:"outline_radius"`
+	}{Background: "#808080"}
+	if err := optionsToStruct(data.Options, &opts); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed decoding command options", "error", err)
+		return
+	}
+	if !d.settings.DebugCommands {
+		if err := d.interactionRespond(event.Interaction, "Debug commands are not enabled. Restart with bot.settings.debug_commands set in config.yml."); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply to enable", "error", err)
+		}
+		return
+	}
+	bg, err := imagegen.ParseHexColor(opts.Background)
+	if err != nil {
+		if err = d.interactionRespond(event.Interaction, escapeMarkdown(err.Error())); err != nil {
+			slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+		}
+		return
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, defaultImageWidth, defaultImageHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	imagegen.DrawLabelsOnImageWithOptions(img, opts.Labels, &imagegen.LabelOptions{FontScale: opts.FontScale, OutlineRadius: opts.OutlineRadius})
+	w := bytes.Buffer{}
+	if err = jpeg.Encode(&w, img, nil); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed encoding", "error", err)
+		return
+	}
+	content := "*Labels*: " + escapeMarkdown(opts.Labels) + "\n" +
+		"*Background*: " + opts.Background + "\n" +
+		"*Font scale*: " + strconv.FormatFloat(opts.FontScale, 'g', -1, 64) + "\n" +
+		"*Outline radius*: " + strconv.FormatFloat(opts.OutlineRadius, 'g', -1, 64)
+	r := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Files:   []*discordgo.File{{Name: "debug_meme.jpg", ContentType: "image/jpeg", Reader: &w}},
+		},
+	}
+	if err = d.dg.InteractionRespond(event.Interaction, r); err != nil {
+		slog.Error("discord", "command", data.Name, "message", "failed reply", "error", err)
+	}
+}
+
+func (d *discordBot) interactionRespond(int *discordgo.Interaction, s string) error {
+	r := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseChannelMessageWithSource, Data: &discordgo.InteractionResponseData{Content: s}}
+	return d.dg.InteractionRespond(int, r)
+}
+
+// Internal
+
+// chatRoutine serializes the chat requests.
+func (d *discordBot) chatRoutine() {
+	// Prewarm the system prompt, clearing previous memory.
+	if d.settings.PromptSystem != "" {
+		c := d.getMemory("", "", "", &sillybot.PromptVars{})
+		d.resetMemory(c, d.settings.PromptSystem, "", &sillybot.PromptVars{})
+		if _, err := d.l.Prompt(d.ctx, c.Messages, &llm.PromptOptions{MaxTokens: 100, Temperature: 1.0}); err != nil {
+			slog.Error("discord", "error", err)
+		}
+	}
+	for req := range d.chat {
+		if req.authorID == "" {
+			d.wg.Done()
+			return
+		}
+		d.mu.Lock()
+		d.promoteChatLocked()
+		d.mu.Unlock()
+		if !d.startChat(req) {
+			slog.Info("discord", "message", "skipped cancelled request", "author", req.authorID, "channel", req.channelID)
+			continue
+		}
+		d.setActive("chat", fmt.Sprintf("author=%s channel=%s message=%q", req.authorID, req.channelID, req.msg))
+		start := time.Now()
+		d.handlePrompt(req)
+		d.setActive("chat", "")
+		d.mu.Lock()
+		d.chatLatency.add(time.Since(start))
+		d.mu.Unlock()
+	}
+}
+
+// imageRoutine processes the image requests. There is one per worker, name
+// identifies it.
+func (d *discordBot) imageRoutine(name string) {
+	for req := range d.image {
+		if req.int == nil && req.job == nil {
+			d.wg.Done()
+			return
+		}
+		d.setActive(name, req.activity())
+		start := time.Now()
+		if req.job != nil {
+			req.job()
+		} else {
+			d.handleImage(req)
+		}
+		d.setActive(name, "")
+		d.mu.Lock()
+		d.imageLatency.add(time.Since(start))
+		d.pendingImages -= req.cost()
+		d.promoteImagesLocked()
+		d.mu.Unlock()
+	}
+}
+
+// presenceRoutine refreshes the presence to reflect the load.
+//
+// Discord rate limits the gateway, so it is polled instead of updated on each
+// request.
+func (d *discordBot) presenceRoutine() {
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-t.C:
+			d.updatePresence()
+		}
+	}
+}
+
+// updatePresence sets the presence if it changed.
+func (d *discordBot) updatePresence() {
+	p := &d.settings.Presence
+	if p.Text == "" && !p.ShowLoad {
+		return
+	}
+	d.mu.Lock()
+	chat, images := d.loadLocked()
+	text := ""
+	if p.ShowLoad {
+		text = loadText(chat, images)
+	}
+	if text == "" {
+		text = p.Text
+	}
+	if text == d.presence {
+		d.mu.Unlock()
+		return
+	}
+	d.presence = text
+	d.mu.Unlock()
+	if err := d.dg.UpdateStatusComplex(presenceData(p.Activity, text)); err != nil {
+		slog.Error("discord", "message", "failed to update presence", "error", err)
+	}
+}
+
+// enqueueChat queues a chat request. It returns the position in line,
+// starting at 1, or 0 when the queue is full and the request was rejected.
+func (d *discordBot) enqueueChat(req msgReq) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pos := len(d.chat) + len(d.waitingChat) + 1
+	if d.active["chat"] != "" {
+		pos++
+	}
+	// Don't pass the requests already waiting.
+	if len(d.waitingChat) == 0 {
+		select {
+		case d.chat <- req:
+			return pos
+		default:
+		}
+	}
+	if d.settings.Queue.Overflow != "wait" {
+		queueRejections.IncWith("chat")
+		return 0
+	}
+	d.waitingChat = append(d.waitingChat, req)
+	return pos
+}
+
+// enqueueImage queues an image request. It returns the position in line,
+// starting at 1, or 0 when the queue is full and the request was rejected.
+//
+// The requested images are accounted for, so a few large batches cannot
+// starve the other users.
+func (d *discordBot) enqueueImage(req intReq) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// With multiple workers, the request starts as soon as any of them is
+	// free.
+	pos := max(len(d.image)+len(d.waitingImages)+d.busyImageWorkersLocked()-d.imageWorkers()+2, 1)
+	// Don't pass the requests already waiting.
+	if len(d.waitingImages) == 0 && d.pendingImages+req.cost() <= d.maxPendingImages() {
+		select {
+		case d.image <- req:
+			d.pendingImages += req.cost()
+			return pos
+		default:
+		}
+	}
+	if d.settings.Queue.Overflow != "wait" {
+		queueRejections.IncWith("image")
+		return 0
+	}
+	d.waitingImages = append(d.waitingImages, req)
+	return pos
+}
+
+// imageWorkers returns the number of imageRoutine processing the requests
+// concurrently.
+func (d *discordBot) imageWorkers() int {
+	return max(d.settings.Queue.Workers, 1)
+}
+
+// maxPendingImages returns the maximum number of images guaranteed to the
+// queued image requests: a full batch for each worker plus one waiting.
+func (d *discordBot) maxPendingImages() int {
+	return (d.imageWorkers() + 1) * imageBatch
+}
+
+// busyImageWorkersLocked returns the number of imageRoutine processing a
+// request.
+func (d *discordBot) busyImageWorkersLocked() int {
+	n := 0
+	for routine := range d.active {
+		if strings.HasPrefix(routine, "image") {
+			n++
+		}
+	}
+	return n
+}
+
+// promoteChatLocked moves the waiting chat requests into the queue as room
+// becomes available.
+func (d *discordBot) promoteChatLocked() {
+	for len(d.waitingChat) != 0 {
+		select {
+		case d.chat <- d.waitingChat[0]:
+			d.waitingChat = d.waitingChat[1:]
+		default:
+			return
+		}
+	}
+}
+
+// promoteImagesLocked moves the waiting image requests into the queue as
+// room becomes available.
+func (d *discordBot) promoteImagesLocked() {
+	for len(d.waitingImages) != 0 && d.pendingImages+d.waitingImages[0].cost() <= d.maxPendingImages() {
+		select {
+		case d.image <- d.waitingImages[0]:
+			d.pendingImages += d.waitingImages[0].cost()
+			d.waitingImages = d.waitingImages[1:]
+		default:
+			return
+		}
+	}
+}
+
+// loadLocked returns the number of chat requests and images pending,
+// including the ones being processed and waiting.
+func (d *discordBot) loadLocked() (int, int) {
+	chat := len(d.chat) + len(d.waitingChat)
+	if d.active["chat"] != "" {
+		chat++
+	}
+	images := d.pendingImages
+	for i := range d.waitingImages {
+		images += d.waitingImages[i].cost()
+	}
+	return chat, images
+}
+
+// queuePosition returns the text telling the user their position in line,
+// if they have to wait and the overflow behavior is "wait".
+// rateLimited takes a request from the budget of the user of the interaction.
+// It returns the reply to send when the user is over the limit, "" otherwise.
+//
+// Every interaction queuing a chat or an image request must call it.
+func (d *discordBot) rateLimited(event *discordgo.InteractionCreate, name string) string {
+	wait := d.limiter.take(interactionUser(event.Interaction).ID, time.Now())
+	if wait == 0 {
+		return ""
+	}
+	slog.Info("discord", "command", name, "message", "rate limited", "wait", wait)
+	return tr(event.Locale, msgRateLimited, cooldown(wait))
+}
+
+func (d *discordBot) queuePosition(l discordgo.Locale, pos int) string {
+	if pos < 2 || d.settings.Queue.Overflow != "wait" {
+		return ""
+	}
+	return tr(l, msgQueuePosition, pos)
+}
+
+// rememberRequest records the last request of a user in a channel, for
+// /regenerate.
+func (d *discordBot) rememberRequest(userID, channelID string, r lastRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastRequests.set(lastRequestKey(userID, channelID), r)
+}
+
+// rememberEnhanced records the labels and the image prompt generated by the
+// LLM for an image request, so /regenerate can reuse them.
+//
+// It is a no-op if the user made another request in the meantime.
+func (d *discordBot) rememberEnhanced(req *intReq, labelsContent, imagePrompt string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := lastRequestKey(interactionUser(req.int).ID, req.int.ChannelID)
+	if last, ok := d.lastRequests.get(key); ok && last.image != nil && last.image.int.ID == req.int.ID {
+		last.labelsContent = labelsContent
+		last.imagePrompt = imagePrompt
+		d.lastRequests.set(key, last)
+	}
+}
+
+func (d *discordBot) toolWebSearch(ctx context.Context, query string) (*customsearch.Search, error) {
+	// - https://developers.google.com/custom-search/v1/using_rest
+	// - https://console.cloud.google.com/apis/credentials
+	// - https://console.cloud.google.com/apis/library/customsearch.googleapis.com
+	// - https://console.cloud.google.com/apis/api/customsearch.googleapis.com/metrics
+	// - http://www.google.com/cse/manage/all
+	// - https://developers.google.com/custom-search/v1/introduction
+	s, err := customsearch.NewService(ctx, option.WithAPIKey(d.gcptoken))
+	if err != nil {
+		return nil, err
+	}
+	//return s.Cse.List().Cx(d.cxtoken).Context(ctx).Q(query).Num(5).Do()
+	return s.Cse.List().Cx(d.cxtoken).Q(query).Do()
+	// TODO: Doesn't seem to work at the moment. :(
+	// Note that the free quota is minimal:
+	// - Google: 100 queries per day
+	// - Bing: 1000 queries per month, 2.5¢ after
+	// Investigate:
+	// - https://learn.microsoft.com/en-us/bing/search-apis/bing-web-search/overview
+	// - https://learn.microsoft.com/en-us/bing/search-apis/bing-web-search/quickstarts/rest/go
+	// - https://portal.azure.com/#view/Microsoft_Azure_ProjectOxford/CognitiveServicesHub/~/CognitiveSearch
+}
+
+// allowed returns true if the user can use the bot in this channel, as
+// configured in bot.settings.access. A thread is checked as its parent
+// channel.
+func (d *discordBot) allowed(guildID, channelID, userID string) bool {
+	if guildID != "" {
+		if ch, err := d.dg.State.Channel(channelID); err == nil && ch.IsThread() {
+			channelID = ch.ParentID
+		}
+	}
+	return d.settings.Access.Allowed(guildID, channelID, userID)
+}
+
+// getMemory returns the conversation for the channel. A new conversation is
+// initialized with the system prompt rendered with v, asking to reply in
+// language if not empty.
+func (d *discordBot) getMemory(guildID, channelID, language string, v *sillybot.PromptVars) *llm.Conversation {
+	// TODO: Send a warning or forget when one of Model, Prompt, Tools changed.
+	c := d.mem.GetInGuild(guildID, "", channelID)
+	if len(c.Messages) == 0 {
+		d.resetMemory(c, d.conversationPrompt(c), language, v)
+	}
+	return c
+}
+
+// conversationPrompt returns the system prompt of the conversation: the one of
+// its persona if any, otherwise the default one of the channel.
+func (d *discordBot) conversationPrompt(c *llm.Conversation) string {
+	if p := findPersona(d.settings.Personas, c.Persona); p != nil {
+		return p.Prompt
+	}
+	return d.systemPrompt(c.Guild, c.Channel)
+}
+
+// systemPromptKey is the preference key of the system prompt overrides.
+//
+// The overrides are stored as the preferences of the pseudo users
+// "guild:<id>" and "channel:<id>", so they are persisted in the memory.
+const systemPromptKey = "system_prompt"
+
+// systemPrompt returns the system prompt to use for a new conversation. The
+// channel override has priority over the guild one, then the default one.
+func (d *discordBot) systemPrompt(guildID, channelID string) string {
+	if channelID != "" {
+		if s := d.mem.GetPreferences("channel:" + channelID)[systemPromptKey]; s != "" {
+			return s
+		}
+	}
+	if guildID != "" {
+		if s := d.mem.GetPreferences("guild:" + guildID)[systemPromptKey]; s != "" {
+			return s
+		}
+	}
+	return d.settings.PromptSystem
+}
+
+// resetMemory forgets the conversation and starts over with the system
+// prompt rendered with v, asking to reply in language if not empty. It returns
+// the system prompt used.
+func (d *discordBot) resetMemory(c *llm.Conversation, system, language string, v *sillybot.PromptVars) string {
+	if s, err := sillybot.RenderSystemPrompt(system, v); err != nil {
+		slog.Error("discord", "message", "invalid system prompt", "system_prompt", system, "error", err)
+	} else {
+		system = s
+	}
+	c.Messages = nil
+	c.LongWarned = false
+	if toolsMsg, _ := d.tools(); toolsMsg.Content != "" {
+		c.Messages = []llm.Message{toolsMsg}
+	}
+	if system = withLanguage(system, language); system != "" {
+		c.Messages = append(c.Messages, llm.Message{Role: llm.System, Content: system})
+	}
+	return system
+}
+
+// promptVars returns the variables of the system prompt of a new conversation
+// started by userName.
+func (d *discordBot) promptVars(guildID, userName string) *sillybot.PromptVars {
+	v := &sillybot.PromptVars{UserName: userName, Date: time.Now().Format("2006-01-02")}
+	if guildID != "" {
+		if g, err := d.dg.State.Guild(guildID); err == nil {
+			v.GuildName = g.Name
+		}
+	}
+	return v
+}
+
+// userLanguage returns the language to reply in to the user, based on their
+// Discord locale. Returns "" when disabled.
+func (d *discordBot) userLanguage(userID string) string {
+	if !d.settings.ReplyInUserLocale {
+		return ""
+	}
+	return localeLanguage(d.userLocale(userID))
+}
+
+// userLocale returns the Discord locale of the user, as seen in their last
+// interaction. Returns discordgo.Unknown when not known yet.
+func (d *discordBot) userLocale(userID string) discordgo.Locale {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.locales[userID].locale
+}
+
+// seenLocale is the locale of a user as of their last interaction.
+type seenLocale struct {
+	locale discordgo.Locale
+	seen   time.Time
+}
+
+// localeTTL is how long the locale of a user is remembered after their last
+// interaction.
+const localeTTL = 30 * 24 * time.Hour
+
+// setLocaleLocked records the locale of the user. It forgets the locales not
+// seen for localeTTL, at most once per hour, so the map doesn't grow with
+// every user ever seen.
+func (d *discordBot) setLocaleLocked(userID string, l discordgo.Locale, now time.Time) {
+	d.locales[userID] = seenLocale{locale: l, seen: now}
+	if now.Sub(d.localesSwept) < time.Hour {
+		return
+	}
+	d.localesSwept = now
+	for id, v := range d.locales {
+		if now.Sub(v.seen) >= localeTTL {
+			delete(d.locales, id)
+		}
+	}
+}
+
+// trimMemory forgets the oldest turns of the conversation to respect both the
+// user's context length and the token budget. The turns exceeding the token
+// budget are summarized first when configured.
+func (d *discordBot) trimMemory(ctx context.Context, c *llm.Conversation) {
+	c.Trim()
+	if d.settings.PromptSummary != "" {
+		if n, err := c.Compact(ctx, d.l, d.settings.PromptSummary, d.settings.MaxContextTokens); err != nil {
+			slog.Error("discord", "message", "failed to summarize the conversation, forgetting instead", "user", c.User, "channel", c.Channel, "error", err)
+		} else if n != 0 {
+			slog.Info("discord", "message", "summarized conversation to fit the token budget", "user", c.User, "channel", c.Channel, "summarized", n, "max_context_tokens", d.settings.MaxContextTokens)
+		}
+	}
+	if n := c.TrimTokens(d.settings.MaxContextTokens); n != 0 {
+		slog.Info("discord", "message", "trimmed conversation to fit the token budget", "user", c.User, "channel", c.Channel, "forgotten", n, "max_context_tokens", d.settings.MaxContextTokens)
+	}
+}
+
+// conversation returns the conversation to reply in. A stateless request gets
+// a throwaway one with only the system prompt, so the memory is neither read
+// nor written.
+func (d *discordBot) conversation(req msgReq) *llm.Conversation {
+	if req.stateless {
+		c := &llm.Conversation{User: req.authorID, Channel: req.channelID, Guild: req.guildID}
+		system := req.system
+		if system == "" {
+			system = d.systemPrompt(req.guildID, req.channelID)
+		}
+		d.resetMemory(c, system, req.language, d.promptVars(req.guildID, req.authorName))
+		return c
+	}
+	c := d.getMemory(req.guildID, req.channelID, req.language, d.promptVars(req.guildID, req.authorName))
+	if req.regenerate && !forgetLastTurn(c, req.msg) {
+		slog.Info("discord", "message", "regenerating a turn that is not the last one", "channel", req.channelID)
+	}
+	return c
+}
+
+// handlePrompt uses the LLM to generate a response.
+func (d *discordBot) handlePrompt(req msgReq) {
+	defer req.typingDone()
+	start := time.Now()
+	if !d.l.Loaded() {
+		// The model was unloaded while idle, it can take a while to load.
+		if _, err := d.channelMessageSendComplex(req.replyToID, req.channelID, req.guildID, tr(d.userLocale(req.authorID), msgWarmingUp)); err != nil {
+			slog.Error("discord", "message", "failed posting message", "error", err)
+		}
+		if err := d.l.Load(); err != nil {
+			requestErrors.IncWith("prompt")
+			if _, err = d.dg.ChannelMessageSend(req.channelID, "Failed to load the model: "+err.Error()); err != nil {
+				slog.Error("discord", "message", "failed posting message", "error", err)
+			}
+			return
+		}
+	}
+	if true {
+		d.handlePromptStreaming(req)
+	} else {
+		d.handlePromptBlocking(req)
+	}
+	promptsServed.Inc()
+	promptLatency.ObserveDuration(time.Since(start))
+}
+
+// handlePromptBlocking asks the LLM to reply back, wait for the whole answer,
+// then process it. This function exists for testing.
+func (d *discordBot) handlePromptBlocking(req msgReq) {
+	c := d.conversation(req)
+	c.Messages = append(c.Messages, llm.Message{Role: llm.User, Content: req.msg, Image: req.image})
+	if !req.stateless {
+		d.trimMemory(d.ctx, c)
+	}
+	replyToID := req.replyToID
+	for {
+		// 32768
+		reply, err := d.l.Prompt(d.ctx, c.Messages, &llm.PromptOptions{Temperature: req.sampling.temperature, TopP: req.sampling.topP})
+		if err != nil {
+			requestErrors.IncWith("prompt")
+			if _, err = d.dg.ChannelMessageSend(req.channelID, "Prompt generation failed: "+err.Error()+"\nTry `/forget` to reset the internal state"); err != nil {
+				slog.Error("discord", "message", "failed posting message", "error", err)
+			}
+			return
+		}
+		f := llm.NewFilter(&d.settings.ReplyFilters)
+		reply = f.Push(reply) + f.Flush()
+		// Remember our own answer.
+		c.Messages = append(c.Messages, llm.Message{Role: llm.Assistant, Content: reply})
+		gotToolCall := false
+		for reply != "" {
+			if d.l.CurrentEncoding() != nil && !gotToolCall {
+				if called := d.handleMistralToolCall(reply, c); called != "" {
+					// TODO: Tell the user a function is being used, not after it was used.
+					gotToolCall = true
+					if msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*"); err != nil {
+						slog.Error("discord", "message", "failed posting message", "error", err, "content", "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
+					} else {
+						replyToID = msg.ID
+					}
+					if err := d.dg.ChannelTyping(req.channelID); err != nil {
+						slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
+					}
+					// We need to do a new loop.
+					break
+				}
+			}
+			// Only split the response if it is too large.
+			t := reply
+			rest := ""
+			if len(reply) > maxMessage {
+				if t, rest = splitResponse(reply, false); t == "" || len(t) > maxMessage {
+					t, rest = splitResponseForced(reply, true)
+				}
+			}
+			d.mirror(req, t, false)
+			msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, t)
+			if err != nil {
+				slog.Error("discord", "message", "failed posting message", "error", err, "content", t)
+			} else {
+				replyToID = msg.ID
+			}
+			reply = rest
+		}
+		if !gotToolCall {
+			d.mirror(req, "", true)
+			d.warnLongConversation(req, c)
+			return
+		}
+	}
+}
+
+// handlePromptStreaming request a reply from the LLM and streams replies back.
+func (d *discordBot) handlePromptStreaming(req msgReq) {
+	c := d.conversation(req)
+	c.Messages = append(c.Messages, llm.Message{Role: llm.User, Content: req.msg, Image: req.image})
+	if !req.stateless {
+		d.trimMemory(d.ctx, c)
+	}
+	// reqCtx is cancelled by the cancel button attached to the first reply.
+	reqCtx, reqCancel := context.WithCancel(d.ctx)
+	defer reqCancel()
+	cancelID := ""
+	defer func() {
+		if cancelID != "" {
+			d.removeCancelButton(req.channelID, cancelID)
+		}
+	}()
+	send := func(replyToID, content string) (*discordgo.Message, error) {
+		if cancelID != "" {
+			msg, err := d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, content)
+			if cannotDM(err) {
+				// The user blocked the bot in the meantime, stop generating.
+				reqCancel()
+			}
+			return msg, err
+		}
+		msg, err := d.channelMessageSendWithCancel(replyToID, req.channelID, req.guildID, content)
+		if cannotDM(err) {
+			reqCancel()
+		}
+		if err == nil {
+			cancelID = msg.ID
+			d.mu.Lock()
+			d.cancels[msg.ID] = pendingReply{authorID: req.authorID, cancel: reqCancel}
+			d.mu.Unlock()
+		}
+		return msg, err
+	}
+	wg := sync.WaitGroup{}
+	// prefixed is set once the signature prefix was posted.
+	prefixed := false
+	for round := 0; ; round++ {
+		ctx, cancel := context.WithCancel(reqCtx)
+		gotToolCall := false
+		// lastRound is set before words is closed when the reply ends, i.e. the
+		// LLM didn't call tools.
+		lastRound := false
+		// Make it blocking to force a goroutine context switch when a word is
+		// received. When it's buffered, there can be significant delay when LLM is
+		// running on the CPU.
+		words := make(chan string)
+		filter := llm.NewFilter(&d.settings.ReplyFilters)
+		wg.Add(1)
+		go func() {
+			const rate = 2000 * time.Millisecond
+			t := time.NewTicker(rate)
+			last := time.Now()
+			replyToID := req.replyToID
+			text := ""
+			pending := ""
+			// editID is the message edited in place with editText, when enabled.
+			editID := ""
+			editText := ""
+			// post sends t as a new message, or appends it to the message edited in
+			// place when it fits. Unless final is set, the first message of the
+			// reply has the cancel button. The first message starts with the
+			// signature prefix, or it is posted on its own when it doesn't fit.
+			var post func(t string, final bool)
+			post = func(t string, final bool) {
+				if !prefixed {
+					prefixed = true
+					if p := d.settings.Signature.Prefix; p != "" {
+						if len(p)+len(t) > maxMessage {
+							post(p, final)
+						} else {
+							t = p + t
+						}
+					}
+				}
+				if editID != "" && len(editText)+len(t) <= maxMessage {
+					// The ticker throttles the edits below Discord's rate limit.
+					_, err := d.dg.ChannelMessageEdit(req.channelID, editID, editText+t)
+					if err == nil {
+						editText += t
+						return
+					}
+					// Post it as a new message instead.
+					slog.Error("discord", "message", "failed editing message", "error", err, "content", t)
+				}
+				var msg *discordgo.Message
+				var err error
+				if final {
+					msg, err = d.channelMessageSendComplex(replyToID, req.channelID, req.guildID, t)
+				} else {
+					msg, err = send(replyToID, t)
+				}
+				if err != nil {
+					slog.Error("discord", "message", "failed posting message", "error", err, "content", t)
+					return
+				}
+				replyToID = msg.ID
+				if d.settings.EditInPlace {
+					editID = msg.ID
+					editText = t
+				}
+			}
+			for {
+				select {
+				case w, ok := <-words:
+					//slog.Debug("discord", "w", w, "ok", ok)
+					// Refreshed below from now on.
+					req.typingDone()
+					if !ok {
+						pending += filter.Flush()
+						if d.l.CurrentEncoding() != nil && !gotToolCall {
+							if called := d.handleMistralToolCall(pending, c); called != "" {
+								// TODO: Tell the user a function is being used, not after it was used.
+								gotToolCall = true
+								// No need to wait for additional content.
+								// TODO: investigate why it's not taking effect faster.
+								cancel()
+								if msg, err := send(replyToID, "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*"); err != nil {
+									slog.Error("discord", "message", "failed posting message", "error", err, "content", "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
+								} else {
+									replyToID = msg.ID
+								}
+								if err := d.dg.ChannelTyping(req.channelID); err != nil {
+									slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
+								}
+							}
+						}
+						if !gotToolCall {
+							// That's the end, flush all the remaining content.
+							if pending != "" {
+								text += pending
+								d.mirror(req, pending, false)
+							}
+							if s := d.settings.Signature.Suffix; s != "" && lastRound {
+								// It is split like the reply if needed.
+								pending = closeFence(pending) + s
+							}
+							if pending != "" {
+								// When a model is asked to do a large program, it's frequent
+								// that it will buffer the whole response and send it back in
+								// one shot. In this case, the content received can be very
+								// large.
+								// TODO: It could be a function call!! Handle it.
+								// The generation is done, no need for the cancel button.
+								for len(pending) > maxMessage {
+									t, rest := splitResponseForced(pending, true)
+									post(t, true)
+									pending = rest
+								}
+								post(pending, true)
+							}
+							d.mirror(req, "", true)
+							// Remember our own answer.
+							c.Messages = append(c.Messages, llm.Message{Role: llm.Assistant, Content: text})
+						}
+						t.Stop()
+						wg.Done()
+						return
+					}
+					pending += filter.Push(w)
+				case now := <-t.C:
+					// It becomes urgent when it's twice the period. When the model
+					// replies with more than maxMessage per rate without a safe
+					// boundary, it is force split.
+					if t, rest := splitResponseForced(pending, now.Sub(last) >= 2*rate); t != "" {
+						if d.l.CurrentEncoding() != nil && !gotToolCall {
+							// TODO: function call is when a line, any line, starts with "[".
+							// Sometimes the last "]" is not followed by a \n, which breaks json
+							// parsing.
+							if called := d.handleMistralToolCall(t, c); called != "" {
+								// TODO: Tell the user a function is being used, not after it was used.
+								gotToolCall = true
+								// No need to wait for additional content.
+								// TODO: investigate why it's not taking effect faster.
+								cancel()
+								msg, err := send(replyToID, "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
+								if err != nil {
+									slog.Error("discord", "message", "failed posting message", "error", err, "content", "*An instant please, I'm calling tool "+escapeMarkdown(called)+"*")
+								} else {
+									replyToID = msg.ID
+								}
+							}
+						}
+						if !gotToolCall {
+							d.mirror(req, t, false)
+							post(t, false)
+							last = now
+						}
+						text += t
+						pending = rest
+					}
+				}
+				if err := d.dg.ChannelTyping(req.channelID); err != nil {
+					slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
+				}
+			}
+		}()
+		// Stop offering the tools once the LLM keeps calling them, to force it to
+		// reply.
+		var availTools []llm.Tool
+		if round < maxToolRounds {
+			_, availTools = d.tools()
+		}
+		// We're chatting, we don't want too much content.
+		// 32768
+		calls, err := d.l.PromptStreamingTools(ctx, c.Messages, availTools, &llm.PromptOptions{Temperature: req.sampling.temperature, TopP: req.sampling.topP}, words)
+		lastRound = len(calls) == 0 || reqCtx.Err() != nil
+		close(words)
+		wg.Wait()
+		cancel()
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		if err != nil {
+			requestErrors.IncWith("prompt")
+			if _, err = d.dg.ChannelMessageSend(req.channelID, "Prompt generation failed: "+err.Error()+"\nTry `/forget` to reset the internal state"); err != nil {
+				slog.Error("discord", "message", "failed posting message", "error", err)
+			}
+			break
+		}
+		if len(calls) != 0 && reqCtx.Err() == nil {
+			// The text of the reply, if any, was remembered above. Attach the
+			// calls to it and answer them before prompting again.
+			c.Messages[len(c.Messages)-1].ToolCalls = calls
+			for _, call := range calls {
+				c.Messages = append(c.Messages, llm.Message{Role: llm.ToolResult, Content: d.callTool(reqCtx, req, call), ToolCallID: call.ID})
+			}
+			continue
+		}
+		if !gotToolCall {
+			d.warnLongConversation(req, c)
+			break
+		}
+	}
+}
+
+// warnLongConversation tells the user once that the conversation is getting
+// close to the token budget, so its older turns will soon be forgotten.
+func (d *discordBot) warnLongConversation(req msgReq, c *llm.Conversation) {
+	if req.stateless || !needsLongWarning(c, d.settings.LongConversation.Tokens(d.settings.MaxContextTokens)) {
+		return
+	}
+	c.LongWarned = true
+	msg := d.settings.LongConversation.Message
+	if msg == "" {
+		msg = tr(d.userLocale(req.authorID), msgLongConversation)
+	}
+	if _, err := d.channelMessageSendComplex("", req.channelID, req.guildID, "-# "+msg); err != nil {
+		slog.Error("discord", "message", "failed posting message", "error", err)
+	}
+}
+
+// needsLongWarning returns true if the conversation crossed the threshold
+// for the first time. threshold 0 means disabled.
+func needsLongWarning(c *llm.Conversation, threshold int) bool {
+	return threshold > 0 && !c.LongWarned && llm.EstimateTokens(c.Messages) >= threshold
+}
+
+// maxToolRounds is the number of consecutive times the LLM can call tools
+// before having to reply.
+const maxToolRounds = 3
+
+// getCurrentTimeTool lets the LLM know the current time while chatting.
+var getCurrentTimeTool = llm.Tool{
+	Type: "function",
+	Function: llm.ToolFunction{
+		Name:        "get_current_time",
+		Description: "Get the current clock time and today's date.",
+		Parameters: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+	},
+}
+
+// generateImageTool lets the LLM generate an image while chatting.
+var generateImageTool = llm.Tool{
+	Type: "function",
+	Function: llm.ToolFunction{
+		Name:        "generate_image",
+		Description: "Generate an image and show it to the user. Use it when the user asks to draw, paint or picture something.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"prompt": map[string]interface{}{
+					"type":        "string",
+					"description": "Detailed description of the image to generate, in English, e.g. \"a fluffy orange cat sleeping on a windowsill, soft light\".",
+				},
+			},
+			"required": []string{"prompt"},
+		},
+	},
+}
+
+// callTool runs a tool requested by the LLM while chatting and returns the
+// result to send back to it.
+func (d *discordBot) callTool(ctx context.Context, req msgReq, call llm.ToolCallRequest) string {
+	var args map[string]string
+	if call.Function.Arguments != "" {
+		if err := llm.ParseJSON(call.Function.Arguments, &args); err != nil {
+			slog.Warn("discord", "message", "invalid tool arguments", "tool", call.Function.Name, "arguments", call.Function.Arguments, "error", err)
+			return "Invalid arguments: " + err.Error()
+		}
+	}
+	slog.Info("discord", "tool_call", call.Function.Name, "arguments", args)
+	switch call.Function.Name {
+	case "get_current_time":
+		return tools.GetTodayClockTime()
+	case "generate_image":
+		prompt := args["prompt"]
+		if prompt == "" {
+			return "The prompt argument is required."
+		}
+		if d.ig == nil {
+			return "Image generation is not available."
+		}
+		// Go through the image queue like the image commands. The reply is not
+		// waiting for the image, it is posted once ready.
+		job := intReq{cmdName: call.Function.Name, description: prompt, job: func() {
+			if err := d.sendToolImage(d.ctx, req, prompt); err != nil {
+				requestErrors.IncWith("tool")
+				slog.Error("discord", "tool", call.Function.Name, "error", err)
+			}
+		}}
+		if d.enqueueImage(job) == 0 {
+			return "The image queue is full. Tell the user to retry in a moment."
+		}
+		return "The image is being generated and will be shown to the user once ready. Do not describe it in detail."
+	default:
+		slog.Warn("discord", "message", "unknown tool", "tool", call.Function.Name)
+		return "Unknown tool " + call.Function.Name
+	}
+}
+
+// sendToolImage generates an image requested by the LLM and posts it in the
+// conversation.
+func (d *discordBot) sendToolImage(ctx context.Context, req msgReq, prompt string) error {
+	if err := d.dg.ChannelTyping(req.channelID); err != nil {
+		slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
+	}
+	seed, err := randomSeed()
+	if err != nil {
+		return err
+	}
+	img, err := d.ig.GenImage(ctx, prompt, seed, &imagegen.GenOptions{NoWatermark: true})
+	if err != nil {
+		return err
+	}
+	content := "*Image prompt*: " + escapeMarkdown(truncate(prompt, maxMessage-100)) + "\n*Seed*: " + strconv.Itoa(seed)
+	filtered := false
+	if img, filtered = d.filterImage(ctx, img); filtered {
+		content += "\n" + filteredNote
+	}
+	watermark := watermarkFor(*d.ig.Watermark(), d.settings.Watermarks[req.guildID], false)
+	if !watermark.Disabled {
+		imagegen.AddWatermarkWithOptions(img, &watermark)
+	}
+	output := d.ig.Output()
+	b, err := output.EncodeWithin(img, d.uploadLimit(req.guildID))
+	if err != nil {
+		return err
+	}
+	msgSend := discordgo.MessageSend{
+		Content: content,
+		Files:   []*discordgo.File{{Name: "image" + output.Ext(), ContentType: output.ContentType(), Reader: bytes.NewReader(b)}},
+	}
+	if req.replyToID != "" {
+		msgSend.Reference = &discordgo.MessageReference{MessageID: req.replyToID, ChannelID: req.channelID, GuildID: req.guildID}
+	}
+	if _, err = d.dg.ChannelMessageSendComplex(req.channelID, &msgSend); err != nil {
+		return err
+	}
+	imagesGenerated.Inc()
+	return nil
+}
+
+// filteredNote tells the user an image was replaced because it failed the
+// safety check.
+const filteredNote = "*Filtered*: the image was blurred by the safety filter"
+
+// filterImage runs the safety check on a generated image. It returns a blurred
+// copy and true if the image is filtered. When the check fails, the image is
+// filtered to be on the safe side.
+func (d *discordBot) filterImage(ctx context.Context, img *image.NRGBA) (*image.NRGBA, bool) {
+	unsafe, err := d.ig.Unsafe(ctx, img)
+	if err != nil {
+		slog.Error("discord", "message", "failed checking the image safety, filtering it", "error", err)
+		unsafe = true
+	}
+	if !unsafe {
+		return img, false
+	}
+	return imagegen.Obscure(img), true
+}
+
+// mirror sends a chunk of the reply to the webhook, if configured. It never
+// blocks.
+func (d *discordBot) mirror(req msgReq, text string, done bool) {
+	d.webhook.send(webhookEvent{Channel: req.channelID, Guild: req.guildID, ReplyTo: req.replyToID, Text: text, Done: done})
+}
+
+// maxAttachmentSize is the maximum size of an image attached to a chat message.
+const maxAttachmentSize = 10 << 20
+
+// imageAttachment returns the first image attached to a message, if any.
+//
+// Some clients don't send the content type, the file extension is used then.
+func imageAttachment(attachments []*discordgo.MessageAttachment) *discordgo.MessageAttachment {
+	for _, a := range attachments {
+		t := a.ContentType
+		if t == "" {
+			t = mime.TypeByExtension(strings.ToLower(filepath.Ext(a.Filename)))
+		}
+		// Ignore the parameters, if any.
+		t, _, _ = mime.ParseMediaType(t)
+		switch t {
+		case "image/png", "image/jpeg", "image/gif", "image/webp":
+			return a
+		}
+	}
+	return nil
+}
+
+// imageDataURL returns the image as a data URL. The content type is sniffed
+// from the data since the one of the attachment can be missing or wrong.
+func imageDataURL(b []byte) string {
+	return "data:" + http.DetectContentType(b) + ";base64," + base64.StdEncoding.EncodeToString(b)
+}
+
+// downloadAttachment retrieves the content of an attachment.
+func (d *discordBot) downloadAttachment(a *discordgo.MessageAttachment) ([]byte, error) {
+	if a.Size > maxAttachmentSize {
+		return nil, fmt.Errorf("attachment is too large: %d bytes", a.Size)
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", a.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.dg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize))
+}
+
+func (d *discordBot) channelMessageSendComplex(replyToID, channelID, guildID, content string) (st *discordgo.Message, err error) {
+	msgSend := discordgo.MessageSend{Content: content}
+	if replyToID != "" {
+		msgSend.Reference = &discordgo.MessageReference{MessageID: replyToID, ChannelID: channelID, GuildID: guildID}
+	}
+	return d.dg.ChannelMessageSendComplex(channelID, &msgSend)
+}
+
+// cancelButtonID is the custom ID of the button to cancel a streamed reply.
+const cancelButtonID = "cancel_reply"
+
+// channelMessageSendWithCancel is like channelMessageSendComplex with a button
+// to cancel the generation.
+func (d *discordBot) channelMessageSendWithCancel(replyToID, channelID, guildID, content string) (*discordgo.Message, error) {
+	msgSend := discordgo.MessageSend{
+		Content: content,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "Cancel", Style: discordgo.DangerButton, CustomID: cancelButtonID},
+			}},
+		},
+	}
+	if replyToID != "" {
+		msgSend.Reference = &discordgo.MessageReference{MessageID: replyToID, ChannelID: channelID, GuildID: guildID}
+	}
+	return d.dg.ChannelMessageSendComplex(channelID, &msgSend)
+}
+
+// removeCancelButton forgets the cancellable reply and removes its button,
+// unless it was already cancelled.
+func (d *discordBot) removeCancelButton(channelID, messageID string) {
+	d.mu.Lock()
+	_, ok := d.cancels[messageID]
+	delete(d.cancels, messageID)
+	d.mu.Unlock()
+	if ok {
+		d.removeComponents(channelID, messageID)
+	}
+}
+
+// removeComponents removes the buttons of a message.
+func (d *discordBot) removeComponents(channelID, messageID string) {
+	edit := discordgo.NewMessageEdit(channelID, messageID)
+	edit.Components = &[]discordgo.MessageComponent{}
+	if _, err := d.dg.ChannelMessageEditComplex(edit); err != nil {
+		slog.Error("discord", "message", "failed removing cancel button", "error", err)
+	}
+}
+
+// handleMistralToolCall check if the pending string and returns its name if so.
+//
+// TODO: This shouldn't receive the whole conversation. It should return the
+// name before calling so it can alert the user, especially for tools that take
+// a long time to run.
 func (d *discordBot) handleMistralToolCall(pending string, c *llm.Conversation) string {
 	var calls []tools.MistralToolCall
 	for _, line := range strings.Split(pending, "\n") {
 		if line = strings.TrimSpace(line); line == "" {
 			continue
 		}
-		if err := json.Unmarshal([]byte(line), &calls); err != nil {
-			//slog.Debug("discord", "message", "line is not tool call", "line", line)
-			continue
+		if err := json.Unmarshal([]byte(line), &calls); err != nil {
+			//slog.Debug("discord", "message", "line is not tool call", "line", line)
+			continue
+		}
+		if len(calls) != 1 {
+			slog.Warn("discord", "message", "unexpected number of calls", "line", line, "calls", calls)
+			continue
+		}
+		name := calls[0].Name
+		result := ""
+		// TODO: Use reflect to determine arguments automatically.
+		// TODO: Stop hardcoding the function names.
+		switch calls[0].Name {
+		case "web_search":
+			query := calls[0].Arguments["query"]
+			if len(calls[0].Arguments) != 1 || query == "" {
+				slog.Warn("discord", "message", "not the call we wanted", "line", line, "calls", calls)
+				continue
+			}
+			slog.Info("discord", "tool_call", calls[0].Name, "query", query)
+			search, err := d.toolWebSearch(d.ctx, query)
+			if err != nil {
+				slog.Error("discord", "tool", "web_search", "error", err)
+				// Continue as if it wasn't a tool call.
+				continue
+			}
+			for _, l := range search.Items {
+				result += "- " + l.Title + ": " + l.Snippet + "\n"
+			}
+			if result == "" {
+				slog.Info("discord", "tool_call", calls[0].Name, "result", result, "error", "no result!")
+				result = "No result was found on the internet due to an internal error in discord-bot"
+			}
+			slog.Info("discord", "tool_call", calls[0].Name, "result", result)
+			name += fmt.Sprintf("(query=%q) = %s", query, result)
+		case "calculate":
+			op := calls[0].Arguments["operation"]
+			f := calls[0].Arguments["first_number"]
+			s := calls[0].Arguments["second_number"]
+			result = tools.Calculate(op, f, s)
+			slog.Info("discord", "tool_call", calls[0].Name, "operation", op, "first", f, "second", s, "result", result)
+			name += fmt.Sprintf("(operation=%s, first=%s, second=%s) = %s", op, f, s, result)
+		case "get_today_date_current_clock_time":
+			result = tools.GetTodayClockTime()
+			slog.Info("discord", "tool_call", calls[0].Name, "result", result)
+			name += fmt.Sprintf("() = %s", result)
+		default:
+			slog.Warn("discord", "message", "unknown tool", "line", line, "calls", calls)
+		}
+		// See MistralRequestValidatorV3._validate_tool_message() in
+		// https://github.com/mistralai/mistral-common/blob/main/src/mistral_common/protocol/instruct/validator.py
+		callid := 0
+		for _, c := range c.Messages {
+			if c.Role == llm.ToolCall {
+				callid++
+			}
+		}
+		res := tools.MistralToolCallResult{Content: result, CallID: fmt.Sprintf("c%08d", callid)}
+		b, err := json.Marshal(res)
+		if err != nil {
+			slog.Error("discord", "tool", "json", "error", err)
+			// Continue as if it wasn't a tool call.
+			continue
+		}
+		// We want to ignore the rest of the reply and send a new query.
+		// TODO: Inject CallID instead of pending[:i]. We need to determine if
+		// Mistral prefers to receive its own content as-is or reformatted?
+		c.Messages = append(c.Messages, llm.Message{Role: llm.ToolCall, Content: line})
+		c.Messages = append(c.Messages, llm.Message{Role: llm.ToolCallResult, Content: string(b)})
+		// TODO: We should probably cancel the context and start over, there's no
+		// point in receiving more data.
+		return name
+	}
+	return ""
+}
+
+// splitResponse take pending reply from the LLM and returns the amount of
+// bytes to send back. Returns 0 if nothing should be sent.
+//
+// The basic assumption here is that most LLMs are trained to generate
+// markdown, for the better or worst.
+//
+// If you spot a case where it doesn't work right in the wild, please fix and
+// add a test case! Make sure it's 100% test coverage (except the panic).
+func splitResponse(t string, urgent bool) (string, string) {
+	rest := ""
+	// First priority is 3 backticks. We must never break that in the middle,
+	// unless it's longer than maxMessage.
+	if backticks := strings.Count(t, "```"); backticks == 1 {
+		i := strings.Index(t, "```")
+		if len(t) > maxMessage {
+			// The code block is still open and already too long; flush what we
+			// have instead of holding it until the closing backticks.
+			if s, r := splitOpenFence(t, i); s != "" {
+				return s, r
+			}
+		}
+		// Trim everything before the backticks.
+		rest = t[i:]
+		t = t[:i]
+	} else if backticks >= 2 {
+		// Cut right after the second.
+		start := strings.Index(t, "```")
+		end := strings.Index(t[start+3:], "```") + start + 3 + 3
+		if end > maxMessage {
+			// Dang we need to slice it. Look for empty lines to split at natural
+			// places.
+			if i := strings.LastIndex(t[:maxMessage], "\n\n"); i > start {
+				// Inject a new 3 backticks to reconstruct the escaping.
+				suffix := "\n```"
+				prefix := "```"
+				if tend := strings.Index(t[start:], "\n"); tend != -1 {
+					// Take the original one as it may contain the highlighting style,
+					// like ```python or ```bash.
+					prefix = t[start : start+tend]
+				}
+				return t[:i+1] + suffix, prefix + t[i+1:]
+			}
+			// No empty line, e.g. dense code. Fall back to any line.
+			if s, r := splitOpenFence(t, start); s != "" {
+				return s, r
+			}
+		}
+		return t[:end], t[end:]
+	}
+	if t == "" {
+		return t, rest
+	}
+
+	minLength := 50
+	if urgent {
+		minLength = 10
+	}
+
+	// If there's an empty line, use it. Never cut in the middle of an emphasis
+	// pair, e.g. **bold**, since it would break the formatting of both messages.
+	if i := strings.LastIndex(t, "\n\n"); i >= minLength && i < maxMessage && unbalancedEmphasis(t[:i+1]) == -1 {
+		return t[:i+1], t[i+1:] + rest
+	}
+	// If there's a EOL, use it.
+	if i := strings.LastIndexByte(t, '\n'); i >= minLength && i < maxMessage && unbalancedEmphasis(t[:i+1]) == -1 {
+		return t[:i+1], t[i+1:] + rest
+	}
+
+	// Now look for enumerations. The only thing we want to break on for
+	// enumerations is '\n'.
+	isEnum := strings.HasPrefix(t, "- ") || strings.HasPrefix(t, "* ")
+	if !isEnum {
+		var err error
+		isEnum, err = regexp.MatchString(`^\d+\. .*`, t)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if isEnum && !urgent {
+		return "", t + rest
+	}
+
+	if len(t) < minLength {
+		// Not enough characters to send, ignore.
+		return "", t + rest
+	}
+
+	// If there's backticks, e.g. `foo.bar`, they mess up punctuation search. So
+	// only start the search after the last backticks.
+	start := 0
+	if backticks := strings.Count(t, "`"); (backticks & 1) == 1 {
+		// Impair number of backticks. Limit ourselves up to the last one.
+		i := strings.LastIndexByte(t, '`')
+		rest = t[i:]
+		t = t[:i]
+	}
+
+	// Take the first punctuation that doesn't cut an emphasis pair.
+	end := -1
+	for _, m := range punctuation.FindAllStringIndex(t[start:], -1) {
+		if unbalancedEmphasis(t[:start+m[1]]) == -1 {
+			end = start + m[1]
+			break
+		}
+	}
+	if end == -1 {
+		return "", t + rest
+	}
+	if end > maxMessage {
+		// Arbitrary cut.
+		end = maxMessage
+	}
+	return t[:end], t[end:] + rest
+}
+
+// splitOpenFence splits t inside the code block starting at start, at the
+// last line that fits in a message once the block is closed with synthetic
+// backticks. The remainder reopens the block with the original fence so the
+// highlighting style, like ```python, is preserved.
+//
+// Returns "" when there's no line to split at, e.g. a single very long line.
+func splitOpenFence(t string, start int) (string, string) {
+	tend := strings.IndexByte(t[start:], '\n')
+	if tend == -1 {
+		return "", t
+	}
+	const suffix = "```"
+	i := strings.LastIndexByte(t[:min(len(t), maxMessage-len(suffix))], '\n')
+	if i <= start+tend {
+		return "", t
+	}
+	return t[:i+1] + suffix, t[start:start+tend+1] + t[i+1:]
+}
+
+// unbalancedEmphasis returns the offset of the first emphasis marker ('*',
+// '**', '_' or '__') that is not closed in t, or -1 if they are all balanced.
+//
+// It follows loosely the markdown rules: a marker opens when followed by a
+// non-whitespace and closes when preceded by a non-whitespace, so list bullets
+// and "2 * 3" are ignored. '_' within a word, like in snake_case, is ignored.
+// Markers within backquotes and escaped ones are ignored.
+func unbalancedEmphasis(t string) int {
+	open := map[string]int{}
+	for i := 0; i < len(t); {
+		c := t[i]
+		switch c {
+		case '\\':
+			i += 2
+			continue
+		case '`':
+			// Skip the code span, up to the matching backquotes.
+			n := runLength(t[i:], c)
+			j := strings.Index(t[i+n:], t[i:i+n])
+			if j == -1 {
+				// The backquotes logic handles the unterminated code span.
+				i = len(t)
+				continue
+			}
+			i += n + j + n
+			continue
+		case '*', '_':
+		default:
+			i++
+			continue
+		}
+		n := runLength(t[i:], c)
+		var prev, next rune
+		if i > 0 {
+			prev, _ = utf8.DecodeLastRuneInString(t[:i])
+		}
+		if i+n < len(t) {
+			next, _ = utf8.DecodeRuneInString(t[i+n:])
+		}
+		canOpen := next != 0 && !unicode.IsSpace(next)
+		canClose := prev != 0 && !unicode.IsSpace(prev)
+		if c == '_' && isWordRune(prev) && isWordRune(next) {
+			canOpen = false
+			canClose = false
+		}
+		// A run of 3 is both the double and the single marker, e.g. ***foo***.
+		var markers []string
+		switch n {
+		case 1:
+			markers = []string{t[i : i+1]}
+		case 2:
+			markers = []string{t[i : i+2]}
+		case 3:
+			markers = []string{t[i : i+2], t[i : i+1]}
+		}
+		for _, m := range markers {
+			if _, ok := open[m]; ok && canClose {
+				delete(open, m)
+			} else if !ok && canOpen {
+				open[m] = i
+			}
+		}
+		i += n
+	}
+	first := -1
+	for _, j := range open {
+		if first == -1 || j < first {
+			first = j
+		}
+	}
+	return first
+}
+
+// runLength returns the number of consecutive c at the start of s.
+func runLength(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// splitResponseForced is like splitResponse but never returns more than
+// maxMessage bytes to send.
+//
+// When splitResponse can't find a safe boundary and the pending text is
+// already too large to be sent in one message, it is split with forceSplit.
+func splitResponseForced(t string, urgent bool) (string, string) {
+	s, rest := splitResponse(t, urgent)
+	if len(s) > maxMessage {
+		f, r := forceSplit(s)
+		return f, r + rest
+	}
+	if s == "" && len(rest) > maxMessage {
+		return forceSplit(rest)
+	}
+	return s, rest
+}
+
+// chunkLines packs the lines into as few messages as possible, each at most
+// maxMessage bytes. A line too long for a single message is split without
+// breaking a markdown link or a code span, when possible.
+func chunkLines(lines []string) []string {
+	var out []string
+	buf := ""
+	for _, line := range lines {
+		if buf != "" && len(buf)+1+len(line) > maxMessage {
+			out = append(out, buf)
+			buf = ""
+		}
+		if buf != "" {
+			buf += "\n"
+		}
+		buf += line
+		for len(buf) > maxMessage {
+			var head string
+			head, buf = splitMarkdownLine(buf)
+			out = append(out, head)
+		}
+	}
+	if buf != "" {
+		out = append(out, buf)
+	}
+	return out
+}
+
+// reMarkdownSpan matches a markdown link or a code span, which must not be
+// split across messages.
+var reMarkdownSpan = regexp.MustCompile("\\[[^\\]\n]*\\]\\([^)\\s]*\\)|`[^`\n]*`")
+
+// splitMarkdownLine splits t so the first part is at most maxMessage bytes. It
+// cuts on a whitespace outside of a markdown link or a code span. It falls
+// back to forceSplit when there's no such place.
+func splitMarkdownLine(t string) (string, string) {
+	if len(t) <= maxMessage {
+		return t, ""
+	}
+	spans := reMarkdownSpan.FindAllStringIndex(t, -1)
+	inSpan := func(i int) bool {
+		for _, s := range spans {
+			if i > s[0] && i < s[1] {
+				return true
+			}
+		}
+		return false
+	}
+	for end := maxMessage; end > 0; end-- {
+		if c := t[end-1]; (c == ' ' || c == '\n') && !inSpan(end-1) {
+			return t[:end], t[end:]
+		}
+	}
+	return forceSplit(t)
+}
+
+// forceSplit splits t so the first part is at most maxMessage bytes.
+//
+// It is the last resort when there is no natural boundary, e.g. a very long
+// line of code. It tries to cut on a whitespace, never cuts in the middle of
+// an UTF-8 sequence and when the cut is inside a code fence, closes it and
+// reopens it in the rest with the same highlighting style.
+func forceSplit(t string) (string, string) {
+	if len(t) <= maxMessage {
+		return t, ""
+	}
+	const fence = "```"
+	// Reserve room to close a code fence.
+	end := maxMessage - len("\n"+fence)
+	for end > 0 && !utf8.RuneStart(t[end]) {
+		end--
+	}
+	if i := strings.LastIndexAny(t[:end], " \n\t"); i > end/2 {
+		end = i + 1
+	}
+	// Never cut a fence in half.
+	for i := strings.Index(t, fence); i != -1 && i < end; {
+		if end < i+len(fence) {
+			end = i
+			break
+		}
+		j := strings.Index(t[i+len(fence):], fence)
+		if j == -1 {
+			break
+		}
+		i += len(fence) + j
+	}
+	head := t[:end]
+	if strings.Count(head, fence)&1 == 0 {
+		return head, t[end:]
+	}
+	// We are inside a code fence. Take the original header as it may contain
+	// the highlighting style, like ```python or ```bash.
+	start := strings.LastIndex(head, fence)
+	nl := strings.IndexByte(head[start:], '\n')
+	if nl == -1 && start > 0 {
+		// The header itself would be cut, cut before it instead.
+		return t[:start], t[start:]
+	}
+	header := fence
+	if nl != -1 {
+		header = head[start : start+nl]
+	}
+	if !strings.HasSuffix(head, "\n") {
+		head += "\n"
+	}
+	return head + fence, header + "\n" + t[end:]
+}
+
+// punctuation matches when it's ending the string or when it's followed by a
+// whitespace. We don't need to handle \n (LF) since it's already handled
+// earlier.
+var punctuation = regexp.MustCompile(`[\.\?\!]($| )`)
+
+// handleImage generates images based on the user prompt.
+func (d *discordBot) handleImage(req intReq) {
+	// Do it in a separate goroutine so we can send updates to the user as it
+	// progresses. It provides a much better UX than batching all at once at the
+	// end.
+	type update struct {
+		content string
+		// progress is the image generation progress, shown after content until
+		// the image is ready.
+		progress string
+		img      []byte
+		// bg is the image without the labels, when requested.
+		bg []byte
+		// prompt is the image prompt of img, to upscale it.
+		prompt string
+		err    error
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+	output := &imagegen.OutputOptions{}
+	if d.ig != nil {
+		output = d.ig.Output()
+	}
+	limit := d.uploadLimit(req.int.GuildID)
+	updates := make(chan update, 10)
+	go func() {
+		defer close(updates)
+		// Generate multiple images when the queue is empty.
+		// First repeat what the user provided otherwise it's non-obvious for other
+		// users.
+		u := update{}
+		if req.description != "" {
+			u.content += "*Description*: " + escapeMarkdown(req.description) + "\n"
+		}
+		if req.imagePrompt != "" {
+			u.content += "*Image prompt*: " + escapeMarkdown(req.imagePrompt) + "\n"
+		}
+		if req.labelsContent != "" {
+			u.content += "*Labels*: " + escapeMarkdown(req.labelsContent) + "\n"
+		}
+		if req.style != "" {
+			u.content += "*Style*: " + escapeMarkdown(req.style) + "\n"
+		}
+		if req.strength != 0 {
+			u.content += "*Strength*: " + strconv.FormatFloat(req.strength, 'f', -1, 64) + "\n"
+		}
+		if req.lora != "" {
+			u.content += "*LoRA*: " + escapeMarkdown(req.lora)
+			if req.loraWeight != nil {
+				u.content += " (" + strconv.FormatFloat(*req.loraWeight, 'f', -1, 64) + ")"
+			}
+			u.content += "\n"
+		}
+		if req.sampler != "" {
+			u.content += "*Sampler*: " + escapeMarkdown(req.sampler) + "\n"
+		}
+		if req.cmdName != "meme_labels_auto" && d.ig != nil {
+			steps := req.steps
+			if steps == 0 {
+				steps = d.ig.Steps()
+			}
+			u.content += "*Steps*: " + strconv.Itoa(steps) + "\n"
+		}
+		var defWatermark imagegen.WatermarkOptions
+		if d.ig != nil {
+			defWatermark = *d.ig.Watermark()
+		}
+		watermark := watermarkFor(defWatermark, d.settings.Watermarks[req.int.GuildID], req.noWatermark)
+		if req.noWatermark && !watermark.Disabled {
+			u.content += "*Watermark*: required on this server\n"
+		}
+		labelOpts := d.settings.MemeLabels
+		if req.outlineColor != "" {
+			labelOpts.OutlineColor = req.outlineColor
+		}
+		if req.outlineRadius != 0 {
+			labelOpts.OutlineRadius = req.outlineRadius
+		}
+		n := imageBatch
+		if req.count != 0 {
+			n = req.count
+		}
+		if req.cmdName != "meme_labels_auto" {
+			if u.err = validateBatchPixels(n, req.width, req.height, d.settings.MaxBatchPixels); u.err != nil {
+				updates <- u
+				return
+			}
+		}
+		updates <- u
+		if req.cmdName != "meme_labels_auto" && d.ig != nil && !d.ig.Loaded() {
+			// The model was unloaded while idle, it can take a while to load.
+			updates <- update{content: u.content, progress: tr(req.int.Locale, msgWarmingUp)}
+			if u.err = d.ig.Load(); u.err != nil {
+				updates <- u
+				return
+			}
+		}
+		for i := 0; i < n && ctx.Err() == nil; i++ {
+			// Steps:
+			// - Select seed if needed
+			// - Generate labels if needed
+			// - Generate image description, seeding description + labels if needed
+			// - Generate the image if needed (meme_labels_auto is a special case)
+			seed := req.seed
+			if seed != 0 {
+				// Increment by one for each loop.
+				seed = seed + i
+			} else if seed, u.err = randomSeed(); u.err != nil {
+				updates <- u
+				return
+			}
+			u.content += "*Image #" + strconv.Itoa(i+1) + "*: *Seed*: " + strconv.Itoa(seed) + "\n"
+
+			// Use the LLM to generate the labels and the image prompt based on the
+			// description.
+			labelsContent := req.labelsContent
+			imagePrompt := req.imagePrompt
+			labelsSeed := 0
+			switch req.cmdName {
+			case "meme_auto", "image_auto":
+				if labelsContent, imagePrompt, labelsSeed, u.err = d.enhance(ctx, &req, seed, i); u.err != nil {
+					updates <- u
+					return
+				}
+			case "meme_labels_auto":
+				if labelsContent, labelsSeed, u.err = d.genLabels(ctx, &req, seed, i); u.err != nil {
+					u.err = fmt.Errorf("failed to enhance labels: %w", u.err)
+					updates <- u
+					return
+				}
+			}
+			if req.cmdName == "meme_auto" || req.cmdName == "meme_labels_auto" {
+				if labelsSeed != 0 {
+					u.content += "*Seed (label)*: " + strconv.Itoa(labelsSeed) + "\n"
+				}
+				u.content += "*Labels*: " + escapeMarkdown(labelsContent) + "\n"
+				updates <- u
+				if req.cmdName == "meme_labels_auto" {
+					if i == 0 {
+						d.rememberEnhanced(&req, labelsContent, "")
+					}
+					// "meme_labels_auto" is a special case where we don't actually need an image.
+					continue
+				}
+			}
+			if req.cmdName == "meme_auto" || req.cmdName == "image_auto" {
+				if len(u.content)+len(imagePrompt) < maxMessage-100 {
+					// We have to skip on these otherwise we hit the 2000 characters limit super fast.
+					u.content += "*Image prompt*: " + escapeMarkdown(imagePrompt) + "\n"
+					updates <- u
+				}
+			}
+
+			if i == 0 {
+				d.rememberEnhanced(&req, labelsContent, imagePrompt)
+			}
+
+			// Generate the image.
+			if req.style != "" {
+				imagePrompt += ", " + req.style
+			}
+			genOpts := imagegen.GenOptions{Steps: req.steps, Width: req.width, Height: req.height, NegativePrompt: req.negativePrompt, NoWatermark: true, BaseImage: req.baseImage, Strength: req.strength, LoRA: req.lora, LoRAWeight: req.loraWeight, Sampler: req.sampler}
+			progress := make(chan imagegen.Progress)
+			var img *image.NRGBA
+			var err error
+			go func() {
+				defer close(progress)
+				img, err = d.ig.GenImageStream(ctx, imagePrompt, seed, &genOpts, progress)
+			}()
+			for p := range progress {
+				updates <- update{content: u.content, progress: progressText(i+1, p)}
+			}
+			if err != nil {
+				u.err = err
+				updates <- u
+				return
+			}
+			filtered := false
+			if img, filtered = d.filterImage(ctx, img); filtered {
+				u.content += "*Image #" + strconv.Itoa(i+1) + "*: " + filteredNote + "\n"
+			}
+			if !watermark.Disabled {
+				imagegen.AddWatermarkWithOptions(img, &watermark)
+			}
+			if req.keepBackground && labelsContent != "" {
+				// DrawLabelsOnImage modifies the image in place, encode the clean
+				// background first.
+				bg := &image.NRGBA{Pix: slices.Clone(img.Pix), Stride: img.Stride, Rect: img.Rect}
+				if u.bg, u.err = output.EncodeWithin(bg, limit); u.err != nil {
+					updates <- u
+					return
+				}
+			}
+			imagegen.DrawLabelsOnImageWithOptions(img, labelsContent, &labelOpts)
+			// High resolutions can exceed the upload limit, which would fail the
+			// whole message.
+			u.img, u.err = output.EncodeWithin(img, limit)
+			if u.err == nil && req.baseImage == nil {
+				// Embed the parameters so /seed_from_image can generate it again.
+				// A remix can't be reproduced without the original image.
+				p := imagegen.Params{
+					Prompt: imagePrompt, NegativePrompt: req.negativePrompt, Seed: seed, Steps: req.steps, Width: req.width, Height: req.height,
+					Sampler: req.sampler, LoRA: req.lora, LoRAWeight: req.loraWeight, Labels: labelsContent,
+				}
+				u.img, u.err = imagegen.EmbedParams(u.img, &p)
+			}
+			if u.err == nil {
+				imagesGenerated.Inc()
+			}
+			u.prompt = imagePrompt
+			updates <- u
+			u.img = nil
+			u.bg = nil
+			u.prompt = ""
+			if u.err != nil {
+				return
+			}
+			// Save it to disk. Don't fail the user in this case, log an error.
+			data := map[string]interface{}{
+				"channel":      req.int.ChannelID,
+				"guild":        req.int.GuildID,
+				"description":  req.description,
+				"image_prompt": imagePrompt,
+				"labels":       labelsContent,
+				"seed":         seed,
+				"command":      req.cmdName,
+				"model":        d.l.CurrentModel(),
+			}
+			if user := interactionUser(req.int); user != nil {
+				data["user"] = user.Username
+			}
+			b, err := json.Marshal(data)
+			if err != nil {
+				slog.Error("discord", "message", "failed marshaling metadata", "error", err)
+			}
+			p := filepath.Join(d.memDir, time.Now().Format("2006-01-02-15-04-05.000000"))
+			if err2 := os.WriteFile(p+".json", b, 0o644); err2 != nil {
+				slog.Error("discord", "message", "failed saving metadata", "error", err2)
+				err = err2
+			}
+			w := bytes.Buffer{}
+			if err2 := png.Encode(&w, img); err2 != nil {
+				slog.Error("discord", "message", "failed encoding png", "error", err2)
+				err = err2
+			}
+			if err2 := os.WriteFile(p+".png", w.Bytes(), 0o644); err2 != nil {
+				slog.Error("discord", "message", "failed saving png", "error", err2)
+				err = err2
+			}
+			if d.promptLog != nil {
+				e := sillybot.PromptLogEntry{
+					Guild:          req.int.GuildID,
+					Channel:        req.int.ChannelID,
+					Command:        req.cmdName,
+					Description:    req.description,
+					ImagePrompt:    imagePrompt,
+					Labels:         labelsContent,
+					Seed:           seed,
+					Steps:          req.steps,
+					Width:          req.width,
+					Height:         req.height,
+					NegativePrompt: req.negativePrompt,
+					Model:          string(d.l.CurrentModel()),
+				}
+				if user := interactionUser(req.int); user != nil {
+					e.User = user.Username
+				}
+				if err2 := d.promptLog.Write(&e); err2 != nil {
+					slog.Error("discord", "message", "failed logging prompt", "error", err2)
+				}
+			}
+			// If there were an error or there's another request pending, stop. The
+			// explicitly requested images are always generated.
+			if err != nil || (i+1 >= req.cost() && (len(d.image) != 0 || len(d.chat) != 0)) {
+				break
+			}
+		}
+	}()
+
+	// Then stream the updates to it feels more interactive. Throttle so discord
+	// doesn't block us. Each image is added to the gallery as soon as it is
+	// generated.
+	const period = time.Second
+	t := time.NewTicker(period)
+	defer t.Stop()
+	g := update{}
+	hasUpdates := false
+	var gallery []galleryImage
+	galleryChanged := false
+	// last is the last image of the gallery, offered for upscaling.
+	var last pendingUpscale
+	// attachments are the images already posted.
+	var attachments []*discordgo.MessageAttachment
+	// lastUpdate is when the interaction was last edited. The progress updates
+	// arriving faster are held back and the latest is sent on the next tick.
+	var lastUpdate time.Time
+	for {
+		ok := false
+		skip := false
+		select {
+		case <-t.C:
+			if !hasUpdates {
+				skip = true
+				if err := d.dg.ChannelTyping(req.int.ChannelID); err != nil {
+					slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
+					break
+				}
+			}
+		case g, ok = <-updates:
+			if !ok {
+				return
+			}
+			hasUpdates = true
+			if len(g.img) != 0 {
+				gallery = append(gallery, galleryImage{img: g.img, bg: g.bg})
+				galleryChanged = true
+				last = pendingUpscale{img: g.img, prompt: g.prompt, n: len(gallery)}
+			}
+			if time.Since(lastUpdate) < period && g.err == nil && g.img == nil {
+				// Throttle.
+				skip = true
+			}
 		}
-		if len(calls) != 1 {
-			slog.Warn("discord", "message", "unexpected number of calls", "line", line, "calls", calls)
+		if skip {
 			continue
 		}
-		name := calls[0].Name
-		result := ""
-		// TODO: Use reflect to determine arguments automatically.
-		// TODO: Stop hardcoding the function names.
-		switch calls[0].Name {
-		case "web_search":
-			query := calls[0].Arguments["query"]
-			if len(calls[0].Arguments) != 1 || query == "" {
-				slog.Warn("discord", "message", "not the call we wanted", "line", line, "calls", calls)
-				continue
-			}
-			slog.Info("discord", "tool_call", calls[0].Name, "query", query)
-			search, err := d.toolWebSearch(d.ctx, query)
-			if err != nil {
-				slog.Error("discord", "tool", "web_search", "error", err)
-				// Continue as if it wasn't a tool call.
-				continue
+		if g.err != nil {
+			requestErrors.IncWith("image")
+			slog.Error("discord", "imagereq", req, "error", g.err)
+			g.content += "\n*Error*: " + imageErrorText(g.err) + "\n"
+		}
+		content := g.content
+		if g.progress != "" {
+			content += g.progress + "\n"
+		}
+		resp := discordgo.WebhookEdit{Content: &content}
+		upscale := false
+		if galleryChanged {
+			// Only upload the new images. The new image is always the last one so
+			// they stay in order.
+			files, note := galleryFiles(gallery, output, limit)
+			kept, upload := keptAttachments(attachments, files)
+			resp.Files = upload
+			resp.Attachments = &kept
+			content += note
+			galleryChanged = false
+			if upscale = d.canUpscale(); upscale {
+				resp.Components = &[]discordgo.MessageComponent{
+					discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+						discordgo.Button{Label: "Upscale #" + strconv.Itoa(last.n), Style: discordgo.SecondaryButton, CustomID: upscaleButtonID},
+					}},
+				}
 			}
-			for _, l := range search.Items {
-				result += "- " + l.Title + ": " + l.Snippet + "\n"
+		}
+		content = signed(&d.settings.Signature, content)
+		m, err := d.dg.InteractionResponseEdit(req.int, &resp)
+		if err != nil {
+			slog.Error("discord", "imagereq", req, "message", "failed posting interaction", "error", err)
+		} else {
+			lastUpdate = time.Now()
+			attachments = m.Attachments
+			if upscale {
+				last.created = time.Now()
+				d.mu.Lock()
+				d.addUpscaleLocked(m.ID, last)
+				d.mu.Unlock()
 			}
-			if result == "" {
-				slog.Info("discord", "tool_call", calls[0].Name, "result", result, "error", "no result!")
-				result = "No result was found on the internet due to an internal error in discord-bot"
+		}
+		if g.err != nil {
+			return
+		}
+		hasUpdates = false
+	}
+}
+
+// signed returns content with the signature, truncating content to fit in a
+// single message.
+func signed(s *sillybot.SignatureOptions, content string) string {
+	if s.Prefix == "" && s.Suffix == "" {
+		return content
+	}
+	// Keep room for the ellipsis and closing the code block.
+	return s.Prefix + closeFence(truncate(content, maxMessage-len(s.Prefix)-len(s.Suffix)-len("...\n```"))) + s.Suffix
+}
+
+// closeFence closes the code block left open at the end of t, if any, so the
+// text following it is not swallowed.
+func closeFence(t string) string {
+	if strings.Count(t, "```")%2 == 0 {
+		return t
+	}
+	if !strings.HasSuffix(t, "\n") {
+		t += "\n"
+	}
+	return t + "```"
+}
+
+// imageErrorText returns the image generation error to show to the user, with
+// guidance for the common failures.
+func imageErrorText(err error) string {
+	if errors.Is(err, imagegen.ErrOutOfMemory) {
+		return "The image server ran out of VRAM. Try smaller dimensions with `width` and `height`, or fewer images with `count`."
+	}
+	if errors.Is(err, imagegen.ErrTimeout) {
+		return "Generation timed out, the server may be overloaded. Please retry in a moment."
+	}
+	return escapeMarkdown(err.Error())
+}
+
+// progressText returns the progress of the generation of the image #n as
+// text, e.g. "*Image #1*: step 4/8 ▰▰▰▰▱▱▱▱".
+func progressText(n int, p imagegen.Progress) string {
+	const width = 8
+	done := 0
+	if p.Steps > 0 {
+		done = min(max(p.Step*width/p.Steps, 0), width)
+	}
+	return fmt.Sprintf("*Image #%d*: step %d/%d %s%s", n, p.Step, p.Steps, strings.Repeat("▰", done), strings.Repeat("▱", width-done))
+}
+
+// genLabels uses the LLM to generate the meme labels based on the
+// description. It tries a few seeds until the labels are short enough.
+//
+// labelsSeed is the seed used when it differs from the image's, 0 otherwise.
+func (d *discordBot) genLabels(ctx context.Context, req *intReq, seed, i int) (labels string, labelsSeed int, err error) {
+	options := [3]string{}
+	for j := 0; j < len(options); j++ {
+		msgs := []llm.Message{{Role: llm.System, Content: d.settings.PromptLabels}, {Role: llm.User, Content: req.description}}
+		// Intentionally limit the number of tokens, otherwise it's Stable
+		// Diffusion that is unhappy.
+		imgseed := seed + 4*i + 4*j
+		newLabels, err := d.l.Prompt(ctx, msgs, &llm.PromptOptions{MaxTokens: 70, Seed: imgseed, Temperature: req.labelsSampling.temperature, TopP: req.labelsSampling.topP})
+		if err != nil {
+			return "", 0, err
+		}
+		options[j] = strings.Trim(newLabels, "\",.")
+		// Is it good enough?
+		if m, n := maxCommaLen(options[j]); n <= 3 && m < 30 {
+			// Select this one.
+			if i != 0 || j != 0 {
+				labelsSeed = imgseed
 			}
-			slog.Info("discord", "tool_call", calls[0].Name, "result", result)
-			name += fmt.Sprintf("(query=%q) = %s", query, result)
-		case "calculate":
-			op := calls[0].Arguments["operation"]
-			f := calls[0].Arguments["first_number"]
-			s := calls[0].Arguments["second_number"]
-			result = tools.Calculate(op, f, s)
-			slog.Info("discord", "tool_call", calls[0].Name, "operation", op, "first", f, "second", s, "result", result)
-			name += fmt.Sprintf("(operation=%s, first=%s, second=%s) = %s", op, f, s, result)
-		case "get_today_date_current_clock_time":
-			result = tools.GetTodayClockTime()
-			slog.Info("discord", "tool_call", calls[0].Name, "result", result)
-			name += fmt.Sprintf("() = %s", result)
-		default:
-			slog.Warn("discord", "message", "unknown tool", "line", line, "calls", calls)
+			return newLabels, labelsSeed, nil
+		}
+	}
+	// No great option found, take a guess which is the less bad one.
+	// TODO: We loose the seed when we sort.
+	slices.SortFunc(options[:], memeLabelHeuristics)
+	return options[0], 0, nil
+}
+
+// enhance uses the LLM to generate the labels of meme_auto and the image
+// prompt of meme_auto and image_auto from the description.
+func (d *discordBot) enhance(ctx context.Context, req *intReq, seed, i int) (labels, imagePrompt string, labelsSeed int, err error) {
+	if req.cmdName == "image_auto" {
+		if imagePrompt, err = d.genImagePrompt(ctx, req, seed, ""); err != nil {
+			return "", "", 0, fmt.Errorf("failed to enhance image generation prompt: %w", err)
+		}
+		return "", imagePrompt, 0, nil
+	}
+	// Both are independent so generate them concurrently to halve the latency.
+	// A failure cancels the other request.
+	var labelsErr, promptErr error
+	ctx2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if labels, labelsSeed, labelsErr = d.genLabels(ctx2, req, seed, i); labelsErr != nil {
+			cancel2()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if imagePrompt, promptErr = d.genImagePrompt(ctx2, req, seed, ""); promptErr != nil {
+			cancel2()
+		}
+	}()
+	wg.Wait()
+	if err = enhanceErrors(labelsErr, promptErr); err != nil {
+		return "", "", 0, err
+	}
+	return labels, imagePrompt, labelsSeed, nil
+}
+
+// randomSeed returns a random seed between 1 and 65000.
+//
+// Never pass seed 0, instead select a random seed ourself so the user can
+// still recreate the output. It's unclear to me what the upper bound it. Do
+// not use 65535 because genLabels increments it.
+func randomSeed() (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(65000))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate seed: %w", err)
+	}
+	// We never want 0.
+	return int(i.Int64()) + 1, nil
+}
+
+// genImagePrompt uses the LLM to generate the image prompt based on the
+// description and the labels, if any.
+func (d *discordBot) genImagePrompt(ctx context.Context, req *intReq, seed int, labels string) (string, error) {
+	content := "Prompt: " + req.description
+	if labels != "" {
+		content += "\nText relevant to the image: " + labels
+	}
+	msgs := []llm.Message{{Role: llm.System, Content: d.settings.PromptImage}, {Role: llm.User, Content: content}}
+	// Stop at the end of the first paragraph, the LLM sometimes adds an
+	// explanation after the prompt that would only waste the image model's
+	// limited token budget.
+	imagePrompt, err := d.l.Prompt(ctx, msgs, &llm.PromptOptions{MaxTokens: 125, Seed: seed, Temperature: req.promptSampling.temperature, TopP: req.promptSampling.topP, Stop: []string{"\n\n"}})
+	if err != nil {
+		return "", err
+	}
+	imagePrompt = strings.TrimSpace(imagePrompt)
+	imagePrompt = strings.ReplaceAll(imagePrompt, "\n", " ")
+	imagePrompt = strings.ReplaceAll(imagePrompt, "  ", " ")
+	return imagePrompt, nil
+}
+
+// enhanceErrors reports the failures of the concurrent LLM requests. A request
+// cancelled because the other one failed is not reported.
+func enhanceErrors(labelsErr, promptErr error) error {
+	var errs []error
+	if mustReport(labelsErr, promptErr) {
+		errs = append(errs, fmt.Errorf("failed to enhance labels: %w", labelsErr))
+	}
+	if mustReport(promptErr, labelsErr) {
+		errs = append(errs, fmt.Errorf("failed to enhance image generation prompt: %w", promptErr))
+	}
+	return errors.Join(errs...)
+}
+
+// mustReport returns true if err must be reported, i.e. it is not only the
+// cancellation caused by the failure of other.
+func mustReport(err, other error) bool {
+	if err == nil {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) || other == nil || errors.Is(other, context.Canceled)
+}
+
+func maxCommaLen(x string) (int, int) {
+	m := 0
+	parts := strings.Split(x, ",")
+	for _, p := range parts {
+		if l := len(p); l > m {
+			m = l
+		}
+	}
+	return m, len(parts)
+}
+
+// memeLabelHeuristics uses simple heuristics to decide which label is "best".
+//
+// TODO: Improve heuristics.
+func memeLabelHeuristics(a, b string) int {
+	ma, na := maxCommaLen(a)
+	mb, nb := maxCommaLen(b)
+	// We want 2 or 3 items, and then lower max length.
+	pa := 0
+	if na == 1 {
+		pa = 1
+	} else if na > 3 {
+		pa = na
+	}
+	pb := 0
+	if nb == 1 {
+		pb = 1
+	} else if nb > 3 {
+		pb = nb
+	}
+	if pa != pb {
+		if pa < pb {
+			return -1
+		}
+		return 1
+	}
+	if ma < mb {
+		return -1
+	}
+	if ma > mb {
+		return 1
+	}
+	return 0
+}
+
+// msgReq is an incoming message pending to be processed.
+type msgReq struct {
+	// msg is the message received.
+	// See
+	// https://discord.com/developers/docs/reference#message-formatting-formats
+	// for the formatting of references.
+	msg       string
+	authorID  string
+	channelID string
+	guildID   string
+	replyToID string
+	// authorName is the display name of the author, filled in the system
+	// prompt of a new conversation.
+	authorName string
+	// language is the language to reply in, if the conversation is new. Empty
+	// means the default.
+	language string
+	// image is the attached image as a base64 data URL, if any.
+	image string
+	// sampling is the LLM sampling used to reply.
+	sampling samplingParams
+	// regenerate replaces the previous reply to msg, when it is the last turn
+	// of the conversation.
+	regenerate bool
+	// stateless replies with only the system prompt and msg, without reading
+	// or writing the conversation's memory.
+	stateless bool
+	// system overrides the system prompt of a stateless request, e.g. to
+	// caption an image.
+	system string
+	// stopTyping stops refreshing the typing indicator, if it was started by
+	// keepTyping.
+	stopTyping context.CancelFunc
+	// queued is set when the request was sent with sendChat, so it can be
+	// cancelled while waiting in line.
+	queued *queuedChat
+}
+
+// queuedChat tracks a chat request waiting in line. Its fields are guarded by
+// discordBot.mu.
+type queuedChat struct {
+	// messageID is the position in line message, with the cancel button.
+	messageID string
+	// started is set once the request is processed.
+	started bool
+}
+
+// typingDone stops refreshing the typing indicator, once the first word of
+// the reply is posted or the request is done.
+func (r *msgReq) typingDone() {
+	if r.stopTyping != nil {
+		r.stopTyping()
+	}
+}
+
+// modelSampling returns the sampling recommended for the LLM in use, if any.
+func (d *discordBot) modelSampling() llm.Sampling {
+	if d.l == nil {
+		return llm.Sampling{}
+	}
+	return d.l.Sampling()
+}
+
+// samplingParams is the LLM sampling of a request.
+type samplingParams struct {
+	temperature float64
+	topP        float64
+}
+
+// newSamplingParams returns the configured sampling, overridden by the
+// model's recommended sampling, then by the command options when set. The
+// values are clamped to their valid range.
+func newSamplingParams(o *sillybot.SamplingOptions, m llm.Sampling, temperature, topP *float64) samplingParams {
+	t, p := o.Values()
+	if m.Temperature != nil {
+		t = *m.Temperature
+	}
+	if m.TopP != 0 {
+		p = m.TopP
+	}
+	if temperature != nil {
+		t = *temperature
+	}
+	if topP != nil {
+		p = *topP
+	}
+	t, p = sillybot.ClampSampling(t, p)
+	return samplingParams{temperature: t, topP: p}
+}
+
+// maxAttachments is the maximum number of files attached to a message.
+const maxAttachments = 10
+
+// galleryImage is an image generated for a request, optionally with the
+// background without the labels.
+type galleryImage struct {
+	img []byte
+	bg  []byte
+}
+
+// uploadLimit returns the upload limit of the guild, or of a direct message
+// when guildID is empty.
+func (d *discordBot) uploadLimit(guildID string) int {
+	if guildID == "" {
+		return maxUpload
+	}
+	g, err := d.dg.State.Guild(guildID)
+	if err != nil {
+		return maxUpload
+	}
+	return uploadLimit(g.PremiumTier)
+}
+
+// galleryFiles returns the files to attach for the gallery.
+//
+// It keeps the most recent images that fit in the Discord limits, limit being
+// the upload limit, and returns a note to append to the message if some were
+// skipped.
+func galleryFiles(gallery []galleryImage, output *imagegen.OutputOptions, limit int) ([]*discordgo.File, string) {
+	var files []*discordgo.File
+	size := 0
+	first := len(gallery)
+	skippedBG := false
+	for i := len(gallery) - 1; i >= 0; i-- {
+		g := gallery[i]
+		if len(files) == maxAttachments || size+len(g.img) > limit {
+			break
 		}
-		// See MistralRequestValidatorV3._validate_tool_message() in
-		// https://github.com/mistralai/mistral-common/blob/main/src/mistral_common/protocol/instruct/validator.py
-		callid := 0
-		for _, c := range c.Messages {
-			if c.Role == llm.ToolCall {
-				callid++
+		first = i
+		size += len(g.img)
+		name := "image" + strconv.Itoa(i+1)
+		// Prepend since the gallery is processed in reverse.
+		if len(g.bg) != 0 {
+			if len(files)+2 <= maxAttachments && size+len(g.bg) <= limit {
+				size += len(g.bg)
+				files = append([]*discordgo.File{{Name: name + "-background" + output.Ext(), ContentType: output.ContentType(), Reader: bytes.NewReader(g.bg)}}, files...)
+			} else {
+				skippedBG = true
 			}
 		}
-		res := tools.MistralToolCallResult{Content: result, CallID: fmt.Sprintf("c%08d", callid)}
-		b, err := json.Marshal(res)
-		if err != nil {
-			slog.Error("discord", "tool", "json", "error", err)
-			// Continue as if it wasn't a tool call.
-			continue
+		files = append([]*discordgo.File{{Name: name + output.Ext(), ContentType: output.ContentType(), Reader: bytes.NewReader(g.img)}}, files...)
+	}
+	note := ""
+	if first != 0 {
+		note += "*Gallery*: only the last " + strconv.Itoa(len(gallery)-first) + " images fit in this message\n"
+	}
+	if skippedBG {
+		note += "*Background*: skipped, too large to upload\n"
+	}
+	return files, note
+}
+
+// keptAttachments splits the gallery files into the attachments of the
+// previous message to keep, matched by name, and the files to upload.
+//
+// This way only the new images are uploaded as they are generated. The
+// attachments of the previous message not in files are dropped.
+func keptAttachments(prev []*discordgo.MessageAttachment, files []*discordgo.File) ([]*discordgo.MessageAttachment, []*discordgo.File) {
+	kept := []*discordgo.MessageAttachment{}
+	var upload []*discordgo.File
+	for _, f := range files {
+		i := slices.IndexFunc(prev, func(a *discordgo.MessageAttachment) bool { return a.Filename == f.Name })
+		if i == -1 {
+			upload = append(upload, f)
+		} else {
+			kept = append(kept, prev[i])
 		}
-		// We want to ignore the rest of the reply and send a new query.
-		// TODO: Inject CallID instead of pending[:i]. We need to determine if
-		// Mistral prefers to receive its own content as-is or reformatted?
-		c.Messages = append(c.Messages, llm.Message{Role: llm.ToolCall, Content: line})
-		c.Messages = append(c.Messages, llm.Message{Role: llm.ToolCallResult, Content: string(b)})
-		// TODO: We should probably cancel the context and start over, there's no
-		// point in receiving more data.
-		return name
 	}
-	return ""
+	return kept, upload
 }
 
-// splitResponse take pending reply from the LLM and returns the amount of
-// bytes to send back. Returns 0 if nothing should be sent.
+// intReq is an interaction request to generate an image.
+type intReq struct {
+	description    string
+	imagePrompt    string
+	labelsContent  string
+	seed           int
+	steps          int
+	width          int
+	height         int
+	negativePrompt string
+	style          string
+	keepBackground bool
+	noWatermark    bool
+	// outlineColor and outlineRadius override the configured outline of the
+	// labels when set.
+	outlineColor  string
+	outlineRadius float64
+	// count is the number of images explicitly requested. When 0, additional
+	// images are generated opportunistically while the queue is empty.
+	count int
+	// baseImage is the encoded image to remix, for image_remix.
+	baseImage []byte
+	// strength is how much baseImage is transformed. 0 means the default.
+	strength float64
+	// lora is the additional LoRA to apply and loraWeight how strongly. nil
+	// means the default weight.
+	lora       string
+	loraWeight *float64
+	// sampler is the diffusion sampler. Empty means the server's default.
+	sampler string
+	// labelsSampling and promptSampling are the LLM sampling used to generate
+	// the meme labels and to enhance the image prompt.
+	labelsSampling samplingParams
+	promptSampling samplingParams
+	cmdName        string
+	// Only there for ID and Token.
+	int *discordgo.Interaction
+	// job is run by the worker instead of handleImage, for the GPU work not
+	// triggered by an image command, e.g. the images requested by the chat
+	// tools.
+	job func()
+}
+
+// activity describes the request for the active requests.
+func (r *intReq) activity() string {
+	if r.job != nil {
+		return fmt.Sprintf("command=%s description=%q", r.cmdName, r.description)
+	}
+	return fmt.Sprintf("command=%s channel=%s description=%q prompt=%q", r.cmdName, r.int.ChannelID, r.description, r.imagePrompt)
+}
+
+// cost returns the number of images guaranteed to the request.
+func (r *intReq) cost() int {
+	return max(r.count, 1)
+}
+
+// maxLastRequests is the maximum number of requests remembered for
+// /regenerate. The images to remix are kept in memory so keep it small.
+const maxLastRequests = 100
+
+// lastRequest is the last request of a user in a channel. Only one of chat
+// and image is set.
+type lastRequest struct {
+	chat  *msgReq
+	image *intReq
+	// labelsContent and imagePrompt are the ones generated by the LLM for the
+	// first image of image, if any.
+	labelsContent string
+	imagePrompt   string
+}
+
+// imageRequest returns the image request to regenerate with a new seed.
 //
-// The basic assumption here is that most LLMs are trained to generate
-// markdown, for the better or worst.
+// Unless enhance is set, the labels and the image prompt previously generated
+// by the LLM are reused.
+func (l *lastRequest) imageRequest(enhance bool) intReq {
+	r := *l.image
+	r.seed = 0
+	if enhance {
+		return r
+	}
+	switch r.cmdName {
+	case "meme_auto":
+		if l.labelsContent != "" && l.imagePrompt != "" {
+			r.cmdName = "meme_manual"
+			r.labelsContent = l.labelsContent
+			r.imagePrompt = l.imagePrompt
+		}
+	case "image_auto":
+		if l.imagePrompt != "" {
+			r.cmdName = "image_manual"
+			r.imagePrompt = l.imagePrompt
+		}
+	}
+	return r
+}
+
+// lastRequests is a LRU of the last request of each user in each channel.
 //
-// If you spot a case where it doesn't work right in the wild, please fix and
-// add a test case! Make sure it's 100% test coverage (except the panic).
-func splitResponse(t string, urgent bool) (string, string) {
-	rest := ""
-	// First priority is 3 backticks. We must never break that in the middle,
-	// unless it's longer than maxMessage.
-	if backticks := strings.Count(t, "```"); backticks == 1 {
-		// Trim everything before the backticks.
-		i := strings.Index(t, "```")
-		rest = t[i:]
-		t = t[:i]
-	} else if backticks >= 2 {
-		// Cut right after the second.
-		start := strings.Index(t, "```")
-		end := strings.Index(t[start+3:], "```") + start + 3 + 3
-		if end > maxMessage {
-			// Dang we need to slice it. Look for empty lines to split at natural
-			// places.
-			if i := strings.LastIndex(t[:maxMessage], "\n\n"); i != -1 {
-				// Inject a new 3 backticks to reconstruct the escaping.
-				suffix := "\n```"
-				prefix := "```\n"
-				if tend := strings.Index(t[start:], "\n"); tend != -1 {
-					// Take the original one as it may contain the highlighting style,
-					// like ```python or ```bash.
-					prefix = t[start : start+tend]
-				}
-				return t[:i+1] + suffix, prefix + t[i+1:]
+// The zero value is ready to use.
+type lastRequests struct {
+	// keys are ordered from the least to the most recently used.
+	keys []string
+	reqs map[string]lastRequest
+}
+
+func lastRequestKey(userID, channelID string) string {
+	return userID + "/" + channelID
+}
+
+// get returns the request and marks it as the most recently used.
+func (l *lastRequests) get(key string) (lastRequest, bool) {
+	r, ok := l.reqs[key]
+	if ok {
+		l.touch(key)
+	}
+	return r, ok
+}
+
+// set records the request, evicting the least recently used one if needed.
+func (l *lastRequests) set(key string, r lastRequest) {
+	if l.reqs == nil {
+		l.reqs = map[string]lastRequest{}
+	}
+	if _, ok := l.reqs[key]; ok {
+		l.touch(key)
+	} else {
+		if len(l.keys) == maxLastRequests {
+			delete(l.reqs, l.keys[0])
+			l.keys = slices.Delete(l.keys, 0, 1)
+		}
+		l.keys = append(l.keys, key)
+	}
+	l.reqs[key] = r
+}
+
+func (l *lastRequests) touch(key string) {
+	i := slices.Index(l.keys, key)
+	l.keys = append(slices.Delete(l.keys, i, i+1), key)
+}
+
+// forgetLastTurn removes the last turn of the conversation if it is msg, so
+// it can be asked again.
+func forgetLastTurn(c *llm.Conversation, msg string) bool {
+	for i := len(c.Messages) - 1; i >= 0; i-- {
+		if c.Messages[i].Role == llm.User {
+			if c.Messages[i].Content != msg {
+				return false
 			}
+			c.Messages = c.Messages[:i]
+			return true
 		}
-		return t[:end], t[end:]
 	}
-	if t == "" {
-		return t, rest
+	return false
+}
+
+// imageBatch is the maximum number of images generated per request.
+const imageBatch = 4
+
+// minImageCount is the minimum value for the count option.
+var minImageCount = 1.
+
+// minSampling is the minimum value for the temperature and top_p options.
+var minSampling = 0.
+
+// minStrength is the minimum value for the strength option. Lower values
+// return the base image mostly unchanged.
+var minStrength = 0.1
+
+// remixSize returns the size of an image generated from a base image of w by
+// h pixels. It keeps the aspect ratio with about as many pixels as the default
+// size, rounded to multiples of 64.
+func remixSize(w, h int) (int, int) {
+	if w <= 0 || h <= 0 {
+		return defaultImageWidth, defaultImageHeight
+	}
+	scale := math.Sqrt(float64(defaultImageWidth*defaultImageHeight) / float64(w*h))
+	round := func(v float64) int {
+		return min(max(int(math.Round(v/64))*64, minImageSize), maxImageSize)
+	}
+	return round(float64(w) * scale), round(float64(h) * scale)
+}
+
+// Default image size used by py/image_gen.py when none is specified.
+const (
+	defaultImageWidth  = 1216
+	defaultImageHeight = 832
+)
+
+// adminPermission restricts a command to the server administrators by
+// default.
+var adminPermission int64 = discordgo.PermissionAdministrator
+
+// minTurns is the minimum value for /set_context_length.
+var minTurns = 0.
+
+// Bounds for the meme labels parameters of /debug_meme and /meme_manual.
+var (
+	minFontScale     = 0.1
+	maxFontScale     = 5.
+	minOutlineRadius = 1.
+	maxOutlineRadius = 50.
+)
+
+// Bounds for the image generation parameters.
+var (
+	minSteps         = 1.
+	maxSteps         = 50.
+	minImageSize     = 256
+	maxImageSize     = 1536
+	imageSizeStepPix = 64
+)
+
+// imagePrefs are the user's personal image generation defaults. They are
+// persisted in the memory.
+type imagePrefs struct {
+	Steps          int
+	Width          int
+	Height         int
+	NegativePrompt string
+	Style          string
+	KeepBackground bool
+}
+
+func (p *imagePrefs) from(m map[string]string) {
+	p.Steps, _ = strconv.Atoi(m["steps"])
+	p.Width, _ = strconv.Atoi(m["width"])
+	p.Height, _ = strconv.Atoi(m["height"])
+	p.NegativePrompt = m["negative_prompt"]
+	p.Style = m["style"]
+	p.KeepBackground = m["keep_background"] == "true"
+}
+
+func (p *imagePrefs) to() map[string]string {
+	m := map[string]string{}
+	if p.Steps != 0 {
+		m["steps"] = strconv.Itoa(p.Steps)
+	}
+	if p.Width != 0 && p.Height != 0 {
+		m["width"] = strconv.Itoa(p.Width)
+		m["height"] = strconv.Itoa(p.Height)
+	}
+	if p.NegativePrompt != "" {
+		m["negative_prompt"] = p.NegativePrompt
 	}
+	if p.Style != "" {
+		m["style"] = p.Style
+	}
+	if p.KeepBackground {
+		m["keep_background"] = "true"
+	}
+	return m
+}
 
-	minLength := 50
-	if urgent {
-		minLength = 10
+func (p *imagePrefs) validate() error {
+	if p.Steps != 0 && (p.Steps < int(minSteps) || p.Steps > int(maxSteps)) {
+		return fmt.Errorf("steps must be between %d and %d", int(minSteps), int(maxSteps))
 	}
+	return validateImageSize(p.Width, p.Height)
+}
 
-	// If there's an empty line, use it.
-	if i := strings.LastIndex(t, "\n\n"); i >= minLength && i < maxMessage {
-		return t[:i+1], t[i+1:] + rest
+func (p *imagePrefs) String() string {
+	out := "*Your image preferences*:"
+	if p.Steps == 0 && p.Width == 0 && p.NegativePrompt == "" && p.Style == "" && !p.KeepBackground {
+		return out + " none, the defaults are used."
 	}
-	// If there's a EOL, use it.
-	if i := strings.LastIndexByte(t, '\n'); i >= minLength && i < maxMessage {
-		return t[:i+1], t[i+1:] + rest
+	if p.Steps != 0 {
+		out += "\n- *Steps*: " + strconv.Itoa(p.Steps)
+	}
+	if p.Width != 0 {
+		out += fmt.Sprintf("\n- *Size*: %dx%d", p.Width, p.Height)
+	}
+	if p.NegativePrompt != "" {
+		out += "\n- *Negative prompt*: " + escapeMarkdown(p.NegativePrompt)
 	}
+	if p.Style != "" {
+		out += "\n- *Style*: " + escapeMarkdown(p.Style)
+	}
+	if p.KeepBackground {
+		out += "\n- *Keep background*: yes"
+	}
+	return out
+}
 
-	// Now look for enumerations. The only thing we want to break on for
-	// enumerations is '\n'.
-	isEnum := strings.HasPrefix(t, "- ") || strings.HasPrefix(t, "* ")
-	if !isEnum {
-		var err error
-		isEnum, err = regexp.MatchString(`^\d+\. .*`, t)
-		if err != nil {
-			panic(err)
-		}
+// clampSteps clamps the number of inference steps to the supported range.
+func clampSteps(steps int) int {
+	return min(max(steps, int(minSteps)), int(maxSteps))
+}
+
+// validateImageSize returns an error if the dimensions are not supported by
+// the image generator. Both zero means the default size.
+func validateImageSize(w, h int) error {
+	if w == 0 && h == 0 {
+		return nil
 	}
-	if isEnum && !urgent {
-		return "", t + rest
+	if w == 0 || h == 0 {
+		return errors.New("both width and height must be specified")
 	}
+	if w < minImageSize || h < minImageSize || w > maxImageSize || h > maxImageSize {
+		return fmt.Errorf("width and height must be between %d and %d", minImageSize, maxImageSize)
+	}
+	if w%imageSizeStepPix != 0 || h%imageSizeStepPix != 0 {
+		return fmt.Errorf("width and height must be multiples of %d", imageSizeStepPix)
+	}
+	return nil
+}
 
-	if len(t) < minLength {
-		// Not enough characters to send, ignore.
-		return "", t + rest
+// aspectRatios are the sizes for the aspect_ratio option. They are about one
+// megapixel, the size the SDXL family of models was trained at.
+var aspectRatios = []struct {
+	name          string
+	width, height int
+}{
+	{"1:1", 1024, 1024},
+	{"4:3", 1152, 896},
+	{"3:4", 896, 1152},
+	{"16:9", 1344, 768},
+	{"9:16", 768, 1344},
+}
+
+// imageSizeOptions returns the options to override the image size of the
+// image commands.
+func samplingOptions() []*discordgo.ApplicationCommandOption {
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionNumber,
+			Name:        "temperature",
+			Description: "LLM creativity, from 0 (deterministic) to 2. Overrides the configured value.",
+			MinValue:    &minSampling,
+			MaxValue:    2,
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionNumber,
+			Name:        "top_p",
+			Description: "LLM nucleus sampling, from 0 to 1. Overrides the configured value.",
+			MinValue:    &minSampling,
+			MaxValue:    1,
+		},
 	}
+}
 
-	// If there's backticks, e.g. `foo.bar`, they mess up punctuation search. So
-	// only start the search after the last backticks.
-	start := 0
-	if backticks := strings.Count(t, "`"); (backticks & 1) == 1 {
-		// Impair number of backticks. Limit ourselves up to the last one.
-		i := strings.LastIndexByte(t, '`')
-		rest = t[i:]
-		t = t[:i]
+// stepsOptions returns the option to override the number of inference steps
+// for one request.
+func stepsOptions() []*discordgo.ApplicationCommandOption {
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "steps",
+			Description: "Number of inference steps. More can improve the quality on models not tuned for few steps.",
+			MinValue:    &minSteps,
+			MaxValue:    maxSteps,
+		},
 	}
+}
 
-	// TODO: Highlighting pairs: '*' and '_'
-	m := punctuation.FindStringIndex(t[start:])
-	if m == nil {
-		return "", t + rest
+// loraOptions returns the options to select one of the available LoRAs, if
+// any.
+//
+// Discord limits the choices to 25; past that the name is free form and
+// validated when generating.
+func loraOptions(loras []string) []*discordgo.ApplicationCommandOption {
+	if len(loras) == 0 {
+		return nil
 	}
-	end := start + m[1]
-	if end > maxMessage {
-		// Arbitrary cut.
-		end = maxMessage
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if len(loras) <= 25 {
+		choices = make([]*discordgo.ApplicationCommandOptionChoice, len(loras))
+		for i, l := range loras {
+			choices[i] = &discordgo.ApplicationCommandOptionChoice{Name: l, Value: l}
+		}
+	}
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "lora",
+			Description: "Additional LoRA to change the style of the image.",
+			Choices:     choices,
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionNumber,
+			Name:        "lora_weight",
+			Description: "How strongly the LoRA is applied, from 0 to 2. Defaults to 1.",
+			MinValue:    &minSampling,
+			MaxValue:    2,
+		},
 	}
-	return t[:end], t[end:] + rest
 }
 
-// punctuation matches when it's ending the string or when it's followed by a
-// whitespace. We don't need to handle \n (LF) since it's already handled
-// earlier.
-var punctuation = regexp.MustCompile(`[\.\?\!]($| )`)
+// samplerOptions returns the option to select one of the samplers the image
+// server supports, if any.
+func samplerOptions(samplers []string) []*discordgo.ApplicationCommandOption {
+	if len(samplers) == 0 {
+		return nil
+	}
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if len(samplers) <= 25 {
+		choices = make([]*discordgo.ApplicationCommandOptionChoice, len(samplers))
+		for i, s := range samplers {
+			choices[i] = &discordgo.ApplicationCommandOptionChoice{Name: s, Value: s}
+		}
+	}
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "sampler",
+			Description: "Diffusion sampler, e.g. euler_a. Defaults to the image server's.",
+			Choices:     choices,
+		},
+	}
+}
 
-// handleImage generates images based on the user prompt.
-func (d *discordBot) handleImage(req intReq) {
-	// Do it in a separate goroutine so we can send updates to the user as it
-	// progresses. It provides a much better UX than batching all at once at the
-	// end.
-	type update struct {
-		content string
-		img     []byte
-		err     error
+func imageSizeOptions() []*discordgo.ApplicationCommandOption {
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, len(aspectRatios))
+	for i, a := range aspectRatios {
+		choices[i] = &discordgo.ApplicationCommandOptionChoice{Name: a.name, Value: a.name}
 	}
-	ctx, cancel := context.WithCancel(d.ctx)
-	defer cancel()
-	updates := make(chan update, 10)
-	go func() {
-		defer close(updates)
-		// Generate multiple images when the queue is empty.
-		// First repeat what the user provided otherwise it's non-obvious for other
-		// users.
-		u := update{}
-		if req.description != "" {
-			u.content += "*Description*: " + escapeMarkdown(req.description) + "\n"
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "width",
+			Description: "Image width in pixels. Must be a multiple of 64. Requires height.",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "height",
+			Description: "Image height in pixels. Must be a multiple of 64. Requires width.",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "aspect_ratio",
+			Description: "Image shape. Do not combine with width and height.",
+			Choices:     choices,
+		},
+	}
+}
+
+// imageSize returns the image size requested with the command options. Zero
+// means the user's preferences, or the default size.
+func imageSize(aspectRatio string, w, h int) (int, int, error) {
+	if aspectRatio == "" {
+		if err := validateImageSize(w, h); err != nil {
+			return 0, 0, err
 		}
-		if req.imagePrompt != "" {
-			u.content += "*Image prompt*: " + escapeMarkdown(req.imagePrompt) + "\n"
+		return w, h, nil
+	}
+	if w != 0 || h != 0 {
+		return 0, 0, errors.New("use either aspect_ratio or width and height, not both")
+	}
+	for _, a := range aspectRatios {
+		if a.name == aspectRatio {
+			return a.width, a.height, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unknown aspect ratio %q", aspectRatio)
+}
+
+// listPromptTemplates returns the description of the templates, limited to
+// maxMessage.
+func listPromptTemplates(templates []sillybot.PromptTemplate) string {
+	if len(templates) == 0 {
+		return "No prompt template is configured. Add some to bot.settings.prompt_templates in config.yml."
+	}
+	out := "*Prompt templates*:"
+	for _, p := range templates {
+		line := "\n- `" + p.Name + "` (" + p.Kind + ")"
+		if p.Description != "" {
+			line += ": " + escapeMarkdown(p.Description)
+		}
+		line += "\n  `" + strings.ReplaceAll(p.Template, "`", "'") + "`"
+		if len(out)+len(line) > maxMessage {
+			break
 		}
-		if req.labelsContent != "" {
-			u.content += "*Labels*: " + escapeMarkdown(req.labelsContent) + "\n"
+		out += line
+	}
+	return out
+}
+
+// validateBatchPixels returns an error if generating count images of w×h
+// pixels exceeds budget. Both zero dimensions means the default size. A budget
+// of 0 means no limit.
+func validateBatchPixels(count, w, h, budget int) error {
+	if budget <= 0 {
+		return nil
+	}
+	if w == 0 && h == 0 {
+		w, h = defaultImageWidth, defaultImageHeight
+	}
+	if total := count * w * h; total > budget {
+		msg := fmt.Sprintf("%d images of %dx%d is %d pixels, above the limit of %d pixels", count, w, h, total, budget)
+		if n := budget / (w * h); n > 0 {
+			return fmt.Errorf("%s; use at most %d images at this size or use a smaller size with /prefs", msg, n)
 		}
-		updates <- u
-		for i := 0; i < 4 && ctx.Err() == nil; i++ {
-			// Steps:
-			// - Select seed if needed
-			// - Generate labels if needed
-			// - Generate image description, seeding description + labels if needed
-			// - Generate the image if needed (meme_labels_auto is a special case)
-			seed := req.seed
-			if seed != 0 {
-				// Increment by one for each loop.
-				seed = seed + i
-			} else {
-				// Never pass seed 0, instead select a random seed ourself so the user
-				// can still recreate the output. Generate a number between 1 and
-				// 65000. It's unclear to me what the upper bound it. Do not use 65535
-				// because we loop down below when generating labels.
-				i, err := rand.Int(rand.Reader, big.NewInt(65000))
-				if err != nil {
-					u.err = fmt.Errorf("failed to generate seed: %w", err)
-					updates <- u
-					return
-				}
-				// We never want 0.
-				seed = int(i.Int64()) + 1
-			}
-			u.content += "*Image #" + strconv.Itoa(i+1) + "*: *Seed*: " + strconv.Itoa(seed) + "\n"
+		return fmt.Errorf("%s; use a smaller size with /prefs", msg)
+	}
+	return nil
+}
 
-			// Labels: use the LLM to generate the labels based on the description.a
-			labelsContent := req.labelsContent
-			if req.cmdName == "meme_auto" || req.cmdName == "meme_labels_auto" {
-				options := [3]string{}
-				j := 0
-				for ; j < len(options); j++ {
-					msgs := []llm.Message{{Role: llm.System, Content: d.settings.PromptLabels}, {Role: llm.User, Content: req.description}}
-					// Intentionally limit the number of tokens, otherwise it's Stable
-					// Diffusion that is unhappy.
-					imgseed := seed + 4*i + 4*j
-					newLabels, err := d.l.Prompt(ctx, msgs, 70, imgseed, 1.0)
-					if err != nil {
-						u.err = fmt.Errorf("failed to enhance labels: %w", err)
-						updates <- u
-						return
-					}
-					options[j] = strings.Trim(newLabels, "\",.")
-					// Is it good enough?
-					if m, n := maxCommaLen(options[j]); n <= 3 && m < 30 {
-						// Select this one.
-						labelsContent = newLabels
-						if i != 0 || j != 0 {
-							u.content += "*Seed (label)*: " + strconv.Itoa(imgseed) + "\n"
-						}
-						break
-					}
-				}
-				if j == len(options) {
-					// No great option found, take a guess which is the less bad one.
-					// TODO: We loose the seed when we sort.
-					slices.SortFunc(options[:], memeLabelHeuristics)
-					labelsContent = options[0]
-				}
-				u.content += "*Labels*: " + escapeMarkdown(labelsContent) + "\n"
-				updates <- u
-				if req.cmdName == "meme_labels_auto" {
-					// "meme_labels_auto" is a special case where we don't actually need an image.
-					continue
-				}
-			}
+// localeLanguage returns the language name of a Discord locale. Unknown or
+// unsupported locales default to English.
+func localeLanguage(l discordgo.Locale) string {
+	if l == discordgo.Unknown {
+		return "English"
+	}
+	name, ok := discordgo.Locales[l]
+	if !ok {
+		return "English"
+	}
+	// Trim the region, e.g. "French (Canada)", except for Chinese where it
+	// implies simplified versus traditional.
+	if i := strings.Index(name, " ("); i != -1 && !strings.HasPrefix(name, "Chinese") {
+		name = name[:i]
+	}
+	return name
+}
 
-			imagePrompt := req.imagePrompt
-			if req.cmdName == "meme_auto" || req.cmdName == "image_auto" {
-				// Image: use the LLM to generate the image prompt based on the description.
-				msgs := []llm.Message{
-					{Role: llm.System, Content: d.settings.PromptImage},
-					{Role: llm.User, Content: "Prompt: " + req.description + "\n" + "Text relevant to the image: " + labelsContent},
-				}
-				if imagePrompt, u.err = d.l.Prompt(ctx, msgs, 125, seed, 1.0); u.err != nil {
-					u.err = fmt.Errorf("failed to enhance image generation prompt: %w", u.err)
-					updates <- u
-					return
-				}
-				imagePrompt = strings.TrimSpace(imagePrompt)
-				imagePrompt = strings.ReplaceAll(imagePrompt, "\n", " ")
-				imagePrompt = strings.ReplaceAll(imagePrompt, "  ", " ")
-				if len(u.content)+len(imagePrompt) < maxMessage-100 {
-					// We have to skip on these otherwise we hit the 2000 characters limit super fast.
-					u.content += "*Image prompt*: " + escapeMarkdown(imagePrompt) + "\n"
-					updates <- u
-				}
-			}
+// withLanguage returns the system prompt amended to ask to reply in language.
+// English is the default so it is not specified.
+func withLanguage(system, language string) string {
+	if language == "" || strings.EqualFold(language, "English") {
+		return system
+	}
+	return strings.TrimSpace(system + " You reply in " + language + ".")
+}
 
-			// Generate the image.
-			img, err := d.ig.GenImage(ctx, imagePrompt, seed)
-			if err != nil {
-				u.err = err
-				updates <- u
-				return
-			}
-			w := bytes.Buffer{}
-			imagegen.DrawLabelsOnImage(img, labelsContent)
-			u.err = jpeg.Encode(&w, img, nil)
-			u.img = w.Bytes()
-			updates <- u
-			u.img = nil
-			if u.err != nil {
-				return
-			}
-			// Save it to disk. Don't fail the user in this case, log an error.
-			data := map[string]interface{}{
-				"channel":      req.int.ChannelID,
-				"guild":        req.int.GuildID,
-				"description":  req.description,
-				"image_prompt": imagePrompt,
-				"labels":       labelsContent,
-				"seed":         seed,
-				"command":      req.cmdName,
-				"model":        d.l.Model,
-			}
-			if req.int.User != nil {
-				data["user"] = req.int.User.Username
-			}
-			if req.int.Member != nil {
-				data["user"] = req.int.Member.User.Username
-			}
-			b, err := json.Marshal(data)
-			if err != nil {
-				slog.Error("discord", "message", "failed marshaling metadata", "error", err)
-			}
-			p := filepath.Join(d.memDir, time.Now().Format("2006-01-02-15-04-05.000000"))
-			if err2 := os.WriteFile(p+".json", b, 0o644); err2 != nil {
-				slog.Error("discord", "message", "failed saving metadata", "error", err2)
-				err = err2
-			}
-			// Create a new buffer.
-			w = bytes.Buffer{}
-			if err2 := png.Encode(&w, img); err2 != nil {
-				slog.Error("discord", "message", "failed encoding png", "error", err2)
-				err = err2
-			}
-			if err2 := os.WriteFile(p+".png", w.Bytes(), 0o644); err2 != nil {
-				slog.Error("discord", "message", "failed saving png", "error", err2)
-				err = err2
-			}
-			// If there were an error or there's another request pending, stop.
-			if err != nil || len(d.image) != 0 || len(d.chat) != 0 {
-				break
-			}
+// findKnownLLM returns the known model matching name, either its basename or
+// its repository, case insensitive.
+func findKnownLLM(knownLLMs []llm.KnownLLM, name string) *llm.KnownLLM {
+	name = strings.TrimSuffix(strings.TrimSpace(name), "-")
+	for i := range knownLLMs {
+		k := &knownLLMs[i]
+		if strings.EqualFold(strings.TrimSuffix(k.Source.Basename(), "-"), name) || strings.EqualFold(k.Source.RepoID(), name) {
+			return k
 		}
-	}()
+	}
+	return nil
+}
 
-	// Then stream the updates to it feels more interactive. Throttle so discord
-	// doesn't block us.
-	const period = time.Second
-	t := time.NewTicker(period)
-	defer t.Stop()
-	g := update{}
-	hasUpdates := false
-	var lastUpdate time.Time
-	for {
-		ok := false
-		skip := false
-		select {
-		case <-t.C:
-			if !hasUpdates {
-				skip = true
-				if err := d.dg.ChannelTyping(req.int.ChannelID); err != nil {
-					slog.Error("discord", "message", "failed posting 'user typing'", "error", err)
-					break
-				}
-			}
-		case g, ok = <-updates:
-			if !ok {
-				return
-			}
-			hasUpdates = true
-			if time.Since(lastUpdate) < period && g.err == nil && g.img == nil {
-				// Throttle.
-				skip = true
+// loadText describes the pending work, or returns "" when idle.
+func loadText(chat, images int) string {
+	var parts []string
+	if images == 1 {
+		parts = append(parts, "1 image")
+	} else if images > 1 {
+		parts = append(parts, strconv.Itoa(images)+" images")
+	}
+	if chat == 1 {
+		parts = append(parts, "1 reply")
+	} else if chat > 1 {
+		parts = append(parts, strconv.Itoa(chat)+" replies")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "Generating " + strings.Join(parts, " and ")
+}
+
+// presenceData returns the presence for the activity type and text. An empty
+// text clears the activity.
+func presenceData(activity, text string) discordgo.UpdateStatusData {
+	u := discordgo.UpdateStatusData{Status: string(discordgo.StatusOnline), Activities: []*discordgo.Activity{}}
+	if text == "" {
+		return u
+	}
+	a := &discordgo.Activity{Name: text}
+	switch activity {
+	case "playing":
+		a.Type = discordgo.ActivityTypeGame
+	case "listening":
+		a.Type = discordgo.ActivityTypeListening
+	case "watching":
+		a.Type = discordgo.ActivityTypeWatching
+	case "competing":
+		a.Type = discordgo.ActivityTypeCompeting
+	default:
+		// Custom statuses are shown from State; Name is required but not shown.
+		a.Type = discordgo.ActivityTypeCustom
+		a.Name = "Custom Status"
+		a.State = text
+	}
+	u.Activities = append(u.Activities, a)
+	return u
+}
+
+// modelChoices returns the known models matching what the user typed, for
+// autocompletion.
+//
+// The models whose basename, repo ID or repo name start with prefix come
+// first, then the ones containing it.
+func modelChoices(knownLLMs []llm.KnownLLM, prefix string) []*discordgo.ApplicationCommandOptionChoice {
+	var starts, contains []*discordgo.ApplicationCommandOptionChoice
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	for _, k := range knownLLMs {
+		name := strings.TrimSuffix(k.Source.Basename(), "-")
+		repoID := k.Source.RepoID()
+		_, repo, _ := strings.Cut(repoID, "/")
+		c := &discordgo.ApplicationCommandOptionChoice{Name: name, Value: name}
+		for _, s := range []string{name, repoID, repo} {
+			s = strings.ToLower(s)
+			if strings.HasPrefix(s, prefix) {
+				starts = append(starts, c)
+				c = nil
+				break
 			}
 		}
-		if skip {
-			continue
-		}
-		if g.err != nil {
-			slog.Error("discord", "imagereq", req, "error", g.err)
-			g.content += "\n*Error*: " + escapeMarkdown(g.err.Error()) + "\n"
-		}
-		resp := discordgo.WebhookEdit{Content: &g.content}
-		if len(g.img) != 0 {
-			resp.Files = []*discordgo.File{{Name: "prompt.jpg", ContentType: "image/jpeg", Reader: bytes.NewReader(g.img)}}
+		if c != nil && (strings.Contains(strings.ToLower(name), prefix) || strings.Contains(strings.ToLower(repoID), prefix)) {
+			contains = append(contains, c)
 		}
-		if _, err := d.dg.InteractionResponseEdit(req.int, &resp); err != nil {
-			slog.Error("discord", "imagereq", req, "message", "failed posting interaction", "error", err)
-		}
-		if g.err != nil {
-			return
+	}
+	out := append(starts, contains...)
+	// Discord's limit.
+	if len(out) > 25 {
+		out = out[:25]
+	}
+	return out
+}
+
+// personaChoices returns the personas matching the prefix being typed, and
+// the default one.
+func personaChoices(personas []sillybot.Persona, prefix string) []*discordgo.ApplicationCommandOptionChoice {
+	var out []*discordgo.ApplicationCommandOptionChoice
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if strings.HasPrefix("default", prefix) && findPersona(personas, "default") == nil {
+		out = append(out, &discordgo.ApplicationCommandOptionChoice{Name: "default", Value: "default"})
+	}
+	for _, p := range personas {
+		if strings.Contains(strings.ToLower(p.Name), prefix) {
+			out = append(out, &discordgo.ApplicationCommandOptionChoice{Name: p.Name, Value: p.Name})
 		}
-		hasUpdates = false
 	}
+	// Discord's limit.
+	if len(out) > 25 {
+		out = out[:25]
+	}
+	return out
 }
 
-func maxCommaLen(x string) (int, int) {
-	m := 0
-	parts := strings.Split(x, ",")
-	for _, p := range parts {
-		if l := len(p); l > m {
-			m = l
+// findPersona returns the persona named name, or nil.
+func findPersona(personas []sillybot.Persona, name string) *sillybot.Persona {
+	if name == "" {
+		return nil
+	}
+	for i := range personas {
+		if personas[i].Name == name {
+			return &personas[i]
 		}
 	}
-	return m, len(parts)
+	return nil
 }
 
-// memeLabelHeuristics uses simple heuristics to decide which label is "best".
-//
-// TODO: Improve heuristics.
-func memeLabelHeuristics(a, b string) int {
-	ma, na := maxCommaLen(a)
-	mb, nb := maxCommaLen(b)
-	// We want 2 or 3 items, and then lower max length.
-	pa := 0
-	if na == 1 {
-		pa = 1
-	} else if na > 3 {
-		pa = na
+// listPersonas returns the description of the personas, limited to
+// maxMessage. current is the persona in use.
+func listPersonas(personas []sillybot.Persona, current string) string {
+	if len(personas) == 0 {
+		return "No persona is configured. Add some to bot.settings.personas in config.yml."
 	}
-	pb := 0
-	if nb == 1 {
-		pb = 1
-	} else if nb > 3 {
-		pb = nb
+	if current == "" {
+		current = "default"
 	}
-	if pa != pb {
-		if pa < pb {
-			return -1
+	out := "*Personas*, currently using `" + current + "`:\n- `default`: The default system prompt."
+	for _, p := range personas {
+		line := "\n- `" + p.Name + "`"
+		if p.Description != "" {
+			line += ": " + escapeMarkdown(p.Description)
 		}
-		return 1
+		if len(out)+len(line) > maxMessage {
+			break
+		}
+		out += line
 	}
-	if ma < mb {
-		return -1
+	return out
+}
+
+// currentQuantization returns the quantization of the model in use, e.g.
+// "Q5_K_M", or "" if it is not a known model.
+func currentQuantization(knownLLMs []llm.KnownLLM, model huggingface.PackedFileRef) string {
+	for _, k := range knownLLMs {
+		if strings.HasPrefix(string(model), string(k.Source)) {
+			return strings.TrimPrefix(string(model), string(k.Source))
+		}
 	}
-	if ma > mb {
-		return 1
+	return ""
+}
+
+// watermarkFor returns the watermark to add, based on the instance's default,
+// the guild's policy and the user's opt out. A required watermark can't be
+// opted out.
+func watermarkFor(def imagegen.WatermarkOptions, p sillybot.WatermarkPolicy, optOut bool) imagegen.WatermarkOptions {
+	w := def
+	if p.Text != "" {
+		w.Text = p.Text
 	}
-	return 0
+	if p.Required {
+		w.Disabled = false
+	} else if p.Disabled || optOut {
+		w.Disabled = true
+	}
+	return w
 }
 
-// msgReq is an incoming message pending to be processed.
-type msgReq struct {
-	// msg is the message received.
-	// See
-	// https://discord.com/developers/docs/reference#message-formatting-formats
-	// for the formatting of references.
-	msg       string
-	authorID  string
-	channelID string
-	guildID   string
-	replyToID string
+// interactionUser returns the user that triggered the interaction. It is in
+// Member when in a guild and in User when in a DM.
+func interactionUser(i *discordgo.Interaction) *discordgo.User {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User
+	}
+	return i.User
 }
 
-// intReq is an interaction request to generate an image.
-type intReq struct {
-	description   string
-	imagePrompt   string
-	labelsContent string
-	seed          int
-	cmdName       string
-	// Only there for ID and Token.
-	int *discordgo.Interaction
+// displayName returns the name of the user as shown in Discord.
+func displayName(u *discordgo.User) string {
+	if u.GlobalName != "" {
+		return u.GlobalName
+	}
+	return u.Username
 }
 
+// optionsToStruct decodes the command options into the struct pointed to by
+// out. Options are matched to the fields by their json tag. A sub-command is
+// decoded into the struct field, or pointer to struct, of the same name.
+// Unknown options are ignored.
 func optionsToStruct(opts []*discordgo.ApplicationCommandInteractionDataOption, out interface{}) error {
-	// The world's slowest implementation.
-	// TODO: Use something faster, e.g. use reflect directly. PR appreciated. ❤
-	t := map[string]interface{}{}
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("expected a pointer to a struct, got %T", out)
+	}
+	return decodeOptions(opts, v.Elem())
+}
+
+func decodeOptions(opts []*discordgo.ApplicationCommandInteractionDataOption, v reflect.Value) error {
+	t := v.Type()
 	for _, o := range opts {
-		t[o.Name] = o.Value
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() && jsonName(f) == o.Name {
+				if err := decodeOption(o, v.Field(i)); err != nil {
+					return fmt.Errorf("option %q: %w", o.Name, err)
+				}
+				break
+			}
+		}
 	}
-	b, err := json.Marshal(t)
-	if err != nil {
-		return err
+	return nil
+}
+
+func decodeOption(o *discordgo.ApplicationCommandInteractionDataOption, v reflect.Value) error {
+	isSubCommand := o.Type == discordgo.ApplicationCommandOptionSubCommand || o.Type == discordgo.ApplicationCommandOptionSubCommandGroup
+	if !isSubCommand && o.Value == nil {
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if isSubCommand {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("can't decode a sub-command into %s", v.Type())
+		}
+		return decodeOptions(o.Options, v)
 	}
-	return json.Unmarshal(b, out)
+	// Values decoded from the gateway are float64 for numbers. Accept the other
+	// numeric types to ease testing.
+	val := reflect.ValueOf(o.Value)
+	switch v.Kind() {
+	case reflect.String:
+		if val.Kind() == reflect.String {
+			v.SetString(val.String())
+			return nil
+		}
+	case reflect.Bool:
+		if val.Kind() == reflect.Bool {
+			v.SetBool(val.Bool())
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch {
+		case val.CanInt():
+			i = val.Int()
+		case val.CanFloat():
+			f := val.Float()
+			if f != math.Trunc(f) {
+				return fmt.Errorf("%g is not an integer", f)
+			}
+			i = int64(f)
+		default:
+			return fmt.Errorf("can't decode %T into %s", o.Value, v.Type())
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("%d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case val.CanFloat():
+			v.SetFloat(val.Float())
+			return nil
+		case val.CanInt():
+			v.SetFloat(float64(val.Int()))
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return fmt.Errorf("can't decode %T into %s", o.Value, v.Type())
+}
+
+// jsonName returns the name of the field as encoded by encoding/json.
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
 }
 
 func escapeMarkdown(s string) string {
@@ -1481,3 +6525,15 @@ func escapeMarkdown(s string) string {
 	re := regexp.MustCompile(_MARKDOWN_STOCK_REGEX)
 	return re.ReplaceAllStringFunc(s, func(m string) string { return "\\" + m })
 }
+
+// truncate shortens s to at most n bytes, without splitting a rune, adding an
+// ellipsis when shortened.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
@@ -5,9 +5,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/sillybot"
+	"github.com/maruel/sillybot/huggingface"
+	"github.com/maruel/sillybot/imagegen"
+	"github.com/maruel/sillybot/llm"
 )
 
 func TestSplitResponse(t *testing.T) {
@@ -91,6 +108,39 @@ func TestSplitResponse(t *testing.T) {
 				"```java\nimport java.util.Random;\nimport java.util.Scanner;\n\npublic class SnakeGame {\n\n    // Game board\n    private char[][] board;\n    private int width;\n    private int height;\n    private char snake;\n    private char apple;\n    private int snakeX, snakeY;\n    private int appleX, appleY;\n    private Direction direction;\n\n    // Game Controller\n    private Scanner scanner;\n    private Random random;\n\n    public SnakeGame(int width, int height) {\n        this.width = width;\n        this.height = height;\n        this.board = new char[height][width];\n        this.scanner = new Scanner(System.in);\n        this.random = new Random();\n\n        initializeGame();\n    }\n\n    private void initializeGame() {\n        // Initialize game board, snake, apple, and direction\n        // ...\n    }\n\n    private void render() {\n        // Render the game board and the current game state\n        // ...\n    }\n\n    private void update() {\n        // Update the game state based on user inputs and game logic\n        // ...\n    }\n\n    private void handleInput() {\n        // Read user input and update direction accordingly\n        // ...\n    }\n\n    private void checkGameOver() {\n        // Check for game over conditions and handle game over logic\n        // ...\n    }\n\n```",
 			"```java\n    public void start() {\n        while (!isGameOver()) {\n            handleInput();\n            update();\n            render();\n        }\n    }\n\n    public boolean isGameOver() {\n        // Implement game over conditions here\n        // ...\n    }\n\n    // Other utility functions such as moveSnake, eatApple, etc.\n    // ...\n\n    public static void main(String[] args) {\n        SnakeGame game = new SnakeGame(20, 20);\n        game.start();\n    }\n}\n```",
 		},
+		// An open code block longer than a message is flushed, reopening it with
+		// the same language tag.
+		{
+			"```python\n" + strings.Repeat("print(1234567)\n", 150),
+			false,
+			"```python\n" + strings.Repeat("print(1234567)\n", 132) + "```",
+			"```python\n" + strings.Repeat("print(1234567)\n", 18),
+		},
+		{
+			"Here:\n```go\n" + strings.Repeat("fmt.Println(1)\n", 150),
+			false,
+			"Here:\n```go\n" + strings.Repeat("fmt.Println(1)\n", 132) + "```",
+			"```go\n" + strings.Repeat("fmt.Println(1)\n", 18),
+		},
+		{"```go\n" + strings.Repeat("fmt.Println(1)\n", 10), false, "", "```go\n" + strings.Repeat("fmt.Println(1)\n", 10)},
+		// A closed code block without empty lines is split at a line.
+		{
+			"```bash\n" + strings.Repeat("echo 123456789\n", 150) + "```",
+			false,
+			"```bash\n" + strings.Repeat("echo 123456789\n", 132) + "```",
+			"```bash\n" + strings.Repeat("echo 123456789\n", 18) + "```",
+		},
+		// Do not split in the middle of emphasis pairs.
+		{"This is an *important point. It spans* sentences. And more", false, "This is an *important point. It spans* sentences. ", "And more"},
+		{"This is an *important point. It spans", true, "", "This is an *important point. It spans"},
+		{"Before we start, remember that **this is very important.\nReally** and more", false, "", "Before we start, remember that **this is very important.\nReally** and more"},
+		{"Before we start, remember that **this is very important.\nReally** and more", true, "", "Before we start, remember that **this is very important.\nReally** and more"},
+		{"This is a long sentence that is long enough. And **bold. text", false, "This is a long sentence that is long enough. ", "And **bold. text"},
+		{"We need to talk about _the thing. It matters_ a lot. Ok", false, "We need to talk about _the thing. It matters_ a lot. ", "Ok"},
+		{"We need to talk about _the thing.\n\nIt matters_ a lot", false, "", "We need to talk about _the thing.\n\nIt matters_ a lot"},
+		// Not emphasis.
+		{"Use the variable my_var in your code. It works fine, trust me", false, "Use the variable my_var in your code. ", "It works fine, trust me"},
+		{"Compute 2 * 3 and `a*b` in your head. It works fine, trust me", false, "Compute 2 * 3 and `a*b` in your head. ", "It works fine, trust me"},
 	}
 	for i, line := range data {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
@@ -100,3 +150,1649 @@ func TestSplitResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestUnbalancedEmphasis(t *testing.T) {
+	data := []struct {
+		input string
+		want  int
+	}{
+		{"", -1},
+		{"*a*", -1},
+		{"**a**", -1},
+		{"***a***", -1},
+		{"_a_ __b__", -1},
+		{"a *b", 2},
+		{"a **b* c", 2},
+		{"a **b", 2},
+		{"***a**", 0},
+		{"a _b", 2},
+		{"a __b_", 2},
+		{"* a\n* b", -1},
+		{"snake_case", -1},
+		{"2 * 3", -1},
+		{"\\*a", -1},
+		{"`*a` *b", 5},
+		{"```\n*a\n```", -1},
+		{"`*a", -1},
+	}
+	for i, line := range data {
+		if got := unbalancedEmphasis(line.input); got != line.want {
+			t.Errorf("#%d: %q: want %d, got %d", i, line.input, line.want, got)
+		}
+	}
+}
+
+func TestSplitResponseForced(t *testing.T) {
+	data := []struct {
+		name     string
+		input    string
+		wantt    string
+		wantrest string
+	}{
+		{
+			"short",
+			"Hi fellow kids!",
+			"Hi fellow kids!",
+			"",
+		},
+		{
+			"long_word",
+			strings.Repeat("a", 2500),
+			strings.Repeat("a", maxMessage-4),
+			strings.Repeat("a", 2500-maxMessage+4),
+		},
+		{
+			"long_line_spaces",
+			strings.Repeat("abcdefghi ", 250),
+			strings.Repeat("abcdefghi ", 199),
+			strings.Repeat("abcdefghi ", 51),
+		},
+		{
+			"code_one_line",
+			"```python\n" + strings.Repeat("x", 2500) + "\n```",
+			"```python\n" + strings.Repeat("x", maxMessage-4-10) + "\n```",
+			"```python\n" + strings.Repeat("x", 2500-maxMessage+4+10) + "\n```",
+		},
+		{
+			"code_unterminated",
+			"Here:\n```go\n" + strings.Repeat("y", 2500),
+			"Here:\n```go\n" + strings.Repeat("y", maxMessage-4-12) + "\n```",
+			"```go\n" + strings.Repeat("y", 2500-maxMessage+4+12),
+		},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			gott, gotrest := splitResponseForced(line.input, true)
+			if line.wantt != gott || line.wantrest != gotrest {
+				t.Fatalf("Want: %q\nGot:  %q\nWant: %q\nGot:  %q", line.wantt, gott, line.wantrest, gotrest)
+			}
+			if len(gott) > maxMessage {
+				t.Fatalf("too long: %d", len(gott))
+			}
+		})
+	}
+}
+
+func TestForceSplit(t *testing.T) {
+	t.Run("utf8", func(t *testing.T) {
+		in := strings.Repeat("é", 1500)
+		gott, gotrest := forceSplit(in)
+		if len(gott) > maxMessage || !utf8.ValidString(gott) || !utf8.ValidString(gotrest) || gott+gotrest != in {
+			t.Fatalf("%d %d", len(gott), len(gotrest))
+		}
+	})
+	t.Run("fence_boundary", func(t *testing.T) {
+		// Put a closing fence right on the cut boundary.
+		in := "```\n" + strings.Repeat("z", maxMessage-4-4-1) + "```" + strings.Repeat("w", 500)
+		gott, gotrest := forceSplit(in)
+		if len(gott) > maxMessage || strings.Count(gott, "```")&1 != 0 || strings.Count(gotrest, "```")&1 != 0 {
+			t.Fatalf("%q\n%q", gott, gotrest)
+		}
+	})
+	t.Run("loop", func(t *testing.T) {
+		// Make sure repeatedly splitting a large code block always makes
+		// progress and keeps the fences balanced.
+		pending := "```bash\n" + strings.Repeat("echo hi;", 1000) + "\n```"
+		n := 0
+		for len(pending) > maxMessage {
+			var chunk string
+			chunk, pending = splitResponseForced(pending, true)
+			if chunk == "" || len(chunk) > maxMessage || strings.Count(chunk, "```") != 2 {
+				t.Fatalf("%d: %q", n, chunk)
+			}
+			if n++; n > 10 {
+				t.Fatal("no progress")
+			}
+		}
+		if !strings.HasPrefix(pending, "```bash\n") {
+			t.Fatal(pending)
+		}
+	})
+}
+
+func TestImagePrefs(t *testing.T) {
+	p := imagePrefs{Steps: 4, Width: 1024, Height: 768, Style: "watercolor", KeepBackground: true}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	got := imagePrefs{}
+	got.from(p.to())
+	if diff := cmp.Diff(p, got); diff != "" {
+		t.Fatal(diff)
+	}
+	for i, bad := range []imagePrefs{
+		{Steps: 500},
+		{Width: 1024},
+		{Width: 1000, Height: 1000},
+		{Width: 4096, Height: 4096},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Fatalf("#%d: expected error for %+v", i, bad)
+		}
+	}
+}
+
+func TestListPromptTemplates(t *testing.T) {
+	if got := listPromptTemplates(nil); !strings.HasPrefix(got, "No prompt template") {
+		t.Fatal(got)
+	}
+	templates := []sillybot.PromptTemplate{
+		{Name: "cat", Kind: "image", Description: "A cat.", Template: "a {{.mood}} cat"},
+		{Name: "eli5", Kind: "chat", Template: "Explain {{.topic}}"},
+	}
+	want := "*Prompt templates*:\n- `cat` (image): A cat.\n  `a {{.mood}} cat`\n- `eli5` (chat)\n  `Explain {{.topic}}`"
+	if got := listPromptTemplates(templates); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestSeenGuild(t *testing.T) {
+	d := discordBot{guilds: map[string]struct{}{}}
+	if d.seenGuild("1") {
+		t.Fatal("first connect")
+	}
+	if !d.seenGuild("1") {
+		t.Fatal("reconnect")
+	}
+	if d.seenGuild("2") {
+		t.Fatal("other guild")
+	}
+}
+
+func TestValidateBatchPixels(t *testing.T) {
+	data := []struct {
+		count, w, h, budget int
+		ok                  bool
+	}{
+		{4, 1024, 1024, 0, true},
+		{4, 1024, 1024, 4 * 1024 * 1024, true},
+		{4, 1024, 1024, 4*1024*1024 - 1, false},
+		{1, 1024, 1024, 1024*1024 - 1, false},
+		{4, 0, 0, 4 * defaultImageWidth * defaultImageHeight, true},
+		{4, 0, 0, 4*defaultImageWidth*defaultImageHeight - 1, false},
+	}
+	for i, line := range data {
+		if err := validateBatchPixels(line.count, line.w, line.h, line.budget); (err == nil) != line.ok {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+}
+
+func TestLocaleLanguage(t *testing.T) {
+	data := []struct {
+		in   discordgo.Locale
+		want string
+	}{
+		{discordgo.EnglishGB, "English"},
+		{discordgo.French, "French"},
+		{discordgo.PortugueseBR, "Portuguese"},
+		{discordgo.ChineseTW, "Chinese (Taiwan)"},
+		{discordgo.Unknown, "English"},
+		{"xx-YY", "English"},
+	}
+	for i, line := range data {
+		if got := localeLanguage(line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+	if got := withLanguage("Be brief.", "English"); got != "Be brief." {
+		t.Fatal(got)
+	}
+	if got := withLanguage("Be brief.", "French"); got != "Be brief. You reply in French." {
+		t.Fatal(got)
+	}
+	if got := withLanguage("", "French"); got != "You reply in French." {
+		t.Fatal(got)
+	}
+}
+
+func TestQuantizations(t *testing.T) {
+	knownLLMs := []llm.KnownLLM{
+		{Source: "hf:Qwen/Qwen2-0.5B-Instruct-GGUF/HEAD/qwen2-0_5b-instruct-"},
+		{Source: "hf:Qwen/Qwen2-7B-Instruct-GGUF/HEAD/qwen2-7b-instruct-"},
+	}
+	for _, name := range []string{"qwen2-7b-instruct", "Qwen2-7B-Instruct-", "qwen/qwen2-7b-instruct-gguf"} {
+		if k := findKnownLLM(knownLLMs, name); k != &knownLLMs[1] {
+			t.Fatalf("%q: %v", name, k)
+		}
+	}
+	if k := findKnownLLM(knownLLMs, "qwen2"); k != nil {
+		t.Fatal(k)
+	}
+	files := []string{
+		"README.md",
+		"qwen2-7b-instruct-q4_0.gguf",
+		"qwen2-7b-instruct-q8_0.gguf",
+		"qwen2-7b-instruct-fp16.gguf.cat0",
+		"qwen2-7b-instruct-fp16.gguf.cat1",
+		"qwen2-7b-instruct-q6_k-00001-of-00002.gguf",
+		"qwen2-7b-instruct-q6_k-00002-of-00002.gguf",
+		"qwen2-7b-instruct-q5_k_m/qwen2-7b-instruct-q5_k_m.gguf",
+	}
+	var got []string
+	for _, f := range knownLLMs[1].QuantizationFiles(files) {
+		got = append(got, knownLLMs[1].QuantizationName(f))
+	}
+	if diff := cmp.Diff([]string{"q4_0", "q8_0", "fp16", "q6_k"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestModelChoices(t *testing.T) {
+	knownLLMs := []llm.KnownLLM{
+		{Source: "hf:Qwen/Qwen2-0.5B-Instruct-GGUF/HEAD/qwen2-0_5b-instruct-"},
+		{Source: "hf:bartowski/gemma-2-9b-it-GGUF/HEAD/gemma-2-9b-it-"},
+	}
+	var got []string
+	for _, c := range modelChoices(knownLLMs, "GEMMA") {
+		got = append(got, c.Name)
+	}
+	if diff := cmp.Diff([]string{"gemma-2-9b-it"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := len(modelChoices(knownLLMs, "")); got != 2 {
+		t.Fatal(got)
+	}
+	got = nil
+	for _, c := range modelChoices(knownLLMs, "bartowski/") {
+		got = append(got, c.Name)
+	}
+	if diff := cmp.Diff([]string{"gemma-2-9b-it"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	// Prefix matches come first.
+	got = nil
+	for _, c := range modelChoices(knownLLMs, "g") {
+		got = append(got, c.Name)
+	}
+	if diff := cmp.Diff([]string{"gemma-2-9b-it", "qwen2-0_5b-instruct"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	got = nil
+	for _, c := range modelChoices(knownLLMs, "-it") {
+		got = append(got, c.Name)
+	}
+	if diff := cmp.Diff([]string{"gemma-2-9b-it"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	many := make([]llm.KnownLLM, 30)
+	for i := range many {
+		many[i].Source = huggingface.PackedFileRef(fmt.Sprintf("hf:a/b%d/HEAD/b%d-", i, i))
+	}
+	if got := len(modelChoices(many, "b")); got != 25 {
+		t.Fatal(got)
+	}
+	if got := currentQuantization(knownLLMs, "hf:bartowski/gemma-2-9b-it-GGUF/HEAD/gemma-2-9b-it-Q5_K_M"); got != "Q5_K_M" {
+		t.Fatal(got)
+	}
+	if got := currentQuantization(knownLLMs, "python"); got != "" {
+		t.Fatal(got)
+	}
+}
+
+func TestNewSamplingParams(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	data := []struct {
+		o        sillybot.SamplingOptions
+		m        llm.Sampling
+		t, p     *float64
+		wantT    float64
+		wantTopP float64
+	}{
+		{sillybot.SamplingOptions{}, llm.Sampling{}, nil, nil, 1, 0},
+		{sillybot.SamplingOptions{Temperature: f(0.2), TopP: 0.5}, llm.Sampling{}, nil, nil, 0.2, 0.5},
+		{sillybot.SamplingOptions{Temperature: f(0.2), TopP: 0.5}, llm.Sampling{Temperature: f(0.7)}, nil, nil, 0.7, 0.5},
+		{sillybot.SamplingOptions{Temperature: f(0.2), TopP: 0.5}, llm.Sampling{Temperature: f(0), TopP: 0.9}, nil, nil, 0, 0.9},
+		{sillybot.SamplingOptions{}, llm.Sampling{Temperature: f(0.7), TopP: 0.9}, f(1.5), f(0.3), 1.5, 0.3},
+	}
+	for i, line := range data {
+		got := newSamplingParams(&line.o, line.m, line.t, line.p)
+		if got.temperature != line.wantT || got.topP != line.wantTopP {
+			t.Fatalf("#%d: want %g/%g, got %g/%g", i, line.wantT, line.wantTopP, got.temperature, got.topP)
+		}
+	}
+}
+
+func TestLoadText(t *testing.T) {
+	data := []struct {
+		chat, images int
+		want         string
+	}{
+		{0, 0, ""},
+		{1, 0, "Generating 1 reply"},
+		{0, 2, "Generating 2 images"},
+		{3, 1, "Generating 1 image and 3 replies"},
+	}
+	for i, line := range data {
+		if got := loadText(line.chat, line.images); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestPresenceData(t *testing.T) {
+	u := presenceData("listening", "/help")
+	if len(u.Activities) != 1 || u.Activities[0].Type != discordgo.ActivityTypeListening || u.Activities[0].Name != "/help" {
+		t.Fatalf("unexpected %+v", u.Activities)
+	}
+	u = presenceData("", "Generating 1 image")
+	if len(u.Activities) != 1 || u.Activities[0].Type != discordgo.ActivityTypeCustom || u.Activities[0].State != "Generating 1 image" {
+		t.Fatalf("unexpected %+v", u.Activities)
+	}
+	if u = presenceData("playing", ""); len(u.Activities) != 0 {
+		t.Fatalf("unexpected %+v", u.Activities)
+	}
+}
+
+func TestGalleryFiles(t *testing.T) {
+	names := func(files []*discordgo.File) []string {
+		var out []string
+		for _, f := range files {
+			out = append(out, f.Name)
+		}
+		return out
+	}
+	small := []byte("jpg")
+	output := &imagegen.OutputOptions{Format: "jpeg"}
+	files, note := galleryFiles([]galleryImage{{img: small}, {img: small, bg: small}}, output, maxUpload)
+	if diff := cmp.Diff([]string{"image1.jpg", "image2.jpg", "image2-background.jpg"}, names(files)); diff != "" || note != "" {
+		t.Fatal(diff, note)
+	}
+
+	// Too many images, only the last ones are kept.
+	var gallery []galleryImage
+	for range maxAttachments + 2 {
+		gallery = append(gallery, galleryImage{img: small})
+	}
+	files, note = galleryFiles(gallery, output, maxUpload)
+	if len(files) != maxAttachments || files[0].Name != "image3.jpg" || !strings.Contains(note, "last 10 images") {
+		t.Fatal(names(files), note)
+	}
+
+	// Too large, the background is skipped.
+	large := make([]byte, maxUpload/2+1)
+	files, note = galleryFiles([]galleryImage{{img: large, bg: large}}, output, maxUpload)
+	if diff := cmp.Diff([]string{"image1.jpg"}, names(files)); diff != "" || !strings.Contains(note, "*Background*") {
+		t.Fatal(diff, note)
+	}
+
+	// A boosted server fits both.
+	files, note = galleryFiles([]galleryImage{{img: large, bg: large}}, output, uploadLimit(discordgo.PremiumTier2))
+	if len(files) != 2 || note != "" {
+		t.Fatal(names(files), note)
+	}
+
+	// The default format is PNG.
+	files, _ = galleryFiles([]galleryImage{{img: small}}, &imagegen.OutputOptions{}, maxUpload)
+	if files[0].Name != "image1.png" || files[0].ContentType != "image/png" {
+		t.Fatal(files[0].Name, files[0].ContentType)
+	}
+}
+
+func TestKeptAttachments(t *testing.T) {
+	output := &imagegen.OutputOptions{Format: "jpeg"}
+	gallery := []galleryImage{{img: []byte("1")}}
+	files, _ := galleryFiles(gallery, output, maxUpload)
+	kept, upload := keptAttachments(nil, files)
+	if len(kept) != 0 || len(upload) != 1 {
+		t.Fatal(kept, upload)
+	}
+	// Only the new image is uploaded.
+	prev := []*discordgo.MessageAttachment{{ID: "a1", Filename: "image1.jpg"}}
+	gallery = append(gallery, galleryImage{img: []byte("2"), bg: []byte("2")})
+	files, _ = galleryFiles(gallery, output, maxUpload)
+	kept, upload = keptAttachments(prev, files)
+	if len(kept) != 1 || kept[0].ID != "a1" || len(upload) != 2 || upload[0].Name != "image2.jpg" || upload[1].Name != "image2-background.jpg" {
+		t.Fatal(kept, upload)
+	}
+	// The images that don't fit anymore are dropped.
+	prev = append(prev, &discordgo.MessageAttachment{ID: "a2", Filename: "image2.jpg"})
+	kept, upload = keptAttachments(prev, files[1:2])
+	if len(kept) != 1 || kept[0].ID != "a2" || len(upload) != 0 {
+		t.Fatal(kept, upload)
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	data := []struct {
+		tier discordgo.PremiumTier
+		want int
+	}{
+		{discordgo.PremiumTierNone, 10 << 20},
+		{discordgo.PremiumTier1, 10 << 20},
+		{discordgo.PremiumTier2, 50 << 20},
+		{discordgo.PremiumTier3, 100 << 20},
+	}
+	for i, line := range data {
+		if got := uploadLimit(line.tier); got != line.want {
+			t.Fatalf("#%d: want %d, got %d", i, line.want, got)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	f := &fakeDiscord{}
+	dg, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dg.Client = &http.Client{Transport: f}
+	d := discordBot{dg: dg, chat: make(chan msgReq, 1), active: map[string]string{}, cancels: map[string]pendingReply{}}
+	d.settings.Queue.Overflow = "wait"
+	click := func(messageID, content, userID string) string {
+		d.onMessageComponent(&discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			ID:      "int1",
+			Token:   "token",
+			Type:    discordgo.InteractionMessageComponent,
+			Data:    discordgo.MessageComponentInteractionData{CustomID: cancelButtonID},
+			Message: &discordgo.Message{ID: messageID, Content: content},
+			User:    &discordgo.User{ID: userID},
+		}})
+		return f.last()
+	}
+
+	// The first request takes the only room in the queue, the second one waits
+	// in line.
+	for i, msg := range []string{"first", "second"} {
+		if !d.sendChat(msgReq{msg: msg, authorID: "user1", channelID: "channel1"}) {
+			t.Fatalf("#%d: rejected", i)
+		}
+	}
+	if p, ok := d.cancels["msg1"]; !ok || !p.queued || len(d.waitingChat) != 1 {
+		t.Fatalf("expected the second request to wait with a cancel button: %v %v", d.cancels, d.waitingChat)
+	}
+	if got := click("msg1", "You're #2 in line, please be patient.", "user1"); !strings.Contains(got, "your request was removed from the line") {
+		t.Fatal(got)
+	}
+	if len(d.waitingChat) != 0 || len(d.cancels) != 0 {
+		t.Fatalf("expected the request to be dropped: %v %v", d.cancels, d.waitingChat)
+	}
+
+	// A cancelled request already moved into the queue is skipped.
+	if !d.sendChat(msgReq{msg: "third", authorID: "user1", channelID: "channel1"}) {
+		t.Fatal("rejected")
+	}
+	if req := <-d.chat; req.msg != "first" || !d.startChat(req) {
+		t.Fatalf("unexpected request %q", req.msg)
+	}
+	d.promoteChatLocked()
+	click("msg1", "You're #2 in line, please be patient.", "user1")
+	if req := <-d.chat; req.msg != "third" || d.startChat(req) {
+		t.Fatalf("expected %q to be skipped", req.msg)
+	}
+
+	// A reply being streamed is cancelled only by the user who asked.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.cancels["reply1"] = pendingReply{authorID: "user1", cancel: cancel}
+	if got := click("reply1", "Once upon a time", "user2"); !strings.Contains(got, "Only the person who asked") || ctx.Err() != nil {
+		t.Fatal(got)
+	}
+	if got := click("reply1", "Once upon a time", "user1"); !strings.Contains(got, "Once upon a time") || ctx.Err() == nil {
+		t.Fatal(got)
+	}
+	if len(d.cancels) != 0 {
+		t.Fatal(d.cancels)
+	}
+}
+
+// fakeDiscord fakes the Discord REST API. Every request succeeds and returns
+// the message "msg1".
+type fakeDiscord struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeDiscord) RoundTrip(r *http.Request) (*http.Response, error) {
+	b := []byte{}
+	if r.Body != nil {
+		b, _ = io.ReadAll(r.Body)
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+string(b))
+	f.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"msg1","channel_id":"channel1"}`)),
+		Request:    r,
+	}, nil
+}
+
+// last returns the last request, as "<method> <path> <body>".
+func (f *fakeDiscord) last() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return ""
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+func TestClose_Timeout(t *testing.T) {
+	dg, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := discordBot{
+		dg:              dg,
+		chat:            make(chan msgReq, 5),
+		image:           make(chan intReq, 3),
+		shutdownTimeout: 10 * time.Millisecond,
+		active:          map[string]string{},
+	}
+	// Simulate a chat request stuck in a backend.
+	d.wg.Add(1)
+	d.setActive("chat", "stuck")
+	start := time.Now()
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Close didn't time out")
+	}
+}
+
+func TestEnqueueImage(t *testing.T) {
+	d := discordBot{image: make(chan intReq, 3)}
+	if pos := d.enqueueImage(intReq{count: 4}); pos != 1 {
+		t.Fatalf("expected queued first, got %d", pos)
+	}
+	if pos := d.enqueueImage(intReq{count: 4}); pos != 2 {
+		t.Fatalf("expected queued second, got %d", pos)
+	}
+	if pos := d.enqueueImage(intReq{}); pos != 0 {
+		t.Fatal("expected the queue to be full")
+	}
+	if d.pendingImages != 8 {
+		t.Fatalf("expected 8 pending images, got %d", d.pendingImages)
+	}
+}
+
+func TestEnqueue_Wait(t *testing.T) {
+	d := discordBot{chat: make(chan msgReq, 1), image: make(chan intReq, 3)}
+	d.settings.Queue.Overflow = "wait"
+	for i, want := range []int{1, 2, 3} {
+		if pos := d.enqueueChat(msgReq{msg: strconv.Itoa(i)}); pos != want {
+			t.Fatalf("#%d: want %d, got %d", i, want, pos)
+		}
+	}
+	if s := d.queuePosition(discordgo.Unknown, 3); s != "You're #3 in line, please be patient." {
+		t.Fatal(s)
+	}
+	if s := d.queuePosition(discordgo.Unknown, 1); s != "" {
+		t.Fatal(s)
+	}
+	// The waiting requests are promoted in order as the queue is drained.
+	for i := 0; i < 3; i++ {
+		if req := <-d.chat; req.msg != strconv.Itoa(i) {
+			t.Fatalf("#%d: got %q", i, req.msg)
+		}
+		d.promoteChatLocked()
+	}
+	if len(d.waitingChat) != 0 {
+		t.Fatal(d.waitingChat)
+	}
+
+	// Images wait for the pending images budget.
+	for i, want := range []int{1, 2, 3} {
+		if pos := d.enqueueImage(intReq{count: 4, seed: i}); pos != want {
+			t.Fatalf("#%d: want %d, got %d", i, want, pos)
+		}
+	}
+	if chat, images := d.loadLocked(); chat != 0 || images != 12 {
+		t.Fatal(chat, images)
+	}
+	req := <-d.image
+	d.pendingImages -= req.cost()
+	d.promoteImagesLocked()
+	if len(d.waitingImages) != 0 || d.pendingImages != 8 {
+		t.Fatal(len(d.waitingImages), d.pendingImages)
+	}
+}
+
+func TestImageAttachment(t *testing.T) {
+	if a := imageAttachment(nil); a != nil {
+		t.Fatal("expected no attachment")
+	}
+	atts := []*discordgo.MessageAttachment{
+		{ID: "1", ContentType: "text/plain"},
+		{ID: "2", ContentType: "image/png"},
+		{ID: "3", ContentType: "image/jpeg"},
+	}
+	if a := imageAttachment(atts); a == nil || a.ID != "2" {
+		t.Fatalf("unexpected attachment %v", a)
+	}
+	if a := imageAttachment(atts[:1]); a != nil {
+		t.Fatal("expected no attachment")
+	}
+	atts = []*discordgo.MessageAttachment{
+		{ID: "1", Filename: "notes.txt"},
+		{ID: "2", ContentType: "image/webp; charset=binary"},
+		{ID: "3", Filename: "cat.WEBP"},
+	}
+	for i := range atts[1:] {
+		if a := imageAttachment(atts[i+1:]); a == nil || a.ID != atts[i+1].ID {
+			t.Fatalf("#%d: unexpected attachment %v", i, a)
+		}
+	}
+	if a := imageAttachment(atts[:1]); a != nil {
+		t.Fatal("expected no attachment")
+	}
+}
+
+func TestImageDataURL(t *testing.T) {
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8 ")
+	if got := imageDataURL(webp); !strings.HasPrefix(got, "data:image/webp;base64,") {
+		t.Fatal(got)
+	}
+}
+
+func TestOptionsToStruct(t *testing.T) {
+	type sub struct {
+		Name string `json:"name"`
+	}
+	type opts struct {
+		Text    string  `json:"text"`
+		Count   int     `json:"count"`
+		Enabled bool    `json:"enabled"`
+		Scale   float64 `json:"scale"`
+		Flag    *bool   `json:"flag"`
+		Sub     *sub    `json:"sub"`
+		Group   struct {
+			Sub sub `json:"sub"`
+		} `json:"group"`
+	}
+	yes := true
+	data := []struct {
+		name string
+		opts []*discordgo.ApplicationCommandInteractionDataOption
+		want opts
+		err  string
+	}{
+		{
+			"string",
+			[]*discordgo.ApplicationCommandInteractionDataOption{{Name: "text", Type: discordgo.ApplicationCommandOptionString, Value: "hi"}},
+			opts{Text: "hi"},
+			"",
+		},
+		{
+			"integer",
+			[]*discordgo.ApplicationCommandInteractionDataOption{{Name: "count", Type: discordgo.ApplicationCommandOptionInteger, Value: 3.}},
+			opts{Count: 3},
+			"",
+		},
+		{
+			"boolean",
+			[]*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "enabled", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+				{Name: "flag", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			opts{Enabled: true, Flag: &yes},
+			"",
+		},
+		{
+			"number",
+			[]*discordgo.ApplicationCommandInteractionDataOption{{Name: "scale", Type: discordgo.ApplicationCommandOptionNumber, Value: 1.5}},
+			opts{Scale: 1.5},
+			"",
+		},
+		{
+			"unknown",
+			[]*discordgo.ApplicationCommandInteractionDataOption{{Name: "other", Type: discordgo.ApplicationCommandOptionString, Value: "hi"}},
+			opts{},
+			"",
+		},
+		{
+			"sub_command",
+			[]*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "sub", Type: discordgo.ApplicationCommandOptionSubCommand, Options: []*discordgo.ApplicationCommandInteractionDataOption{
+					{Name: "name", Type: discordgo.ApplicationCommandOptionString, Value: "bob"},
+				}},
+			},
+			opts{Sub: &sub{Name: "bob"}},
+			"",
+		},
+		{
+			"sub_command_group",
+			[]*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "group", Type: discordgo.ApplicationCommandOptionSubCommandGroup, Options: []*discordgo.ApplicationCommandInteractionDataOption{
+					{Name: "sub", Type: discordgo.ApplicationCommandOptionSubCommand, Options: []*discordgo.ApplicationCommandInteractionDataOption{
+						{Name: "name", Type: discordgo.ApplicationCommandOptionString, Value: "alice"},
+					}},
+				}},
+			},
+			opts{Group: struct {
+				Sub sub `json:"sub"`
+			}{Sub: sub{Name: "alice"}}},
+			"",
+		},
+		{
+			"mismatched_type",
+			[]*discordgo.ApplicationCommandInteractionDataOption{{Name: "count", Type: discordgo.ApplicationCommandOptionString, Value: "3"}},
+			opts{},
+			`option "count": can't decode string into int`,
+		},
+		{
+			"fractional_integer",
+			[]*discordgo.ApplicationCommandInteractionDataOption{{Name: "count", Type: discordgo.ApplicationCommandOptionNumber, Value: 1.5}},
+			opts{},
+			`option "count": 1.5 is not an integer`,
+		},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			got := opts{}
+			err := optionsToStruct(line.opts, &got)
+			if line.err != "" {
+				if err == nil || err.Error() != line.err {
+					t.Fatalf("want error %q, got %v", line.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(line.want, got); diff != "" {
+				t.Fatalf("(want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProgressText(t *testing.T) {
+	data := []struct {
+		n    int
+		p    imagegen.Progress
+		want string
+	}{
+		{1, imagegen.Progress{Step: 0, Steps: 8}, "*Image #1*: step 0/8 ▱▱▱▱▱▱▱▱"},
+		{1, imagegen.Progress{Step: 4, Steps: 8}, "*Image #1*: step 4/8 ▰▰▰▰▱▱▱▱"},
+		{2, imagegen.Progress{Step: 25, Steps: 25}, "*Image #2*: step 25/25 ▰▰▰▰▰▰▰▰"},
+		{1, imagegen.Progress{}, "*Image #1*: step 0/0 ▱▱▱▱▱▱▱▱"},
+	}
+	for i, line := range data {
+		if got := progressText(line.n, line.p); got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestDownloadProgressText(t *testing.T) {
+	data := []struct {
+		p    huggingface.Progress
+		want string
+	}{
+		{huggingface.Progress{Downloaded: 3 << 29, Total: 6 << 29}, "Downloading `m.gguf`: 1.5GiB/3.0GiB (50%)"},
+		{huggingface.Progress{Downloaded: 1 << 30, Total: -1}, "Downloading `m.gguf`: 1.0GiB"},
+	}
+	for i, line := range data {
+		if got := downloadProgressText("m.gguf", line.p); got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestRemixSize(t *testing.T) {
+	data := []struct {
+		w, h  int
+		wantW int
+		wantH int
+	}{
+		{1024, 1024, 1024, 1024},
+		{1920, 1080, 1344, 768},
+		{1080, 1920, 768, 1344},
+		{100, 2000, 256, 1536},
+		{0, 0, defaultImageWidth, defaultImageHeight},
+	}
+	for i, line := range data {
+		if w, h := remixSize(line.w, line.h); w != line.wantW || h != line.wantH {
+			t.Errorf("#%d: want %dx%d, got %dx%d", i, line.wantW, line.wantH, w, h)
+		}
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	data := []struct {
+		aspectRatio string
+		w, h        int
+		wantW       int
+		wantH       int
+		wantErr     bool
+	}{
+		{"", 0, 0, 0, 0, false},
+		{"", 512, 768, 512, 768, false},
+		{"16:9", 0, 0, 1344, 768, false},
+		{"9:16", 0, 0, 768, 1344, false},
+		{"1:1", 0, 0, 1024, 1024, false},
+		{"", 512, 0, 0, 0, true},
+		{"", 500, 500, 0, 0, true},
+		{"", 2048, 512, 0, 0, true},
+		{"1:1", 512, 512, 0, 0, true},
+		{"2:1", 0, 0, 0, 0, true},
+	}
+	for i, line := range data {
+		w, h, err := imageSize(line.aspectRatio, line.w, line.h)
+		if (err != nil) != line.wantErr || w != line.wantW || h != line.wantH {
+			t.Errorf("#%d: got %dx%d, %v", i, w, h, err)
+		}
+	}
+	for _, a := range aspectRatios {
+		if err := validateImageSize(a.width, a.height); err != nil {
+			t.Errorf("%s: %v", a.name, err)
+		}
+	}
+}
+
+func TestSystemPrompt(t *testing.T) {
+	d := discordBot{mem: &llm.Memory{}, settings: sillybot.Settings{PromptSystem: "default"}}
+	if got := d.systemPrompt("g", "c"); got != "default" {
+		t.Fatal(got)
+	}
+	d.mem.SetPreferences("guild:g", map[string]string{systemPromptKey: "guild"})
+	if got := d.systemPrompt("g", "c"); got != "guild" {
+		t.Fatal(got)
+	}
+	d.mem.SetPreferences("channel:c", map[string]string{systemPromptKey: "channel"})
+	if got := d.systemPrompt("g", "c"); got != "channel" {
+		t.Fatal(got)
+	}
+	if got := d.systemPrompt("g", "other"); got != "guild" {
+		t.Fatal(got)
+	}
+	if got := d.systemPrompt("", ""); got != "default" {
+		t.Fatal(got)
+	}
+	if c := d.getMemory("g", "c", "", &sillybot.PromptVars{}); len(c.Messages) != 1 || c.Messages[0].Content != "channel" {
+		t.Fatal(c.Messages)
+	}
+	d.mem.SetPreferences("channel:c2", map[string]string{systemPromptKey: "Talk to {{.UserName}} on {{.GuildName}}, it is {{.Now}}."})
+	c := d.getMemory("g", "c2", "", &sillybot.PromptVars{UserName: "Joe", GuildName: "Ottawa"})
+	if want := "Talk to Joe on Ottawa, it is {{.Now}}."; len(c.Messages) != 1 || c.Messages[0].Content != want {
+		t.Fatal(c.Messages)
+	}
+}
+
+func TestPersona(t *testing.T) {
+	personas := []sillybot.Persona{
+		{Name: "helpful", Description: "A helpful assistant.", Prompt: "You are helpful to {{.UserName}}."},
+		{Name: "sarcastic", Prompt: "You are sarcastic."},
+	}
+	d := discordBot{mem: &llm.Memory{}, settings: sillybot.Settings{PromptSystem: "default", Personas: personas}}
+	c := d.getMemory("g", "c", "", &sillybot.PromptVars{})
+	if got := d.conversationPrompt(c); got != "default" {
+		t.Fatal(got)
+	}
+	c.Persona = "sarcastic"
+	if got := d.conversationPrompt(c); got != "You are sarcastic." {
+		t.Fatal(got)
+	}
+	// A new conversation in the channel keeps the persona.
+	c.Messages = nil
+	if c = d.getMemory("g", "c", "", &sillybot.PromptVars{}); len(c.Messages) != 1 || c.Messages[0].Content != "You are sarcastic." {
+		t.Fatal(c.Messages)
+	}
+	// The persona was removed from config.yml.
+	c.Persona = "removed"
+	if got := d.conversationPrompt(c); got != "default" {
+		t.Fatal(got)
+	}
+
+	data := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"default", "helpful", "sarcastic"}},
+		{"D", []string{"default"}},
+		{"castic", []string{"sarcastic"}},
+		{"pirate", nil},
+	}
+	for i, line := range data {
+		var got []string
+		for _, c := range personaChoices(personas, line.prefix) {
+			got = append(got, c.Name)
+		}
+		if !slices.Equal(got, line.want) {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+
+	want := "*Personas*, currently using `sarcastic`:\n- `default`: The default system prompt.\n- `helpful`: A helpful assistant.\n- `sarcastic`"
+	if got := listPersonas(personas, "sarcastic"); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if got := listPersonas(nil, ""); !strings.HasPrefix(got, "No persona") {
+		t.Fatal(got)
+	}
+}
+
+func TestConversation_Stateless(t *testing.T) {
+	d := discordBot{dg: &discordgo.Session{State: discordgo.NewState()}, mem: &llm.Memory{}, settings: sillybot.Settings{PromptSystem: "default"}}
+	c := d.getMemory("g", "c", "", &sillybot.PromptVars{})
+	c.Messages = append(c.Messages, llm.Message{Role: llm.User, Content: "hi"})
+	s := d.conversation(msgReq{msg: "question", channelID: "c", guildID: "g", stateless: true})
+	if len(s.Messages) != 1 || s.Messages[0].Content != "default" {
+		t.Fatal(s.Messages)
+	}
+	s.Messages = append(s.Messages, llm.Message{Role: llm.User, Content: "question"})
+	if got := d.conversation(msgReq{channelID: "c", guildID: "g"}); len(got.Messages) != 2 || got.Messages[1].Content != "hi" {
+		t.Fatal(got.Messages)
+	}
+	// e.g. /describe.
+	if got := d.conversation(msgReq{channelID: "c", guildID: "g", stateless: true, system: describePrompt}); len(got.Messages) != 1 || got.Messages[0].Content != describePrompt {
+		t.Fatal(got.Messages)
+	}
+}
+
+func TestExportConversation(t *testing.T) {
+	c := &llm.Conversation{
+		Started:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		LastUpdate: time.Date(2024, 5, 1, 12, 5, 0, 0, time.UTC),
+		Messages:   []llm.Message{{Role: llm.System, Content: "Be nice."}},
+	}
+	if b, _, err := exportConversation(c, "markdown"); b != nil || err != nil {
+		t.Fatal(string(b), err)
+	}
+	c.Messages = append(c.Messages,
+		llm.Message{Role: llm.User, Content: "What's this?", Image: "data:image/png;base64,AA=="},
+		llm.Message{Role: llm.Assistant, Content: "A cat.", ToolCalls: []llm.ToolCallRequest{{ID: "1", Type: "function", Function: llm.ToolCallFunction{Name: "get_current_time", Arguments: "{}"}}}},
+	)
+	b, name, err := exportConversation(c, "markdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Conversation\n\n" +
+		"- Started: 2024-05-01T12:00:00Z\n" +
+		"- Last update: 2024-05-01T12:05:00Z\n" +
+		"\n## System prompt\n\nBe nice.\n" +
+		"\n## User\n\nWhat's this?\n\n*[image]*\n" +
+		"\n## Assistant\n\nA cat.\n\n*Called* `get_current_time` *with* `{}`\n"
+	if diff := cmp.Diff(want, string(b)); diff != "" || name != "conversation-20240501-120000.md" {
+		t.Fatal(name, diff)
+	}
+	if b, name, err = exportConversation(c, "json"); err != nil || name != "conversation-20240501-120000.json" {
+		t.Fatal(name, err)
+	}
+	got := struct {
+		Started  time.Time
+		Messages []exportedMessage
+	}{}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Started.Equal(c.Started) || len(got.Messages) != 3 || !got.Messages[1].HasImage || got.Messages[2].ToolCalls[0].Function.Name != "get_current_time" {
+		t.Fatalf("%+v", got)
+	}
+	if _, _, err = exportConversation(c, "pdf"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWatermarkFor(t *testing.T) {
+	data := []struct {
+		def      imagegen.WatermarkOptions
+		policy   sillybot.WatermarkPolicy
+		optOut   bool
+		want     bool
+		wantText string
+	}{
+		{imagegen.WatermarkOptions{}, sillybot.WatermarkPolicy{}, false, true, ""},
+		{imagegen.WatermarkOptions{}, sillybot.WatermarkPolicy{}, true, false, ""},
+		{imagegen.WatermarkOptions{}, sillybot.WatermarkPolicy{Text: "AI"}, false, true, "AI"},
+		{imagegen.WatermarkOptions{}, sillybot.WatermarkPolicy{Disabled: true}, false, false, ""},
+		{imagegen.WatermarkOptions{}, sillybot.WatermarkPolicy{Required: true, Text: "AI"}, true, true, "AI"},
+		{imagegen.WatermarkOptions{Text: "brand"}, sillybot.WatermarkPolicy{}, false, true, "brand"},
+		{imagegen.WatermarkOptions{Text: "brand"}, sillybot.WatermarkPolicy{Text: "AI"}, false, true, "AI"},
+		{imagegen.WatermarkOptions{Disabled: true}, sillybot.WatermarkPolicy{}, false, false, ""},
+		{imagegen.WatermarkOptions{Disabled: true}, sillybot.WatermarkPolicy{Required: true}, true, true, ""},
+	}
+	for i, line := range data {
+		w := watermarkFor(line.def, line.policy, line.optOut)
+		if got := !w.Disabled; got != line.want || w.Text != line.wantText {
+			t.Fatalf("#%d: want %t %q, got %t %q", i, line.want, line.wantText, got, w.Text)
+		}
+	}
+}
+
+func TestParamsRequest(t *testing.T) {
+	p := imagegen.Params{Prompt: "a cat", Seed: 42, Steps: 8, Width: 512, Height: 768, Sampler: "euler"}
+	if got := paramsText(&p); got != "*Image prompt*: a cat\n*Seed*: 42\n*Steps*: 8\n*Size*: 512x768\n*Sampler*: euler\n" {
+		t.Fatalf("%q", got)
+	}
+	req, err := paramsRequest(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.cmdName != "image_manual" || req.imagePrompt != "a cat" || req.steps != 8 || req.width != 512 || req.sampler != "euler" || req.count != 1 {
+		t.Fatalf("%+v", req)
+	}
+	p.Labels = "hi"
+	if req, _ = paramsRequest(&p); req.cmdName != "meme_manual" || req.labelsContent != "hi" {
+		t.Fatalf("%+v", req)
+	}
+	// The parameters come from an uploaded file.
+	for i, bad := range []imagegen.Params{{Prompt: "a cat", Steps: 1000}, {Prompt: "a cat", Width: 100000, Height: 512}, {Seed: 1}} {
+		if _, err = paramsRequest(&bad); err == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestLastRequests(t *testing.T) {
+	l := lastRequests{}
+	if _, ok := l.get("a"); ok {
+		t.Fatal("unexpected request")
+	}
+	for i := 0; i < maxLastRequests; i++ {
+		l.set(strconv.Itoa(i), lastRequest{chat: &msgReq{msg: strconv.Itoa(i)}})
+	}
+	// Use the oldest so the second oldest is evicted instead.
+	if r, ok := l.get("0"); !ok || r.chat.msg != "0" {
+		t.Fatalf("unexpected %v", r)
+	}
+	l.set("new", lastRequest{image: &intReq{}})
+	if _, ok := l.get("1"); ok {
+		t.Fatal("expected 1 to be evicted")
+	}
+	if _, ok := l.get("0"); !ok {
+		t.Fatal("expected 0 to be kept")
+	}
+	if len(l.keys) != maxLastRequests || len(l.reqs) != maxLastRequests {
+		t.Fatalf("unexpected size %d, %d", len(l.keys), len(l.reqs))
+	}
+}
+
+func TestLastRequest_ImageRequest(t *testing.T) {
+	data := []struct {
+		last    lastRequest
+		enhance bool
+		want    intReq
+	}{
+		{
+			lastRequest{image: &intReq{cmdName: "meme_auto", description: "d", seed: 3}, labelsContent: "l", imagePrompt: "p"},
+			false,
+			intReq{cmdName: "meme_manual", description: "d", labelsContent: "l", imagePrompt: "p"},
+		},
+		{
+			lastRequest{image: &intReq{cmdName: "meme_auto", description: "d", seed: 3}, labelsContent: "l", imagePrompt: "p"},
+			true,
+			intReq{cmdName: "meme_auto", description: "d"},
+		},
+		{
+			// The image prompt wasn't generated, the LLM has to be used again.
+			lastRequest{image: &intReq{cmdName: "meme_auto", description: "d"}, labelsContent: "l"},
+			false,
+			intReq{cmdName: "meme_auto", description: "d"},
+		},
+		{
+			lastRequest{image: &intReq{cmdName: "image_auto", description: "d"}, imagePrompt: "p"},
+			false,
+			intReq{cmdName: "image_manual", description: "d", imagePrompt: "p"},
+		},
+		{
+			lastRequest{image: &intReq{cmdName: "image_manual", imagePrompt: "p", seed: 42}},
+			false,
+			intReq{cmdName: "image_manual", imagePrompt: "p"},
+		},
+	}
+	for i, line := range data {
+		got := line.last.imageRequest(line.enhance)
+		if diff := cmp.Diff(line.want, got, cmp.AllowUnexported(intReq{}, samplingParams{})); diff != "" {
+			t.Fatalf("#%d: (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestAddPreviewLocked(t *testing.T) {
+	d := discordBot{previews: map[string]pendingPreview{}}
+	now := time.Now()
+	d.addPreviewLocked("expired", pendingPreview{created: now.Add(-2 * previewTTL)})
+	for i := range maxPreviews {
+		d.addPreviewLocked(strconv.Itoa(i), pendingPreview{created: now.Add(time.Duration(i) * time.Second)})
+	}
+	if _, ok := d.previews["expired"]; ok {
+		t.Fatal("expected the expired preview to be forgotten")
+	}
+	if len(d.previews) != maxPreviews {
+		t.Fatal(len(d.previews))
+	}
+	d.addPreviewLocked("new", pendingPreview{created: now.Add(time.Hour / 2)})
+	if _, ok := d.previews["0"]; ok {
+		t.Fatal("expected the oldest preview to be forgotten")
+	}
+	if _, ok := d.previews["new"]; !ok || len(d.previews) != maxPreviews {
+		t.Fatal(len(d.previews))
+	}
+}
+
+func TestAddUpscaleLocked(t *testing.T) {
+	d := discordBot{upscales: map[string]pendingUpscale{}}
+	now := time.Now()
+	d.addUpscaleLocked("expired", pendingUpscale{created: now.Add(-2 * upscaleTTL)})
+	for i := range maxUpscales {
+		d.addUpscaleLocked(strconv.Itoa(i), pendingUpscale{created: now.Add(time.Duration(i) * time.Second)})
+	}
+	if _, ok := d.upscales["expired"]; ok {
+		t.Fatal("expected the expired image to be forgotten")
+	}
+	// Replacing the image of a message doesn't evict another one.
+	d.addUpscaleLocked("0", pendingUpscale{n: 2, created: now.Add(time.Minute)})
+	if len(d.upscales) != maxUpscales || d.upscales["0"].n != 2 {
+		t.Fatal(len(d.upscales))
+	}
+	d.addUpscaleLocked("new", pendingUpscale{created: now.Add(time.Hour / 2)})
+	if _, ok := d.upscales["1"]; ok {
+		t.Fatal("expected the oldest image to be forgotten")
+	}
+	if _, ok := d.upscales["new"]; !ok || len(d.upscales) != maxUpscales {
+		t.Fatal(len(d.upscales))
+	}
+}
+
+func TestPreviewText(t *testing.T) {
+	want := "*Description*: a \\*cat\\*\n*Labels*: l\n*Image prompt*: p\n*Seed*: 42\nClick **Generate** to create the image."
+	if got := previewText("a *cat*", "l", "p", 42); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if got := previewText("d", "", "p", 1); strings.Contains(got, "Labels") {
+		t.Fatal(got)
+	}
+}
+
+func TestNeedsLongWarning(t *testing.T) {
+	c := llm.Conversation{Messages: []llm.Message{
+		{Role: llm.System, Content: "system"},
+		{Role: llm.User, Content: strings.Repeat("hi ", 100)},
+	}}
+	n := llm.EstimateTokens(c.Messages)
+	if needsLongWarning(&c, 0) {
+		t.Fatal("disabled")
+	}
+	if needsLongWarning(&c, n+1) {
+		t.Fatal("below the threshold")
+	}
+	if !needsLongWarning(&c, n) {
+		t.Fatal("expected a warning")
+	}
+	c.LongWarned = true
+	if needsLongWarning(&c, n) {
+		t.Fatal("only warn once")
+	}
+}
+
+func TestForgetLastTurn(t *testing.T) {
+	c := llm.Conversation{Messages: []llm.Message{
+		{Role: llm.System, Content: "system"},
+		{Role: llm.User, Content: "hi"},
+		{Role: llm.Assistant, Content: "hello"},
+		{Role: llm.User, Content: "joke"},
+		{Role: llm.Assistant, Content: "no"},
+	}}
+	if forgetLastTurn(&c, "hi") {
+		t.Fatal("hi is not the last turn")
+	}
+	if !forgetLastTurn(&c, "joke") {
+		t.Fatal("expected joke to be forgotten")
+	}
+	if len(c.Messages) != 3 || c.Messages[2].Content != "hello" {
+		t.Fatalf("unexpected %v", c.Messages)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("hello", 5); got != "hello" {
+		t.Fatal(got)
+	}
+	if got := truncate("hello", 4); got != "hell..." {
+		t.Fatal(got)
+	}
+	if got := truncate("hé", 2); got != "h..." {
+		t.Fatal(got)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	s := discordgo.NewState()
+	if err := s.GuildAdd(&discordgo.Guild{ID: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChannelAdd(&discordgo.Channel{ID: "thread", GuildID: "g", ParentID: "c", Type: discordgo.ChannelTypeGuildPublicThread}); err != nil {
+		t.Fatal(err)
+	}
+	d := discordBot{dg: &discordgo.Session{State: s}}
+	d.settings.Access.Channels.Allow = []string{"c"}
+	if !d.allowed("g", "c", "u") {
+		t.Fatal("expected the channel to be allowed")
+	}
+	if !d.allowed("g", "thread", "u") {
+		t.Fatal("expected the thread to be allowed")
+	}
+	if d.allowed("g", "other", "u") {
+		t.Fatal("expected the channel to be ignored")
+	}
+}
+
+func TestSigned(t *testing.T) {
+	s := sillybot.SignatureOptions{}
+	if got := signed(&s, "*Seed*: 1"); got != "*Seed*: 1" {
+		t.Fatal(got)
+	}
+	s = sillybot.SignatureOptions{Prefix: "**Bot**: ", Suffix: "\n-# AI generated"}
+	if got, want := signed(&s, "*Seed*: 1"), "**Bot**: *Seed*: 1\n-# AI generated"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if got := signed(&s, strings.Repeat("a", 2*maxMessage)); len(got) > maxMessage || !strings.HasSuffix(got, "...\n-# AI generated") {
+		t.Fatal(len(got), got[len(got)-30:])
+	}
+}
+
+func TestCloseFence(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"Hi", "Hi"},
+		{"```go\nfoo()\n```", "```go\nfoo()\n```"},
+		{"```go\nfoo()\n", "```go\nfoo()\n```"},
+		{"```go\nfoo()", "```go\nfoo()\n```"},
+	}
+	for i, line := range data {
+		if got := closeFence(line.in); got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestClampSteps(t *testing.T) {
+	for in, want := range map[int]int{-1: 1, 1: 1, 20: 20, 50: 50, 1000: 50} {
+		if got := clampSteps(in); got != want {
+			t.Fatalf("clampSteps(%d) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	l := latency{}
+	if got := l.String(); got != "no request yet" {
+		t.Fatal(got)
+	}
+	l.add(time.Second)
+	if got := l.String(); got != "1s over 1 request" {
+		t.Fatal(got)
+	}
+	l.add(4 * time.Second)
+	if got := l.String(); got != "2.5s over 2 requests" {
+		t.Fatal(got)
+	}
+}
+
+func TestRecentChannels(t *testing.T) {
+	now := time.Now()
+	channels := map[string]time.Time{
+		"old":    now.Add(-2 * time.Hour),
+		"recent": now.Add(-time.Minute),
+		"newest": now,
+		"older":  now.Add(-30 * time.Minute),
+	}
+	got := recentChannels(channels, now.Add(-time.Hour), 10)
+	if diff := cmp.Diff([]string{"newest", "recent", "older"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	got = recentChannels(channels, now.Add(-time.Hour), 1)
+	if diff := cmp.Diff([]string{"newest"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestTouchChannel(t *testing.T) {
+	d := &discordBot{channels: map[string]time.Time{}}
+	d.settings.Goodbye.Recent = 2 * time.Hour
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.touchChannelLocked("old", now)
+	now = now.Add(90 * time.Minute)
+	d.touchChannelLocked("recent", now)
+	now = now.Add(time.Hour)
+	d.touchChannelLocked("new", now)
+	got := recentChannels(d.channels, time.Time{}, 10)
+	if diff := cmp.Diff([]string{"new", "recent"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestSetLocale(t *testing.T) {
+	d := &discordBot{locales: map[string]seenLocale{}}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.setLocaleLocked("old", discordgo.French, now)
+	now = now.Add(localeTTL - time.Hour)
+	d.setLocaleLocked("recent", discordgo.SpanishES, now)
+	now = now.Add(2 * time.Hour)
+	d.setLocaleLocked("new", discordgo.Japanese, now)
+	if got := d.userLocale("old"); got != discordgo.Unknown {
+		t.Fatalf("expected forgotten, got %q", got)
+	}
+	if got := d.userLocale("recent"); got != discordgo.SpanishES {
+		t.Fatalf("want %q, got %q", discordgo.SpanishES, got)
+	}
+	if len(d.locales) != 2 {
+		t.Fatalf("expected 2 locales, got %d", len(d.locales))
+	}
+}
+
+func TestAddressedToBot(t *testing.T) {
+	data := []struct {
+		content        string
+		isDM, isThread bool
+		want           bool
+	}{
+		// DMs don't require a mention.
+		{"hi", true, false, true},
+		{"<@42> hi", true, false, true},
+		{"hi", false, true, true},
+		{"<@42> hi", false, false, true},
+		{"hi", false, false, false},
+		{"<@7> hi", false, false, false},
+	}
+	for i, line := range data {
+		if got := addressedToBot(line.content, "42", line.isDM, line.isThread); got != line.want {
+			t.Errorf("#%d: want %t, got %t", i, line.want, got)
+		}
+	}
+}
+
+func TestCannotDM(t *testing.T) {
+	data := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{&discordgo.RESTError{}, false},
+		{&discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeMissingAccess}}, false},
+		{&discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeCannotSendMessagesToThisUser}}, true},
+		{fmt.Errorf("wrapped: %w", &discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeCannotSendMessagesToThisUser}}), true},
+	}
+	for i, line := range data {
+		if got := cannotDM(line.err); got != line.want {
+			t.Errorf("#%d: want %t, got %t", i, line.want, got)
+		}
+	}
+}
+
+func TestIsReactionTrigger(t *testing.T) {
+	data := []struct {
+		trigger string
+		emoji   discordgo.Emoji
+		want    bool
+	}{
+		{"🤖", discordgo.Emoji{Name: "🤖"}, true},
+		{"🤖", discordgo.Emoji{Name: "👍"}, false},
+		{"sillybot", discordgo.Emoji{ID: "123", Name: "sillybot"}, true},
+		{"sillybot:123", discordgo.Emoji{ID: "123", Name: "sillybot"}, true},
+		{"", discordgo.Emoji{Name: "🤖"}, false},
+	}
+	for i, line := range data {
+		if got := isReactionTrigger(line.trigger, &line.emoji); got != line.want {
+			t.Errorf("#%d: want %t, got %t", i, line.want, got)
+		}
+	}
+}
+
+func TestEnhanceErrors(t *testing.T) {
+	boom := errors.New("boom")
+	data := []struct {
+		labelsErr, promptErr error
+		want                 string
+	}{
+		{nil, nil, ""},
+		{boom, context.Canceled, "failed to enhance labels: boom"},
+		{context.Canceled, boom, "failed to enhance image generation prompt: boom"},
+		{boom, boom, "failed to enhance labels: boom\nfailed to enhance image generation prompt: boom"},
+		{context.Canceled, context.Canceled, "failed to enhance labels: context canceled\nfailed to enhance image generation prompt: context canceled"},
+	}
+	for i, line := range data {
+		got := ""
+		if err := enhanceErrors(line.labelsErr, line.promptErr); err != nil {
+			got = err.Error()
+		}
+		if got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestChunkLines(t *testing.T) {
+	if got := chunkLines(nil); len(got) != 0 {
+		t.Fatal(got)
+	}
+	if diff := cmp.Diff([]string{"Known models:"}, chunkLines([]string{"Known models:"})); diff != "" {
+		t.Fatal(diff)
+	}
+	// Many short lines are packed.
+	line := strings.Repeat("a", 999)
+	if diff := cmp.Diff([]string{line + "\n" + line, line}, chunkLines([]string{line, line, line})); diff != "" {
+		t.Fatal(diff)
+	}
+	// A model with a huge info line. Links and code spans must not be split.
+	long := "- [`model`](https://huggingface.co/author/repo) Quantizations:"
+	for i := 0; len(long) < 3*maxMessage; i++ {
+		long += " [`q" + strconv.Itoa(i) + "`](https://huggingface.co/author/repo/blob/main/model-q" + strconv.Itoa(i) + ".gguf)"
+	}
+	got := chunkLines([]string{"Known models:", long})
+	if len(got) < 4 {
+		t.Fatalf("expected at least 4 messages, got %d", len(got))
+	}
+	if got[0] != "Known models:" || strings.Join(got[1:], "") != long {
+		t.Fatal("content was lost")
+	}
+	for i, m := range got {
+		if len(m) > maxMessage {
+			t.Fatalf("#%d: too long: %d", i, len(m))
+		}
+		if strings.Count(m, "`")%2 != 0 || strings.Count(m, "[") != strings.Count(m, "](") || strings.Count(m, "(") != strings.Count(m, ")") {
+			t.Fatalf("#%d: broken markdown: %q", i, m)
+		}
+	}
+}
+
+func TestSplitMarkdownLine(t *testing.T) {
+	// No whitespace outside of a span: fall back to forceSplit.
+	in := "`" + strings.Repeat("a b ", maxMessage) + "`"
+	head, rest := splitMarkdownLine(in)
+	if len(head) > maxMessage || head+rest != in {
+		t.Fatalf("%d %d", len(head), len(rest))
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	if isAdmin(nil) {
+		t.Fatal("a DM has no admin")
+	}
+	if isAdmin(&discordgo.Member{Permissions: discordgo.PermissionSendMessages}) {
+		t.Fatal("expected not admin")
+	}
+	if !isAdmin(&discordgo.Member{Permissions: discordgo.PermissionSendMessages | discordgo.PermissionAdministrator}) {
+		t.Fatal("expected admin")
+	}
+}
+
+func TestEnqueueImage_Workers(t *testing.T) {
+	d := discordBot{image: make(chan intReq, 5), active: map[string]string{}}
+	d.settings.Queue.Workers = 2
+	d.active["image"] = "busy"
+	if pos := d.enqueueImage(intReq{}); pos != 1 {
+		t.Fatalf("expected to start right away, got %d", pos)
+	}
+	d.active["image2"] = "busy"
+	if pos := d.enqueueImage(intReq{}); pos != 3 {
+		t.Fatalf("expected queued third, got %d", pos)
+	}
+	// Each worker gets a full batch.
+	for i, want := range []int{4, 5, 0} {
+		if pos := d.enqueueImage(intReq{count: 4}); pos != want {
+			t.Fatalf("#%d: want %d, got %d", i, want, pos)
+		}
+	}
+	if d.pendingImages != 10 {
+		t.Fatalf("expected 10 pending images, got %d", d.pendingImages)
+	}
+}
+
+func TestCallTool(t *testing.T) {
+	d := discordBot{}
+	data := []struct {
+		name string
+		args string
+		want string
+	}{
+		{"generate_image", `{"prompt":"a cat"}`, "Image generation is not available."},
+		{"generate_image", `{}`, "The prompt argument is required."},
+		// Slightly malformed arguments are repaired.
+		{"generate_image", `{"prompt": "a cat",}`, "Image generation is not available."},
+		{"generate_image", `{"prompt":`, "The prompt argument is required."},
+		{"generate_image", `prompt=a cat`, "Invalid arguments: no valid JSON found in reply"},
+		{"launch_rockets", "", "Unknown tool launch_rockets"},
+	}
+	for i, line := range data {
+		call := llm.ToolCallRequest{ID: "call1", Type: "function", Function: llm.ToolCallFunction{Name: line.name, Arguments: line.args}}
+		if got := d.callTool(context.Background(), msgReq{}, call); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+	call := llm.ToolCallRequest{Function: llm.ToolCallFunction{Name: "get_current_time", Arguments: "{}"}}
+	if got := d.callTool(context.Background(), msgReq{}, call); got == "" {
+		t.Fatal("expected the time")
+	}
+}
+
+func TestCallTool_Queued(t *testing.T) {
+	d := discordBot{ig: &imagegen.Session{}, image: make(chan intReq, 1)}
+	call := llm.ToolCallRequest{Function: llm.ToolCallFunction{Name: "generate_image", Arguments: `{"prompt":"a cat"}`}}
+	want := "The image is being generated and will be shown to the user once ready. Do not describe it in detail."
+	if got := d.callTool(context.Background(), msgReq{}, call); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if req := <-d.image; req.job == nil || req.description != "a cat" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if d.pendingImages != 1 {
+		t.Fatalf("expected 1 pending image, got %d", d.pendingImages)
+	}
+	d.image <- intReq{}
+	want = "The image queue is full. Tell the user to retry in a moment."
+	if got := d.callTool(context.Background(), msgReq{}, call); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestHelpEmbed(t *testing.T) {
+	perm := int64(discordgo.PermissionAdministrator)
+	chat := discordgo.ChatApplicationCommand
+	cmds := []*discordgo.ApplicationCommand{
+		{Name: "meme_auto", Type: chat, Description: "Meme.", Options: []*discordgo.ApplicationCommandOption{{Name: "description"}, {Name: "seed"}}},
+		{Name: "image_auto", Type: chat, Description: "Image."},
+		{Name: "regenerate", Type: chat, Description: "Redo."},
+		{Name: "switch_model", Type: chat, Description: "Switch.", DefaultMemberPermissions: &perm},
+		{Name: "help", Type: chat, Description: "Help."},
+		{Name: "forget", Type: discordgo.UserApplicationCommand},
+	}
+	e := helpEmbed("sillybot", false, cmds)
+	if !strings.Contains(e.Description, "`@sillybot ") || !strings.Contains(e.Description, "thread") {
+		t.Fatal(e.Description)
+	}
+	if e := helpEmbed("sillybot", true, cmds); strings.Contains(e.Description, "thread") {
+		t.Fatal(e.Description)
+	}
+	want := []*discordgo.MessageEmbedField{
+		{Name: "Memes", Value: "`/meme_auto <description> <seed>`: Meme."},
+		{Name: "Images", Value: "`/image_auto`: Image.\n`/regenerate`: Redo."},
+		{Name: "Admin", Value: "`/switch_model`: Switch."},
+		{Name: "Other", Value: "`/help`: Help."},
+	}
+	if diff := cmp.Diff(want, e.Fields); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// A category too large for a field is continued in the next one and the
+	// options are dropped when the embed is too large.
+	cmds = nil
+	for i := 0; i < 60; i++ {
+		cmds = append(cmds, &discordgo.ApplicationCommand{Name: "image_" + strconv.Itoa(i), Type: chat, Description: strings.Repeat("x", 80), Options: []*discordgo.ApplicationCommandOption{{Name: "prompt"}}})
+	}
+	e = helpEmbed("sillybot", false, cmds)
+	total := len(e.Title) + len(e.Description)
+	for i, f := range e.Fields {
+		if len(f.Value) > maxEmbedField {
+			t.Fatalf("#%d: %d", i, len(f.Value))
+		}
+		if i != 0 && f.Name != "Images (continued)" {
+			t.Fatalf("#%d: %q", i, f.Name)
+		}
+		if strings.Contains(f.Value, "<prompt>") {
+			t.Fatalf("#%d: %q", i, f.Value)
+		}
+		total += len(f.Name) + len(f.Value)
+	}
+	if total > maxEmbedTotal {
+		t.Fatal(total)
+	}
+}
+
+func TestWelcomeChannel(t *testing.T) {
+	g := &discordgo.Guild{
+		SystemChannelID: "sys",
+		Channels: []*discordgo.Channel{
+			{ID: "voice", Type: discordgo.ChannelTypeGuildVoice, Position: 0},
+			{ID: "general", Type: discordgo.ChannelTypeGuildText, Position: 2},
+			{ID: "rules", Type: discordgo.ChannelTypeGuildText, Position: 1},
+			{ID: "sys", Type: discordgo.ChannelTypeGuildText, Position: 3},
+		},
+	}
+	data := []struct {
+		allowed []string
+		want    string
+	}{
+		{[]string{"sys", "general", "rules"}, "sys"},
+		{[]string{"general", "rules", "voice"}, "rules"},
+		{[]string{"general"}, "general"},
+		{nil, ""},
+	}
+	for i, line := range data {
+		got := welcomeChannel(g, func(id string) bool { return slices.Contains(line.allowed, id) })
+		if got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestImageErrorText(t *testing.T) {
+	if got := imageErrorText(fmt.Errorf("%w: CUDA out of memory.", imagegen.ErrOutOfMemory)); !strings.Contains(got, "ran out of VRAM") {
+		t.Fatal(got)
+	}
+	if got := imageErrorText(fmt.Errorf("%w after 5m0s", imagegen.ErrTimeout)); !strings.HasPrefix(got, "Generation timed out") {
+		t.Fatal(got)
+	}
+	if got := imageErrorText(errors.New("bad *prompt*")); got != "bad \\*prompt\\*" {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// msgID identifies a user facing message in the catalog.
+type msgID int
+
+const (
+	msgForgetUnknown msgID = iota
+	msgForgetZapped
+	msgSystemPrompt
+	msgChatQueueFull
+	msgImageQueueFull
+	// msgQueuePosition takes the position in line.
+	msgQueuePosition
+	msgLongConversation
+	msgWarmingUp
+	// msgRateLimited takes the wait, e.g. "12s".
+	msgRateLimited
+	msgWelcome
+	msgShuttingDown
+	msgQueueCancelled
+)
+
+// catalog is the user facing messages per locale. English is the fallback,
+// it must have every message. The other locales can be incomplete.
+//
+// To add a language, copy the English messages and translate them. Keep the
+// markdown and the fmt verbs as-is.
+var catalog = map[discordgo.Locale]map[msgID]string{
+	discordgo.EnglishUS: {
+		msgForgetUnknown:    "I don't know you. I can't wait to start our discussion so I can get to know you better!",
+		msgForgetZapped:     "The memory of our past conversations just got zapped.",
+		msgSystemPrompt:     "*System prompt*: ",
+		msgChatQueueFull:    "Sorry! I have too many pending chat requests. Please retry in a moment.",
+		msgImageQueueFull:   "Sorry! I have too many pending image requests. Please retry in a moment.",
+		msgQueuePosition:    "You're #%d in line, please be patient.",
+		msgLongConversation: "Our conversation is getting long; I may forget its older parts. Use `/forget` to start over.",
+		msgWarmingUp:        "*Warming up the model...*",
+		msgRateLimited:      "Slow down! You can send another request in %s.",
+		msgShuttingDown:     "Sorry! I'm shutting down and your request was cancelled. Please retry once I'm back.",
+		msgQueueCancelled:   "*Cancelled*: your request was removed from the line.",
+		msgWelcome: "I'm back up! 👋 I can do many things!\n" +
+			"- Tag me in channels to chat with me. Start a DM to talk alone, then no need to tag me at every messages.\n" +
+			"- I can generate images and memes 🖼️. Try `/image_auto flowers garden gorgeous realistic` or `/meme_auto AI overlord`\n" +
+			"- Type `/help` to see all my commands.\n" +
+			"**Important**: Keep it civil otherwise I'll have to be turned down.",
+	},
+	discordgo.French: {
+		msgForgetUnknown:    "Je ne te connais pas encore. J'ai hâte de commencer notre discussion pour mieux te connaître!",
+		msgForgetZapped:     "La mémoire de nos conversations passées vient d'être effacée.",
+		msgSystemPrompt:     "*Prompt système*: ",
+		msgChatQueueFull:    "Désolé! J'ai trop de messages en attente. Réessaie dans un moment.",
+		msgImageQueueFull:   "Désolé! J'ai trop d'images en attente. Réessaie dans un moment.",
+		msgQueuePosition:    "Tu es #%d dans la file, merci de patienter.",
+		msgLongConversation: "Notre conversation devient longue; je risque d'en oublier le début. Utilise `/forget` pour recommencer.",
+		msgWarmingUp:        "*Chargement du modèle...*",
+		msgRateLimited:      "Doucement! Tu pourras envoyer une autre requête dans %s.",
+		msgShuttingDown:     "Désolé! Je m'arrête et ta requête a été annulée. Réessaie quand je serai de retour.",
+		msgQueueCancelled:   "*Annulée*: ta requête a été retirée de la file.",
+		msgWelcome: "Je suis de retour! 👋 Je peux faire plein de choses!\n" +
+			"- Mentionne-moi dans les canaux pour discuter avec moi. Écris-moi en privé pour parler seul à seul, sans avoir à me mentionner à chaque message.\n" +
+			"- Je peux générer des images et des memes 🖼️. Essaie `/image_auto flowers garden gorgeous realistic` ou `/meme_auto AI overlord`\n" +
+			"- Tape `/help` pour voir toutes mes commandes.\n" +
+			"**Important**: Restez courtois sinon je devrai être désactivé.",
+	},
+	discordgo.SpanishES: {
+		msgForgetUnknown:    "No te conozco. ¡Tengo muchas ganas de empezar nuestra conversación para conocerte mejor!",
+		msgForgetZapped:     "La memoria de nuestras conversaciones pasadas acaba de ser borrada.",
+		msgSystemPrompt:     "*Prompt del sistema*: ",
+		msgChatQueueFull:    "¡Lo siento! Tengo demasiados mensajes pendientes. Vuelve a intentarlo en un momento.",
+		msgImageQueueFull:   "¡Lo siento! Tengo demasiadas imágenes pendientes. Vuelve a intentarlo en un momento.",
+		msgQueuePosition:    "Eres el #%d en la fila, por favor ten paciencia.",
+		msgLongConversation: "Nuestra conversación se está alargando; puedo olvidar sus partes más antiguas. Usa `/forget` para empezar de nuevo.",
+		msgWarmingUp:        "*Cargando el modelo...*",
+		msgRateLimited:      "¡Más despacio! Podrás enviar otra solicitud en %s.",
+		msgShuttingDown:     "¡Lo siento! Me estoy apagando y tu solicitud fue cancelada. Vuelve a intentarlo cuando esté de vuelta.",
+		msgQueueCancelled:   "*Cancelada*: tu solicitud fue retirada de la fila.",
+		msgWelcome: "¡Estoy de vuelta! 👋 ¡Puedo hacer muchas cosas!\n" +
+			"- Mencióname en los canales para charlar conmigo. Envíame un mensaje directo para hablar a solas, sin necesidad de mencionarme en cada mensaje.\n" +
+			"- Puedo generar imágenes y memes 🖼️. Prueba `/image_auto flowers garden gorgeous realistic` o `/meme_auto AI overlord`\n" +
+			"- Escribe `/help` para ver todos mis comandos.\n" +
+			"**Importante**: Mantengan la cordialidad o tendré que ser desactivado.",
+	},
+}
+
+// baseLocales is the locale in the catalog to use for each language, for the
+// regional locales without their own messages.
+var baseLocales = map[string]discordgo.Locale{
+	"en": discordgo.EnglishUS,
+	"es": discordgo.SpanishES,
+	"fr": discordgo.French,
+}
+
+// tr returns the message in the locale, formatted with args.
+//
+// A regional locale without its own messages uses the ones of the same
+// language in baseLocales, e.g. "es-419" uses "es-ES". Missing messages fall
+// back to English.
+func tr(l discordgo.Locale, id msgID, args ...interface{}) string {
+	s, ok := catalog[l][id]
+	if !ok {
+		lang, _, _ := strings.Cut(string(l), "-")
+		s, ok = catalog[baseLocales[lang]][id]
+	}
+	if !ok {
+		s = catalog[discordgo.EnglishUS][id]
+	}
+	if len(args) != 0 {
+		return fmt.Sprintf(s, args...)
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestTr(t *testing.T) {
+	data := []struct {
+		l    discordgo.Locale
+		id   msgID
+		args []interface{}
+		want string
+	}{
+		{discordgo.Unknown, msgForgetZapped, nil, "The memory of our past conversations just got zapped."},
+		{discordgo.EnglishGB, msgForgetZapped, nil, "The memory of our past conversations just got zapped."},
+		{discordgo.French, msgQueuePosition, []interface{}{3}, "Tu es #3 dans la file, merci de patienter."},
+		{discordgo.SpanishLATAM, msgQueuePosition, []interface{}{2}, "Eres el #2 en la fila, por favor ten paciencia."},
+		{discordgo.Japanese, msgQueuePosition, []interface{}{4}, "You're #4 in line, please be patient."},
+		{"fr-CA", msgForgetZapped, nil, "La mémoire de nos conversations passées vient d'être effacée."},
+	}
+	for i, line := range data {
+		if got := tr(line.l, line.id, line.args...); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	en := catalog[discordgo.EnglishUS]
+	for id := msgForgetUnknown; id <= msgWelcome; id++ {
+		if en[id] == "" {
+			t.Fatalf("missing English message %d", id)
+		}
+	}
+	for l, msgs := range catalog {
+		lang, _, _ := strings.Cut(string(l), "-")
+		if _, ok := catalog[baseLocales[lang]]; !ok {
+			t.Fatalf("%s: missing base locale", l)
+		}
+		for id, s := range msgs {
+			if _, ok := en[id]; !ok {
+				t.Fatalf("%s: unknown message %d", l, id)
+			}
+			// The translations must take the same arguments.
+			if strings.Count(s, "%") != strings.Count(en[id], "%") {
+				t.Fatalf("%s: message %d has different arguments: %q", l, id, s)
+			}
+		}
+	}
+}
@@ -106,6 +106,7 @@ func mainImpl() error {
 	config := flag.String("config", "config.yml", "Configuration file. If not present, it is automatically created.")
 	version := flag.Bool("version", false, "Print version then exit")
 	cpuprofile := flag.String("cpuprofile", "", "file to save trace to. A frequent name is cpu.pprof; you can analyze it with go tool pprof -http=:6060 cpu.pprof")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for pending requests on exit. 0 means no limit.")
 	tracefile := flag.String("trace", "", "file to save trace to. A frequent name is trace.out; you can analyze it with go tool trace -http=:6060 trace.out")
 	flag.Usage = func() {
 		o := flag.CommandLine.Output()
@@ -193,39 +194,23 @@ func mainImpl() error {
 	}
 
 	// Load memory.
-	mem := &llm.Memory{}
+	mem := &llm.Memory{MaxConversations: cfg.Bot.Settings.MaxConversations}
 	memcache := filepath.Join(memDir, "discord.json")
-	f, err := os.Open(memcache)
-	if err == nil {
-		err = mem.Load(f)
-		_ = f.Close()
-		if err != nil {
-			slog.Error("main", "message", "failed to load memory", "error", err)
-			// Continue anyway.
-		}
-	} else {
-		slog.Info("main", "memory", "no memory to load", "error", err)
+	if err = mem.LoadFile(memcache); err != nil {
+		slog.Error("main", "message", "failed to load memory", "error", err)
+		// Continue anyway.
 	}
 
-	d, err := newDiscordBot(ctx, *bottoken, *gcptoken, *cxtoken, *verbose, l, mem, cfg.KnownLLMs, ig, cfg.Bot.Settings, memDir)
+	d, err := newDiscordBot(ctx, *bottoken, *gcptoken, *cxtoken, *verbose, l, mem, cfg.KnownLLMs, ig, cfg.Bot.Settings, memDir, *shutdownTimeout)
 	if err != nil {
 		return err
 	}
 	<-ctx.Done()
 	err = d.Close()
 	// Save memory.
-	f, err2 := os.Create(memcache)
-	if err2 != nil {
-		return err2
-	}
-	err2 = mem.Save(f)
-	err3 := f.Close()
-	if err2 != nil {
+	if err2 := mem.SaveFile(memcache); err2 != nil {
 		return err2
 	}
-	if err3 != nil {
-		return err3
-	}
 	return err
 }
 
@@ -0,0 +1,80 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/maruel/sillybot/internal/metrics"
+)
+
+var (
+	promptsServed   = metrics.NewCounter("sillybot_prompts_total", "Chat requests replied to.")
+	promptLatency   = metrics.NewHistogram("sillybot_prompt_seconds", "Duration of the chat replies, including the tool calls.", metrics.DefaultBuckets)
+	imagesGenerated = metrics.NewCounter("sillybot_images_total", "Images sent to the users.")
+	queueRejections = metrics.NewCounterVec("sillybot_queue_rejections_total", "Requests rejected because the queue was full, by queue.", "queue")
+	requestErrors   = metrics.NewCounterVec("sillybot_errors_total", "Failed requests by type.", "type")
+)
+
+// newMetricsServer registers the gauges sampled from the bot's state and
+// starts serving /metrics in the Prometheus text format on listen.
+func newMetricsServer(listen string, d *discordBot) (*httpServer, error) {
+	metrics.NewGaugeFunc("sillybot_conversations_active", "Conversations active in the last hour.", func() float64 {
+		return float64(d.mem.Count(time.Now().Add(-time.Hour)))
+	})
+	metrics.NewGaugeFunc("sillybot_queue_chat", "Chat requests queued, including the one being processed.", func() float64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		chat, _ := d.loadLocked()
+		return float64(chat)
+	})
+	metrics.NewGaugeFunc("sillybot_queue_images", "Images queued, including the ones being generated.", func() float64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		_, images := d.loadLocked()
+		return float64(images)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return serveHTTP("metrics", listen, "/metrics", mux)
+}
+
+// httpServer serves HTTP requests in the background.
+type httpServer struct {
+	srv  *http.Server
+	done chan struct{}
+}
+
+// serveHTTP starts serving h on listen. name is used in the logs, along with
+// the URL of path.
+func serveHTTP(name, listen, path string, h http.Handler) (*httpServer, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &httpServer{srv: &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(name, "message", "failed serving", "error", err)
+		}
+	}()
+	slog.Info(name, "state", "running", "url", "http://"+l.Addr().String()+path)
+	return s, nil
+}
+
+// Close stops serving.
+func (s *httpServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	<-s.done
+	return err
+}
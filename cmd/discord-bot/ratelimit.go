@@ -0,0 +1,94 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/maruel/sillybot"
+)
+
+// rateLimiter limits the requests of each user with a token bucket.
+type rateLimiter struct {
+	// perSecond is the rate at which the tokens are refilled.
+	perSecond float64
+	burst     float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// swept is when the full buckets were last forgotten.
+	swept time.Time
+}
+
+// bucket is the tokens left to a user as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when the rate limiting is disabled.
+func newRateLimiter(opts *sillybot.RateLimitOptions) *rateLimiter {
+	if opts.PerMinute <= 0 {
+		return nil
+	}
+	burst := opts.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(opts.PerMinute))
+	}
+	return &rateLimiter{
+		perSecond: opts.PerMinute / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+	}
+}
+
+// take consumes a token for the user. It returns 0 if the request is allowed,
+// otherwise how long the user has to wait for the next one.
+//
+// It is safe to call on a nil rateLimiter, which allows everything.
+func (r *rateLimiter) take(userID string, now time.Time) time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweepLocked(now)
+	b := r.buckets[userID]
+	if b == nil {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[userID] = b
+	}
+	b.tokens = min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / r.perSecond * float64(time.Second)).Round(time.Millisecond)
+}
+
+// sweepLocked forgets the buckets that refilled completely since they were
+// last used, at most once per refill period, so the map doesn't grow with
+// every user ever seen.
+func (r *rateLimiter) sweepLocked(now time.Time) {
+	refill := time.Duration(r.burst / r.perSecond * float64(time.Second))
+	if now.Sub(r.swept) < refill {
+		return
+	}
+	r.swept = now
+	for id, b := range r.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(r.buckets, id)
+		}
+	}
+}
+
+// cooldown formats the wait for the user, rounded up to the second, e.g.
+// "12s".
+func cooldown(d time.Duration) string {
+	return ((d + time.Second - 1) / time.Second * time.Second).String()
+}
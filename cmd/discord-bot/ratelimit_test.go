@@ -0,0 +1,85 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/maruel/sillybot"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if r := newRateLimiter(&sillybot.RateLimitOptions{}); r != nil {
+		t.Fatal("expected disabled")
+	}
+	var disabled *rateLimiter
+	if got := disabled.take("a", time.Now()); got != 0 {
+		t.Fatal(got)
+	}
+
+	r := newRateLimiter(&sillybot.RateLimitOptions{PerMinute: 6, Burst: 2})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := []struct {
+		user  string
+		after time.Duration
+		want  time.Duration
+	}{
+		{"a", 0, 0},
+		{"a", 0, 0},
+		{"a", 0, 10 * time.Second},
+		// Other users are not affected.
+		{"b", 0, 0},
+		{"a", 4 * time.Second, 6 * time.Second},
+		{"a", 6 * time.Second, 0},
+		{"a", 0, 10 * time.Second},
+		// Refilled up to the burst.
+		{"a", time.Hour, 0},
+		{"a", 0, 0},
+		{"a", 0, 10 * time.Second},
+	}
+	for i, line := range data {
+		now = now.Add(line.after)
+		if got := r.take(line.user, now); got != line.want {
+			t.Fatalf("#%d: want %s, got %s", i, line.want, got)
+		}
+	}
+	// "b" refilled completely and was forgotten.
+	if _, ok := r.buckets["b"]; ok {
+		t.Fatal("expected b to be forgotten")
+	}
+	if _, ok := r.buckets["a"]; !ok {
+		t.Fatal("expected a to be remembered")
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	data := []struct {
+		in   time.Duration
+		want string
+	}{
+		{11200 * time.Millisecond, "12s"},
+		{12 * time.Second, "12s"},
+		{90 * time.Second, "1m30s"},
+	}
+	for i, line := range data {
+		if got := cooldown(line.in); got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	d := &discordBot{limiter: newRateLimiter(&sillybot.RateLimitOptions{PerMinute: 1, Burst: 1})}
+	event := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{User: &discordgo.User{ID: "a"}}}
+	if got := d.rateLimited(event, "ask"); got != "" {
+		t.Fatalf("want no limit, got %q", got)
+	}
+	if got := d.rateLimited(event, "ask"); !strings.Contains(got, "1m") {
+		t.Fatalf("want the cooldown, got %q", got)
+	}
+}
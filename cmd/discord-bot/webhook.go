@@ -0,0 +1,133 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/maruel/sillybot"
+	"github.com/maruel/sillybot/internal"
+)
+
+// webhookEvent is a chunk of a chat reply, as posted to the webhook.
+type webhookEvent struct {
+	Channel string `json:"channel"`
+	Guild   string `json:"guild,omitempty"`
+	// ReplyTo is the ID of the message being replied to.
+	ReplyTo string `json:"reply_to,omitempty"`
+	Text    string `json:"text,omitempty"`
+	// Done is set on the last chunk of the reply.
+	Done bool `json:"done,omitempty"`
+}
+
+// webhookSink mirrors the chat replies to an outgoing webhook.
+//
+// Sending never blocks; chunks are dropped when the webhook can't keep up.
+// Consecutive chunks of the same reply are coalesced into a single request.
+type webhookSink struct {
+	ctx     context.Context
+	url     string
+	timeout time.Duration
+	events  chan webhookEvent
+	done    chan struct{}
+
+	// mu guards closed, so a reply still streaming on shutdown doesn't send
+	// on the closed channel.
+	mu     sync.Mutex
+	closed bool
+}
+
+func newWebhookSink(ctx context.Context, opts *sillybot.WebhookOptions) *webhookSink {
+	w := &webhookSink{
+		ctx:     ctx,
+		url:     opts.URL,
+		timeout: opts.Timeout,
+		events:  make(chan webhookEvent, 100),
+		done:    make(chan struct{}),
+	}
+	if w.timeout <= 0 {
+		w.timeout = 10 * time.Second
+	}
+	go w.run()
+	return w
+}
+
+// send queues a chunk to post. It is a no-op on a nil sink.
+func (w *webhookSink) send(e webhookEvent) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+		slog.Warn("webhook", "message", "dropped chunk", "channel", e.Channel)
+	}
+}
+
+// Close posts the remaining chunks and stops. The chunks sent afterward are
+// dropped.
+func (w *webhookSink) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+func (w *webhookSink) run() {
+	defer close(w.done)
+	for e := range w.events {
+		// Coalesce what is already queued for the same reply.
+		var next *webhookEvent
+	coalesce:
+		for !e.Done {
+			select {
+			case n, ok := <-w.events:
+				if !ok {
+					break coalesce
+				}
+				if n.Channel != e.Channel || n.ReplyTo != e.ReplyTo {
+					next = &n
+					break coalesce
+				}
+				e.Text += n.Text
+				e.Done = n.Done
+			default:
+				break coalesce
+			}
+		}
+		w.post(&e)
+		if next != nil {
+			w.post(next)
+		}
+	}
+}
+
+func (w *webhookSink) post(e *webhookEvent) {
+	ctx, cancel := context.WithTimeout(w.ctx, w.timeout)
+	defer cancel()
+	resp, err := internal.JSONPostRequest(ctx, w.url, "", e)
+	if err != nil {
+		slog.Error("webhook", "message", "failed posting", "error", err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		slog.Error("webhook", "message", "failed posting", "status", resp.Status)
+	}
+}
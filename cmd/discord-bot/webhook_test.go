@@ -0,0 +1,78 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/sillybot"
+)
+
+func TestWebhookSink(t *testing.T) {
+	mu := sync.Mutex{}
+	var got []webhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := webhookEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, e)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	w := newWebhookSink(context.Background(), &sillybot.WebhookOptions{URL: srv.URL})
+	w.send(webhookEvent{Channel: "c", Text: "Hello"})
+	w.send(webhookEvent{Channel: "c", Text: " world"})
+	w.send(webhookEvent{Channel: "c", Done: true})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A reply abandoned on shutdown may still be streaming.
+	w.send(webhookEvent{Channel: "c", Text: "late"})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	text := ""
+	done := false
+	for _, e := range got {
+		text += e.Text
+		done = done || e.Done
+	}
+	if text != "Hello world" || !done {
+		t.Fatalf("unexpected events %+v", got)
+	}
+}
+
+func TestWebhookSink_Failure(t *testing.T) {
+	// The webhook hangs, send must not block.
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+	w := newWebhookSink(context.Background(), &sillybot.WebhookOptions{URL: srv.URL, Timeout: 10 * time.Millisecond})
+	start := time.Now()
+	for range 1000 {
+		w.send(webhookEvent{Channel: "c", Text: "a"})
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("send blocked")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nil sink is a no-op.
+	var n *webhookSink
+	n.send(webhookEvent{})
+}
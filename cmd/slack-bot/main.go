@@ -130,18 +130,11 @@ func mainImpl() error {
 		return err
 	}
 	// Load memory.
-	mem := &llm.Memory{}
+	mem := &llm.Memory{MaxConversations: cfg.Bot.Settings.MaxConversations}
 	memcache := filepath.Join(memDir, "slack.json")
-	f, err := os.Open(memcache)
-	if err == nil {
-		err = mem.Load(f)
-		_ = f.Close()
-		if err != nil {
-			slog.Error("main", "message", "failed to load memory", "error", err)
-			// Continue anyway.
-		}
-	} else {
-		slog.Info("main", "memory", "no memory to load", "error", err)
+	if err = mem.LoadFile(memcache); err != nil {
+		slog.Error("main", "message", "failed to load memory", "error", err)
+		// Continue anyway.
 	}
 
 	s, err := newSlackBot(*apptoken, *bottoken, *verbose, l, mem, ig, cfg.Bot.Settings)
@@ -150,18 +143,9 @@ func mainImpl() error {
 	}
 	err = s.Run(ctx)
 	// Save memory.
-	f, err2 := os.Create(memcache)
-	if err2 != nil {
-		return err2
-	}
-	err2 = mem.Save(f)
-	err3 := f.Close()
-	if err2 != nil {
+	if err2 := mem.SaveFile(memcache); err2 != nil {
 		return err2
 	}
-	if err3 != nil {
-		return err3
-	}
 	return err
 }
 
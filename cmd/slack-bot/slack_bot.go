@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"image/png"
 	"io"
 	"log"
 	"log/slog"
@@ -299,13 +298,22 @@ func (s *slackBot) onAppMention(ctx context.Context, req msgReq) {
 func (s *slackBot) handlePrompt(ctx context.Context, req msgReq) {
 	c := s.mem.Get(req.userid, req.channel)
 	if len(c.Messages) == 0 {
-		c.Messages = []llm.Message{{Role: llm.System, Content: s.settings.PromptSystem}}
+		// The user and workspace names are not known here.
+		system, err := sillybot.RenderSystemPrompt(s.settings.PromptSystem, &sillybot.PromptVars{Date: time.Now().Format("2006-01-02")})
+		if err != nil {
+			slog.Error("slack", "message", "invalid system prompt", "error", err)
+			system = s.settings.PromptSystem
+		}
+		c.Messages = []llm.Message{{Role: llm.System, Content: system}}
 	}
 	_, ts, err := s.sc.PostMessageContext(ctx, req.channel, slack.MsgOptionText("(generating)", false), slack.MsgOptionTS(req.ts))
 	if err != nil {
 		slog.Error("slack", "message", "failed posting message", "error", err)
 	}
 	c.Messages = append(c.Messages, llm.Message{Role: llm.User, Content: req.msg})
+	if n := c.TrimTokens(s.settings.MaxContextTokens); n != 0 {
+		slog.Info("slack", "message", "trimmed conversation to fit the token budget", "user", c.User, "channel", c.Channel, "forgotten", n, "max_context_tokens", s.settings.MaxContextTokens)
+	}
 	words := make(chan string, 10)
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -345,7 +353,8 @@ func (s *slackBot) handlePrompt(ctx context.Context, req msgReq) {
 		}
 	}()
 	// We're chatting, we don't want too much content.
-	err = s.l.PromptStreaming(ctx, c.Messages, 2000, 0, 1.0, words)
+	temperature, topP := s.settings.Sampling.Chat.Values()
+	err = s.l.PromptStreaming(ctx, c.Messages, &llm.PromptOptions{MaxTokens: 2000, Temperature: temperature, TopP: topP}, words)
 	close(words)
 	wg.Wait()
 
@@ -371,14 +380,15 @@ func (s *slackBot) handleImage(ctx context.Context, req *imgReq) {
 
 		// Intentionally limit the number of tokens, otherwise it's Stable
 		// Diffusion that is unhappy.
-		if reply, err := s.l.Prompt(ctx, msgs, 70, 0, 1.0); err != nil {
+		temperature, topP := s.settings.Sampling.ImagePrompt.Values()
+		if reply, err := s.l.Prompt(ctx, msgs, &llm.PromptOptions{MaxTokens: 70, Temperature: temperature, TopP: topP}); err != nil {
 			slog.Error("discord", "message", "failed to enhance prompt", "error", err)
 		} else {
 			msg = reply
 		}
 	}
 	// TODO: Generate multiple images when the queue is empty?
-	img, err := s.ig.GenImage(ctx, msg, 1)
+	img, err := s.ig.GenImage(ctx, msg, 1, nil)
 	if err != nil {
 		_, _, _, err = s.sc.SendMessageContext(
 			ctx, req.channel,
@@ -391,14 +401,15 @@ func (s *slackBot) handleImage(ctx context.Context, req *imgReq) {
 		return
 	}
 	w := bytes.Buffer{}
-	if err = png.Encode(&w, img); err != nil {
-		slog.Error("slack", "message", "failed encoding PNG", "error", err)
+	output := s.ig.Output()
+	if err = output.Encode(&w, img); err != nil {
+		slog.Error("slack", "message", "failed encoding image", "error", err)
 		return
 	}
 	// TODO: Figure out how to use a block instead to include the generation request.
 	param := slack.UploadFileV2Parameters{
 		Title:    req.username + " asked for: " + req.msg,
-		Filename: "image.png",
+		Filename: "image" + output.Ext(),
 		FileSize: w.Len(),
 		Reader:   &w,
 		Channel:  req.channel,
@@ -8,6 +8,8 @@ package huggingface
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,7 +18,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
@@ -187,6 +193,17 @@ type Model struct {
 	LicenseURL string
 	// Files is the list of files in the repository.
 	Files []string
+	// FileSizes is the size in bytes of the files in Files, when known. It
+	// also contains the combined size of the logical files in Shards.
+	FileSizes map[string]int64
+	// Shards are the files in Files that are part of a larger file split in
+	// multiple shards, keyed by the logical file name. The shards are in
+	// order. See ShardOf for the supported naming patterns.
+	Shards map[string][]string
+	// FileSHA256 is the hex encoded SHA-256 of the files in Files, when known.
+	// Hugging Face only publishes it for files stored with LFS, which includes
+	// all the model weights.
+	FileSHA256 map[string]string
 	// Created is the time the repository was created. It can be at the earliest
 	// 2022-03-02 as documented at
 	// https://huggingface.co/docs/hub/api#repo-listing-api.
@@ -200,10 +217,25 @@ type Model struct {
 // Client is the client for https://huggingface.co/.
 type Client struct {
 	Cache string
+	// ModelInfoTTL is how long the results of GetModelInfo are cached in
+	// memory. The cache is disabled when 0. Defaults to DefaultModelInfoTTL.
+	ModelInfoTTL time.Duration
 
 	// serverBase is mocked in test.
 	serverBase string
 	token      string
+
+	mu    sync.Mutex
+	infos map[ModelRef]cachedModelInfo
+}
+
+// DefaultModelInfoTTL is the default Client.ModelInfoTTL.
+const DefaultModelInfoTTL = time.Hour
+
+// cachedModelInfo is a result of GetModelInfo.
+type cachedModelInfo struct {
+	m       Model
+	fetched time.Time
 }
 
 // New returns a new *Client client to download files and list repositories.
@@ -231,7 +263,7 @@ func New(token string, cache string) (*Client, error) {
 	if token != "" && !strings.HasPrefix(token, "hf_") {
 		return nil, errors.New("token is invalid, it must have prefix 'hf_'")
 	}
-	return &Client{serverBase: "https://huggingface.co", token: token, Cache: cache}, nil
+	return &Client{serverBase: "https://huggingface.co", token: token, Cache: cache, ModelInfoTTL: DefaultModelInfoTTL}, nil
 }
 
 // https://huggingface.co/docs/hub/api#get-apimodelsrepoid-or-apimodelsrepoidrevisionrevision
@@ -239,6 +271,10 @@ type modelInfoResponse struct {
 	LastModified time.Time `json:"lastModified"`
 	Siblings     []struct {
 		Filename string `json:"rfilename"`
+		Size     int64  `json:"size"`
+		LFS      struct {
+			SHA256 string `json:"sha256"`
+		} `json:"lfs"`
 	}
 	CardData struct {
 		BaseModel  string `json:"base_model"`
@@ -253,10 +289,38 @@ type modelInfoResponse struct {
 }
 
 // GetModelInfo fills the supplied Model with information from the HuggingFace Hub.
+//
+// The results are cached for ModelInfoTTL. The slices and maps of m are shared
+// with the cache and must not be modified.
 func (c *Client) GetModelInfo(ctx context.Context, m *Model) error {
+	if c.ModelInfoTTL <= 0 {
+		return c.getModelInfo(ctx, m)
+	}
+	c.mu.Lock()
+	e, ok := c.infos[m.ModelRef]
+	c.mu.Unlock()
+	if ok && time.Since(e.fetched) < c.ModelInfoTTL {
+		*m = e.m
+		return nil
+	}
+	if err := c.getModelInfo(ctx, m); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.infos == nil {
+		c.infos = map[ModelRef]cachedModelInfo{}
+	}
+	c.infos[m.ModelRef] = cachedModelInfo{m: *m, fetched: time.Now()}
+	return nil
+}
+
+// getModelInfo is the uncached GetModelInfo.
+func (c *Client) getModelInfo(ctx context.Context, m *Model) error {
 	slog.Info("hf", "model", m.RepoID())
-	url := c.serverBase + "/api/models/" + m.RepoID() + "/revision/HEAD"
-	resp, err := authGet(ctx, url, c.token)
+	// blobs=true is needed to get the file sizes.
+	url := c.serverBase + "/api/models/" + m.RepoID() + "/revision/HEAD?blobs=true"
+	resp, err := authGet(ctx, url, c.token, 0)
 	if err != nil {
 		return fmt.Errorf("failed to list repoID %s: %w", m.RepoID(), err)
 	}
@@ -279,9 +343,25 @@ func (c *Client) GetModelInfo(ctx context.Context, m *Model) error {
 	}
 	m.License = r.CardData.License
 	m.LicenseURL = r.CardData.LicenseURL
+	m.FileSizes = nil
+	m.FileSHA256 = nil
+	m.Shards = nil
 	for i := range r.Siblings {
 		m.Files[i] = r.Siblings[i].Filename
+		if r.Siblings[i].Size != 0 {
+			if m.FileSizes == nil {
+				m.FileSizes = map[string]int64{}
+			}
+			m.FileSizes[m.Files[i]] = r.Siblings[i].Size
+		}
+		if h := r.Siblings[i].LFS.SHA256; h != "" {
+			if m.FileSHA256 == nil {
+				m.FileSHA256 = map[string]string{}
+			}
+			m.FileSHA256[m.Files[i]] = h
+		}
 	}
+	m.groupShards()
 	for k, s := range r.SafeTensors.Parameters {
 		if s > m.NumWeights {
 			m.TensorType = k
@@ -296,41 +376,467 @@ func (c *Client) GetModelInfo(ctx context.Context, m *Model) error {
 
 // EnsureFile ensures the file is available, downloads it otherwise.
 //
-// TODO: Support split files.
+// Use EnsureShardedFile for a file split in multiple shards.
 func (c *Client) EnsureFile(ctx context.Context, ref PackedFileRef, mode os.FileMode) (string, error) {
 	dst := filepath.Join(c.Cache, ref.Basename())
 	if _, err := os.Stat(dst); err == nil {
 		return dst, err
 	}
 	url := c.serverBase + "/" + ref.RepoID() + "/resolve/HEAD/" + ref.Basename() + "?download=true"
-	return dst, DownloadFile(ctx, url, dst, c.token, mode)
+	// Retry once if the file is corrupted.
+	for i := 0; ; i++ {
+		hashed, err := downloadFile(ctx, url, dst, c.token, mode, progressFromContext(ctx))
+		if err != nil {
+			return dst, err
+		}
+		if hashed {
+			// The SHA-256 was already checked against the download headers.
+			return dst, nil
+		}
+		err = c.VerifyFile(ctx, ref.ModelRef(), ref.Basename())
+		if err == nil {
+			return dst, nil
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			// Failing to fetch the metadata is not a reason to throw away a file
+			// that was downloaded completely with the expected size.
+			slog.Warn("hf", "message", "failed to verify", "file", dst, "error", err)
+			return dst, nil
+		}
+		_ = os.Remove(dst)
+		if i == 1 {
+			return dst, err
+		}
+		slog.Warn("hf", "message", "corrupted download, retrying", "file", dst, "error", err)
+	}
 }
 
+// EnsureShardedFile ensures a file split in shards is available, downloading
+// the shards otherwise. shards are the shards of ref in order, as listed in
+// Model.Shards.
+//
+// It returns the path to use to load the file. Shards in the ".catN" format
+// are concatenated into the logical file and deleted. Shards in the
+// "-00001-of-00002" format are kept as is and the path to the first one is
+// returned, since llama.cpp loads the others automatically.
+func (c *Client) EnsureShardedFile(ctx context.Context, ref PackedFileRef, shards []string, mode os.FileMode) (string, error) {
+	if len(shards) == 0 {
+		return "", fmt.Errorf("no shard for %s", ref)
+	}
+	dst := filepath.Join(c.Cache, ref.Basename())
+	isCat := strings.HasPrefix(filepath.Ext(shards[0]), ".cat")
+	if isCat {
+		if _, err := os.Stat(dst); err == nil {
+			return dst, nil
+		}
+	}
+	prefix := strings.TrimSuffix(string(ref), ref.Basename())
+	paths := make([]string, 0, len(shards))
+	for _, s := range shards {
+		p, err := c.EnsureFile(ctx, PackedFileRef(prefix+s), mode)
+		if err != nil {
+			return p, err
+		}
+		paths = append(paths, p)
+	}
+	if !isCat {
+		return paths[0], nil
+	}
+	slog.Info("hf", "message", "concatenating shards", "file", dst, "shards", len(paths))
+	if err := concatFiles(dst, paths, mode); err != nil {
+		return dst, err
+	}
+	for _, p := range paths {
+		_ = os.Remove(p)
+	}
+	return dst, nil
+}
+
+// ShardOf returns the logical file name of a shard and its index, starting at
+// 0. ok is false if the file is not a shard.
+//
+// Two naming patterns are supported:
+//   - "<name>-00001-of-00003.gguf" as created by llama.cpp's gguf-split.
+//   - "<name>.cat0" for files to concatenate.
+func ShardOf(name string) (logical string, index int, ok bool) {
+	if m := reGGUFSplit.FindStringSubmatch(name); m != nil {
+		i, _ := strconv.Atoi(m[2])
+		if i < 1 {
+			return "", 0, false
+		}
+		return m[1] + m[4], i - 1, true
+	}
+	if m := reCatSplit.FindStringSubmatch(name); m != nil {
+		i, _ := strconv.Atoi(m[2])
+		return m[1], i, true
+	}
+	return "", 0, false
+}
+
+var (
+	reGGUFSplit = regexp.MustCompile(`^(.+)-(\d{5})-of-(\d{5})(\.gguf)$`)
+	reCatSplit  = regexp.MustCompile(`^(.+)\.cat(\d+)$`)
+)
+
+// groupShards fills Shards from Files.
+func (m *Model) groupShards() {
+	type shard struct {
+		name  string
+		index int
+	}
+	groups := map[string][]shard{}
+	for _, f := range m.Files {
+		if logical, i, ok := ShardOf(f); ok {
+			groups[logical] = append(groups[logical], shard{f, i})
+		}
+	}
+	for logical, l := range groups {
+		slices.SortFunc(l, func(a, b shard) int { return a.index - b.index })
+		if m.Shards == nil {
+			m.Shards = map[string][]string{}
+		}
+		var size int64
+		names := make([]string, len(l))
+		for i := range l {
+			names[i] = l[i].name
+			if size != -1 {
+				if s := m.FileSizes[l[i].name]; s != 0 {
+					size += s
+				} else {
+					size = -1
+				}
+			}
+		}
+		m.Shards[logical] = names
+		if size > 0 {
+			if m.FileSizes == nil {
+				m.FileSizes = map[string]int64{}
+			}
+			m.FileSizes[logical] = size
+		}
+	}
+}
+
+// concatFiles writes the concatenation of srcs into dst.
+func concatFiles(dst string, srcs []string, mode os.FileMode) error {
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		if err = appendFile(f, src); err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func appendFile(w io.Writer, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ErrChecksumMismatch is returned by Client.VerifyFile when the file doesn't
+// match the one published on Hugging Face.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// VerifyFile verifies the file in the cache against the SHA-256 published on
+// Hugging Face.
+//
+// Only the size is verified for files not stored with LFS, since their hash
+// is not published.
+func (c *Client) VerifyFile(ctx context.Context, m ModelRef, filename string) error {
+	info := Model{ModelRef: m}
+	if err := c.GetModelInfo(ctx, &info); err != nil {
+		return err
+	}
+	if !slices.Contains(info.Files, filename) {
+		return fmt.Errorf("file %q not found in %s", filename, m.RepoID())
+	}
+	p := filepath.Join(c.Cache, filename)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if size, ok := info.FileSizes[filename]; ok && fi.Size() != size {
+		return fmt.Errorf("%w: %s: expected %d bytes, got %d", ErrChecksumMismatch, p, size, fi.Size())
+	}
+	want := info.FileSHA256[filename]
+	if want == "" {
+		return nil
+	}
+	got, err := hashFile(p)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s: expected sha256 %s, got %s", ErrChecksumMismatch, p, want, got)
+	}
+	return nil
+}
+
+// Progress is the state of a file download.
+type Progress struct {
+	// Downloaded is the number of bytes downloaded so far, including the ones
+	// retrieved before a resumed download was interrupted.
+	Downloaded int64
+	// Total is the size of the file in bytes, or -1 if unknown.
+	Total int64
+}
+
+// Percent returns the percentage downloaded, or -1 if the size is unknown.
+func (p Progress) Percent() int {
+	if p.Total <= 0 {
+		return -1
+	}
+	return int(p.Downloaded * 100 / p.Total)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes Client.EnsureFile report the
+// download progress to f.
+//
+// This is useful when the download is triggered deep in the call stack, e.g.
+// when loading a model.
+func WithProgress(ctx context.Context, f func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+func progressFromContext(ctx context.Context) func(Progress) {
+	f, _ := ctx.Value(progressKey{}).(func(Progress))
+	return f
+}
+
+// progressInterval throttles the progress reports. Multi-gigabyte files
+// would otherwise call the callback hundreds of thousands of times.
+const progressInterval = time.Second
+
+// progressWriter reports the number of bytes written to it.
+type progressWriter struct {
+	f    func(Progress)
+	p    Progress
+	last time.Time
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.p.Downloaded += int64(len(b))
+	if now := time.Now(); now.Sub(w.last) >= progressInterval {
+		w.last = now
+		w.f(w.p)
+	}
+	return len(b), nil
+}
+
+// SetMaxConcurrentDownloads limits the number of files downloaded
+// simultaneously by DownloadFile. Additional downloads are queued until a slot
+// frees up.
+//
+// Use -1 to remove the limit and 0 to restore the default of 2.
+func SetMaxConcurrentDownloads(n int) {
+	downloads.setLimit(n)
+}
+
+// partialSuffix is appended to the file being downloaded. It is renamed to
+// its final name once complete and validated, so an interrupted download can
+// be resumed on the next run.
+const partialSuffix = ".partial"
+
 // DownloadFile downloads a file optionally with a bearer token.
 //
-// It prints a progress bar.
-func DownloadFile(ctx context.Context, url, dst string, token string, mode os.FileMode) error {
-	slog.Info("hf", "downloading", url)
-	resp, err := authGet(ctx, url, token)
+// The data is written to dst+".partial" first. If this file exists, e.g. when
+// a previous download was interrupted, the download is resumed with an HTTP
+// Range request. The file is validated against the expected size and, when
+// the server provides it, its SHA-256 before being renamed to dst.
+//
+// It prints a progress bar. If progress is not nil, it is called with the
+// current progress at most once per second, on start and on completion.
+func DownloadFile(ctx context.Context, url, dst string, token string, mode os.FileMode, progress func(Progress)) error {
+	_, err := downloadFile(ctx, url, dst, token, mode, progress)
+	return err
+}
+
+// downloadFile implements DownloadFile. hashed is true when the SHA-256 was
+// validated.
+func downloadFile(ctx context.Context, url, dst string, token string, mode os.FileMode, progress func(Progress)) (hashed bool, err error) {
+	release, err := downloads.acquire(ctx, url)
 	if err != nil {
-		return fmt.Errorf("failed to download %q: %w", dst, err)
+		return false, fmt.Errorf("failed to download %q: %w", dst, err)
+	}
+	defer release()
+	partial := dst + partialSuffix
+	var offset int64
+	if fi, err2 := os.Stat(partial); err2 == nil {
+		offset = fi.Size()
+	}
+	slog.Info("hf", "downloading", url, "offset", offset)
+	etag := linkedEtag(ctx, url, token)
+	resp, err := authGet(ctx, url, token, offset)
+	if err != nil {
+		return false, fmt.Errorf("failed to download %q: %w", dst, err)
 	}
 	defer resp.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	total := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		if offset, total, err = parseContentRange(resp.Header.Get("Content-Range")); err != nil {
+			return false, fmt.Errorf("failed to download %q: %w", dst, err)
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	} else if offset != 0 {
+		slog.Info("hf", "message", "server doesn't support resuming", "url", url)
+		offset = 0
+	}
 	// Only then create the file.
-	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	f, err := os.OpenFile(partial, flags, mode)
 	if err != nil {
-		return fmt.Errorf("failed to download %q: %w", dst, err)
+		return false, fmt.Errorf("failed to download %q: %w", dst, err)
+	}
+	if flags&os.O_APPEND != 0 {
+		// Make sure the file is exactly at the offset the server replied from.
+		if err = f.Truncate(offset); err != nil {
+			_ = f.Close()
+			return false, fmt.Errorf("failed to download %q: %w", dst, err)
+		}
 	}
-	defer f.Close()
 	// This is iffy to spam the user but necessary for large files.
 	// TODO: check if resp.ContentLength is small and skip output in this case.
-	bar := progressbar.DefaultBytes(resp.ContentLength, "downloading")
-	_, err = io.Copy(io.MultiWriter(f, bar), resp.Body)
-	return err
+	bar := progressbar.DefaultBytes(total, "downloading")
+	_ = bar.Set64(offset)
+	var w io.Writer = io.MultiWriter(f, bar)
+	var pw *progressWriter
+	if progress != nil {
+		pw = &progressWriter{f: progress, p: Progress{Downloaded: offset, Total: total}, last: time.Now()}
+		progress(pw.p)
+		w = io.MultiWriter(w, pw)
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if pw != nil && err == nil {
+		progress(pw.p)
+	}
+	if err != nil {
+		// Keep the partial file to resume later.
+		return false, fmt.Errorf("failed to download %q: %w", dst, err)
+	}
+	if hashed, err = validateDownload(partial, total, etag); err != nil {
+		// It's corrupted, start over next time.
+		_ = os.Remove(partial)
+		return false, fmt.Errorf("failed to download %q: %w", dst, err)
+	}
+	return hashed, os.Rename(partial, dst)
+}
+
+// parseContentRange parses a "bytes <start>-<end>/<total>" header. total is
+// -1 when unknown.
+func parseContentRange(s string) (int64, int64, error) {
+	var start, end int64
+	total := "*"
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if total == "*" {
+		return start, -1, nil
+	}
+	t, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return start, t, nil
+}
+
+// validateDownload checks the downloaded file size and hash when known.
+// hashed is true when the hash was checked.
+//
+// Hugging Face returns the SHA-256 of files stored with LFS as the
+// X-Linked-Etag header.
+func validateDownload(p string, size int64, etag string) (hashed bool, err error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	if size >= 0 && fi.Size() != size {
+		return false, fmt.Errorf("expected %d bytes, got %d", size, fi.Size())
+	}
+	want := strings.Trim(etag, "\"")
+	if len(want) != 64 {
+		// Not a SHA-256.
+		return false, nil
+	}
+	if _, err = hex.DecodeString(want); err != nil {
+		return false, nil
+	}
+	got, err := hashFile(p)
+	if err != nil {
+		return false, err
+	}
+	if got != want {
+		return false, fmt.Errorf("expected sha256 %s, got %s", want, got)
+	}
+	return true, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of a file.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkedEtag returns the X-Linked-Etag header of url, or "" when not
+// available.
+//
+// Hugging Face only sends it on the redirect to the CDN, so the redirect must
+// not be followed.
+func linkedEtag(ctx context.Context, url, token string) string {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		// Unlikely.
+		return ""
+	}
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	c := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		slog.Warn("hf", "message", "failed to get the hash", "url", url, "error", err)
+		return ""
+	}
+	_ = resp.Body.Close()
+	return resp.Header.Get("X-Linked-Etag")
 }
 
 // authGet does an authenticated HTTP request with a Bearer token.
-func authGet(ctx context.Context, url, token string) (*http.Response, error) {
+//
+// When offset is not 0, only the data starting at offset is requested. The
+// server may ignore it and reply with the whole content.
+func authGet(ctx context.Context, url, token string, offset int64) (*http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		// Unlikely.
@@ -339,9 +845,23 @@ func authGet(ctx context.Context, url, token string) (*http.Response, error) {
 	if token != "" {
 		req.Header.Add("Authorization", "Bearer "+token)
 	}
+	if offset != 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
 	for i := 0; i < 10; i++ {
 		resp, err := http.DefaultClient.Do(req)
-		if resp.StatusCode != 200 {
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset != 0 {
+			// The partial file is likely larger than the file, start over.
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			offset = 0
+			req.Header.Del("Range")
+			continue
+		}
+		if resp.StatusCode != 200 && resp.StatusCode != http.StatusPartialContent {
 			_, _ = io.Copy(io.Discard, resp.Body)
 			_ = resp.Body.Close()
 			if resp.StatusCode == 401 {
@@ -357,7 +877,65 @@ func authGet(ctx context.Context, url, token string) (*http.Response, error) {
 			}
 			return nil, fmt.Errorf("request status: %s", resp.Status)
 		}
-		return resp, err
+		return resp, nil
 	}
 	return nil, errors.New("failed retrying on 429")
 }
+
+// defaultMaxConcurrentDownloads is the default download limit.
+const defaultMaxConcurrentDownloads = 2
+
+// downloads is the process wide download limiter.
+var downloads = limiter{sem: make(chan struct{}, defaultMaxConcurrentDownloads)}
+
+// limiter is a resizable semaphore. A nil sem means no limit.
+type limiter struct {
+	mu     sync.Mutex
+	sem    chan struct{}
+	queued int
+}
+
+func (l *limiter) setLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// In-flight downloads release into the channel they acquired from, so it's
+	// safe to swap it.
+	if n == 0 {
+		n = defaultMaxConcurrentDownloads
+	}
+	if n < 0 {
+		l.sem = nil
+	} else {
+		l.sem = make(chan struct{}, n)
+	}
+}
+
+// acquire blocks until a download slot is available.
+func (l *limiter) acquire(ctx context.Context, url string) (func(), error) {
+	l.mu.Lock()
+	sem := l.sem
+	if sem == nil {
+		l.mu.Unlock()
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		l.mu.Unlock()
+		return func() { <-sem }, nil
+	default:
+	}
+	l.queued++
+	slog.Info("hf", "queued", url, "pending", l.queued, "limit", cap(sem))
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -5,12 +5,21 @@
 package huggingface
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,6 +28,7 @@ import (
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestPackedFileRef(t *testing.T) {
@@ -93,6 +103,10 @@ func TestGetModelInfo(t *testing.T) {
 			"tokenizer.model",
 			"tokenizer_config.json",
 		},
+		FileSizes: map[string]int64{
+			"model-00001-of-00002.safetensors": 4972489328,
+			"model-00002-of-00002.safetensors": 2669692552,
+		},
 		Created:    time.Date(2024, 04, 22, 16, 18, 17, 0, time.UTC),
 		Modified:   time.Date(2024, 07, 01, 21, 16, 50, 0000, time.UTC),
 		TensorType: "BF16",
@@ -105,6 +119,444 @@ func TestGetModelInfo(t *testing.T) {
 	}
 }
 
+func TestGetModelInfo_Cache(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(apiRepoPhi3Data))
+	}))
+	defer server.Close()
+	c, err := New("", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serverBase = server.URL
+	ref := ModelRef{Author: "microsoft", Repo: "Phi-3-mini-4k-instruct"}
+	for i := range 2 {
+		m := Model{ModelRef: ref}
+		if err := c.GetModelInfo(context.Background(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.License != "mit" || len(m.Files) != 19 {
+			t.Fatalf("#%d: %+v", i, m)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("want 1 call, got %d", calls)
+	}
+
+	// Expired.
+	c.mu.Lock()
+	e := c.infos[ref]
+	e.fetched = e.fetched.Add(-DefaultModelInfoTTL)
+	c.infos[ref] = e
+	c.mu.Unlock()
+	m := Model{ModelRef: ref}
+	if err := c.GetModelInfo(context.Background(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("want 2 calls, got %d", calls)
+	}
+
+	// Disabled.
+	c.ModelInfoTTL = 0
+	if err := c.GetModelInfo(context.Background(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("want 3 calls, got %d", calls)
+	}
+}
+
+func TestDownloadFile_Concurrency(t *testing.T) {
+	const limit = 2
+	mu := sync.Mutex{}
+	active := 0
+	maxActive := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if active++; active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		// Give the other downloads a chance to start if they were not blocked.
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	SetMaxConcurrentDownloads(limit)
+	t.Cleanup(func() { SetMaxConcurrentDownloads(0) })
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	eg := errgroup.Group{}
+	for i := 0; i < 3*limit; i++ {
+		dst := filepath.Join(dir, strconv.Itoa(i))
+		eg.Go(func() error {
+			return DownloadFile(ctx, server.URL+"/file", dst, "", 0o644, nil)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if maxActive != limit {
+		t.Fatalf("expected at most %d concurrent downloads, got %d", limit, maxActive)
+	}
+}
+
+func TestSetMaxConcurrentDownloads(t *testing.T) {
+	t.Cleanup(func() { SetMaxConcurrentDownloads(0) })
+	data := []struct {
+		n    int
+		want int
+	}{
+		{1, 1},
+		{-1, -1},
+		{0, defaultMaxConcurrentDownloads},
+	}
+	for i, line := range data {
+		SetMaxConcurrentDownloads(line.n)
+		got := -1
+		if downloads.sem != nil {
+			got = cap(downloads.sem)
+		}
+		if got != line.want {
+			t.Fatalf("#%d: want %d, got %d", i, line.want, got)
+		}
+	}
+}
+
+func TestDownloadFile_Cancel(t *testing.T) {
+	SetMaxConcurrentDownloads(1)
+	t.Cleanup(func() { SetMaxConcurrentDownloads(0) })
+	release, err := downloads.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = DownloadFile(ctx, "http://localhost:1/file", filepath.Join(t.TempDir(), "f"), "", 0o644, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDownloadFile_Resume(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	sum := sha256.Sum256(content)
+	etag := hex.EncodeToString(sum[:])
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		w.Header().Set("X-Linked-Etag", `"`+etag+`"`)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dst := filepath.Join(t.TempDir(), "file")
+	// Simulate an interrupted download.
+	if err := os.WriteFile(dst+".partial", content[:6], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var progress []Progress
+	if err := DownloadFile(context.Background(), server.URL+"/file", dst, "", 0o644, func(p Progress) { progress = append(progress, p) }); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"bytes=6-"}, ranges); diff != "" {
+		t.Fatal(diff)
+	}
+	// The resumed bytes are reported first.
+	want := []Progress{{Downloaded: 6, Total: 16}, {Downloaded: 16, Total: 16}}
+	if diff := cmp.Diff(want, progress); diff != "" {
+		t.Fatal(diff)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if _, err = os.Stat(dst + ".partial"); !os.IsNotExist(err) {
+		t.Fatalf("partial file was not removed: %v", err)
+	}
+}
+
+func TestDownloadFile_Redirect(t *testing.T) {
+	good := []byte("good weights")
+	sum := sha256.Sum256(good)
+	content := good
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			// Like Hugging Face, the hash is only sent on the redirect to the CDN.
+			w.Header().Set("X-Linked-Etag", fmt.Sprintf(`"%x"`, sum))
+			http.Redirect(w, r, "/cdn/file", http.StatusFound)
+		case "/cdn/file":
+			http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+		default:
+			t.Errorf("unexpected path, got: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	dst := filepath.Join(t.TempDir(), "file")
+	hashed, err := downloadFile(context.Background(), server.URL+"/file", dst, "", 0o644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hashed {
+		t.Fatal("expected the hash to be checked")
+	}
+	content = []byte("evil weights")
+	if _, err = downloadFile(context.Background(), server.URL+"/file", dst+"2", "", 0o644, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDownloadFile_Corrupted(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Linked-Etag", `"`+strings.Repeat("0", 64)+`"`)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dst := filepath.Join(t.TempDir(), "file")
+	if err := DownloadFile(context.Background(), server.URL+"/file", dst, "", 0o644, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, p := range []string{dst, dst + ".partial"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected to be removed: %v", p, err)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	good := []byte("good weights")
+	sum := sha256.Sum256(good)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/models/author/repo/revision/HEAD" {
+			t.Errorf("unexpected path, got: %s", r.URL.Path)
+		}
+		fmt.Fprintf(w, `{"siblings":[{"rfilename":"README.md"},{"rfilename":"model.gguf","size":%d,"lfs":{"sha256":"%x"}}]}`, len(good), sum)
+	}))
+	defer server.Close()
+	c, err := New("", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serverBase = server.URL
+	m := ModelRef{Author: "author", Repo: "repo"}
+	ctx := context.Background()
+	p := filepath.Join(c.Cache, "model.gguf")
+
+	if err = os.WriteFile(p, good, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.VerifyFile(ctx, m, "model.gguf"); err != nil {
+		t.Fatal(err)
+	}
+	// Same size, different content.
+	if err = os.WriteFile(p, []byte("evil weights"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.VerifyFile(ctx, m, "model.gguf"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	// Truncated.
+	if err = os.WriteFile(p, good[:4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.VerifyFile(ctx, m, "model.gguf"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	// No hash published.
+	if err = os.WriteFile(filepath.Join(c.Cache, "README.md"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.VerifyFile(ctx, m, "README.md"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.VerifyFile(ctx, m, "unknown.gguf"); err == nil || errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestEnsureFile_Retry(t *testing.T) {
+	good := []byte("good weights")
+	sum := sha256.Sum256(good)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/models/author/repo/revision/HEAD":
+			fmt.Fprintf(w, `{"siblings":[{"rfilename":"model.gguf","size":%d,"lfs":{"sha256":"%x"}}]}`, len(good), sum)
+		case "/author/repo/resolve/HEAD/model.gguf":
+			// Corrupt the first download. Don't send the hash header so it's
+			// not caught by DownloadFile.
+			if r.Method == "HEAD" {
+				return
+			}
+			if fetches++; fetches == 1 {
+				w.Write([]byte("evil weights"))
+			} else {
+				w.Write(good)
+			}
+		default:
+			t.Errorf("unexpected path, got: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	c, err := New("", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serverBase = server.URL
+	dst, err := c.EnsureFile(context.Background(), "hf:author/repo/HEAD/model.gguf", 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected 2 downloads, got %d", fetches)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(good, got) {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestEnsureFile_Hashed(t *testing.T) {
+	good := []byte("good weights")
+	sum := sha256.Sum256(good)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/author/repo/resolve/HEAD/model.gguf":
+			w.Header().Set("X-Linked-Etag", fmt.Sprintf(`"%x"`, sum))
+			w.Write(good)
+		default:
+			// The download was already validated, the file must not be hashed
+			// again.
+			t.Errorf("unexpected path, got: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	c, err := New("", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serverBase = server.URL
+	if _, err = c.EnsureFile(context.Background(), "hf:author/repo/HEAD/model.gguf", 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	data := []struct {
+		in      string
+		logical string
+		index   int
+		ok      bool
+	}{
+		{"model-q8_0-00001-of-00003.gguf", "model-q8_0.gguf", 0, true},
+		{"model-q8_0-00003-of-00003.gguf", "model-q8_0.gguf", 2, true},
+		{"model-fp16.gguf.cat0", "model-fp16.gguf", 0, true},
+		{"model-fp16.gguf.cat1", "model-fp16.gguf", 1, true},
+		{"model-q8_0.gguf", "", 0, false},
+		{"model-00000-of-00002.gguf", "", 0, false},
+		{"model-00001-of-00002.safetensors", "", 0, false},
+	}
+	for i, line := range data {
+		logical, index, ok := ShardOf(line.in)
+		if logical != line.logical || index != line.index || ok != line.ok {
+			t.Errorf("#%d: want %q, %d, %t; got %q, %d, %t", i, line.logical, line.index, line.ok, logical, index, ok)
+		}
+	}
+}
+
+func TestEnsureShardedFile(t *testing.T) {
+	parts := map[string]string{
+		"model-fp16.gguf.cat1":           "world",
+		"model-fp16.gguf.cat0":           "hello ",
+		"model-q8_0-00002-of-00002.gguf": "second",
+		"model-q8_0-00001-of-00002.gguf": "first",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/models/author/repo/revision/HEAD" {
+			var siblings []string
+			for name, content := range parts {
+				sum := sha256.Sum256([]byte(content))
+				siblings = append(siblings, fmt.Sprintf(`{"rfilename":%q,"size":%d,"lfs":{"sha256":"%x"}}`, name, len(content), sum))
+			}
+			fmt.Fprintf(w, `{"siblings":[%s]}`, strings.Join(siblings, ","))
+			return
+		}
+		content, ok := parts[strings.TrimPrefix(r.URL.Path, "/author/repo/resolve/HEAD/")]
+		if !ok {
+			t.Errorf("unexpected path, got: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	c, err := New("", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serverBase = server.URL
+	ctx := context.Background()
+	m := Model{ModelRef: ModelRef{Author: "author", Repo: "repo"}}
+	if err = c.GetModelInfo(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+	wantShards := map[string][]string{
+		"model-fp16.gguf": {"model-fp16.gguf.cat0", "model-fp16.gguf.cat1"},
+		"model-q8_0.gguf": {"model-q8_0-00001-of-00002.gguf", "model-q8_0-00002-of-00002.gguf"},
+	}
+	if diff := cmp.Diff(wantShards, m.Shards); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := m.FileSizes["model-fp16.gguf"]; got != 11 {
+		t.Fatalf("unexpected combined size %d", got)
+	}
+
+	// Concatenated.
+	dst, err := c.EnsureShardedFile(ctx, "hf:author/repo/HEAD/model-fp16.gguf", m.Shards["model-fp16.gguf"], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(c.Cache, "model-fp16.gguf"); dst != want {
+		t.Fatalf("want %q, got %q", want, dst)
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "hello world" {
+		t.Fatalf("unexpected content %q: %v", got, err)
+	}
+	if _, err = os.Stat(filepath.Join(c.Cache, "model-fp16.gguf.cat0")); !os.IsNotExist(err) {
+		t.Fatalf("expected the shard to be deleted, got %v", err)
+	}
+
+	// Referenced.
+	dst, err = c.EnsureShardedFile(ctx, "hf:author/repo/HEAD/model-q8_0.gguf", m.Shards["model-q8_0.gguf"], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(c.Cache, "model-q8_0-00001-of-00002.gguf"); dst != want {
+		t.Fatalf("want %q, got %q", want, dst)
+	}
+	if _, err = os.Stat(filepath.Join(c.Cache, "model-q8_0-00002-of-00002.gguf")); err != nil {
+		t.Fatal(err)
+	}
+}
+
 var apiRepoPhi3Data = `
 {
 		"lastModified": "2024-07-01T21:16:50.000Z",
@@ -152,10 +604,12 @@ var apiRepoPhi3Data = `
             "rfilename": "generation_config.json"
         },
         {
-            "rfilename": "model-00001-of-00002.safetensors"
+            "rfilename": "model-00001-of-00002.safetensors",
+            "size": 4972489328
         },
         {
-            "rfilename": "model-00002-of-00002.safetensors"
+            "rfilename": "model-00002-of-00002.safetensors",
+            "size": 2669692552
         },
         {
             "rfilename": "model.safetensors.index.json"
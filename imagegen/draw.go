@@ -9,12 +9,16 @@ import (
 	_ "embed"
 	"fmt"
 	"image"
-	"image/draw"
+	"image/color"
 	"image/png"
 	"math"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
+	"golang.org/x/image/draw"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/gofont/goitalic"
 	"golang.org/x/image/font/opentype"
@@ -23,6 +27,82 @@ import (
 
 // DrawLabelsOnImage draw text on an image.
 func DrawLabelsOnImage(img *image.NRGBA, meme string) {
+	DrawLabelsOnImageWithOptions(img, meme, nil)
+}
+
+// LabelOptions tunes how the labels are drawn. The zero value uses the
+// defaults.
+type LabelOptions struct {
+	// FontScale multiplies the automatically selected font size. Defaults to 1.
+	FontScale float64 `yaml:"font_scale"`
+	// OutlineRadius is the radius in pixels of the outline around the text.
+	// Defaults to 5. Increase it for legibility on busy images.
+	OutlineRadius float64 `yaml:"outline_radius"`
+	// OutlineColor is the color of the outline as "#RRGGBB". Defaults to
+	// black.
+	OutlineColor string `yaml:"outline_color"`
+	// FillColor is the color of the text as "#RRGGBB". Defaults to white.
+	FillColor string `yaml:"fill_color"`
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (l *LabelOptions) Validate() error {
+	if l.FontScale < 0 {
+		return fmt.Errorf("invalid font_scale %g", l.FontScale)
+	}
+	if l.OutlineRadius < 0 {
+		return fmt.Errorf("invalid outline_radius %g", l.OutlineRadius)
+	}
+	if l.OutlineColor != "" {
+		if _, err := ParseHexColor(l.OutlineColor); err != nil {
+			return err
+		}
+	}
+	if l.FillColor != "" {
+		if _, err := ParseHexColor(l.FillColor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseHexColor parses a "#RRGGBB" color.
+func ParseHexColor(s string) (color.NRGBA, error) {
+	c := color.NRGBA{A: 255}
+	if len(s) != 7 || s[0] != '#' {
+		return c, fmt.Errorf("invalid color %q; use the form #RRGGBB", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return c, fmt.Errorf("invalid color %q; use the form #RRGGBB", s)
+	}
+	c.R = uint8(v >> 16)
+	c.G = uint8(v >> 8)
+	c.B = uint8(v)
+	return c, nil
+}
+
+// DrawLabelsOnImageWithOptions draw text on an image.
+//
+// opts is optional. Invalid colors use the defaults.
+func DrawLabelsOnImageWithOptions(img *image.NRGBA, meme string, opts *LabelOptions) {
+	o := labelStyle{fontScale: 1, outlineRadius: 5, outline: color.Black, fill: color.White}
+	if opts != nil {
+		if opts.FontScale > 0 {
+			o.fontScale = opts.FontScale
+		}
+		if opts.OutlineRadius > 0 {
+			o.outlineRadius = opts.OutlineRadius
+		}
+		if c, err := ParseHexColor(opts.OutlineColor); err == nil {
+			o.outline = c
+		}
+		if c, err := ParseHexColor(opts.FillColor); err == nil {
+			o.fill = c
+		}
+	}
 	if meme = strings.Trim(meme, ","); len(meme) == 0 {
 		return
 	}
@@ -40,33 +120,44 @@ func DrawLabelsOnImage(img *image.NRGBA, meme string) {
 		}
 		prev = r
 	}
+	// Long labels are wrapped on multiple lines. Leave room for the other
+	// labels.
+	maxHeight := img.Bounds().Dy() / (len(lines) + 1)
 	switch len(lines) {
 	case 0:
 	case 1:
-		drawTextOnImage(img, memeFont, 0, lines[0])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 0, lines[0])
 	case 2:
-		drawTextOnImage(img, memeFont, 0, lines[0])
-		drawTextOnImage(img, memeFont, 100, lines[1])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 0, lines[0])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 100, lines[1])
 	case 3:
-		drawTextOnImage(img, memeFont, 0, lines[0])
-		drawTextOnImage(img, memeFont, 50, lines[1])
-		drawTextOnImage(img, memeFont, 100, lines[2])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 0, lines[0])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 50, lines[1])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 100, lines[2])
 	case 4:
-		drawTextOnImage(img, memeFont, 0, lines[0])
-		drawTextOnImage(img, memeFont, 30, lines[1])
-		drawTextOnImage(img, memeFont, 60, lines[2])
-		drawTextOnImage(img, memeFont, 100, lines[3])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 0, lines[0])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 30, lines[1])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 60, lines[2])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 100, lines[3])
 	default:
-		drawTextOnImage(img, memeFont, 0, lines[0])
-		drawTextOnImage(img, memeFont, 20, lines[1])
-		drawTextOnImage(img, memeFont, 50, lines[2])
-		drawTextOnImage(img, memeFont, 80, lines[3])
-		drawTextOnImage(img, memeFont, 100, lines[4])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 0, lines[0])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 20, lines[1])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 50, lines[2])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 80, lines[3])
+		drawTextOnImage(img, memeFont, &o, maxHeight, 100, lines[4])
 	}
 }
 
 //
 
+// labelStyle is LabelOptions with the defaults applied.
+type labelStyle struct {
+	fontScale     float64
+	outlineRadius float64
+	outline       color.Color
+	fill          color.Color
+}
+
 var (
 	//go:embed mascot.png
 	mascotPNG []byte
@@ -97,69 +188,314 @@ func mustLoadFont(b []byte) *opentype.Font {
 	return f
 }
 
-// drawTextOnImage draws a single line text on an image.
-func drawTextOnImage(img *image.NRGBA, f *opentype.Font, top int, text string) {
+// minFontDivisor bounds the font size to a fraction of the image width. Long
+// labels are wrapped on multiple lines instead of being shrunk below it.
+const minFontDivisor = 14
+
+// drawTextOnImage draws a label on an image, wrapping it on multiple lines if
+// needed. top is the vertical position in percent of the image height.
+func drawTextOnImage(img *image.NRGBA, f *opentype.Font, opts *labelStyle, maxHeight, top int, text string) {
 	// This code is "not awesome". Please send a PR to improve it.
 	bounds := img.Bounds()
 	w := bounds.Dx()
 	h := bounds.Dy()
-	d := font.Drawer{Dst: img, Src: image.Black}
-
-	// Do once with a size way too large, then adjust the size.
-	// opentype.NewFace() never returns an error.
-	face1, _ := opentype.NewFace(memeFont, &opentype.FaceOptions{Size: 1000, DPI: 72})
-	face2, _ := opentype.NewFace(notoEmojiFont, &opentype.FaceOptions{Size: 1000, DPI: 72})
-	d.Face = &multiface{faces: []font.Face{face1, face2}}
-
-	// Lazy ass.
-	texttomeasure := text
-	for len(texttomeasure) < 15 {
-		texttomeasure += "a"
-	}
-	textWidth := d.MeasureString(texttomeasure).Round()
-	size := 1000. * float64(w) / (250. + float64(textWidth))
-	face1, _ = opentype.NewFace(memeFont, &opentype.FaceOptions{Size: size, DPI: 72})
-	face2, _ = opentype.NewFace(notoEmojiFont, &opentype.FaceOptions{Size: size, DPI: 72})
-	d.Face = &multiface{faces: []font.Face{face1, face2}}
-	textWidth = d.MeasureString(text).Round()
+	size, lines := layoutText(w, maxHeight, opts.fontScale, text)
+	// Round down so the faces can be reused.
+	size = math.Floor(size)
+	face := faces.get(size)
+	defer faces.put(size, face)
+	d := font.Drawer{Face: face}
 	textHeight := d.Face.Metrics().Height.Ceil()
-	// The text tends to offshoot on the right so offset it on the left, divide
-	// by 4 instead of 2.
-	x := (w - textWidth) / 4
-	y := top * h / 100
+	// The labels at the bottom grow upward, the ones at the top downward.
+	n := len(lines)
+	y := top*h/100 - (n-1)*textHeight*top/100
 	if y < textHeight {
 		y = textHeight
-	} else if y > h-40 {
-		y = h - 40
-	}
-	// Draw a crude outline.
-	// TODO: It's not super efficient to draw this many (36) times! Make it
-	// faster unless it's good enough.
-	// Update: it's imperceptibly good enough.
-	// TODO: Rasterize at 8x then downsize to reduce aliasing and not have to
-	// render so many times. That would be sweet.
-	radius := 5.
+	} else if y+(n-1)*textHeight > h-40 {
+		y = h - 40 - (n-1)*textHeight
+	}
+	for i, line := range lines {
+		// The text tends to offshoot on the right so offset it on the left,
+		// divide by 4 instead of 2.
+		x := (w - d.MeasureString(line).Round()) / 4
+		drawOutlinedString(img, size, x, y+i*textHeight, opts, line)
+	}
+}
+
+// superSample is the factor at which the labels are rasterized before being
+// downscaled, to smooth the edges of the text and its outline.
+const superSample = 4
+
+// drawOutlinedString draws the text with an outline, white on black by
+// default.
+//
+// The text is rasterized once at superSample times the size in a mask, which
+// is then stamped around to create the outline mask. Both masks are downscaled
+// with a box filter before being composited on the image.
+func drawOutlinedString(dst draw.Image, size float64, x, y int, opts *labelStyle, text string) {
+	radius := opts.outlineRadius
+	face := faces.get(size * superSample)
+	defer faces.put(size*superSample, face)
+	md := font.Drawer{Face: face, Src: image.Opaque, Dot: fixed.P(x*superSample, y*superSample)}
+	b, _ := md.BoundString(text)
+	r := int(math.Ceil(radius * superSample))
+	// Align the supersampled masks on the pixel grid of the image.
+	rect := image.Rect(
+		floorDiv(b.Min.X.Floor()-r, superSample), floorDiv(b.Min.Y.Floor()-r, superSample),
+		floorDiv(b.Max.X.Ceil()+r+superSample-1, superSample), floorDiv(b.Max.Y.Ceil()+r+superSample-1, superSample))
+	hi := image.Rectangle{rect.Min.Mul(superSample), rect.Max.Mul(superSample)}
+	mask := image.NewAlpha(hi)
+	md.Dst = mask
+	md.DrawString(text)
+	outline := image.NewAlpha(hi)
+	dx, dy := hi.Dx(), hi.Dy()
+	// Skip the empty rows, there are many in the margins.
+	empty := make([]bool, dy)
+	for row := range empty {
+		empty[row] = !slices.ContainsFunc(mask.Pix[row*mask.Stride:row*mask.Stride+dx], func(v uint8) bool { return v != 0 })
+	}
+	var prev image.Point
 	for i := 0; i < 360; i += 10 {
 		a := math.Pi / 180. * float64(i)
-		dx := math.Cos(a) * radius
-		dy := math.Sin(a) * radius
-		dot := fixed.Point26_6{X: fixed.Int26_6((float64(x) + dx) * 64), Y: fixed.Int26_6((float64(y) + dy) * 64)}
-		if dot != d.Dot {
-			d.Dot = dot
-			d.DrawString(text)
+		off := image.Pt(int(math.Round(math.Cos(a)*radius*superSample)), int(math.Round(math.Sin(a)*radius*superSample)))
+		if i != 0 && off == prev {
+			continue
+		}
+		prev = off
+		// outline = max(outline, mask shifted by off).
+		for row := max(0, off.Y); row < min(dy, dy+off.Y); row++ {
+			if empty[row-off.Y] {
+				continue
+			}
+			src := mask.Pix[(row-off.Y)*mask.Stride+max(0, -off.X) : (row-off.Y)*mask.Stride+min(dx, dx-off.X)]
+			dst := outline.Pix[row*outline.Stride+max(0, off.X):]
+			dst = dst[:len(src)]
+			for j, v := range src {
+				if v > dst[j] {
+					dst[j] = v
+				}
+			}
+		}
+	}
+	draw.DrawMask(dst, rect, image.NewUniform(opts.outline), image.Point{}, downsample(outline, rect), rect.Min, draw.Over)
+	draw.DrawMask(dst, rect, image.NewUniform(opts.fill), image.Point{}, downsample(mask, rect), rect.Min, draw.Over)
+}
+
+// downsample shrinks a mask rasterized at superSample times the resolution
+// into a mask of bounds r, averaging each block of pixels.
+func downsample(src *image.Alpha, r image.Rectangle) *image.Alpha {
+	const n = superSample * superSample
+	dst := image.NewAlpha(r)
+	for y := 0; y < r.Dy(); y++ {
+		d := dst.Pix[y*dst.Stride:]
+		for x := 0; x < r.Dx(); x++ {
+			sum := n / 2
+			for sy := 0; sy < superSample; sy++ {
+				s := src.Pix[(y*superSample+sy)*src.Stride+x*superSample:]
+				for sx := 0; sx < superSample; sx++ {
+					sum += int(s[sx])
+				}
+			}
+			d[x] = uint8(sum / n)
 		}
 	}
-	// Draw the final text.
-	d.Src = image.White
-	d.Dot = fixed.P(x, y)
-	d.DrawString(text)
+	return dst
 }
 
-// addWatermark adds our mascot onto the image.
-func addWatermark(img *image.NRGBA) {
+// floorDiv returns a/b rounded toward negative infinity.
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// layoutText returns the font size and the lines to draw the text on an image
+// w pixels wide.
+//
+// The text is kept on a single line if it is readable. Otherwise it is
+// wrapped on words so the font size stays above the minimum, as long as the
+// lines fit in maxHeight pixels.
+func layoutText(w, maxHeight int, scale float64, text string) (float64, []string) {
+	// Measure with a size way too large, then adjust the size.
+	face := faces.get(1000)
+	defer faces.put(1000, face)
+	d := font.Drawer{Face: face}
+	lineHeight := float64(d.Face.Metrics().Height.Ceil()) / 1000.
+	// fit returns the font size for the line to fit the width.
+	fit := func(line string) float64 {
+		// Lazy ass.
+		for len(line) < 15 {
+			line += "a"
+		}
+		return scale * 1000. * float64(w) / (250. + float64(d.MeasureString(line).Round()))
+	}
+	size := fit(text)
+	words := strings.Fields(text)
+	if len(words) < 2 {
+		return size, []string{text}
+	}
+	for target := scale * float64(w) / minFontDivisor; target > size; target *= 0.85 {
+		lines := []string{words[0]}
+		for _, word := range words[1:] {
+			if l := lines[len(lines)-1] + " " + word; fit(l) >= target {
+				lines[len(lines)-1] = l
+			} else {
+				lines = append(lines, word)
+			}
+		}
+		s := fit(lines[0])
+		for _, l := range lines[1:] {
+			s = min(s, fit(l))
+		}
+		if float64(len(lines))*lineHeight*s <= float64(maxHeight) {
+			return s, lines
+		}
+	}
+	return size, []string{text}
+}
+
+// faces caches the faces used to draw the labels by font size, since creating
+// them is expensive.
+//
+// A face is not safe for concurrent use, so it is removed from the cache while
+// in use.
+var faces faceCache
+
+// maxCachedSizes bounds the number of font sizes cached.
+const maxCachedSizes = 64
+
+type faceCache struct {
+	mu   sync.Mutex
+	free map[float64][]*multiface
+}
+
+// get returns a face of the requested size. Call put once done.
+func (c *faceCache) get(size float64) *multiface {
+	c.mu.Lock()
+	if l := c.free[size]; len(l) != 0 {
+		f := l[len(l)-1]
+		c.free[size] = l[:len(l)-1]
+		c.mu.Unlock()
+		return f
+	}
+	c.mu.Unlock()
+	// opentype.NewFace() never returns an error.
+	face1, _ := opentype.NewFace(memeFont, &opentype.FaceOptions{Size: size, DPI: 72})
+	face2, _ := opentype.NewFace(notoEmojiFont, &opentype.FaceOptions{Size: size, DPI: 72})
+	return &multiface{faces: []font.Face{face1, face2}}
+}
+
+// put returns a face retrieved with get to the cache.
+func (c *faceCache) put(size float64, f *multiface) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.free[size]; !ok && len(c.free) >= maxCachedSizes {
+		// Simplest eviction policy ever.
+		c.free = nil
+	}
+	if c.free == nil {
+		c.free = map[float64][]*multiface{}
+	}
+	c.free[size] = append(c.free[size], f)
+}
+
+// AddWatermark adds our mascot onto the image, optionally followed by a
+// short text.
+func AddWatermark(img *image.NRGBA, text string) {
+	AddWatermarkWithOptions(img, &WatermarkOptions{Text: text})
+}
+
+// WatermarkOptions configures the watermark added onto the generated images.
+// The zero value adds the mascot in the bottom left corner.
+type WatermarkOptions struct {
+	// Disabled removes the watermark.
+	Disabled bool
+	// Text is added next to the mascot, e.g. your own branding.
+	Text string
+	// Position is the corner of the watermark, one of "bottom_left",
+	// "bottom_right", "top_left" or "top_right". Defaults to "bottom_left".
+	Position string
+	// Opacity is between 0.05 (barely visible) and 1 (opaque). Defaults to 1.
+	Opacity float64
+	// Scale multiplies the size of the mascot and the text, between 0.25 and
+	// 4. Defaults to 1.
+	Scale float64
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (w *WatermarkOptions) Validate() error {
+	switch w.Position {
+	case "", "bottom_left", "bottom_right", "top_left", "top_right":
+	default:
+		return fmt.Errorf("invalid watermark position %q", w.Position)
+	}
+	if w.Opacity != 0 && (w.Opacity < 0.05 || w.Opacity > 1) {
+		return fmt.Errorf("invalid watermark opacity %g; must be between 0.05 and 1", w.Opacity)
+	}
+	if w.Scale != 0 && (w.Scale < 0.25 || w.Scale > 4) {
+		return fmt.Errorf("invalid watermark scale %g; must be between 0.25 and 4", w.Scale)
+	}
+	return nil
+}
+
+// AddWatermarkWithOptions adds our mascot onto the image, optionally followed
+// by a short text, unless disabled.
+func AddWatermarkWithOptions(img *image.NRGBA, opts *WatermarkOptions) {
+	if opts.Disabled {
+		return
+	}
+	opacity := opts.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	scale := opts.Scale
+	if scale == 0 {
+		scale = 1
+	}
 	d := img.Bounds()
+	var src image.Image = mascot
 	m := mascot.Bounds()
-	draw.Draw(img, m.Add(image.Pt(0, d.Dy()-m.Dy())), mascot, image.Point{}, draw.Over)
+	if scale != 1 {
+		r := image.Rect(0, 0, max(int(float64(m.Dx())*scale), 1), max(int(float64(m.Dy())*scale), 1))
+		dst := image.NewNRGBA(r)
+		draw.CatmullRom.Scale(dst, r, mascot, m, draw.Src, nil)
+		src, m = dst, r
+	}
+	right := strings.HasSuffix(opts.Position, "_right")
+	top := strings.HasPrefix(opts.Position, "top_")
+	// opentype.NewFace() never returns an error.
+	size := float64(d.Dy()) / 40. * scale
+	face, _ := opentype.NewFace(memeFont, &opentype.FaceOptions{Size: size, DPI: 72})
+	fd := font.Drawer{Dst: img, Src: image.NewUniform(color.NRGBA{255, 255, 255, uint8(math.Round(160 * opacity))}), Face: face}
+	pt := image.Pt(d.Min.X, d.Max.Y-m.Dy())
+	if right {
+		pt.X = d.Max.X - m.Dx()
+	}
+	if top {
+		pt.Y = d.Min.Y
+	}
+	if opacity == 1 {
+		draw.Draw(img, m.Add(pt), src, image.Point{}, draw.Over)
+	} else {
+		mask := image.NewUniform(color.Alpha{A: uint8(math.Round(255 * opacity))})
+		draw.DrawMask(img, m.Add(pt), src, image.Point{}, mask, image.Point{}, draw.Over)
+	}
+	if opts.Text == "" {
+		return
+	}
+	x := pt.X + m.Dx() + int(size/2)
+	if right {
+		x = pt.X - int(size/2) - fd.MeasureString(opts.Text).Ceil()
+	}
+	y := d.Max.Y - int(size/2)
+	if top {
+		y = d.Min.Y + int(size*1.5)
+	}
+	fd.Dot = fixed.P(x, y)
+	fd.DrawString(opts.Text)
 }
 
 // decodePNG decodes a PNG and ensures it is returned as a NRGBA image.
@@ -0,0 +1,120 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package imagegen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+
+	"golang.org/x/image/draw"
+)
+
+// OutputOptions configures how the generated images are encoded before being
+// sent to the users.
+type OutputOptions struct {
+	// Format is one of "png" or "jpeg". Defaults to "png". JPEG is much smaller,
+	// which makes uploads faster.
+	//
+	// TODO: Add "webp" once there's a Go encoder available.
+	Format string
+	// JPEGQuality is the JPEG quality, between 1 and 100. Defaults to 90.
+	JPEGQuality int `yaml:"jpeg_quality"`
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (o *OutputOptions) Validate() error {
+	switch o.Format {
+	case "", "png", "jpeg":
+	case "webp":
+		return errors.New("output format webp is not supported yet; use png or jpeg")
+	default:
+		return fmt.Errorf("invalid output format %q; use png or jpeg", o.Format)
+	}
+	if o.JPEGQuality < 0 || o.JPEGQuality > 100 {
+		return fmt.Errorf("invalid jpeg_quality %d; use a value between 1 and 100", o.JPEGQuality)
+	}
+	return nil
+}
+
+// Encode writes the image in the selected format.
+func (o *OutputOptions) Encode(w io.Writer, img image.Image) error {
+	if o.Format == "jpeg" {
+		q := o.JPEGQuality
+		if q == 0 {
+			q = 90
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: q})
+	}
+	return png.Encode(w, img)
+}
+
+// EncodeWithin is like Encode but makes the encoded image at most limit bytes,
+// e.g. to fit the upload limit of a chat service. It first lowers the JPEG
+// quality down to 50, then downscales the image by steps of 25%.
+//
+// limit <= 0 means no limit.
+func (o *OutputOptions) EncodeWithin(img image.Image, limit int) ([]byte, error) {
+	w := bytes.Buffer{}
+	if err := o.Encode(&w, img); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || w.Len() <= limit {
+		return w.Bytes(), nil
+	}
+	orig := w.Len()
+	opts := *o
+	if opts.Format == "jpeg" {
+		if opts.JPEGQuality == 0 {
+			opts.JPEGQuality = 90
+		}
+		for opts.JPEGQuality > 50 && w.Len() > limit {
+			opts.JPEGQuality = max(opts.JPEGQuality-10, 50)
+			w.Reset()
+			if err := opts.Encode(&w, img); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	for w.Len() > limit {
+		width, height = width*3/4, height*3/4
+		if width < 64 || height < 64 {
+			return nil, fmt.Errorf("image of %d bytes can't fit in %d bytes", orig, limit)
+		}
+		dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+		w.Reset()
+		if err := opts.Encode(&w, dst); err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("ig", "message", "reduced image to fit the size limit", "size", orig, "new_size", w.Len(), "limit", limit, "quality", opts.JPEGQuality, "width", width, "height", height)
+	return w.Bytes(), nil
+}
+
+// Ext returns the file extension of the selected format, including the dot.
+func (o *OutputOptions) Ext() string {
+	if o.Format == "jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// ContentType returns the MIME type of the selected format.
+func (o *OutputOptions) ContentType() string {
+	if o.Format == "jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
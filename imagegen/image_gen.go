@@ -6,20 +6,50 @@
 package imagegen
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/maruel/sillybot/internal"
+	"github.com/maruel/sillybot/internal/metrics"
 	"github.com/maruel/sillybot/py"
 )
 
+// ErrOutOfMemory is returned when the image server ran out of memory while
+// generating, typically the VRAM of a small GPU. Smaller dimensions, fewer
+// steps or fewer concurrent requests may succeed.
+var ErrOutOfMemory = errors.New("the image server ran out of memory")
+
+// ErrTimeout is returned when an image generation took longer than
+// Options.GenTimeout, typically because the server is overloaded.
+var ErrTimeout = errors.New("the image generation timed out")
+
+// ErrServerCrashed is returned when our own image server exited unexpectedly,
+// e.g. killed after running out of memory. It is restarted unless
+// Options.NoRestart is set.
+var ErrServerCrashed = errors.New("the image server crashed")
+
+// ErrUpscaleUnavailable is returned by Upscale when the image server doesn't
+// support upscaling, e.g. an older remote server.
+var ErrUpscaleUnavailable = errors.New("the image server doesn't support upscaling")
+
 // Options for New.
 type Options struct {
 	// Remote is the host:port of a pre-existing server to use instead of
@@ -28,25 +58,199 @@ type Options struct {
 	// Model specifies a model to use. Use "python" to use the python backend.
 	// "python" is currently the only supported value.
 	Model string
+	// Backends is an ordered list of candidate backends. Each is either "local"
+	// to start our own server or a "host:port" of a pre-existing server. The
+	// first healthy one is used. When set, Remote is ignored.
+	Backends []string `yaml:"backends"`
+	// Output is the encoding of the images sent to the users.
+	Output OutputOptions
+	// Auth authenticates the requests to the remote server, either Remote or
+	// the selected entry of Backends. It is not used with our own server. The
+	// requests are unauthenticated when empty.
+	Auth RemoteAuth
+	// MaxAttempts is the maximum number of attempts of each image generation
+	// request. Only the server errors (5xx) and refused connections are
+	// retried, with exponential backoff. The generation failures reported by
+	// the server, e.g. running out of memory, are not retried. Defaults to 3.
+	// Use 1 to disable retries.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Watermark is the watermark added onto the generated images unless
+	// GenOptions.NoWatermark is set.
+	Watermark WatermarkOptions
+	// Steps is the default number of inference steps, tuned for the model.
+	// Defaults to 8, which suits the default model distilled with LCM-LoRA.
+	// Models without a LCM LoRA need 25 to 40 steps.
+	Steps int
+	// LoRAs is the allowlist of LoRAs users can select with GenOptions.LoRA.
+	// Our own server is started with them. A remote server must be started
+	// with the same names, e.g. "image_gen.py --lora pixel=nerijs/pixel-art-xl".
+	LoRAs []LoRA
+	// Safety is the optional NSFW filter applied to the generated images.
+	Safety SafetyOptions
+	// NoRestart disables restarting our own server when it dies, e.g. after
+	// running out of memory. The requests then fail until the bot is
+	// restarted. It has no effect with a remote server.
+	NoRestart bool `yaml:"no_restart"`
+	// IdleTimeout stops our own server after this duration without request,
+	// to free the VRAM, e.g. on a shared workstation. It is started again on
+	// the next request. 0 disables. It has no effect with a remote server.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// GenTimeout is the maximum duration of an image generation or upscale,
+	// including the retries. The request is cancelled and ErrTimeout is
+	// returned when exceeded. Defaults to 5 minutes.
+	GenTimeout time.Duration `yaml:"gen_timeout"`
+
+	_ struct{}
+}
+
+// LoRA is an additional LoRA users can select per request, on top of the
+// model's own.
+type LoRA struct {
+	// Name is how the users select it, e.g. "pixel".
+	Name string
+	// Repo is the Hugging Face repository of the weights, e.g.
+	// "nerijs/pixel-art-xl". It is only used to start our own server.
+	Repo string
+
+	_ struct{}
+}
+
+// validateLoRAs checks the LoRA names are valid and unique.
+func validateLoRAs(loras []LoRA) error {
+	seen := map[string]struct{}{}
+	for _, l := range loras {
+		if l.Name == "" || strings.ContainsAny(l.Name, "= \t\n") {
+			return fmt.Errorf("invalid lora name %q", l.Name)
+		}
+		if _, ok := seen[l.Name]; ok {
+			return fmt.Errorf("duplicate lora %q", l.Name)
+		}
+		seen[l.Name] = struct{}{}
+	}
+	return nil
+}
+
+// RemoteAuth authenticates the requests to a remote image generation server.
+type RemoteAuth struct {
+	// Token is sent as a bearer token, as expected by image_gen.py
+	// --auth-token. It has priority over User and Password.
+	Token string
+	// User and Password are sent with HTTP basic authentication, e.g. to a
+	// reverse proxy in front of the server.
+	User     string
+	Password string
 
 	_ struct{}
 }
 
+// header returns the Authorization header value, if any.
+func (a *RemoteAuth) header() string {
+	if a.Token != "" {
+		return "Bearer " + a.Token
+	}
+	if a.User != "" || a.Password != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.User+":"+a.Password))
+	}
+	return ""
+}
+
 // Session manages an image generation server.
+//
+// Its methods are safe for concurrent use.
 type Session struct {
 	baseURL string
-	done    <-chan error
-	cancel  func() error
+	// auth is the Authorization header value sent to a remote server.
+	auth string
+	// launch starts our own server. It is nil when using a remote server.
+	launch  func(ctx context.Context) (<-chan error, func() error, error)
+	restart bool
+	// ctx is the lifetime of our own server, to reload it.
+	ctx context.Context
+	// configuredLoRAs is Options.LoRAs, to reload our own server.
+	configuredLoRAs []LoRA
+
+	steps       int
+	output      OutputOptions
+	maxAttempts int
+	genTimeout  time.Duration
+	watermark   WatermarkOptions
+	safety      SafetyOptions
 
-	steps int
+	// lastUsed is the time of the last request in Unix nanoseconds, to unload
+	// our own server when idle.
+	lastUsed atomic.Int64
+	// loadMu serializes reloading and unloading our own server.
+	loadMu sync.Mutex
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// proc is our own server, if any.
+	proc *process
+	// down is set while our own server is dead or restarting.
+	down error
+	// closing is set once Close is called, so the server exiting is expected.
+	closing bool
+	// unloaded is set when our own server was stopped after being idle.
+	unloaded bool
+	// inflight is the number of requests in flight.
+	inflight int
+	device   Device
+	// loras is the names of the LoRAs both configured and loaded by the
+	// server.
+	loras []string
+	// samplers is the names of the samplers the server supports.
+	samplers []string
 }
 
 // New initializes a new image generation server.
 func New(ctx context.Context, cache string, opts *Options) (*Session, error) {
-	// Using few steps assumes using a LoRA from Latent Consistency. See
-	// https://huggingface.co/blog/lcm_lora for more information.
-	ig := &Session{steps: 8}
-	if opts.Remote == "" {
+	if err := opts.Output.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.MaxAttempts < 0 {
+		return nil, fmt.Errorf("invalid max_attempts %d", opts.MaxAttempts)
+	}
+	if err := opts.Watermark.Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateLoRAs(opts.LoRAs); err != nil {
+		return nil, err
+	}
+	if opts.Steps < 0 {
+		return nil, fmt.Errorf("invalid steps %d", opts.Steps)
+	}
+	if err := opts.Safety.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.IdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid idle_timeout %s", opts.IdleTimeout)
+	}
+	if opts.GenTimeout < 0 {
+		return nil, fmt.Errorf("invalid gen_timeout %s", opts.GenTimeout)
+	}
+	ig := &Session{ctx: ctx, configuredLoRAs: opts.LoRAs, steps: opts.Steps, output: opts.Output, maxAttempts: opts.MaxAttempts, genTimeout: opts.GenTimeout, watermark: opts.Watermark, safety: opts.Safety}
+	if ig.maxAttempts == 0 {
+		ig.maxAttempts = 3
+	}
+	if ig.genTimeout == 0 {
+		ig.genTimeout = 5 * time.Minute
+	}
+	if ig.steps == 0 {
+		// Using few steps assumes using a LoRA from Latent Consistency. See
+		// https://huggingface.co/blog/lcm_lora for more information.
+		ig.steps = 8
+	}
+	remote := opts.Remote
+	if len(opts.Backends) != 0 {
+		var err error
+		if remote, err = internal.SelectBackend(ctx, "ig", opts.Auth.header(), opts.Backends, 2*time.Second); err != nil {
+			return nil, err
+		}
+		if remote == "local" {
+			remote = ""
+		}
+	}
+	if remote == "" {
 		if opts.Model != "python" {
 			return nil, fmt.Errorf("unknown model %q", opts.Model)
 		}
@@ -59,74 +263,862 @@ func New(ctx context.Context, cache string, opts *Options) (*Session, error) {
 		}
 		port := internal.FindFreePort(8032)
 		cmd := []string{filepath.Join(cachePy, "image_gen.py"), "--port", strconv.Itoa(port)}
-		var err error
-		ig.done, ig.cancel, err = py.Run(ctx, filepath.Join(cachePy, "venv"), cmd, cachePy, filepath.Join(cachePy, "image_gen.log"))
-		if err != nil {
-			return nil, err
+		for _, l := range opts.LoRAs {
+			if l.Repo == "" {
+				return nil, fmt.Errorf("lora %q: repo is required", l.Name)
+			}
+			cmd = append(cmd, "--lora", l.Name+"="+l.Repo)
+		}
+		// The port is kept on restart so the requests retried while the server
+		// restarts reach it.
+		ig.launch = func(ctx context.Context) (<-chan error, func() error, error) {
+			return py.Run(ctx, filepath.Join(cachePy, "venv"), slices.Clone(cmd), cachePy, filepath.Join(cachePy, "image_gen.log"))
 		}
+		ig.restart = !opts.NoRestart
 		ig.baseURL = fmt.Sprintf("http://localhost:%d", port)
 	} else {
-		if !internal.IsHostPort(opts.Remote) {
-			return nil, fmt.Errorf("invalid remote %q; use form 'host:port'", opts.Remote)
+		if !internal.IsHostPort(remote) {
+			return nil, fmt.Errorf("invalid remote %q; use form 'host:port'", remote)
 		}
-		ig.baseURL = "http://" + opts.Remote
+		ig.baseURL = "http://" + remote
+		ig.auth = opts.Auth.header()
 	}
 
+	var p *process
+	if ig.launch != nil {
+		var err error
+		if p, err = ig.startProcess(ctx); err != nil {
+			return nil, err
+		}
+	}
 	slog.Info("ig", "state", "started", "url", ig.baseURL, "message", "Please be patient, it can take several minutes to download everything")
+	if err := ig.waitReady(ctx, p, opts.LoRAs); err != nil {
+		return nil, err
+	}
+	if ig.device.Device == "cpu" {
+		slog.Warn("ig", "message", "NO GPU DETECTED: the image server is running on the CPU, image generation will be very slow")
+	}
+	ig.touch()
+	if p != nil {
+		go ig.monitor(ctx, p, opts.LoRAs)
+		if opts.IdleTimeout > 0 {
+			go ig.unloadWhenIdle(ctx, opts.IdleTimeout)
+		}
+	}
+	return ig, nil
+}
+
+// process is our own server process.
+type process struct {
+	cancel func() error
+	// exited is closed when the process exits; err is then its exit status.
+	exited chan struct{}
+	err    error
+	// stopped is set when it was stopped on purpose, i.e. unloaded while
+	// idle. It is protected by Session.mu.
+	stopped bool
+}
+
+// startProcess starts our own server.
+func (ig *Session) startProcess(ctx context.Context) (*process, error) {
+	done, cancel, err := ig.launch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := &process{cancel: cancel, exited: make(chan struct{})}
+	ig.mu.Lock()
+	closing := ig.closing
+	if !closing {
+		ig.proc = p
+	}
+	ig.mu.Unlock()
+	go func() {
+		p.err = <-done
+		ig.mu.Lock()
+		if !ig.closing && !p.stopped {
+			ig.down = crashError(ig.restart, p.err)
+		}
+		ig.mu.Unlock()
+		close(p.exited)
+	}()
+	if closing {
+		// Close was called while restarting.
+		_ = cancel()
+		<-p.exited
+		return nil, errors.New("image server closed")
+	}
+	return p, nil
+}
+
+// waitReady waits for the server to be healthy. p is our own server process,
+// if any.
+func (ig *Session) waitReady(ctx context.Context, p *process, loras []LoRA) error {
+	var exited <-chan struct{}
+	if p != nil {
+		exited = p.exited
+	}
 	for ctx.Err() == nil {
-		r := struct {
-			Status string
-		}{}
-		if err := internal.JSONGet(ctx, ig.baseURL+"/health", &r); err == nil && r.Status == "ok" {
+		r := healthResponse{}
+		err := internal.JSONGet(ctx, ig.baseURL+"/health", ig.auth, &r)
+		if err == nil && r.Status == "ok" {
+			ig.mu.Lock()
+			ig.device = r.Device
+			ig.loras = availableLoRAs(loras, r.LoRAs)
+			ig.samplers = r.Samplers
+			ig.down = nil
+			ig.mu.Unlock()
 			break
 		}
+		// Connection errors are retried since the server may still be starting
+		// but there's no point in retrying with invalid credentials.
+		if internal.IsUnauthorized(err) {
+			return fmt.Errorf("image server %s rejected the authentication; check bot.image_gen.auth: %w", ig.baseURL, err)
+		}
 		select {
-		case err := <-ig.done:
-			return nil, fmt.Errorf("failed to start: %w", err)
+		case <-exited:
+			return fmt.Errorf("failed to start: %w", p.err)
 		case <-ctx.Done():
 		case <-time.After(100 * time.Millisecond):
 		}
 	}
-	slog.Info("ig", "state", "ready")
-	return ig, nil
+	dev := ig.Device()
+	slog.Info("ig", "state", "ready", "device", dev.String())
+	return nil
+}
+
+// monitor waits for our own server to exit. When it dies unexpectedly, it is
+// restarted unless disabled. A server failing to restart is not retried, to
+// not loop on a persistent failure.
+func (ig *Session) monitor(ctx context.Context, p *process, loras []LoRA) {
+	for {
+		<-p.exited
+		ig.mu.Lock()
+		expected := ig.closing || p.stopped
+		ig.mu.Unlock()
+		if expected || ctx.Err() != nil {
+			return
+		}
+		if !ig.restart {
+			slog.Error("ig", "message", "image server died", "error", p.err)
+			return
+		}
+		slog.Error("ig", "message", "image server died, restarting", "error", p.err)
+		var err error
+		if p, err = ig.startProcess(ctx); err == nil {
+			err = ig.waitReady(ctx, p, loras)
+		}
+		if err != nil {
+			slog.Error("ig", "message", "failed to restart the image server", "error", err)
+			ig.mu.Lock()
+			if !ig.closing {
+				ig.down = fmt.Errorf("%w: failed to restart: %v", ErrServerCrashed, err)
+			}
+			ig.mu.Unlock()
+			return
+		}
+	}
+}
+
+// crashError returns the error for the requests while our own server is
+// dead.
+func crashError(restart bool, err error) error {
+	if restart {
+		return fmt.Errorf("%w (%v); it is restarting, retry in a moment", ErrServerCrashed, err)
+	}
+	return fmt.Errorf("%w: %v", ErrServerCrashed, err)
+}
+
+// acquire registers a request in flight, reloading our own server first if
+// it was unloaded while idle. Call release once done.
+//
+// It returns the channel closed when our own server exits, nil when using a
+// remote server, or the error to fail the request with while our own server
+// is dead.
+func (ig *Session) acquire() (<-chan struct{}, error) {
+	for {
+		if err := ig.Load(); err != nil {
+			return nil, err
+		}
+		ig.mu.Lock()
+		if !ig.unloaded {
+			break
+		}
+		// Unloaded again in the meantime.
+		ig.mu.Unlock()
+	}
+	defer ig.mu.Unlock()
+	if ig.down != nil {
+		return nil, ig.down
+	}
+	ig.inflight++
+	if ig.proc == nil {
+		return nil, nil
+	}
+	return ig.proc.exited, nil
+}
+
+// release unregisters a request in flight.
+func (ig *Session) release() {
+	ig.touch()
+	ig.mu.Lock()
+	ig.inflight--
+	ig.mu.Unlock()
+}
+
+// Loaded returns false when our own server was unloaded after being idle. It
+// is started again by Load or on the next request.
+func (ig *Session) Loaded() bool {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	return !ig.unloaded
+}
+
+// Load starts our own server again if it was unloaded after being idle. It
+// is a no-op otherwise. It can take a while to load the model.
+func (ig *Session) Load() error {
+	ig.touch()
+	if ig.Loaded() {
+		return nil
+	}
+	ig.loadMu.Lock()
+	defer ig.loadMu.Unlock()
+	if ig.Loaded() {
+		return nil
+	}
+	slog.Info("ig", "state", "reloading")
+	p, err := ig.startProcess(ig.ctx)
+	if err == nil {
+		err = ig.waitReady(ig.ctx, p, ig.configuredLoRAs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reload the image server: %w", err)
+	}
+	ig.mu.Lock()
+	ig.unloaded = false
+	ig.mu.Unlock()
+	go ig.monitor(ig.ctx, p, ig.configuredLoRAs)
+	return nil
+}
+
+// touch records activity, to postpone unloading our own server.
+func (ig *Session) touch() {
+	ig.lastUsed.Store(time.Now().UnixNano())
+}
+
+// unloadWhenIdle unloads our own server once it was idle for timeout, until
+// ctx is done.
+func (ig *Session) unloadWhenIdle(ctx context.Context, timeout time.Duration) {
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			ig.unloadIfIdle(timeout)
+		}
+	}
+}
+
+// unloadIfIdle stops our own server if it was idle for timeout and no request
+// is in flight. It returns true if the server was unloaded.
+func (ig *Session) unloadIfIdle(timeout time.Duration) bool {
+	idle := func() bool { return time.Since(time.Unix(0, ig.lastUsed.Load())) >= timeout }
+	if !idle() {
+		return false
+	}
+	ig.loadMu.Lock()
+	defer ig.loadMu.Unlock()
+	ig.mu.Lock()
+	p := ig.proc
+	// Don't interfere with a restart after a crash.
+	if p == nil || ig.closing || ig.down != nil || ig.inflight != 0 || !idle() {
+		ig.mu.Unlock()
+		return false
+	}
+	p.stopped = true
+	ig.proc = nil
+	ig.unloaded = true
+	ig.mu.Unlock()
+	slog.Info("ig", "state", "unloading", "idle", timeout)
+	_ = p.cancel()
+	<-p.exited
+	return true
+}
+
+// crashed returns a clear error instead of err when our own server exited
+// while the request was in flight.
+func (ig *Session) crashed(exited <-chan struct{}, err error) error {
+	var h *internal.HTTPError
+	if exited == nil || err == nil || errors.Is(err, context.Canceled) || (errors.As(err, &h) && h.StatusCode < 500) {
+		return err
+	}
+	// The connection is reset slightly before the process exit is noticed.
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		return err
+	}
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	if ig.down != nil {
+		return ig.down
+	}
+	return err
+}
+
+// Device is the compute device used by the image generation server.
+type Device struct {
+	// Device is "cuda", "mps" or "cpu". It is empty when the server doesn't
+	// report it.
+	Device string `json:"device"`
+	// Name is the name of the GPU, when known.
+	Name string `json:"device_name"`
+	// VRAM is the total memory of the GPU in bytes, when known.
+	VRAM int64 `json:"vram"`
+}
+
+// String returns a short description, e.g. "cuda (NVIDIA GeForce RTX 4090,
+// 24.0GiB)".
+func (d *Device) String() string {
+	if d.Device == "" {
+		return "unknown"
+	}
+	var details []string
+	if d.Name != "" {
+		details = append(details, d.Name)
+	}
+	if d.VRAM != 0 {
+		details = append(details, fmt.Sprintf("%.1fGiB", float64(d.VRAM)/(1<<30)))
+	}
+	if len(details) == 0 {
+		return d.Device
+	}
+	return d.Device + " (" + strings.Join(details, ", ") + ")"
+}
+
+// healthResponse is the reply of the /health endpoint.
+type healthResponse struct {
+	Status string `json:"status"`
+	Device
+	// LoRAs is the names of the LoRAs the server can load.
+	LoRAs []string `json:"loras"`
+	// Samplers is the names of the samplers the server supports. It is empty
+	// for older servers.
+	Samplers []string `json:"samplers"`
+}
+
+// availableLoRAs returns the names of the configured LoRAs the server
+// reported. The other ones are logged and ignored.
+func availableLoRAs(configured []LoRA, server []string) []string {
+	var out []string
+	for _, l := range configured {
+		if !slices.Contains(server, l.Name) {
+			slog.Warn("ig", "message", "lora not loaded by the server; ignoring", "lora", l.Name)
+			continue
+		}
+		out = append(out, l.Name)
+	}
+	return out
 }
 
 func (ig *Session) Close() error {
-	if ig.cancel == nil {
+	ig.mu.Lock()
+	ig.closing = true
+	p := ig.proc
+	ig.mu.Unlock()
+	if p == nil {
 		return nil
 	}
 	slog.Info("ig", "state", "terminating")
-	_ = ig.cancel()
-	return <-ig.done
+	_ = p.cancel()
+	<-p.exited
+	return p.err
+}
+
+// Output returns how the images should be encoded before being sent to the
+// users.
+func (ig *Session) Output() *OutputOptions {
+	return &ig.output
+}
+
+// Device returns the compute device used by the server, as reported on
+// startup.
+func (ig *Session) Device() Device {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	return ig.device
+}
+
+// Watermark returns the watermark added onto the generated images.
+func (ig *Session) Watermark() *WatermarkOptions {
+	return &ig.watermark
+}
+
+// LoRAs returns the names of the LoRAs that can be selected with
+// GenOptions.LoRA.
+func (ig *Session) LoRAs() []string {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	return slices.Clone(ig.loras)
+}
+
+// Samplers returns the names of the samplers that can be selected with
+// GenOptions.Sampler, e.g. "euler_a".
+func (ig *Session) Samplers() []string {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	return slices.Clone(ig.samplers)
+}
+
+// Steps returns the number of inference steps used when not overridden with
+// GenOptions.Steps.
+func (ig *Session) Steps() int {
+	return ig.steps
+}
+
+// GetHealth retrieves the health of the server, e.g. "ok".
+func (ig *Session) GetHealth(ctx context.Context) (string, error) {
+	if !ig.Loaded() {
+		return "unloaded while idle", nil
+	}
+	r := healthResponse{}
+	err := internal.JSONGet(ctx, ig.baseURL+"/health", ig.auth, &r)
+	return r.Status, err
+}
+
+// GenOptions are optional image generation parameters. The zero value uses
+// the server's defaults.
+type GenOptions struct {
+	// Steps is the number of inference steps.
+	Steps int
+	// Width and Height are the image dimensions in pixels. Both must be set to
+	// take effect.
+	Width  int
+	Height int
+	// NegativePrompt describes what should not be in the image. The default
+	// LCM LoRA pipeline enables a light guidance when it is set, which is
+	// slightly slower.
+	NegativePrompt string
+	// NoWatermark skips adding the watermark configured in Options.Watermark.
+	// Use AddWatermarkWithOptions to add it with a custom text instead.
+	NoWatermark bool
+	// BaseImage is an encoded image (PNG, JPEG, GIF or WebP) to remix instead
+	// of starting from noise, also known as img2img. It is resized to Width
+	// and Height.
+	BaseImage []byte
+	// Strength is how much BaseImage is transformed, between 0 and 1. A low
+	// value stays close to the base image. Only used with BaseImage.
+	Strength float64
+	// LoRA is the name of an additional LoRA to apply, one of Session.LoRAs.
+	LoRA string
+	// LoRAWeight is how strongly LoRA is applied, between 0 and 2. Defaults
+	// to 1 when nil. Only used with LoRA.
+	LoRAWeight *float64
+	// Sampler is the name of the sampler, also known as the scheduler, one of
+	// Session.Samplers. Defaults to the server's.
+	Sampler string
+
+	_ struct{}
+}
+
+// validate checks the options the server can't be trusted to reject.
+func (ig *Session) validate(opts *GenOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.Sampler != "" {
+		if samplers := ig.Samplers(); !slices.Contains(samplers, opts.Sampler) {
+			if len(samplers) == 0 {
+				return fmt.Errorf("unknown sampler %q; the image server doesn't support selecting the sampler", opts.Sampler)
+			}
+			return fmt.Errorf("unknown sampler %q; available: %s", opts.Sampler, strings.Join(samplers, ", "))
+		}
+	}
+	if opts.LoRA == "" {
+		return nil
+	}
+	if loras := ig.LoRAs(); !slices.Contains(loras, opts.LoRA) {
+		if len(loras) == 0 {
+			return fmt.Errorf("unknown lora %q; no lora is available", opts.LoRA)
+		}
+		return fmt.Errorf("unknown lora %q; available: %s", opts.LoRA, strings.Join(loras, ", "))
+	}
+	if w := opts.LoRAWeight; w != nil && (*w < 0 || *w > 2) {
+		return fmt.Errorf("invalid lora weight %g; must be between 0 and 2", *w)
+	}
+	return nil
 }
 
 // GenImage returns an image based on the prompt.
 //
 // Use a non-zero seed to get deterministic output (without strong guarantees).
-func (ig *Session) GenImage(ctx context.Context, prompt string, seed int) (*image.NRGBA, error) {
+//
+// opts is optional.
+func (ig *Session) GenImage(ctx context.Context, prompt string, seed int, opts *GenOptions) (*image.NRGBA, error) {
+	start := time.Now()
+	exited, err := ig.acquire()
+	if err != nil {
+		observe(start, err)
+		return nil, err
+	}
+	defer ig.release()
+	var img *image.NRGBA
+	err = ig.withTimeout(ctx, func(ctx context.Context) (err error) {
+		img, err = ig.genImage(ctx, prompt, seed, opts)
+		return err
+	})
+	err = ig.crashed(exited, err)
+	observe(start, err)
+	return img, err
+}
+
+func (ig *Session) genImage(ctx context.Context, prompt string, seed int, opts *GenOptions) (*image.NRGBA, error) {
 	start := time.Now()
 	slog.Info("ig", "prompt", prompt)
-	// If you feel this API is subpar, I hear you. If you got this far to read
-	// this comment, please send a PR to make this a proper API and update
-	// image_gen.py. ❤
-	data := struct {
-		Message string `json:"message"`
-		Steps   int    `json:"steps"`
-		Seed    int    `json:"seed"`
-	}{Message: prompt, Steps: ig.steps, Seed: seed}
+	if err := ig.validate(opts); err != nil {
+		return nil, err
+	}
+	data := ig.genRequest(prompt, seed, opts)
 	r := struct {
 		Image []byte `json:"image"`
 	}{}
-	if err := internal.JSONPost(ctx, ig.baseURL+"/api/generate", data, &r); err != nil {
+	err := ig.retry(ctx, func() error {
+		return internal.JSONPost(ctx, ig.baseURL+"/api/generate", ig.auth, data, &r)
+	})
+	if err != nil {
 		slog.Error("ig", "prompt", prompt, "error", err, "duration", time.Since(start).Round(time.Millisecond))
+		if internal.IsUnauthorized(err) {
+			return nil, fmt.Errorf("image server rejected the authentication: %w", err)
+		}
+		var h *internal.HTTPError
+		if errors.As(err, &h) && h.Message != "" {
+			return nil, serverError(h.Message, h.Kind)
+		}
 		return nil, fmt.Errorf("failed to create image request: %w", err)
 	}
 	slog.Info("ig", "prompt", prompt, "duration", time.Since(start).Round(time.Millisecond))
+	return ig.finishImage(r.Image, opts)
+}
+
+// Progress is the progress of an image generation.
+type Progress struct {
+	// Step is the inference step just completed, starting at 1.
+	Step int
+	// Steps is the total number of inference steps.
+	Steps int
+}
+
+// GenImageStream is like GenImage but reports the progress in the supplied
+// channel after each inference step.
+//
+// If the server doesn't support streaming, e.g. an older remote server, it
+// falls back to GenImage without reporting progress.
+func (ig *Session) GenImageStream(ctx context.Context, prompt string, seed int, opts *GenOptions, progress chan<- Progress) (*image.NRGBA, error) {
+	start := time.Now()
+	exited, err := ig.acquire()
+	if err != nil {
+		observe(start, err)
+		return nil, err
+	}
+	defer ig.release()
+	var img *image.NRGBA
+	err = ig.withTimeout(ctx, func(ctx context.Context) (err error) {
+		img, err = ig.genImageStream(ctx, prompt, seed, opts, progress)
+		return err
+	})
+	err = ig.crashed(exited, err)
+	observe(start, err)
+	return img, err
+}
+
+func (ig *Session) genImageStream(ctx context.Context, prompt string, seed int, opts *GenOptions, progress chan<- Progress) (*image.NRGBA, error) {
+	start := time.Now()
+	slog.Info("ig", "prompt", prompt, "type", "streaming")
+	if err := ig.validate(opts); err != nil {
+		return nil, err
+	}
+	data := ig.genRequest(prompt, seed, opts)
+	url := ig.baseURL + "/api/generate_stream"
+	var resp *http.Response
+	err := ig.retry(ctx, func() error {
+		var err error
+		if resp, err = internal.JSONPostRequest(ctx, url, ig.auth, data); err != nil {
+			return err
+		}
+		if resp.StatusCode >= 500 {
+			err = internal.NewHTTPError(url, resp)
+			_ = resp.Body.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		var h *internal.HTTPError
+		if errors.As(err, &h) && h.Message != "" {
+			return nil, serverError(h.Message, h.Kind)
+		}
+		return nil, fmt.Errorf("failed to create image request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		slog.Warn("ig", "message", "server doesn't support streaming")
+		return ig.genImage(ctx, prompt, seed, opts)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = &internal.HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+		if internal.IsUnauthorized(err) {
+			return nil, fmt.Errorf("image server rejected the authentication: %w", err)
+		}
+		return nil, fmt.Errorf("failed to create image request: %w", err)
+	}
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil, errors.New("image server closed the stream without an image")
+			}
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image server response: %w", err)
+		}
+		if len(line) == 0 {
+			continue
+		}
+		const prefix = "data: "
+		if !bytes.HasPrefix(line, []byte(prefix)) {
+			return nil, fmt.Errorf("unexpected line. expected \"data: \", got %q", line)
+		}
+		d := json.NewDecoder(bytes.NewReader(line[len(prefix):]))
+		d.DisallowUnknownFields()
+		msg := struct {
+			Step  int    `json:"step"`
+			Steps int    `json:"steps"`
+			Image []byte `json:"image"`
+			Error string `json:"error"`
+			Kind  string `json:"kind"`
+		}{}
+		if err = d.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("failed to decode image server response: %w", err)
+		}
+		if msg.Error != "" {
+			slog.Error("ig", "prompt", prompt, "error", msg.Error, "kind", msg.Kind, "duration", time.Since(start).Round(time.Millisecond))
+			return nil, serverError(msg.Error, msg.Kind)
+		}
+		if len(msg.Image) != 0 {
+			slog.Info("ig", "prompt", prompt, "duration", time.Since(start).Round(time.Millisecond))
+			return ig.finishImage(msg.Image, opts)
+		}
+		select {
+		case progress <- Progress{Step: msg.Step, Steps: msg.Steps}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
 
-	img, err := decodePNG(r.Image)
+// Upscale returns the image twice as large, refining the details with an
+// upscaler model guided by the prompt used to generate it.
+//
+// img is an encoded image (PNG, JPEG, GIF or WebP), typically a previously
+// generated one. The watermark is not added again. It returns
+// ErrUpscaleUnavailable if the server doesn't support upscaling.
+func (ig *Session) Upscale(ctx context.Context, img []byte, prompt string) (*image.NRGBA, error) {
+	start := time.Now()
+	exited, err := ig.acquire()
 	if err != nil {
+		observe(start, err)
 		return nil, err
 	}
-	addWatermark(img)
+	defer ig.release()
+	var out *image.NRGBA
+	err = ig.withTimeout(ctx, func(ctx context.Context) (err error) {
+		out, err = ig.upscale(ctx, img, prompt)
+		return err
+	})
+	err = ig.crashed(exited, err)
+	observe(start, err)
+	return out, err
+}
+
+func (ig *Session) upscale(ctx context.Context, img []byte, prompt string) (*image.NRGBA, error) {
+	start := time.Now()
+	slog.Info("ig", "prompt", prompt, "type", "upscale")
+	data := struct {
+		Message string `json:"message"`
+		Image   []byte `json:"image"`
+	}{Message: prompt, Image: img}
+	r := struct {
+		Image []byte `json:"image"`
+	}{}
+	err := ig.retry(ctx, func() error {
+		return internal.JSONPost(ctx, ig.baseURL+"/api/upscale", ig.auth, &data, &r)
+	})
+	if err != nil {
+		slog.Error("ig", "prompt", prompt, "type", "upscale", "error", err, "duration", time.Since(start).Round(time.Millisecond))
+		if internal.IsUnauthorized(err) {
+			return nil, fmt.Errorf("image server rejected the authentication: %w", err)
+		}
+		var h *internal.HTTPError
+		if errors.As(err, &h) {
+			if h.StatusCode == http.StatusNotFound {
+				return nil, ErrUpscaleUnavailable
+			}
+			if h.Message != "" {
+				return nil, serverError(h.Message, h.Kind)
+			}
+		}
+		return nil, fmt.Errorf("failed to create upscale request: %w", err)
+	}
+	slog.Info("ig", "prompt", prompt, "type", "upscale", "duration", time.Since(start).Round(time.Millisecond))
+	return decodePNG(r.Image)
+}
+
+// withTimeout calls fn with a context cancelled after the generation
+// timeout. It returns ErrTimeout when the timeout was exceeded.
+//
+// The request to the server is cancelled, so the caller is not blocked by a
+// stuck server.
+func (ig *Session) withTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ig.genTimeout <= 0 {
+		return fn(ctx)
+	}
+	ctx2, cancel := context.WithTimeoutCause(ctx, ig.genTimeout, ErrTimeout)
+	defer cancel()
+	err := fn(ctx2)
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(ctx2), ErrTimeout) {
+		slog.Error("ig", "message", "image generation timed out", "timeout", ig.genTimeout, "error", err)
+		return fmt.Errorf("%w after %s", ErrTimeout, ig.genTimeout)
+	}
+	return err
+}
+
+// retryDelay is the delay before the first retry. It doubles after each
+// attempt.
+var retryDelay = 500 * time.Millisecond
+
+// retry calls fn up to maxAttempts times while it returns a transient error,
+// e.g. when the server is restarting.
+//
+// It doesn't retry past the context's deadline.
+func (ig *Session) retry(ctx context.Context, fn func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= ig.maxAttempts || !internal.IsTransient(err) {
+			return err
+		}
+		if d, ok := ctx.Deadline(); ok && time.Until(d) < delay {
+			return err
+		}
+		slog.Warn("ig", "message", "retrying image request", "attempt", attempt, "max_attempts", ig.maxAttempts, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+var (
+	genLatency = metrics.NewHistogram("sillybot_image_generation_seconds", "Duration of the successful image generations, including the retries.", metrics.DefaultBuckets)
+	genErrors  = metrics.NewCounterVec("sillybot_image_generation_errors_total", "Failed image generations by kind.", "kind")
+)
+
+// observe records the outcome of an image generation in the metrics.
+func observe(start time.Time, err error) {
+	if err == nil {
+		genLatency.ObserveDuration(time.Since(start))
+		return
+	}
+	genErrors.IncWith(errorKind(err))
+}
+
+// errorKind classifies an image generation error for the metrics.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrOutOfMemory):
+		return "out_of_memory"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrServerCrashed):
+		return "crashed"
+	case internal.IsUnauthorized(err):
+		return "unauthorized"
+	case internal.IsTransient(err):
+		return "unavailable"
+	default:
+		return "other"
+	}
+}
+
+// serverError returns the error for a generation failure reported by the
+// server. The traceback is in the server's log, image_gen.log for our own
+// server.
+func serverError(msg, kind string) error {
+	if kind == "out_of_memory" {
+		return fmt.Errorf("%w: %s", ErrOutOfMemory, msg)
+	}
+	return fmt.Errorf("image generation failed: %s", msg)
+}
+
+// genRequest is the request sent to image_gen.py.
+type genRequest struct {
+	Message        string   `json:"message"`
+	Steps          int      `json:"steps"`
+	Seed           int      `json:"seed"`
+	Width          int      `json:"width,omitempty"`
+	Height         int      `json:"height,omitempty"`
+	NegativePrompt string   `json:"negative_prompt,omitempty"`
+	BaseImage      []byte   `json:"base_image,omitempty"`
+	Strength       float64  `json:"strength,omitempty"`
+	LoRA           string   `json:"lora,omitempty"`
+	LoRAWeight     *float64 `json:"lora_weight,omitempty"`
+	Sampler        string   `json:"sampler,omitempty"`
+}
+
+func (ig *Session) genRequest(prompt string, seed int, opts *GenOptions) *genRequest {
+	// If you feel this API is subpar, I hear you. If you got this far to read
+	// this comment, please send a PR to make this a proper API and update
+	// image_gen.py. ❤
+	data := &genRequest{Message: prompt, Steps: ig.steps, Seed: seed}
+	if opts != nil {
+		if opts.Steps != 0 {
+			data.Steps = opts.Steps
+		}
+		if opts.Width != 0 && opts.Height != 0 {
+			data.Width = opts.Width
+			data.Height = opts.Height
+		}
+		data.NegativePrompt = opts.NegativePrompt
+		if len(opts.BaseImage) != 0 {
+			data.BaseImage = opts.BaseImage
+			data.Strength = opts.Strength
+		}
+		if opts.LoRA != "" {
+			data.LoRA = opts.LoRA
+			data.LoRAWeight = opts.LoRAWeight
+		}
+		data.Sampler = opts.Sampler
+	}
+	return data
+}
+
+// finishImage decodes the PNG returned by the server and adds the watermark
+// unless disabled.
+func (ig *Session) finishImage(b []byte, opts *GenOptions) (*image.NRGBA, error) {
+	img, err := decodePNG(b)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil || !opts.NoWatermark {
+		AddWatermarkWithOptions(img, &ig.watermark)
+	}
 	return img, nil
 }
@@ -5,12 +5,26 @@
 package imagegen
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -41,7 +55,7 @@ func TestImageGen(t *testing.T) {
 			t.Error(err2)
 		}
 	})
-	img, err := s.GenImage(ctx, "cat", 1)
+	img, err := s.GenImage(ctx, "cat", 1, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,6 +78,1036 @@ func TestImageGen_Remote_Fail(t *testing.T) {
 	}
 }
 
+func TestGenImage_BaseImage(t *testing.T) {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	var got genRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+	}))
+	defer srv.Close()
+	s := &Session{baseURL: srv.URL, steps: 8}
+	opts := GenOptions{NoWatermark: true, BaseImage: b.Bytes(), Strength: 0.5}
+	if _, err := s.GenImage(context.Background(), "cat", 1, &opts); err != nil {
+		t.Fatal(err)
+	}
+	want := genRequest{Message: "cat", Steps: 8, Seed: 1, BaseImage: b.Bytes(), Strength: 0.5}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Buffer{}
+	if err := png.Encode(&big, image.NewNRGBA(image.Rect(0, 0, 128, 128))); err != nil {
+		t.Fatal(err)
+	}
+	supported := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/upscale" || !supported {
+			http.NotFound(w, r)
+			return
+		}
+		got := struct {
+			Message string
+			Image   []byte
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if got.Message != "cat" || !bytes.Equal(got.Image, b.Bytes()) {
+			t.Errorf("unexpected request %q", got.Message)
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": big.Bytes()})
+	}))
+	defer srv.Close()
+	s := &Session{baseURL: srv.URL, steps: 8}
+	img, err := s.Upscale(context.Background(), b.Bytes(), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 128, 128) {
+		t.Fatal(img.Bounds())
+	}
+	supported = false
+	if _, err = s.Upscale(context.Background(), b.Bytes(), "cat"); !errors.Is(err, ErrUpscaleUnavailable) {
+		t.Fatal(err)
+	}
+}
+
+func TestImageGen_Auth(t *testing.T) {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "go away", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/health" {
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	remote := strings.TrimPrefix(srv.URL, "http://")
+	// It fails right away instead of waiting for the server to become healthy.
+	opts := Options{Remote: remote, Auth: RemoteAuth{Token: "bad"}}
+	if _, err := New(ctx, t.TempDir(), &opts); err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+	opts = Options{Remote: remote, Auth: RemoteAuth{Token: "secret", User: "ignored"}}
+	s, err := New(ctx, t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); err != nil {
+		t.Fatal(err)
+	}
+	s.auth = ""
+	if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+}
+
+func TestImageGen_Device(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"ok","device":"cuda","device_name":"NVIDIA GeForce RTX 4090","vram":25757220864}`))
+	}))
+	defer srv.Close()
+	opts := Options{Remote: strings.TrimPrefix(srv.URL, "http://")}
+	s, err := New(context.Background(), t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Device{Device: "cuda", Name: "NVIDIA GeForce RTX 4090", VRAM: 25757220864}
+	if diff := cmp.Diff(want, s.Device()); diff != "" {
+		t.Fatal(diff)
+	}
+	if status, err := s.GetHealth(context.Background()); status != "ok" || err != nil {
+		t.Fatal(status, err)
+	}
+}
+
+func TestImageGen_Steps(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	remote := strings.TrimPrefix(srv.URL, "http://")
+	data := []struct {
+		steps int
+		want  int
+	}{
+		{0, 8},
+		{30, 30},
+	}
+	for i, line := range data {
+		s, err := New(ctx, t.TempDir(), &Options{Remote: remote, Steps: line.steps})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Steps(); got != line.want {
+			t.Fatalf("#%d: want %d, got %d", i, line.want, got)
+		}
+	}
+	if _, err := New(ctx, t.TempDir(), &Options{Remote: remote, Steps: -1}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestImageGen_LoRA(t *testing.T) {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	var got genRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			_, _ = w.Write([]byte(`{"status":"ok","loras":["pixel","sketch"]}`))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	remote := strings.TrimPrefix(srv.URL, "http://")
+	opts := Options{Remote: remote, LoRAs: []LoRA{{Name: "pixel"}, {Name: "pixel"}}}
+	if _, err := New(ctx, t.TempDir(), &opts); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+	// "missing" is not loaded by the server so it is ignored and "sketch" is
+	// not in the allowlist.
+	opts = Options{Remote: remote, LoRAs: []LoRA{{Name: "pixel"}, {Name: "missing"}}}
+	s, err := New(ctx, t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"pixel"}, s.LoRAs()); diff != "" {
+		t.Fatal(diff)
+	}
+	tooStrong, weight, zero := 3., 0.8, 0.
+	data := []struct {
+		opts GenOptions
+		err  string
+	}{
+		{GenOptions{LoRA: "sketch"}, `unknown lora "sketch"; available: pixel`},
+		{GenOptions{LoRA: "missing"}, `unknown lora "missing"; available: pixel`},
+		{GenOptions{LoRA: "pixel", LoRAWeight: &tooStrong}, "invalid lora weight 3; must be between 0 and 2"},
+	}
+	for i, line := range data {
+		if _, err := s.GenImage(ctx, "cat", 1, &line.opts); err == nil || err.Error() != line.err {
+			t.Errorf("#%d: want %q, got %v", i, line.err, err)
+		}
+	}
+	if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true, LoRA: "pixel", LoRAWeight: &weight}); err != nil {
+		t.Fatal(err)
+	}
+	want := genRequest{Message: "cat", Steps: 8, Seed: 1, LoRA: "pixel", LoRAWeight: &weight}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	// A weight of 0 is sent, unlike the default one.
+	for _, w := range []*float64{&zero, nil} {
+		got = genRequest{}
+		if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true, LoRA: "pixel", LoRAWeight: w}); err != nil {
+			t.Fatal(err)
+		}
+		want = genRequest{Message: "cat", Steps: 8, Seed: 1, LoRA: "pixel", LoRAWeight: w}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+}
+
+func TestImageGen_Sampler(t *testing.T) {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	health := `{"status":"ok","samplers":["euler_a","lcm"]}`
+	var got genRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			_, _ = w.Write([]byte(health))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	opts := Options{Remote: strings.TrimPrefix(srv.URL, "http://")}
+	s, err := New(ctx, t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"euler_a", "lcm"}, s.Samplers()); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{Sampler: "ddim"}); err == nil || err.Error() != `unknown sampler "ddim"; available: euler_a, lcm` {
+		t.Fatal(err)
+	}
+	if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true, Sampler: "euler_a"}); err != nil {
+		t.Fatal(err)
+	}
+	want := genRequest{Message: "cat", Steps: 8, Seed: 1, Sampler: "euler_a"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	// An older server doesn't advertise any.
+	health = `{"status":"ok"}`
+	if s, err = New(ctx, t.TempDir(), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GenImage(ctx, "cat", 1, &GenOptions{Sampler: "euler_a"}); err == nil || err.Error() != `unknown sampler "euler_a"; the image server doesn't support selecting the sampler` {
+		t.Fatal(err)
+	}
+}
+
+func TestImageGen_Safety(t *testing.T) {
+	score := 0.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+			return
+		}
+		in := struct {
+			Image []byte `json:"image"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Error(err)
+		}
+		if _, err := png.Decode(bytes.NewReader(in.Image)); err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]float64{"score": score})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	remote := strings.TrimPrefix(srv.URL, "http://")
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	data := []struct {
+		safety SafetyOptions
+		score  float64
+		want   bool
+	}{
+		{SafetyOptions{URL: srv.URL + "/classify"}, 1, false},
+		{SafetyOptions{Enabled: true, URL: srv.URL + "/classify"}, 0.2, false},
+		{SafetyOptions{Enabled: true, URL: srv.URL + "/classify"}, 0.5, true},
+		{SafetyOptions{Enabled: true, URL: srv.URL + "/classify", Threshold: 0.9}, 0.8, false},
+	}
+	for i, line := range data {
+		s, err := New(ctx, t.TempDir(), &Options{Remote: remote, Safety: line.safety})
+		if err != nil {
+			t.Fatal(err)
+		}
+		score = line.score
+		got, err := s.Unsafe(ctx, img)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if got != line.want {
+			t.Fatalf("#%d: want %t, got %t", i, line.want, got)
+		}
+	}
+	for i, o := range []SafetyOptions{{Threshold: 2}, {Enabled: true}, {Enabled: true, URL: "localhost:8040"}} {
+		if _, err := New(ctx, t.TempDir(), &Options{Remote: remote, Safety: o}); err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+	s, err := New(ctx, t.TempDir(), &Options{Remote: remote, Safety: SafetyOptions{Enabled: true, URL: srv.URL + "/missing/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	if _, err := s.Unsafe(ctx, img); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestObscure(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 10, 110, 60))
+	for x := 10; x < 110; x++ {
+		for y := 10; y < 60; y++ {
+			v := uint8(255 * (x % 2))
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	got := Obscure(img)
+	if b := got.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Fatal(b)
+	}
+	// The alternating columns are averaged away.
+	if c := got.NRGBAAt(50, 25); c.R < 64 || c.R > 192 {
+		t.Fatal(c)
+	}
+}
+
+func TestImageGen_Restart(t *testing.T) {
+	for _, restart := range []bool{true, false} {
+		t.Run(fmt.Sprintf("restart=%t", restart), func(t *testing.T) {
+			testRestart(t, restart)
+		})
+	}
+}
+
+func testRestart(t *testing.T, restart bool) {
+	f := newFakeLocal(t, restart)
+	ig := f.ig
+	ctx := context.Background()
+	if _, err := ig.GenImage(ctx, "cat", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash it while the restarted server is not ready yet.
+	f.ready.Store(false)
+	f.proc(0) <- errors.New("signal: killed")
+	waitFor(t, func() bool { return ig.downErr() != nil })
+	_, err := ig.GenImage(ctx, "cat", 1, nil)
+	if !errors.Is(err, ErrServerCrashed) {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	if got := strings.Contains(err.Error(), "restarting"); got != restart {
+		t.Fatalf("unexpected error %q", err)
+	}
+	f.ready.Store(true)
+	if restart {
+		waitFor(t, func() bool { return ig.downErr() == nil })
+		if _, err = ig.GenImage(ctx, "cat", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	} else if _, err = ig.GenImage(ctx, "cat", 1, nil); !errors.Is(err, ErrServerCrashed) {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	want := 1
+	if restart {
+		want = 2
+	}
+	if got := f.launched(); got != want {
+		t.Fatalf("want %d launches, got %d", want, got)
+	}
+	if err = ig.Close(); err == nil {
+		t.Fatal("expected exit status")
+	}
+}
+
+func TestImageGen_IdleTimeout(t *testing.T) {
+	f := newFakeLocal(t, true)
+	ig := f.ig
+	ctx := context.Background()
+	if ig.unloadIfIdle(time.Hour) {
+		t.Fatal("expected to stay loaded")
+	}
+	// A request in flight prevents unloading.
+	if _, err := ig.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	ig.lastUsed.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if ig.unloadIfIdle(time.Hour) {
+		t.Fatal("expected to stay loaded")
+	}
+	ig.release()
+	ig.lastUsed.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if !ig.unloadIfIdle(time.Hour) {
+		t.Fatal("expected to be unloaded")
+	}
+	if ig.Loaded() {
+		t.Fatal("expected unloaded")
+	}
+	if status, err := ig.GetHealth(ctx); err != nil || status != "unloaded while idle" {
+		t.Fatal(status, err)
+	}
+	// Stopping it on purpose is not a crash.
+	if err := ig.downErr(); err != nil {
+		t.Fatal(err)
+	}
+	// The next request starts it again.
+	if _, err := ig.GenImage(ctx, "cat", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !ig.Loaded() || f.launched() != 2 {
+		t.Fatalf("expected reloaded, launched %d", f.launched())
+	}
+	if err := ig.Close(); err == nil {
+		t.Fatal("expected exit status")
+	}
+	if _, err := New(ctx, t.TempDir(), &Options{Remote: "localhost:1", IdleTimeout: -time.Second}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// fakeLocal is our own server started with fake python processes.
+type fakeLocal struct {
+	ig *Session
+	// ready is false to make the server unhealthy.
+	ready atomic.Bool
+	mu    sync.Mutex
+	procs []chan error
+}
+
+func newFakeLocal(t *testing.T, restart bool) *fakeLocal {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLocal{}
+	f.ready.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/health" {
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+	}))
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+	f.ig = &Session{baseURL: srv.URL, ctx: ctx, steps: 8, maxAttempts: 1, restart: restart}
+	f.ig.launch = func(ctx context.Context) (<-chan error, func() error, error) {
+		done := make(chan error, 2)
+		f.mu.Lock()
+		f.procs = append(f.procs, done)
+		f.mu.Unlock()
+		return done, func() error {
+			done <- errors.New("signal: interrupt")
+			return nil
+		}, nil
+	}
+	p, err := f.ig.startProcess(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.ig.waitReady(ctx, p, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.ig.touch()
+	go f.ig.monitor(ctx, p, nil)
+	return f
+}
+
+// proc returns the exit channel of the i-th process launched.
+func (f *fakeLocal) proc(i int) chan error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.procs[i]
+}
+
+func (f *fakeLocal) launched() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.procs)
+}
+
+// downErr returns the error returned while our own server is dead.
+func (ig *Session) downErr() error {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	return ig.down
+}
+
+// waitFor polls until cond is true.
+func waitFor(t *testing.T, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestDevice_String(t *testing.T) {
+	data := []struct {
+		in   Device
+		want string
+	}{
+		{Device{}, "unknown"},
+		{Device{Device: "cpu"}, "cpu"},
+		{Device{Device: "cuda", Name: "NVIDIA GeForce RTX 4090", VRAM: 24 << 30}, "cuda (NVIDIA GeForce RTX 4090, 24.0GiB)"},
+	}
+	for i, line := range data {
+		if got := line.in.String(); got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestGenImage_Retry(t *testing.T) {
+	old := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = old }()
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls < 3 {
+			http.Error(w, "restarting", status)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	s := &Session{baseURL: srv.URL, steps: 1, maxAttempts: 3}
+	if _, err := s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+	// Client errors are not retried.
+	calls = 0
+	status = http.StatusBadRequest
+	if _, err := s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	// It gives up after maxAttempts.
+	calls = 0
+	status = http.StatusInternalServerError
+	s.maxAttempts = 2
+	if _, err := s.GenImageStream(ctx, "cat", 1, &GenOptions{NoWatermark: true}, make(chan Progress)); err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+	// It doesn't retry past the deadline.
+	calls = 0
+	retryDelay = time.Hour
+	s.maxAttempts = 3
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if _, err := s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestGenImage_ServerError(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/api/generate_stream":
+			fmt.Fprint(w, "data: {\"step\":1,\"steps\":3}\n\n")
+			fmt.Fprint(w, "data: {\"error\":\"CUDA out of memory.\",\"kind\":\"out_of_memory\"}\n\n")
+		case "/api/generate":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"width must be divisible by 8","kind":"bad_request"}`))
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	s := &Session{baseURL: srv.URL, steps: 3, maxAttempts: 3}
+	_, err := s.GenImageStream(ctx, "cat", 1, &GenOptions{NoWatermark: true}, make(chan Progress, 10))
+	if !errors.Is(err, ErrOutOfMemory) {
+		t.Fatal(err)
+	}
+	// The failures reported by the server are not retried.
+	calls = 0
+	_, err = s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true})
+	if err == nil || err.Error() != "image generation failed: width must be divisible by 8" {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestRemoteAuth(t *testing.T) {
+	data := []struct {
+		auth RemoteAuth
+		want string
+	}{
+		{RemoteAuth{}, ""},
+		{RemoteAuth{Token: "t", User: "u"}, "Bearer t"},
+		{RemoteAuth{User: "u", Password: "p"}, "Basic dTpw"},
+	}
+	for i, line := range data {
+		if got := line.auth.header(); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestGenImageStream(t *testing.T) {
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	streaming := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/generate_stream" && streaming:
+			for i := 1; i <= 3; i++ {
+				fmt.Fprintf(w, "data: {\"step\":%d,\"steps\":3}\n\n", i)
+			}
+			d, _ := json.Marshal(map[string][]byte{"image": b.Bytes()})
+			fmt.Fprintf(w, "data: %s\n\n", d)
+		case r.URL.Path == "/api/generate":
+			_ = json.NewEncoder(w).Encode(map[string][]byte{"image": b.Bytes()})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	s := &Session{baseURL: srv.URL, steps: 3}
+	for _, streaming = range []bool{true, false} {
+		progress := make(chan Progress, 10)
+		img, err := s.GenImageStream(context.Background(), "cat", 1, &GenOptions{NoWatermark: true}, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 64, 64) {
+			t.Fatal(img.Bounds())
+		}
+		close(progress)
+		var got []Progress
+		for p := range progress {
+			got = append(got, p)
+		}
+		var want []Progress
+		if streaming {
+			want = []Progress{{1, 3}, {2, 3}, {3, 3}}
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+}
+
+func TestGenImage_Timeout(t *testing.T) {
+	stuck := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/generate_stream" {
+			// The server is stuck after the first step.
+			fmt.Fprint(w, "data: {\"step\":1,\"steps\":3}\n\n")
+			w.(http.Flusher).Flush()
+		}
+		<-stuck
+	}))
+	defer srv.Close()
+	defer close(stuck)
+	s := &Session{baseURL: srv.URL, steps: 3, maxAttempts: 3, genTimeout: 50 * time.Millisecond}
+	ctx := context.Background()
+	if _, err := s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); !errors.Is(err, ErrTimeout) {
+		t.Fatal(err)
+	}
+	if _, err := s.GenImageStream(ctx, "cat", 1, &GenOptions{NoWatermark: true}, make(chan Progress, 10)); !errors.Is(err, ErrTimeout) {
+		t.Fatal(err)
+	}
+	// A cancellation by the caller is not a timeout.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.GenImage(ctx, "cat", 1, &GenOptions{NoWatermark: true}); err == nil || errors.Is(err, ErrTimeout) {
+		t.Fatal(err)
+	}
+}
+
+func TestOutputOptions(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for _, o := range []OutputOptions{{}, {Format: "png"}, {Format: "jpeg"}, {Format: "jpeg", JPEGQuality: 50}} {
+		if err := o.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		b := bytes.Buffer{}
+		if err := o.Encode(&b, img); err != nil {
+			t.Fatal(err)
+		}
+		_, format, err := image.DecodeConfig(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.TrimPrefix(o.ContentType(), "image/"); format != want {
+			t.Fatalf("want %s, got %s", want, format)
+		}
+	}
+	for _, o := range []OutputOptions{{Format: "webp"}, {Format: "gif"}, {Format: "jpeg", JPEGQuality: 101}} {
+		if err := o.Validate(); err == nil {
+			t.Fatalf("%+v: expected error", o)
+		}
+	}
+}
+
+func TestOutputOptions_EncodeWithin(t *testing.T) {
+	// Noise doesn't compress well.
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7919 >> 3)
+	}
+	for _, o := range []OutputOptions{{Format: "png"}, {Format: "jpeg"}} {
+		b := bytes.Buffer{}
+		if err := o.Encode(&b, img); err != nil {
+			t.Fatal(err)
+		}
+		full := b.Len()
+		got, err := o.EncodeWithin(img, 0)
+		if err != nil || len(got) != full {
+			t.Fatal(len(got), err)
+		}
+		limit := full / 3
+		if got, err = o.EncodeWithin(img, limit); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) > limit {
+			t.Fatalf("%s: %d > %d", o.Format, len(got), limit)
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.TrimPrefix(o.ContentType(), "image/"); format != want {
+			t.Fatalf("want %s, got %s", want, format)
+		}
+		if cfg.Width > 512 || cfg.Width != cfg.Height {
+			t.Fatalf("%s: unexpected size %dx%d", o.Format, cfg.Width, cfg.Height)
+		}
+		if _, err = o.EncodeWithin(img, 100); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func TestEmbedParams(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadParams(b.Bytes()); !errors.Is(err, ErrNoParams) {
+		t.Fatal(err)
+	}
+	want := Params{Prompt: "a cat", Seed: 42, Steps: 8, Width: 16, Height: 16, Sampler: "euler", Labels: "hi"}
+	out, err := EmbedParams(b.Bytes(), &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The image is still valid.
+	if _, err = png.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadParams(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	// Other formats are left as is.
+	o := OutputOptions{Format: "jpeg"}
+	b.Reset()
+	if err = o.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = EmbedParams(b.Bytes(), &want); err != nil || !bytes.Equal(out, b.Bytes()) {
+		t.Fatal(err)
+	}
+	if _, err = ReadParams(out); !errors.Is(err, ErrNoParams) {
+		t.Fatal(err)
+	}
+}
+
+func TestAddWatermark(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	AddWatermark(img, "")
+	without := slices.Clone(img.Pix)
+	AddWatermark(img, "hello")
+	if slices.Equal(without, img.Pix) {
+		t.Fatal("text was not drawn")
+	}
+	if slices.Equal(without, image.NewNRGBA(img.Rect).Pix) {
+		t.Fatal("mascot was not drawn")
+	}
+}
+
+func TestAddWatermarkWithOptions(t *testing.T) {
+	// The mascot must be drawn in the requested corner only.
+	corners := map[string]image.Point{
+		"":             {0, 511},
+		"bottom_left":  {0, 511},
+		"bottom_right": {511, 511},
+		"top_left":     {0, 0},
+		"top_right":    {511, 0},
+	}
+	for pos := range corners {
+		w := WatermarkOptions{Position: pos, Text: "hello"}
+		if err := w.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+		AddWatermarkWithOptions(img, &w)
+		m := mascot.Bounds()
+		for name, c := range corners {
+			r := image.Rect(0, 0, m.Dx(), m.Dy()).Add(image.Pt(min(c.X, 512-m.Dx()), min(c.Y, 512-m.Dy())))
+			drawn := false
+			for y := r.Min.Y; y < r.Max.Y && !drawn; y++ {
+				for x := r.Min.X; x < r.Max.X && !drawn; x++ {
+					drawn = img.NRGBAAt(x, y).A != 0
+				}
+			}
+			if want := corners[name] == corners[pos]; drawn != want {
+				t.Errorf("%q: corner %q: want drawn %t, got %t", pos, name, want, drawn)
+			}
+		}
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	AddWatermarkWithOptions(img, &WatermarkOptions{Disabled: true, Text: "hello"})
+	if !slices.Equal(img.Pix, image.NewNRGBA(img.Rect).Pix) {
+		t.Fatal("expected nothing drawn")
+	}
+	for i, w := range []WatermarkOptions{{Position: "middle"}, {Opacity: 0.01}, {Opacity: 1.5}, {Scale: 0.1}, {Scale: 5}} {
+		if w.Validate() == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestDrawLabelsOnImageWithOptions(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	DrawLabelsOnImage(img, "hello, world")
+	def := slices.Clone(img.Pix)
+	img = image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	DrawLabelsOnImageWithOptions(img, "hello, world", &LabelOptions{})
+	if !slices.Equal(def, img.Pix) {
+		t.Fatal("zero value must use the defaults")
+	}
+	img = image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	DrawLabelsOnImageWithOptions(img, "hello, world", &LabelOptions{FontScale: 0.5, OutlineRadius: 2})
+	if slices.Equal(def, img.Pix) {
+		t.Fatal("options were ignored")
+	}
+	img = image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	DrawLabelsOnImageWithOptions(img, "hello, world", &LabelOptions{OutlineColor: "#000000", FillColor: "#FFFFFF"})
+	if !slices.Equal(def, img.Pix) {
+		t.Fatal("the default colors are black and white")
+	}
+	img = image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	DrawLabelsOnImageWithOptions(img, "hello, world", &LabelOptions{OutlineColor: "#FF0000", FillColor: "#FFFF00"})
+	red, yellow := false, false
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := color.NRGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+		red = red || p == color.NRGBA{0xFF, 0, 0, 0xFF}
+		yellow = yellow || p == color.NRGBA{0xFF, 0xFF, 0, 0xFF}
+	}
+	if !red || !yellow {
+		t.Fatalf("colors were ignored: red=%t yellow=%t", red, yellow)
+	}
+	for i, o := range []LabelOptions{{FontScale: -1}, {OutlineRadius: -1}, {OutlineColor: "black"}, {FillColor: "#FFF"}} {
+		if err := o.Validate(); err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	c, err := ParseHexColor("#336699")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (color.NRGBA{0x33, 0x66, 0x99, 0xFF}); c != want {
+		t.Fatalf("want %v, got %v", want, c)
+	}
+	for _, s := range []string{"", "336699", "#3366", "#GGGGGG", "#33669900"} {
+		if _, err = ParseHexColor(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
+
+func TestLayoutText(t *testing.T) {
+	const w = 512
+	label := "when you finally understand the code you wrote last year but then realize it was all wrong"
+	img := image.NewNRGBA(image.Rect(0, 0, w, w))
+	DrawLabelsOnImage(img, label)
+	size, lines := layoutText(w, w/2, 1, label)
+	if min := float64(w) / minFontDivisor; size < min {
+		t.Fatalf("font size %.1f is below %.1f", size, min)
+	}
+	if len(lines) < 2 {
+		t.Fatalf("expected the label to be wrapped, got %q", lines)
+	}
+	if got := strings.Join(lines, " "); got != label {
+		t.Fatalf("words were lost: %q", got)
+	}
+	// Short labels stay on a single line.
+	if _, lines = layoutText(w, w/2, 1, "hello world"); len(lines) != 1 {
+		t.Fatalf("unexpected wrap: %q", lines)
+	}
+	// It doesn't wrap when there's no vertical room.
+	if _, lines = layoutText(w, 1, 1, label); len(lines) != 1 {
+		t.Fatalf("unexpected wrap: %q", lines)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden images in testdata")
+
+func TestDrawLabelsOnImage_Golden(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 384))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: 80, G: 120, B: 160, A: 255}), image.Point{}, draw.Src)
+	DrawLabelsOnImage(img, "one does not simply 🔥, walk into mordor")
+	checkGolden(t, img, "labels.png")
+}
+
+func TestAddWatermarkWithOptions_Golden(t *testing.T) {
+	data := []struct {
+		name string
+		opts WatermarkOptions
+	}{
+		// Today's appearance.
+		{"watermark.png", WatermarkOptions{Text: "example.com"}},
+		{"watermark_subtle.png", WatermarkOptions{Text: "example.com", Opacity: 0.4, Scale: 0.5, Position: "bottom_right"}},
+		{"watermark_prominent.png", WatermarkOptions{Text: "example.com", Opacity: 0.8, Scale: 2, Position: "top_left"}},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			if err := line.opts.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			img := image.NewNRGBA(image.Rect(0, 0, 512, 384))
+			draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: 80, G: 120, B: 160, A: 255}), image.Point{}, draw.Src)
+			AddWatermarkWithOptions(img, &line.opts)
+			checkGolden(t, img, line.name)
+		})
+	}
+}
+
+// checkGolden compares img with the golden image testdata/name, regenerated
+// with -update.
+func checkGolden(t *testing.T, img *image.NRGBA, name string) {
+	p := filepath.Join("testdata", name)
+	if *update {
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := decodePNG(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Bounds() != img.Bounds() {
+		t.Fatalf("unexpected size %v, want %v", img.Bounds(), want.Bounds())
+	}
+	// The rasterizer uses floating point so allow small differences across
+	// platforms.
+	diff := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		for j := 0; j < 4; j++ {
+			if d := int(img.Pix[i+j]) - int(want.Pix[i+j]); d > 8 || d < -8 {
+				diff++
+				break
+			}
+		}
+	}
+	if max := len(img.Pix) / 4 / 1000; diff > max {
+		t.Fatalf("%d pixels differ, max is %d; run with -update to regenerate %s", diff, max, p)
+	}
+}
+
+func BenchmarkDrawLabelsOnImage(b *testing.B) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 1024))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DrawLabelsOnImage(img, "one does not simply, walk into mordor, without a meme, about it, obviously")
+	}
+}
+
 // TestMain sets up the verbose logging.
 func TestMain(m *testing.M) {
 	flag.Parse()
@@ -0,0 +1,98 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package imagegen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+)
+
+// ErrNoParams is returned by ReadParams when the image has no embedded
+// generation parameters, e.g. it was not generated by the bot or was
+// re-encoded since.
+var ErrNoParams = errors.New("no generation parameters found in the image")
+
+// Params are the parameters used to generate an image, embedded in the PNG
+// images so the image can be generated again.
+type Params struct {
+	// Prompt is the image prompt, including the style.
+	Prompt         string   `json:"prompt"`
+	NegativePrompt string   `json:"negative_prompt,omitempty"`
+	Seed           int      `json:"seed"`
+	Steps          int      `json:"steps,omitempty"`
+	Width          int      `json:"width,omitempty"`
+	Height         int      `json:"height,omitempty"`
+	Sampler        string   `json:"sampler,omitempty"`
+	LoRA           string   `json:"lora,omitempty"`
+	LoRAWeight     *float64 `json:"lora_weight,omitempty"`
+	// Labels are the meme labels drawn on the image, if any.
+	Labels string `json:"labels,omitempty"`
+
+	_ struct{}
+}
+
+// pngSignature is the first 8 bytes of a PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// paramsKeyword is the keyword of the PNG tEXt chunk holding the parameters
+// encoded as JSON.
+const paramsKeyword = "sillybot"
+
+// EmbedParams returns the PNG image b with p embedded in a tEXt chunk. Other
+// formats are returned as is.
+func EmbedParams(b []byte, p *Params) ([]byte, error) {
+	// The IHDR chunk is always first and is 25 bytes.
+	const ihdrEnd = 8 + 25
+	if !bytes.HasPrefix(b, pngSignature) || len(b) < ihdrEnd {
+		return b, nil
+	}
+	j, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte(paramsKeyword+"\x00"), j...)
+	out := make([]byte, 0, len(b)+len(data)+12)
+	out = append(out, b[:ihdrEnd]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, "tEXt"...)
+	out = append(out, data...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+	return append(out, b[ihdrEnd:]...), nil
+}
+
+// ReadParams returns the parameters embedded in the PNG image b by
+// EmbedParams.
+func ReadParams(b []byte) (*Params, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, ErrNoParams
+	}
+	for b = b[len(pngSignature):]; len(b) >= 12; {
+		l := binary.BigEndian.Uint32(b)
+		if uint64(l) > uint64(len(b)-12) {
+			return nil, errors.New("corrupted PNG image")
+		}
+		kind := string(b[4:8])
+		data := b[8 : 8+l]
+		b = b[12+l:]
+		if kind == "IEND" {
+			break
+		}
+		if kind != "tEXt" {
+			continue
+		}
+		if v, ok := bytes.CutPrefix(data, []byte(paramsKeyword+"\x00")); ok {
+			p := &Params{}
+			if err := json.Unmarshal(v, p); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}
+	}
+	return nil, ErrNoParams
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package imagegen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"strings"
+
+	"github.com/maruel/sillybot/internal"
+	"golang.org/x/image/draw"
+)
+
+// SafetyOptions configures the optional NSFW filter applied to the generated
+// images, e.g. for family-friendly servers. It is disabled by default.
+//
+// The classifier is an HTTP endpoint receiving a POST of
+// {"image": "<base64 PNG>"} and replying {"score": 0.87}, where the score is
+// between 0 (safe) and 1 (NSFW).
+type SafetyOptions struct {
+	// Enabled turns on the filter.
+	Enabled bool
+	// URL is the classifier endpoint, e.g. "http://localhost:8040/classify".
+	URL string
+	// Threshold is the score at or above which the image is filtered.
+	// Defaults to 0.5.
+	Threshold float64
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (s *SafetyOptions) Validate() error {
+	if s.Threshold < 0 || s.Threshold > 1 {
+		return fmt.Errorf("invalid safety threshold %g; must be between 0 and 1", s.Threshold)
+	}
+	if s.Enabled && !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		return fmt.Errorf("invalid safety url %q", s.URL)
+	}
+	return nil
+}
+
+// Unsafe returns true if the classifier scores the image at or above the
+// threshold. It always returns false when the filter is disabled.
+func (ig *Session) Unsafe(ctx context.Context, img image.Image) (bool, error) {
+	if !ig.safety.Enabled {
+		return false, nil
+	}
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, img); err != nil {
+		return false, err
+	}
+	in := struct {
+		Image []byte `json:"image"`
+	}{Image: b.Bytes()}
+	out := struct {
+		Score float64 `json:"score"`
+	}{}
+	if err := internal.JSONPost(ctx, ig.safety.URL, "", &in, &out); err != nil {
+		return false, fmt.Errorf("safety check failed: %w", err)
+	}
+	threshold := ig.safety.Threshold
+	if threshold == 0 {
+		threshold = 0.5
+	}
+	slog.Info("ig", "message", "safety check", "score", out.Score, "threshold", threshold)
+	return out.Score >= threshold, nil
+}
+
+// Obscure returns a heavily blurred copy of the image, to replace one that
+// failed the safety check while keeping its dimensions.
+func Obscure(img image.Image) *image.NRGBA {
+	r := img.Bounds()
+	small := image.NewNRGBA(image.Rect(0, 0, max(1, r.Dx()/32), max(1, r.Dy()/32)))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, r, draw.Src, nil)
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.BiLinear.Scale(dst, dst.Bounds(), small, small.Bounds(), draw.Src, nil)
+	return dst
+}
@@ -11,10 +11,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"regexp"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 // General functions I didn't know where to put.
@@ -53,28 +57,30 @@ func IsHostPort(s string) bool {
 }
 
 // JSONPos simplifies doing an HTTP POST in JSON.
-func JSONPost(ctx context.Context, url string, in, out interface{}) error {
-	resp, err := JSONPostRequest(ctx, url, in)
+//
+// auth is the Authorization header value to send, if not empty.
+func JSONPost(ctx context.Context, url, auth string, in, out interface{}) error {
+	resp, err := JSONPostRequest(ctx, url, auth, in)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return NewHTTPError(url, resp)
+	}
 	d := json.NewDecoder(resp.Body)
 	d.DisallowUnknownFields()
-	err = d.Decode(out)
-	_ = resp.Body.Close()
-	var errs []error
-	if err != nil {
-		errs = append(errs, fmt.Errorf("failed to decode server response: %w", err))
-	}
-	if resp.StatusCode >= 400 {
-		errs = append(errs, &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status})
+	if err = d.Decode(out); err != nil {
+		return fmt.Errorf("failed to decode server response: %w", err)
 	}
-	return errors.Join(errs...)
+	return nil
 }
 
 // JSONPostRequest simplifies doing an HTTP POST in JSON. It initiates
 // the requests and returns the response back.
-func JSONPostRequest(ctx context.Context, url string, in interface{}) (*http.Response, error) {
+//
+// auth is the Authorization header value to send, if not empty.
+func JSONPostRequest(ctx context.Context, url, auth string, in interface{}) (*http.Response, error) {
 	b := bytes.Buffer{}
 	e := json.NewEncoder(&b)
 	// OMG this took me a while to figure this out. This affects token encoding.
@@ -87,32 +93,99 @@ func JSONPostRequest(ctx context.Context, url string, in interface{}) (*http.Res
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	setAuth(req, auth)
 	return http.DefaultClient.Do(req)
 }
 
 // JSONGet does a HTTP GET and parses the returned JSON.
-func JSONGet(ctx context.Context, url string, out interface{}) error {
+//
+// auth is the Authorization header value to send, if not empty.
+func JSONGet(ctx context.Context, url, auth string, out interface{}) error {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	setAuth(req, auth)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return NewHTTPError(url, resp)
+	}
 	d := json.NewDecoder(resp.Body)
 	d.DisallowUnknownFields()
-	err = d.Decode(out)
-	_ = resp.Body.Close()
-	var errs []error
+	if err = d.Decode(out); err != nil {
+		return fmt.Errorf("failed to decode server response: %w", err)
+	}
+	return nil
+}
+
+// ProbeHealth returns nil if the server at baseURL replies with status "ok"
+// on /health within timeout.
+//
+// It is used to check if a backend is reachable before selecting it. auth is
+// the Authorization header value to send, if not empty.
+func ProbeHealth(ctx context.Context, baseURL, auth string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/health", nil)
+	if err != nil {
+		return err
+	}
+	setAuth(req, auth)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		errs = append(errs, fmt.Errorf("failed to decode server response: %w", err))
+		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		errs = append(errs, &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status})
+		return &HTTPError{URL: baseURL + "/health", StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	// Be lenient, each server returns different additional fields.
+	r := struct {
+		Status string
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("failed to decode server response: %w", err)
 	}
-	return errors.Join(errs...)
+	if r.Status != "ok" {
+		return fmt.Errorf("server is not ready: %q", r.Status)
+	}
+	return nil
+}
+
+// SelectBackend returns the first usable backend in candidates.
+//
+// Each candidate is either "local", meaning starting our own server, or a
+// "host:port" of a remote server that must reply healthy within timeout.
+// "local" is always considered usable since it cannot be probed before being
+// started. auth is the Authorization header value sent to the remote servers,
+// if not empty.
+func SelectBackend(ctx context.Context, name, auth string, candidates []string, timeout time.Duration) (string, error) {
+	var errs []error
+	for _, c := range candidates {
+		if c == "local" {
+			slog.Info(name, "backend", c)
+			return c, nil
+		}
+		if !IsHostPort(c) {
+			return "", fmt.Errorf("invalid backend %q; use \"local\" or form 'host:port'", c)
+		}
+		err := ProbeHealth(ctx, "http://"+c, auth, timeout)
+		if err == nil {
+			slog.Info(name, "backend", c)
+			return c, nil
+		}
+		slog.Warn(name, "backend", c, "state", "unreachable", "err", err)
+		errs = append(errs, fmt.Errorf("%s: %w", c, err))
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no backend specified")
+	}
+	return "", fmt.Errorf("no healthy backend: %w", errors.Join(errs...))
 }
 
 // HTTPError represents an HTTP request that returned an HTTP error.
@@ -120,8 +193,58 @@ type HTTPError struct {
 	URL        string
 	StatusCode int
 	Status     string
+	// Message is the error returned by the server in the JSON body as
+	// {"error": "...", "kind": "..."}, if any.
+	Message string
+	// Kind is the category of the error returned by the server, e.g.
+	// "out_of_memory", if any.
+	Kind string
+}
+
+// NewHTTPError returns the error for a failed response, including the error
+// returned by the server in the JSON body, if any. It reads the body.
+func NewHTTPError(url string, resp *http.Response) *HTTPError {
+	h := &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	// Be lenient, it may not even be JSON.
+	r := struct {
+		Error string
+		Kind  string
+	}{}
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&r) == nil {
+		h.Message = r.Error
+		h.Kind = r.Kind
+	}
+	return h
 }
 
 func (h *HTTPError) Error() string {
+	if h.Message != "" {
+		return h.Status + ": " + h.Message
+	}
 	return h.Status
 }
+
+// IsUnauthorized returns true if the error is an HTTP 401 or 403, i.e. the
+// server is reachable but rejected the credentials.
+func IsUnauthorized(err error) bool {
+	var h *HTTPError
+	return errors.As(err, &h) && (h.StatusCode == http.StatusUnauthorized || h.StatusCode == http.StatusForbidden)
+}
+
+// IsTransient returns true if the error is likely temporary: a server error
+// (5xx) or a refused connection, e.g. while the server restarts. A server
+// error with a Kind is the server explaining why the request failed, so it is
+// not considered temporary.
+func IsTransient(err error) bool {
+	var h *HTTPError
+	if errors.As(err, &h) {
+		return h.StatusCode >= 500 && h.Kind == ""
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func setAuth(req *http.Request, auth string) {
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+}
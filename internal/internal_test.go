@@ -4,7 +4,16 @@
 
 package internal
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestIsHostPort(t *testing.T) {
 	if IsHostPort("a:1") {
@@ -14,3 +23,103 @@ func TestIsHostPort(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestProbeHealth(t *testing.T) {
+	status := "ok"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status":"` + status + `","slots_idle":1}`))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	if err := ProbeHealth(ctx, server.URL, "", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	status = "loading model"
+	if err := ProbeHealth(ctx, server.URL, "", time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := ProbeHealth(ctx, "http://localhost:1", "", time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+	healthy := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+	got, err := SelectBackend(ctx, "test", "", []string{"localhost:1", healthy, "local"}, time.Second)
+	if err != nil || got != healthy {
+		t.Fatal(got, err)
+	}
+	if got, err = SelectBackend(ctx, "test", "", []string{"localhost:1", "local"}, time.Second); err != nil || got != "local" {
+		t.Fatal(got, err)
+	}
+	if _, err = SelectBackend(ctx, "test", "", []string{"localhost:1"}, time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = SelectBackend(ctx, "test", "", []string{"bad"}, time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestIsUnauthorized(t *testing.T) {
+	if !IsUnauthorized(fmt.Errorf("wrapped: %w", &HTTPError{StatusCode: http.StatusUnauthorized})) {
+		t.Fatal("expected unauthorized")
+	}
+	if IsUnauthorized(&HTTPError{StatusCode: http.StatusNotFound}) {
+		t.Fatal("unexpected unauthorized")
+	}
+	if IsUnauthorized(errors.New("connection refused")) {
+		t.Fatal("unexpected unauthorized")
+	}
+}
+
+func TestJSONPost_Error(t *testing.T) {
+	body := `{"error":"CUDA out of memory.","kind":"out_of_memory"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	var out struct{}
+	err := JSONPost(context.Background(), srv.URL, "", struct{}{}, &out)
+	var h *HTTPError
+	if !errors.As(err, &h) || h.Message != "CUDA out of memory." || h.Kind != "out_of_memory" {
+		t.Fatal(err)
+	}
+	if got := err.Error(); got != "500 Internal Server Error: CUDA out of memory." {
+		t.Fatal(got)
+	}
+	// Not JSON.
+	body = "oops"
+	err = JSONPost(context.Background(), srv.URL, "", struct{}{}, &out)
+	if !errors.As(err, &h) || h.Message != "" || err.Error() != "500 Internal Server Error" {
+		t.Fatal(err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	if !IsTransient(&HTTPError{StatusCode: http.StatusBadGateway}) {
+		t.Fatal("expected transient")
+	}
+	if IsTransient(&HTTPError{StatusCode: http.StatusBadRequest}) {
+		t.Fatal("unexpected transient")
+	}
+	if IsTransient(&HTTPError{StatusCode: http.StatusInternalServerError, Kind: "out_of_memory"}) {
+		t.Fatal("unexpected transient")
+	}
+	_, err := http.Get("http://localhost:1")
+	if !IsTransient(err) {
+		t.Fatalf("expected transient: %v", err)
+	}
+	if IsTransient(context.Canceled) {
+		t.Fatal("unexpected transient")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package metrics exports counters, gauges and histograms in the Prometheus
+// text format.
+//
+// It implements the small subset needed by the bot to not pull the whole
+// Prometheus client. See
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets in seconds, suitable for the LLM
+// and image generation latencies.
+var DefaultBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100}
+
+// Counter is a monotonically increasing value, optionally partitioned by one
+// label.
+type Counter struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]float64
+}
+
+// NewCounter registers a counter without label.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help, "")
+}
+
+// NewCounterVec registers a counter partitioned by label, e.g. "kind".
+func NewCounterVec(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter without label.
+func (c *Counter) Inc() {
+	c.IncWith("")
+}
+
+// IncWith increments the counter for the label value.
+func (c *Counter) IncWith(value string) {
+	c.mu.Lock()
+	c.values[value]++
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		labels := ""
+		if c.label != "" {
+			labels = "{" + c.label + "=" + strconv.Quote(k) + "}"
+		}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(c.values[k]))
+	}
+}
+
+// GaugeFunc is a value sampled when the metrics are scraped.
+type GaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// Histogram counts the observed values in buckets.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+	mu         sync.Mutex
+	counts     []uint64
+	count      uint64
+	sum        float64
+}
+
+// NewHistogram registers a histogram with the upper bounds of the buckets,
+// in increasing order.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(name, h)
+	return h
+}
+
+// Observe adds a value.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveDuration adds a duration in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	header(w, h.name, h.help, "histogram")
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Handler serves all the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write writes all the registered metrics, sorted by name.
+func Write(w io.Writer) {
+	mu.Lock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	m := make([]metric, 0, len(names))
+	slices.Sort(names)
+	for _, n := range names {
+		m = append(m, registry[n])
+	}
+	mu.Unlock()
+	for _, x := range m {
+		x.write(w)
+	}
+}
+
+//
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mu       sync.Mutex
+	registry = map[string]metric{}
+)
+
+// register adds the metric to the registry. A metric registered again under
+// the same name replaces the previous one, e.g. a GaugeFunc bound to a new
+// instance.
+func register(name string, m metric) {
+	mu.Lock()
+	registry[name] = m
+	mu.Unlock()
+}
+
+func header(w io.Writer, name, help, typ string) {
+	help = strings.ReplaceAll(strings.ReplaceAll(help, `\`, `\\`), "\n", `\n`)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
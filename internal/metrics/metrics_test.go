@@ -0,0 +1,67 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.")
+	v := NewCounterVec("test_errors_total", "Errors\nby kind.", "kind")
+	h := NewHistogram("test_seconds", "Latency.", []float64{0.5, 1})
+	n := 2.
+	NewGaugeFunc("test_active", "Active.", func() float64 { return n })
+	c.Inc()
+	c.Inc()
+	v.IncWith("oom")
+	v.IncWith(`a"b`)
+	h.Observe(0.25)
+	h.ObserveDuration(750 * time.Millisecond)
+	h.Observe(3)
+	// Registering again replaces the previous one.
+	NewGaugeFunc("test_active", "Active.", func() float64 { return n + 1 })
+
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatal(ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_active Active.
+# TYPE test_active gauge
+test_active 3
+# HELP test_errors_total Errors\nby kind.
+# TYPE test_errors_total counter
+test_errors_total{kind="a\"b"} 1
+test_errors_total{kind="oom"} 1
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total 2
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 4
+test_seconds_count 3
+`
+	if got := string(b); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FilterOptions selects the post-processing applied to the LLM replies before
+// they are sent to the user.
+type FilterOptions struct {
+	// StripAssistantPrefix removes a leading "Assistant:" that some models emit.
+	StripAssistantPrefix bool `yaml:"strip_assistant_prefix"`
+	// CollapseSpaces replaces repeated spaces inside a line with a single one.
+	// Indentation and code blocks are left as-is.
+	CollapseSpaces bool `yaml:"collapse_spaces"`
+	// CollapseNewlines limits consecutive empty lines to one. Code blocks are
+	// left as-is.
+	CollapseNewlines bool `yaml:"collapse_newlines"`
+	// StripThinking removes the chain-of-thought wrapped in ThinkingTags.
+	StripThinking bool `yaml:"strip_thinking"`
+	// ThinkingTags are the names of the tags wrapping the chain-of-thought,
+	// e.g. "reasoning" for <reasoning>...</reasoning>. Defaults to "think" and
+	// "thinking".
+	ThinkingTags []string `yaml:"thinking_tags"`
+	// ThinkingSpoiler shows the chain-of-thought in Discord spoilers instead of
+	// removing it. It requires StripThinking. The thought is held back until
+	// its closing tag.
+	ThinkingSpoiler bool `yaml:"thinking_spoiler"`
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (f *FilterOptions) Validate() error {
+	for _, t := range f.ThinkingTags {
+		if t == "" || strings.ContainsAny(t, "<>/ \t\n") {
+			return fmt.Errorf("invalid thinking tag %q; use only the name, e.g. \"think\"", t)
+		}
+	}
+	if f.ThinkingSpoiler && !f.StripThinking {
+		return errors.New("thinking_spoiler requires strip_thinking")
+	}
+	return nil
+}
+
+// Filter post-processes a streamed reply from the LLM.
+//
+// It is stateful as the patterns can be split across multiple words. Use a
+// new Filter for each reply.
+type Filter struct {
+	opts FilterOptions
+	// buf is the data held back because it may be the start of a pattern.
+	buf string
+	// started is set once the beginning of the reply was processed.
+	started bool
+	// tags are the opening and closing tags of the thoughts.
+	tags [][2]string
+	// thinkEnd is the closing tag being looked for when inside a thought.
+	thinkEnd string
+	// thought is the thought held back, with ThinkingSpoiler.
+	thought string
+	// trim is set when leading whitespace must be removed, after a stripped
+	// pattern.
+	trim bool
+
+	// State of the emitted data.
+	lineStart bool
+	space     bool
+	newlines  int
+	backticks int
+	inFence   bool
+}
+
+// NewFilter returns a Filter for a new reply.
+func NewFilter(opts *FilterOptions) *Filter {
+	f := &Filter{opts: *opts, lineStart: true, tags: thinkTags[:]}
+	if len(opts.ThinkingTags) != 0 {
+		f.tags = make([][2]string, len(opts.ThinkingTags))
+		for i, t := range opts.ThinkingTags {
+			f.tags[i] = [2]string{"<" + t + ">", "</" + t + ">"}
+		}
+	}
+	return f
+}
+
+var (
+	assistantPrefix = "assistant:"
+	thinkTags       = [...][2]string{{"<thinking>", "</thinking>"}, {"<think>", "</think>"}}
+)
+
+// Push processes a new chunk of the reply and returns the data that is ready
+// to be sent.
+func (f *Filter) Push(s string) string {
+	f.buf += s
+	out := strings.Builder{}
+	for {
+		if !f.started && f.opts.StripAssistantPrefix {
+			t := strings.TrimLeft(f.buf, " \t\n")
+			if len(t) < len(assistantPrefix) && strings.HasPrefix(assistantPrefix, strings.ToLower(t)) {
+				// Wait for more.
+				return out.String()
+			}
+			if strings.HasPrefix(strings.ToLower(t), assistantPrefix) {
+				f.buf = t[len(assistantPrefix):]
+				f.trim = true
+			}
+		}
+		f.started = true
+		if f.trim {
+			if f.buf = strings.TrimLeft(f.buf, " \t\n"); f.buf == "" {
+				return out.String()
+			}
+			f.trim = false
+		}
+		if !f.opts.StripThinking {
+			f.emit(&out, f.buf)
+			f.buf = ""
+			return out.String()
+		}
+		if f.thinkEnd != "" {
+			i := strings.Index(f.buf, f.thinkEnd)
+			if i == -1 {
+				// Drop or hold back the thought but keep what could be the start of
+				// the closing tag.
+				n := len(f.buf) - partialSuffix(f.buf, f.thinkEnd)
+				if f.opts.ThinkingSpoiler {
+					f.thought += f.buf[:n]
+				}
+				f.buf = f.buf[n:]
+				return out.String()
+			}
+			if f.opts.ThinkingSpoiler {
+				f.emit(&out, spoiler(f.thought+f.buf[:i]))
+				f.thought = ""
+			}
+			f.buf = f.buf[i+len(f.thinkEnd):]
+			f.thinkEnd = ""
+			f.trim = true
+			continue
+		}
+		// Look for the first opening tag.
+		start, tag := -1, 0
+		for j := range f.tags {
+			if i := strings.Index(f.buf, f.tags[j][0]); i != -1 && (start == -1 || i < start) {
+				start, tag = i, j
+			}
+		}
+		if start != -1 {
+			f.emit(&out, f.buf[:start])
+			f.buf = f.buf[start+len(f.tags[tag][0]):]
+			f.thinkEnd = f.tags[tag][1]
+			continue
+		}
+		// Hold back what could be the start of an opening tag.
+		keep := 0
+		for _, tag := range f.tags {
+			keep = max(keep, partialSuffix(f.buf, tag[0]))
+		}
+		f.emit(&out, f.buf[:len(f.buf)-keep])
+		f.buf = f.buf[len(f.buf)-keep:]
+		return out.String()
+	}
+}
+
+// Flush returns the data held back. Call it once the reply is complete.
+func (f *Filter) Flush() string {
+	out := strings.Builder{}
+	if f.thinkEnd == "" {
+		f.emit(&out, f.buf)
+	} else if f.opts.ThinkingSpoiler {
+		// The reply ended in the thought.
+		f.emit(&out, spoiler(f.thought+f.buf))
+	}
+	f.buf = ""
+	f.thought = ""
+	return out.String()
+}
+
+// spoiler returns the thought in Discord spoilers, one per paragraph so they
+// stay balanced when the reply is split in multiple messages.
+func spoiler(thought string) string {
+	var out []string
+	for _, p := range strings.Split(thought, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, "||"+strings.ReplaceAll(p, "||", `\|\|`)+"||")
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n\n") + "\n\n"
+}
+
+// emit writes s to out, collapsing spaces and newlines as requested.
+func (f *Filter) emit(out *strings.Builder, s string) {
+	if !f.opts.CollapseSpaces && !f.opts.CollapseNewlines {
+		out.WriteString(s)
+		return
+	}
+	// Only ASCII characters are matched, so it is safe to process bytes even if
+	// an UTF-8 sequence is split across chunks.
+	for i := 0; i < len(s); i++ {
+		r := s[i]
+		if r == '`' {
+			if f.backticks++; f.backticks == 3 {
+				f.inFence = !f.inFence
+				f.backticks = 0
+			}
+		} else {
+			f.backticks = 0
+		}
+		switch {
+		case f.inFence:
+		case r == ' ' && f.opts.CollapseSpaces && f.space && !f.lineStart:
+			continue
+		case r == '\n' && f.opts.CollapseNewlines && f.newlines >= 2:
+			continue
+		}
+		out.WriteByte(r)
+		f.space = r == ' '
+		if r == '\n' {
+			f.newlines++
+			f.lineStart = true
+		} else if r != ' ' && r != '\t' {
+			f.newlines = 0
+			f.lineStart = false
+		}
+	}
+}
+
+// partialSuffix returns the length of the longest suffix of s that is a
+// strict prefix of tag.
+func partialSuffix(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
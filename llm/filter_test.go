@@ -0,0 +1,144 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"testing"
+)
+
+// filterAll runs the filter on input, both in one chunk and one byte at a
+// time, and ensures the outputs are the same.
+func filterAll(t *testing.T, opts FilterOptions, input string) string {
+	f := NewFilter(&opts)
+	whole := f.Push(input) + f.Flush()
+	f = NewFilter(&opts)
+	streamed := ""
+	for i := range len(input) {
+		streamed += f.Push(input[i : i+1])
+	}
+	streamed += f.Flush()
+	if whole != streamed {
+		t.Fatalf("whole %q != streamed %q", whole, streamed)
+	}
+	return whole
+}
+
+func TestFilter_None(t *testing.T) {
+	in := "Assistant: <think>hmm</think>a  b\n\n\n\nc"
+	if got := filterAll(t, FilterOptions{}, in); got != in {
+		t.Fatal(got)
+	}
+}
+
+func TestFilter_StripAssistantPrefix(t *testing.T) {
+	opts := FilterOptions{StripAssistantPrefix: true}
+	data := []struct {
+		in, want string
+	}{
+		{"Assistant: Hello", "Hello"},
+		{"\nassistant:Hello", "Hello"},
+		{"Hello Assistant: you", "Hello Assistant: you"},
+		{"Assist", "Assist"},
+		{"As I said", "As I said"},
+	}
+	for i, line := range data {
+		if got := filterAll(t, opts, line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestFilter_CollapseSpaces(t *testing.T) {
+	opts := FilterOptions{CollapseSpaces: true}
+	data := []struct {
+		in, want string
+	}{
+		{"a   b  c", "a b c"},
+		{"été  à", "été à"},
+		{"    indented  code\n  - item", "    indented code\n  - item"},
+		{"```\na    b\n```\nc   d", "```\na    b\n```\nc d"},
+	}
+	for i, line := range data {
+		if got := filterAll(t, opts, line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestFilter_CollapseNewlines(t *testing.T) {
+	opts := FilterOptions{CollapseNewlines: true}
+	data := []struct {
+		in, want string
+	}{
+		{"a\n\n\n\nb", "a\n\nb"},
+		{"a\nb\n\nc", "a\nb\n\nc"},
+		{"```\na\n\n\n\nb\n```\n\n\n", "```\na\n\n\n\nb\n```\n\n"},
+	}
+	for i, line := range data {
+		if got := filterAll(t, opts, line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestFilter_StripThinking(t *testing.T) {
+	opts := FilterOptions{StripThinking: true}
+	data := []struct {
+		in, want string
+	}{
+		{"<think>Let me see.</think>\nThe answer is 42.", "The answer is 42."},
+		{"A<thinking>hmm</thinking>B<think>x</think>C", "ABC"},
+		{"a < b", "a < b"},
+		{"<think>never closed", ""},
+		{"trailing <thi", "trailing <thi"},
+	}
+	for i, line := range data {
+		if got := filterAll(t, opts, line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestFilter_ThinkingTags(t *testing.T) {
+	opts := FilterOptions{StripThinking: true, ThinkingTags: []string{"reasoning"}}
+	data := []struct {
+		in, want string
+	}{
+		{"<reasoning>Let me see.</reasoning>\nThe answer is 42.", "The answer is 42."},
+		{"<think>kept</think>", "<think>kept</think>"},
+		{"trailing <reas", "trailing <reas"},
+	}
+	for i, line := range data {
+		if got := filterAll(t, opts, line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i, o := range []FilterOptions{{ThinkingTags: []string{"<think>"}}, {ThinkingTags: []string{""}}, {ThinkingSpoiler: true}} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestFilter_ThinkingSpoiler(t *testing.T) {
+	opts := FilterOptions{StripThinking: true, ThinkingSpoiler: true}
+	data := []struct {
+		in, want string
+	}{
+		{"<think>Let me see.</think>\nThe answer is 42.", "||Let me see.||\n\nThe answer is 42."},
+		{"<think>\nFirst.\n\nSecond || third.\n</think>42", "||First.||\n\n||Second \\|\\| third.||\n\n42"},
+		{"<think>\n\n</think>\n\n42", "42"},
+		{"A<think>x</think>B<thinking>y</thinking>C", "A||x||\n\nB||y||\n\nC"},
+		{"<think>never closed", "||never closed||\n\n"},
+	}
+	for i, line := range data {
+		if got := filterAll(t, opts, line.in); got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// ParseJSON decodes the JSON value in the LLM reply s into v.
+//
+// LLMs frequently emit slightly malformed JSON. When s is not valid JSON, it
+// is repaired with RepairJSON before failing.
+func ParseJSON(s string, v interface{}) error {
+	if err := json.Unmarshal([]byte(s), v); err == nil {
+		return nil
+	}
+	r, err := RepairJSON(s)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal([]byte(r), v); err != nil {
+		return fmt.Errorf("invalid JSON in reply: %w", err)
+	}
+	return nil
+}
+
+// RepairJSON extracts the first JSON object or array from the LLM reply s and
+// repairs the common mistakes:
+// - prose or markdown code fences around the value;
+// - trailing commas;
+// - single quoted strings;
+// - unescaped new lines and tabs in strings;
+// - a truncated reply, e.g. when the LLM ran out of tokens.
+func RepairJSON(s string) (string, error) {
+	for i := range len(s) {
+		if s[i] != '{' && s[i] != '[' {
+			continue
+		}
+		if r := repairJSONAt(s[i:]); json.Valid([]byte(r)) {
+			return r, nil
+		}
+	}
+	return "", errors.New("no valid JSON found in reply")
+}
+
+// repairJSONAt repairs the JSON value starting at the beginning of s. The
+// result is not guaranteed to be valid.
+func repairJSONAt(s string) string {
+	out := strings.Builder{}
+	// closers are the closing brackets expected, innermost last.
+	var closers []byte
+	// quote is the quote character of the current string, 0 when not in a
+	// string.
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			switch {
+			case c == '\\' && i+1 < len(s):
+				i++
+				if s[i] == '\'' {
+					// \' is not a valid escape in JSON.
+					out.WriteByte('\'')
+				} else {
+					out.WriteByte(c)
+					out.WriteByte(s[i])
+				}
+			case c == quote:
+				out.WriteByte('"')
+				quote = 0
+			case c == '"':
+				out.WriteString(`\"`)
+			case c == '\n':
+				out.WriteString(`\n`)
+			case c == '\r':
+				out.WriteString(`\r`)
+			case c == '\t':
+				out.WriteString(`\t`)
+			default:
+				out.WriteByte(c)
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+			out.WriteByte('"')
+		case '{':
+			closers = append(closers, '}')
+			out.WriteByte(c)
+		case '[':
+			closers = append(closers, ']')
+			out.WriteByte(c)
+		case '}', ']':
+			if len(closers) != 0 {
+				out.WriteByte(closers[len(closers)-1])
+				closers = closers[:len(closers)-1]
+			}
+		case ',':
+			// Drop trailing commas.
+			if next := strings.TrimLeft(s[i+1:], " \t\r\n"); next != "" && next[0] != '}' && next[0] != ']' {
+				out.WriteByte(c)
+			}
+		default:
+			out.WriteByte(c)
+		}
+		if len(closers) == 0 {
+			// Ignore the prose after the value.
+			return out.String()
+		}
+	}
+	// The reply was truncated.
+	r := out.String()
+	if quote != 0 {
+		r += `"`
+	}
+	r = strings.TrimRight(r, " \t\r\n,")
+	if strings.HasSuffix(r, ":") {
+		r += "null"
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		r += string(closers[i])
+	}
+	return r
+}
+
+// PromptJSON prompts the LLM for a structured reply and decodes it into v.
+//
+// msgs must ask the LLM to reply in JSON. The reply is repaired with
+// ParseJSON and if it still can't be decoded, the LLM is asked once to fix
+// it.
+func (l *Session) PromptJSON(ctx context.Context, msgs []Message, opts *PromptOptions, v interface{}) error {
+	reply, err := l.Prompt(ctx, msgs, opts)
+	if err != nil {
+		return err
+	}
+	if err = ParseJSON(reply, v); err == nil {
+		return nil
+	}
+	slog.Warn("llm", "message", "invalid JSON reply; retrying", "reply", reply, "error", err)
+	msgs = append(slices.Clip(msgs),
+		Message{Role: Assistant, Content: reply},
+		Message{Role: User, Content: "Your reply is not valid JSON: " + err.Error() + ". Reply only with the corrected JSON."})
+	if reply, err = l.Prompt(ctx, msgs, opts); err != nil {
+		return err
+	}
+	return ParseJSON(reply, v)
+}
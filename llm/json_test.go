@@ -0,0 +1,97 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRepairJSON(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{`{"prompt": "a cat"}`, `{"prompt": "a cat"}`},
+		{
+			"Sure! Here is the JSON you asked for:\n```json\n{\"prompt\": \"a cat\", \"negative\": \"dogs\"}\n```\nLet me know if you need anything else.",
+			`{"prompt": "a cat", "negative": "dogs"}`,
+		},
+		{"{\n  \"prompt\": \"a cat\",\n  \"negative\": \"dogs\",\n}", "{\n  \"prompt\": \"a cat\",\n  \"negative\": \"dogs\"\n}"},
+		{`["a", "b",]`, `["a", "b"]`},
+		{`{'prompt': 'a "fat" cat', 'it\'s': 1}`, `{"prompt": "a \"fat\" cat", "it's": 1}`},
+		{"{\"prompt\": \"line one\nline two\"}", `{"prompt": "line one\nline two"}`},
+		{`{"prompt": "a cat", "tags": ["fluffy", "or`, `{"prompt": "a cat", "tags": ["fluffy", "or"]}`},
+		{`{"prompt": "a cat", "negative":`, `{"prompt": "a cat", "negative":null}`},
+		{`{"prompt": "a cat",`, `{"prompt": "a cat"}`},
+		// The first bracket is in the prose.
+		{`I [think] this works: {"query": "weather"}`, `{"query": "weather"}`},
+		{`{"a": {"b": [1, 2,],},}`, `{"a": {"b": [1, 2]}}`},
+	}
+	for i, line := range data {
+		got, err := RepairJSON(line.in)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+	for i, in := range []string{"", "I don't know.", "{:}"} {
+		if got, err := RepairJSON(in); err == nil {
+			t.Errorf("#%d: expected error, got %q", i, got)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	var got struct {
+		Prompt   string `json:"prompt"`
+		Negative string `json:"negative"`
+	}
+	if err := ParseJSON("```json\n{\"prompt\": \"a cat\", \"negative\": \"dogs\",}\n```", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Prompt != "a cat" || got.Negative != "dogs" {
+		t.Fatalf("%+v", got)
+	}
+	if err := ParseJSON(`{"prompt": 1}`, &got); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSession_PromptJSON(t *testing.T) {
+	replies := []string{"Here you go: {prompt: a cat}", `{"prompt": "a cat"}`}
+	var reqs []openAIChatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		reply := replies[len(reqs)]
+		reqs = append(reqs, req)
+		content, _ := json.Marshal(reply)
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":` + string(content) + `}}]}`))
+	}))
+	defer srv.Close()
+	l := Session{baseURL: srv.URL}
+	var got struct {
+		Prompt string `json:"prompt"`
+	}
+	msgs := []Message{{Role: User, Content: "Reply in JSON with the key prompt."}}
+	if err := l.PromptJSON(context.Background(), msgs, &PromptOptions{Seed: 1, Temperature: 1.0}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Prompt != "a cat" {
+		t.Fatalf("%+v", got)
+	}
+	// The invalid reply was sent back to the LLM to be fixed.
+	if len(reqs) != 2 || len(reqs[1].Messages) != 3 || reqs[1].Messages[1].Content != replies[0] {
+		t.Fatalf("unexpected requests %+v", reqs)
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,11 +37,31 @@ import (
 	"golang.org/x/sys/cpu"
 )
 
+// ErrVisionUnsupported is returned by Prompt and PromptStreaming when a
+// message has an image but the model doesn't support images.
+var ErrVisionUnsupported = errors.New("the model doesn't support images")
+
+// ErrToolsUnsupported is returned by PromptStreamingTools when tools are
+// passed but the prompt is encoded by hand, i.e. Encoding is set.
+var ErrToolsUnsupported = errors.New("the tools are only supported with the OpenAI compatible API")
+
 // Options for NewLLM.
 type Options struct {
 	// Remote is the host:port of a pre-existing server to use instead of
 	// starting our own.
+	//
+	// It can also be the base URL of an OpenAI compatible server, e.g.
+	// "http://localhost:11434" for Ollama, "http://localhost:1234" for LM
+	// Studio or "https://api.openai.com". The chat completions API is then
+	// always used and Model can be left empty.
 	Remote string
+	// APIKey is sent as a bearer token to the OpenAI compatible server in
+	// Remote. It is not used otherwise.
+	APIKey string `yaml:"api_key"`
+	// RemoteModel is the model requested from the OpenAI compatible server in
+	// Remote, e.g. "llama3.1:8b". Defaults to the first model the server
+	// lists.
+	RemoteModel string `yaml:"remote_model"`
 	// Model specifies a model to use.
 	//
 	// It will be selected automatically from KnownLLMs.
@@ -50,13 +72,46 @@ type Options struct {
 	// 128K context window models that will require too much memory and quite
 	// slow to run. A good value to recommend is 8192 or 32768.
 	ContextLength int `yaml:"context_length"`
+	// MaxConcurrentDownloads limits the number of model files downloaded
+	// simultaneously from Hugging Face. The rest are queued. Defaults to 2. Use
+	// -1 to remove the limit.
+	MaxConcurrentDownloads int `yaml:"max_concurrent_downloads"`
+	// Backends is an ordered list of candidate backends. Each is either "local"
+	// to start our own server or a "host:port" of a pre-existing server. The
+	// first healthy one is used. When set, Remote is ignored.
+	Backends []string `yaml:"backends"`
+	// IdleTimeout unloads our own server after this duration without request,
+	// to free the memory, e.g. the VRAM of a shared workstation. It is
+	// reloaded on the next request. 0 disables. It has no effect with a remote
+	// server.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// VRAMBudget is the memory available to the model in GiB. When set, Model
+	// can be the source of a known model without the quantization suffix, and
+	// the largest quantization estimated to fit is used. 0 disables.
+	VRAMBudget float64 `yaml:"vram_budget"`
 
 	_ struct{}
 }
 
 // Validate checks for obvious errors in the fields.
 func (o *Options) Validate() error {
-	// TODO: Remote.
+	if o.Remote != "" && !internal.IsHostPort(o.Remote) && !isURL(o.Remote) {
+		return fmt.Errorf("invalid remote %q; use form 'host:port' or 'http://host:port'", o.Remote)
+	}
+	if o.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle_timeout %s", o.IdleTimeout)
+	}
+	if o.VRAMBudget < 0 {
+		return fmt.Errorf("invalid vram_budget %g", o.VRAMBudget)
+	}
+	if o.MaxConcurrentDownloads < -1 {
+		return fmt.Errorf("invalid max_concurrent_downloads %d; use -1 to remove the limit", o.MaxConcurrentDownloads)
+	}
+	for _, b := range o.Backends {
+		if b != "local" && !internal.IsHostPort(b) {
+			return fmt.Errorf("invalid backend %q; use \"local\" or form 'host:port'", b)
+		}
+	}
 	if o.Model != "" && o.Model != "python" {
 		if err := o.Model.Validate(); err != nil {
 			return err
@@ -65,6 +120,12 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// isURL returns true if s is the URL of an OpenAI compatible server, as
+// opposed to a "host:port".
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
 // KnownLLM is a known model.
 //
 // Currently assumes the model is hosted on HuggingFace.
@@ -80,10 +141,39 @@ type KnownLLM struct {
 	// PromptEncoding is only used when using llama-server in /completion mode.
 	// When not present, llama-server is used in OpenAI compatible API mode.
 	PromptEncoding *PromptEncoding `yaml:"prompt_encoding"`
+	// MultimodalProjector is the multimodal projector in the form
+	// "hf:<author>/<repo>/<basename>", without the .gguf suffix. When set, the
+	// model accepts images. Only supported in OpenAI compatible API mode.
+	MultimodalProjector huggingface.PackedFileRef `yaml:"multimodal_projector"`
+	// Sampling is the sampling recommended by the model's authors. It has
+	// priority over the bot's configured sampling but not over the values
+	// requested by the users.
+	Sampling Sampling
+
+	_ struct{}
+}
+
+// Sampling is the recommended sampling of a model.
+type Sampling struct {
+	// Temperature is between 0 (deterministic) and 2 (very creative). Unset
+	// means no recommendation.
+	Temperature *float64
+	// TopP is between 0 and 1. 0 means no recommendation.
+	TopP float64 `yaml:"top_p"`
 
 	_ struct{}
 }
 
+func (s *Sampling) validate() error {
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > 2) {
+		return fmt.Errorf("invalid sampling temperature %g; must be between 0 and 2", *s.Temperature)
+	}
+	if s.TopP < 0 || s.TopP > 1 {
+		return fmt.Errorf("invalid sampling top_p %g; must be between 0 and 1", s.TopP)
+	}
+	return nil
+}
+
 // Validate checks for obvious errors in the fields.
 func (k *KnownLLM) Validate() error {
 	if err := k.Source.Validate(); err != nil {
@@ -100,7 +190,12 @@ func (k *KnownLLM) Validate() error {
 			return err
 		}
 	}
-	return nil
+	if k.MultimodalProjector != "" {
+		if err := k.MultimodalProjector.Validate(); err != nil {
+			return fmt.Errorf("invalid multimodal_projector: %w", err)
+		}
+	}
+	return k.Sampling.validate()
 }
 
 // PromptEncoding describes how to encode the prompt.
@@ -134,17 +229,44 @@ func (p *PromptEncoding) validate() error {
 // While it is expected that the model is an Instruct form, it is not a
 // requirement.
 type Session struct {
-	HF       *huggingface.Client
+	HF *huggingface.Client
+	// Model and Encoding are updated by SwitchModel. Read them with
+	// CurrentModel and CurrentEncoding while the session is in use.
 	Model    huggingface.PackedFileRef
 	Encoding *PromptEncoding
 	baseURL  string
 	backend  string
+	// auth is the Authorization header value sent to an OpenAI compatible
+	// server.
+	auth string
+	// remoteModel is the model requested from an OpenAI compatible server.
+	remoteModel string
 
 	modelFile string
+	vision    bool
+	sampling  Sampling
 	c         *exec.Cmd
 	done      <-chan error
 	cancel    func() error
 
+	// lastUsed is the time of the last request in Unix nanoseconds, to unload
+	// the server when idle.
+	lastUsed atomic.Int64
+	// modelMu protects the writes to Model, Encoding and sampling, so they can
+	// be read without waiting for SwitchModel, which holds mu for minutes.
+	modelMu sync.Mutex
+
+	// mu is held for reading by the requests in flight and for writing by
+	// SwitchModel and when unloading or reloading the server.
+	mu        sync.RWMutex
+	cache     string
+	opts      Options
+	knownLLMs []KnownLLM
+	// ctx is the lifetime of our own server, to reload it.
+	ctx context.Context
+	// unloaded is set when the server was stopped after being idle.
+	unloaded bool
+
 	_ struct{}
 }
 
@@ -154,6 +276,9 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
+	if opts.MaxConcurrentDownloads != 0 {
+		huggingface.SetMaxConcurrentDownloads(opts.MaxConcurrentDownloads)
+	}
 	cacheModels := filepath.Join(cache, "models")
 	if err := os.MkdirAll(cacheModels, 0o755); err != nil {
 		return nil, fmt.Errorf("failed to create the directory to cache models: %w", err)
@@ -162,32 +287,88 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 	if err != nil {
 		return nil, err
 	}
-	l := &Session{HF: hf, Model: opts.Model}
+	l := &Session{HF: hf, cache: cache, opts: *opts, knownLLMs: knownLLMs, ctx: ctx}
+	if err = l.start(ctx); err != nil {
+		return nil, err
+	}
+	l.touch()
+	if opts.IdleTimeout > 0 {
+		go l.unloadWhenIdle(ctx, opts.IdleTimeout)
+	}
+	return l, nil
+}
+
+// start selects the backend and starts the server as specified in l.opts.
+func (l *Session) start(ctx context.Context) error {
+	opts := &l.opts
+	cache := l.cache
+	knownLLMs := l.knownLLMs
+	l.setCurrent(opts.Model, nil, Sampling{})
+	l.vision = false
+	l.c = nil
+	l.done = nil
+	l.cancel = nil
+	l.auth = ""
+	l.remoteModel = ""
+	var err error
+	remote := opts.Remote
+	if len(opts.Backends) != 0 {
+		if remote, err = internal.SelectBackend(ctx, "llm", "", opts.Backends, 2*time.Second); err != nil {
+			return err
+		}
+		if remote == "local" {
+			remote = ""
+		}
+	}
+	openAI := isURL(remote)
+
 	known := -1
 	if opts.Model != "python" {
 		for i, k := range knownLLMs {
 			if strings.HasPrefix(string(opts.Model), string(k.Source)) {
 				known = i
-				l.Encoding = k.PromptEncoding
+				l.setCurrent(l.Model, k.PromptEncoding, k.Sampling)
+				l.vision = k.MultimodalProjector != "" && k.PromptEncoding == nil
 				break
 			}
 		}
-		if known == -1 {
-			return nil, fmt.Errorf("unknown LLM model %q, add to knownllms section first", l.Model)
+		if known == -1 && !openAI {
+			return fmt.Errorf("unknown LLM model %q, add to knownllms section first", l.Model)
 		}
+		if known != -1 && remote == "" && opts.Model == knownLLMs[known].Source {
+			// No quantization was specified, select one that fits.
+			model, err := l.selectQuantization(ctx, &knownLLMs[known], opts.VRAMBudget)
+			if err != nil {
+				return err
+			}
+			l.setCurrent(model, l.Encoding, l.sampling)
+			if l.Model == "" {
+				return fmt.Errorf("specify the quantization of model %q or set vram_budget", opts.Model)
+			}
+			slog.Info("llm", "message", "selected quantization", "model", l.Model, "vram_budget", opts.VRAMBudget)
+			// Don't query again when reloading.
+			opts.Model = l.Model
+		}
+	}
+	if openAI {
+		// Only the chat completions API is available. Let the server reject the
+		// images if the model doesn't support them.
+		l.setCurrent(l.Model, nil, l.sampling)
+		l.vision = l.vision || known == -1
 	}
 
 	cachePy := filepath.Join(cache, "py")
-	if opts.Remote == "" {
+	if remote == "" {
 		llamasrv := ""
 		isLlamafile := false
 		modelFile := ""
+		mmproj := ""
 		if opts.Model == "python" {
 			if err := os.MkdirAll(cachePy, 0o755); err != nil {
-				return nil, fmt.Errorf("failed to create the directory to cache python: %w", err)
+				return fmt.Errorf("failed to create the directory to cache python: %w", err)
 			}
 			if err := py.RecreateVirtualEnvIfNeeded(ctx, cachePy); err != nil {
-				return nil, fmt.Errorf("failed to load llm: %w", err)
+				return fmt.Errorf("failed to load llm: %w", err)
 			}
 			slog.Info("llm", "message", "using python")
 			l.backend = "python"
@@ -195,7 +376,7 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 			// Make sure the server is available.
 			var err error
 			if llamasrv, isLlamafile, err = getLlama(ctx, cache); err != nil {
-				return nil, fmt.Errorf("failed to load llm: %w", err)
+				return fmt.Errorf("failed to load llm: %w", err)
 			}
 			if l.backend = "llama-server"; isLlamafile {
 				l.backend = "llamafile"
@@ -204,13 +385,18 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 			c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
 			d, err := c.CombinedOutput()
 			if err != nil {
-				return nil, fmt.Errorf("failed to get llm version: %w\n%s", err, string(d))
+				return fmt.Errorf("failed to get llm version: %w\n%s", err, string(d))
 			}
 			slog.Info("llm", "path", llamasrv, "version", strings.TrimSpace(string(d)))
 
 			// Make sure the model is available.
-			if modelFile, err = l.ensureModel(ctx, opts.Model, knownLLMs[known]); err != nil {
-				return nil, fmt.Errorf("failed to get llm model: %w", err)
+			if modelFile, err = l.ensureModel(ctx, l.Model, knownLLMs[known]); err != nil {
+				return fmt.Errorf("failed to get llm model: %w", err)
+			}
+			if l.vision {
+				if mmproj, err = l.HF.EnsureFile(ctx, knownLLMs[known].MultimodalProjector+".gguf", 0o644); err != nil {
+					return fmt.Errorf("failed to get llm multimodal projector: %w", err)
+				}
 			}
 		}
 
@@ -221,7 +407,7 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 			cmd := []string{filepath.Join(cachePy, "llm.py"), "--port", strconv.Itoa(port)}
 			done, cancel, err := py.Run(ctx, filepath.Join(cachePy, "venv"), cmd, cachePy, filepath.Join(cachePy, "llm.log"))
 			if err != nil {
-				return nil, fmt.Errorf("failed to start python llm server: %w", err)
+				return fmt.Errorf("failed to start python llm server: %w", err)
 			}
 			l.done = done
 			l.cancel = cancel
@@ -230,7 +416,7 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 			l.done = done
 			log, err := os.OpenFile(filepath.Join(cache, "llm.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
 			if err != nil {
-				return nil, fmt.Errorf("failed to create llm server log file: %w", err)
+				return fmt.Errorf("failed to create llm server log file: %w", err)
 			}
 			defer log.Close()
 			// Surprisingly llama-server seems to be hardcoded to 8 threads. Leave 2
@@ -250,6 +436,9 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 			if opts.ContextLength != 0 {
 				common = append(common, "--ctx-size", strconv.Itoa(opts.ContextLength))
 			}
+			if mmproj != "" {
+				common = append(common, "--mmproj", mmproj)
+			}
 			cmd := mangleForLlamafile(isLlamafile, append(common, "--nobrowser")...)
 			if !isLlamafile {
 				cmd = mangleForLlamafile(isLlamafile, common...)
@@ -264,41 +453,145 @@ func New(ctx context.Context, cache string, opts *Options, knownLLMs []KnownLLM)
 				return l.c.Process.Kill()
 			}
 			if err = l.c.Start(); err != nil {
-				return nil, fmt.Errorf("failed to start llm server: %w", err)
+				return fmt.Errorf("failed to start llm server: %w", err)
 			}
 			go l.waitForTerminated(done)
 			slog.Info("llm", "state", "started", "pid", l.c.Process.Pid, "port", port)
 		}
+	} else if openAI {
+		// Accept the base URL with or without the API version, as documented by
+		// the various servers.
+		l.baseURL = strings.TrimSuffix(strings.TrimSuffix(remote, "/"), "/v1")
+		if opts.APIKey != "" {
+			l.auth = "Bearer " + opts.APIKey
+		}
+		l.remoteModel = opts.RemoteModel
+		slog.Info("llm", "state", "loading")
+		l.backend = "openai"
 	} else {
-		if !internal.IsHostPort(opts.Remote) {
-			return nil, fmt.Errorf("invalid remote %q; use form 'host:port'", opts.Remote)
+		if !internal.IsHostPort(remote) {
+			return fmt.Errorf("invalid remote %q; use form 'host:port'", remote)
 		}
 		// TODO: Support online paid backends:
 		// https://platform.openai.com/docs/api-reference/chat/create
 		// https://docs.anthropic.com/en/api/messages-examples
 		// https://cloud.google.com/vertex-ai/generative-ai/docs/start/quickstarts/quickstart-multimodal
-		l.baseURL = "http://" + opts.Remote
+		l.baseURL = "http://" + remote
 		slog.Info("llm", "state", "loading")
 		l.backend = "remote"
 	}
 
 	for ctx.Err() == nil {
-		if status, _ := l.GetHealth(ctx); status == "ok" {
+		status, err := l.getHealth(ctx)
+		if status == "ok" {
 			break
 		}
+		if internal.IsUnauthorized(err) {
+			return fmt.Errorf("llm server rejected the credentials: %w", err)
+		}
 		select {
 		case err := <-l.done:
-			return nil, fmt.Errorf("starting llm server failed: %w", err)
+			return fmt.Errorf("starting llm server failed: %w", err)
 		case <-ctx.Done():
 		case <-time.After(100 * time.Millisecond):
 		}
 	}
-	slog.Info("llm", "state", "ready", "model", opts.Model, "using", l.backend, "url", l.baseURL)
-	return l, nil
+	if openAI && l.remoteModel == "" {
+		models, err := l.listModels(ctx)
+		if err != nil {
+			return err
+		}
+		if len(models) == 0 {
+			return errors.New("llm server doesn't list any model; set remote_model")
+		}
+		l.remoteModel = models[0]
+	}
+	slog.Info("llm", "state", "ready", "model", opts.Model, "remote_model", l.remoteModel, "using", l.backend, "url", l.baseURL)
+	return nil
 }
 
 func (l *Session) Close() error {
 	slog.Info("llm", "state", "terminating")
+	return l.stop()
+}
+
+// SwitchModel restarts the server with another model, downloading it if
+// needed.
+//
+// It waits for the requests in flight to complete; cancel their context to
+// abort them. If the new model fails to load, the previous one is restarted.
+// It is not supported when using a remote server.
+//
+// ctx controls the lifetime of the new server, like with New.
+func (l *Session) SwitchModel(ctx context.Context, model huggingface.PackedFileRef) error {
+	if model != "python" {
+		if err := model.Validate(); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backend == "remote" || l.backend == "openai" {
+		return errors.New("can't switch the model of a remote server")
+	}
+	if model == l.Model {
+		return nil
+	}
+	slog.Info("llm", "state", "switching", "from", l.Model, "to", model)
+	prev := l.opts
+	if err := l.stop(); err != nil {
+		slog.Warn("llm", "message", "previous server failed", "error", err)
+	}
+	// Always start our own server, even if a remote one became healthy.
+	l.opts.Remote = ""
+	l.opts.Backends = nil
+	l.opts.Model = model
+	l.ctx = ctx
+	l.unloaded = false
+	err := l.start(ctx)
+	if err == nil {
+		return nil
+	}
+	// When start fails, the process either failed to start or already exited.
+	err = fmt.Errorf("failed to load %q: %w", model, err)
+	l.opts = prev
+	l.opts.Remote = ""
+	l.opts.Backends = nil
+	if err2 := l.start(ctx); err2 != nil {
+		// Nothing is running, make Close a no-op.
+		l.done = nil
+		return errors.Join(err, fmt.Errorf("failed to restart %q: %w", prev.Model, err2))
+	}
+	return err
+}
+
+// CurrentModel returns the model in use. It doesn't wait for SwitchModel.
+func (l *Session) CurrentModel() huggingface.PackedFileRef {
+	l.modelMu.Lock()
+	defer l.modelMu.Unlock()
+	return l.Model
+}
+
+// CurrentEncoding returns the prompt encoding of the model in use, nil when
+// using the chat completions API. It doesn't wait for SwitchModel.
+func (l *Session) CurrentEncoding() *PromptEncoding {
+	l.modelMu.Lock()
+	defer l.modelMu.Unlock()
+	return l.Encoding
+}
+
+// setCurrent updates Model, Encoding and the sampling. Only start calls it,
+// with mu held or before the session is returned.
+func (l *Session) setCurrent(model huggingface.PackedFileRef, encoding *PromptEncoding, sampling Sampling) {
+	l.modelMu.Lock()
+	defer l.modelMu.Unlock()
+	l.Model = model
+	l.Encoding = encoding
+	l.sampling = sampling
+}
+
+// stop terminates the server, if we started it.
+func (l *Session) stop() error {
 	if l.done == nil {
 		// Using a remote server.
 		return nil
@@ -325,8 +618,128 @@ func (l *Session) Close() error {
 	return err
 }
 
+// Loaded returns false when our own server was unloaded after being idle. It
+// is reloaded by Load or on the next request.
+func (l *Session) Loaded() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !l.unloaded
+}
+
+// Load reloads our own server if it was unloaded after being idle. It is a
+// no-op otherwise. It can take a while with large models.
+func (l *Session) Load() error {
+	l.touch()
+	if l.Loaded() {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.unloaded {
+		return nil
+	}
+	slog.Info("llm", "state", "reloading", "model", l.Model)
+	if err := l.start(l.ctx); err != nil {
+		return fmt.Errorf("failed to reload %q: %w", l.Model, err)
+	}
+	l.unloaded = false
+	return nil
+}
+
+// touch records activity, to postpone unloading the server.
+func (l *Session) touch() {
+	l.lastUsed.Store(time.Now().UnixNano())
+}
+
+// unloadWhenIdle unloads our own server once it was idle for timeout, until
+// ctx is done.
+func (l *Session) unloadWhenIdle(ctx context.Context, timeout time.Duration) {
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.unloadIfIdle(timeout)
+		}
+	}
+}
+
+// unloadIfIdle stops our own server if it was idle for timeout. It waits for
+// the requests in flight. It returns true if the server was unloaded.
+func (l *Session) unloadIfIdle(timeout time.Duration) bool {
+	idle := func() bool { return time.Since(time.Unix(0, l.lastUsed.Load())) >= timeout }
+	if !idle() {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// l.done is nil when using a remote server.
+	if l.unloaded || l.done == nil || !idle() {
+		return false
+	}
+	slog.Info("llm", "state", "unloading", "model", l.Model, "idle", timeout)
+	if err := l.stop(); err != nil {
+		slog.Warn("llm", "message", "server failed", "error", err)
+	}
+	// Make Close a no-op.
+	l.done = nil
+	l.unloaded = true
+	return true
+}
+
+// SupportsVision returns true if the model accepts images in the messages.
+func (l *Session) SupportsVision() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.vision
+}
+
+// SupportsTools returns true if the LLM can be prompted with tools.
+//
+// The tools require the OpenAI compatible API of a remote server supporting
+// function calling, e.g. llama-server started with --jinja. The llama-server
+// started locally is too old for it.
+func (l *Session) SupportsTools() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.supportsTools()
+}
+
+func (l *Session) supportsTools() bool {
+	return l.Encoding == nil && (l.backend == "openai" || l.backend == "remote")
+}
+
+// Sampling returns the sampling recommended for the model in use, as
+// configured in its KnownLLM entry.
+//
+// It doesn't wait for SwitchModel or a reload.
+func (l *Session) Sampling() Sampling {
+	l.modelMu.Lock()
+	defer l.modelMu.Unlock()
+	return l.sampling
+}
+
 // GetHealth retrieves the heath of the server.
 func (l *Session) GetHealth(ctx context.Context) (string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.unloaded {
+		return "unloaded while idle", nil
+	}
+	return l.getHealth(ctx)
+}
+
+func (l *Session) getHealth(ctx context.Context) (string, error) {
+	if l.backend == "openai" {
+		// There's no standard health endpoint. Listing the models also checks
+		// the credentials.
+		if _, err := l.listModels(ctx); err != nil {
+			return "", err
+		}
+		return "ok", nil
+	}
 	req, err := http.NewRequestWithContext(ctx, "GET", l.baseURL+"/health", nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create HTTP request: %w", err)
@@ -373,6 +786,14 @@ type Metrics struct {
 
 // GetMetrics retrieves the performance statistics from the server.
 func (l *Session) GetMetrics(ctx context.Context, m *Metrics) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.unloaded {
+		return errors.New("the model is unloaded while idle")
+	}
+	if l.backend == "openai" {
+		return errors.New("the metrics are not available from an OpenAI compatible server")
+	}
 	req, err := http.NewRequestWithContext(ctx, "GET", l.baseURL+"/metrics", nil)
 	if err != nil {
 		return fmt.Errorf("failed to create HTTP request: %w", err)
@@ -429,27 +850,59 @@ func (l *Session) GetMetrics(ctx context.Context, m *Metrics) error {
 	return nil
 }
 
+// PromptOptions are the generation options of a prompt.
+type PromptOptions struct {
+	// MaxTokens limits the length of the reply when non-zero.
+	MaxTokens int
+	// Seed makes the output deterministic when non-zero, without strong
+	// guarantees.
+	Seed int
+	// Temperature is between 0 (deterministic and repetitive) and 2 (creative
+	// and random, possibly nonsensical). It is recommended to use 1.0 by
+	// default, except some models (like Mistral-Nemo) requires much lower
+	// value <=0.3.
+	Temperature float64
+	// TopP limits the sampling to the most probable tokens whose cumulative
+	// probability reaches it. Use 0 for the server's default.
+	TopP float64
+	// Stop stops the generation as soon as one of the sequences is generated.
+	// The stop sequence is not included in the reply.
+	Stop []string
+
+	_ struct{}
+}
+
 // Prompt prompts the LLM and returns the reply.
 //
-// See PromptStreaming for the arguments values.
-//
-// The first message is assumed to be the system prompt.
-func (l *Session) Prompt(ctx context.Context, msgs []Message, maxtoks, seed int, temperature float64) (string, error) {
+// opts is optional. The first message is assumed to be the system prompt.
+func (l *Session) Prompt(ctx context.Context, msgs []Message, opts *PromptOptions) (string, error) {
 	r := trace.StartRegion(ctx, "llm.Prompt")
 	defer r.End()
+	if err := l.Load(); err != nil {
+		return "", err
+	}
+	defer l.touch()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 	if len(msgs) == 0 {
 		return "", errors.New("input required")
 	}
+	if !l.vision && hasImage(msgs) {
+		return "", ErrVisionUnsupported
+	}
+	if opts == nil {
+		opts = &PromptOptions{}
+	}
 	start := time.Now()
 	msgs = l.processMsgs(msgs)
 	reply := ""
 	var err error
 	if l.Encoding == nil {
 		slog.Info("llm", "num_msgs", len(msgs), "msg", msgs[len(msgs)-1], "api", "openai", "type", "blocking")
-		reply, err = l.openAIPromptBlocking(ctx, msgs, maxtoks, seed, temperature)
+		reply, err = l.openAIPromptBlocking(ctx, msgs, opts)
 	} else {
 		slog.Info("llm", "num_msgs", len(msgs), "msg", msgs[len(msgs)-1], "api", "llama.cpp", "type", "blocking")
-		reply, err = l.llamaCPPPromptBlocking(ctx, msgs, maxtoks, seed, temperature)
+		reply, err = l.llamaCPPPromptBlocking(ctx, msgs, opts)
 	}
 	if err != nil {
 		slog.Error("llm", "msgs", msgs, "error", err, "duration", time.Since(start).Round(time.Millisecond))
@@ -470,40 +923,58 @@ func (l *Session) Prompt(ctx context.Context, msgs []Message, maxtoks, seed int,
 
 // PromptStreaming prompts the LLM and returns the reply in the supplied channel.
 //
-// Use a non-zero seed to get deterministic output (without strong guarantees).
-//
-// Use low temperature (<1.0) to get more deterministic and repetitive output.
-//
-// Use high temperature (>1.0) to get more creative and random text. High
-// values can result in nonsensical responses.
-//
-// It is recommended to use 1.0 by default, except some models (like
-// Mistral-Nemo) requires much lower value <=0.3.
+// opts is optional. The first message is assumed to be the system prompt.
+func (l *Session) PromptStreaming(ctx context.Context, msgs []Message, opts *PromptOptions, words chan<- string) error {
+	_, err := l.PromptStreamingTools(ctx, msgs, nil, opts, words)
+	return err
+}
+
+// PromptStreamingTools is like PromptStreaming but lets the LLM call the
+// supplied tools. The text of the reply is streamed in words as usual and the
+// calls requested by the LLM are returned once the reply is complete. It is up
+// to the caller to run them, append the assistant message with the calls and
+// one ToolResult message per result, then prompt again.
 //
-// The first message is assumed to be the system prompt.
-func (l *Session) PromptStreaming(ctx context.Context, msgs []Message, maxtoks, seed int, temperature float64, words chan<- string) error {
+// The tools are only supported as reported by SupportsTools.
+func (l *Session) PromptStreamingTools(ctx context.Context, msgs []Message, tools []Tool, opts *PromptOptions, words chan<- string) ([]ToolCallRequest, error) {
 	r := trace.StartRegion(ctx, "llm.PromptStreaming")
 	defer r.End()
+	if err := l.Load(); err != nil {
+		return nil, err
+	}
+	defer l.touch()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 	if len(msgs) == 0 {
-		return errors.New("input required")
+		return nil, errors.New("input required")
+	}
+	if !l.vision && hasImage(msgs) {
+		return nil, ErrVisionUnsupported
+	}
+	if len(tools) != 0 && !l.supportsTools() {
+		return nil, ErrToolsUnsupported
+	}
+	if opts == nil {
+		opts = &PromptOptions{}
 	}
 	start := time.Now()
 	msgs = l.processMsgs(msgs)
 	reply := ""
+	var calls []ToolCallRequest
 	var err error
 	if l.Encoding == nil {
-		slog.Info("llm", "num_msgs", len(msgs), "msg", msgs[len(msgs)-1], "api", "openai", "type", "streaming")
-		reply, err = l.openAIPromptStreaming(ctx, msgs, maxtoks, seed, temperature, words)
+		slog.Info("llm", "num_msgs", len(msgs), "msg", msgs[len(msgs)-1], "api", "openai", "type", "streaming", "tools", len(tools))
+		reply, calls, err = l.openAIPromptStreaming(ctx, msgs, tools, opts, words)
 	} else {
 		slog.Info("llm", "num_msgs", len(msgs), "msg", msgs[len(msgs)-1], "api", "llama.cpp", "type", "streaming")
-		reply, err = l.llamaCPPPromptStreaming(ctx, msgs, maxtoks, seed, temperature, words)
+		reply, err = l.llamaCPPPromptStreaming(ctx, msgs, opts, words)
 	}
 	if err != nil {
 		slog.Error("llm", "reply", reply, "error", err, "duration", time.Since(start).Round(time.Millisecond))
-		return err
+		return calls, err
 	}
-	slog.Info("llm", "reply", reply, "duration", time.Since(start).Round(time.Millisecond))
-	return nil
+	slog.Info("llm", "reply", reply, "tool_calls", calls, "duration", time.Since(start).Round(time.Millisecond))
+	return calls, nil
 }
 
 //
@@ -513,16 +984,25 @@ func (l *Session) waitForTerminated(done chan<- error) {
 	slog.Info("llm", "state", "terminated")
 }
 
-func (l *Session) openAIPromptBlocking(ctx context.Context, msgs []Message, maxtoks, seed int, temperature float64) (string, error) {
+func (l *Session) openAIPromptBlocking(ctx context.Context, msgs []Message, opts *PromptOptions) (string, error) {
 	data := openAIChatCompletionRequest{
-		Model:       "ignored",
-		MaxTokens:   maxtoks,
+		Model:       l.requestModel(),
+		MaxTokens:   opts.MaxTokens,
 		Messages:    msgs,
-		Seed:        seed,
-		Temperature: temperature,
+		Seed:        opts.Seed,
+		Temperature: opts.Temperature,
+		TopP:        opts.TopP,
+		Stop:        opts.Stop,
 	}
 	msg := openAIChatCompletionsResponse{}
-	if err := internal.JSONPost(ctx, l.baseURL+"/v1/chat/completions", data, &msg); err != nil {
+	url := l.baseURL + "/v1/chat/completions"
+	resp, err := internal.JSONPostRequest(ctx, url, l.auth, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to get llama server chat response: %w", err)
+	}
+	err = l.decodeResponse(url, resp, &msg)
+	_ = resp.Body.Close()
+	if err != nil {
 		return "", fmt.Errorf("failed to get llama server chat response: %w", err)
 	}
 	if len(msg.Choices) != 1 {
@@ -531,58 +1011,78 @@ func (l *Session) openAIPromptBlocking(ctx context.Context, msgs []Message, maxt
 	return msg.Choices[0].Message.Content, nil
 }
 
-func (l *Session) openAIPromptStreaming(ctx context.Context, msgs []Message, maxtoks, seed int, temperature float64, words chan<- string) (string, error) {
+func (l *Session) openAIPromptStreaming(ctx context.Context, msgs []Message, tools []Tool, opts *PromptOptions, words chan<- string) (string, []ToolCallRequest, error) {
 	start := time.Now()
 	data := openAIChatCompletionRequest{
-		Model:       "ignored",
+		Model:       l.requestModel(),
 		Messages:    msgs,
-		MaxTokens:   maxtoks,
+		Tools:       tools,
+		MaxTokens:   opts.MaxTokens,
 		Stream:      true,
-		Seed:        seed,
-		Temperature: temperature,
+		Seed:        opts.Seed,
+		Temperature: opts.Temperature,
+		TopP:        opts.TopP,
+		Stop:        opts.Stop,
 	}
-	resp, err := internal.JSONPostRequest(ctx, l.baseURL+"/v1/chat/completions", data)
+	url := l.baseURL + "/v1/chat/completions"
+	resp, err := internal.JSONPostRequest(ctx, url, l.auth, data)
 	if err != nil {
-		return "", fmt.Errorf("failed to get llama server response: %w", err)
+		return "", nil, fmt.Errorf("failed to get llama server response: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", nil, fmt.Errorf("failed to get llama server response: %w", internal.NewHTTPError(url, resp))
+	}
 	r := bufio.NewReader(resp.Body)
 	reply := ""
+	var calls []ToolCallRequest
 	for {
 		line, err := r.ReadBytes('\n')
 		line = bytes.TrimSpace(line)
 		if err == io.EOF {
 			err = nil
 			if len(line) == 0 {
-				return reply, nil
+				return reply, calls, nil
 			}
 		}
 		if err != nil {
-			return reply, fmt.Errorf("failed to get llama server response: %w", err)
+			return reply, calls, fmt.Errorf("failed to get llama server response: %w", err)
 		}
-		if len(line) == 0 {
+		// Skip the empty lines and the server-sent events comments, used as
+		// keep-alive by some servers.
+		if len(line) == 0 || line[0] == ':' {
 			continue
 		}
 		const prefix = "data: "
 		if !bytes.HasPrefix(line, []byte(prefix)) {
-			return reply, fmt.Errorf("unexpected line. expected \"data: \", got %q", line)
+			return reply, calls, fmt.Errorf("unexpected line. expected \"data: \", got %q", line)
+		}
+		if string(line[len(prefix):]) == "[DONE]" {
+			return reply, calls, nil
 		}
 		d := json.NewDecoder(bytes.NewReader(line[len(prefix):]))
-		d.DisallowUnknownFields()
+		if l.backend != "openai" {
+			d.DisallowUnknownFields()
+		}
 		msg := openAIChatCompletionsStreamResponse{}
 		if err = d.Decode(&msg); err != nil {
-			return reply, fmt.Errorf("failed to decode llama server response %q: %w", string(line), err)
+			return reply, calls, fmt.Errorf("failed to decode llama server response %q: %w", string(line), err)
+		}
+		if len(msg.Choices) == 0 && l.backend == "openai" {
+			// The last chunk may only have the usage.
+			continue
 		}
 		if len(msg.Choices) != 1 {
-			return reply, fmt.Errorf("llama server returned an unexpected number of choices, expected 1, got %d", len(msg.Choices))
+			return reply, calls, fmt.Errorf("llama server returned an unexpected number of choices, expected 1, got %d", len(msg.Choices))
 		}
+		calls = mergeToolCallDeltas(calls, msg.Choices[0].Delta.ToolCalls)
 		word := msg.Choices[0].Delta.Content
 		slog.Debug("llm", "word", word, "duration", time.Since(start).Round(time.Millisecond))
 		// TODO: Remove.
 		switch word {
 		// Llama-3, Gemma-2, Phi-3
 		case "<|eot_id|>", "<end_of_turn>", "<|end|>", "<|endoftext|>":
-			return reply, nil
+			return reply, calls, nil
 		case "":
 		default:
 			words <- word
@@ -591,8 +1091,60 @@ func (l *Session) openAIPromptStreaming(ctx context.Context, msgs []Message, max
 	}
 }
 
-func (l *Session) llamaCPPPromptBlocking(ctx context.Context, msgs []Message, maxtoks, seed int, temperature float64) (string, error) {
-	data := llamaCPPCompletionRequest{Seed: int64(seed), Temperature: temperature, NPredict: int64(maxtoks)}
+// requestModel returns the model to put in the OpenAI compatible requests.
+// llama-server ignores it.
+func (l *Session) requestModel() string {
+	if l.remoteModel != "" {
+		return l.remoteModel
+	}
+	return "ignored"
+}
+
+// listModels returns the models served by an OpenAI compatible server.
+func (l *Session) listModels(ctx context.Context) ([]string, error) {
+	url := l.baseURL + "/v1/models"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if l.auth != "" {
+		req.Header.Set("Authorization", l.auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the models: %w", err)
+	}
+	defer resp.Body.Close()
+	msg := openAIModelsResponse{}
+	if err = l.decodeResponse(url, resp, &msg); err != nil {
+		return nil, fmt.Errorf("failed to list the models: %w", err)
+	}
+	out := make([]string, 0, len(msg.Data))
+	for _, m := range msg.Data {
+		out = append(out, m.ID)
+	}
+	return out, nil
+}
+
+// decodeResponse decodes the JSON response. The unknown fields are rejected
+// to catch changes in llama-server but ignored from an OpenAI compatible
+// server, since each one adds its own.
+func (l *Session) decodeResponse(url string, resp *http.Response, out interface{}) error {
+	if resp.StatusCode >= 400 {
+		return internal.NewHTTPError(url, resp)
+	}
+	d := json.NewDecoder(resp.Body)
+	if l.backend != "openai" {
+		d.DisallowUnknownFields()
+	}
+	if err := d.Decode(out); err != nil {
+		return fmt.Errorf("failed to decode server response: %w", err)
+	}
+	return nil
+}
+
+func (l *Session) llamaCPPPromptBlocking(ctx context.Context, msgs []Message, opts *PromptOptions) (string, error) {
+	data := llamaCPPCompletionRequest{Seed: int64(opts.Seed), Temperature: opts.Temperature, TopP: opts.TopP, NPredict: int64(opts.MaxTokens), Stop: opts.Stop}
 	// Doc mentions it causes non-determinism even if a non-zero seed is
 	// specified. Disable if it becomes a problem.
 	data.CachePrompt = true
@@ -600,7 +1152,7 @@ func (l *Session) llamaCPPPromptBlocking(ctx context.Context, msgs []Message, ma
 		return "", err
 	}
 	msg := llamaCPPCompletionResponse{}
-	if err := internal.JSONPost(ctx, l.baseURL+"/completion", data, &msg); err != nil {
+	if err := internal.JSONPost(ctx, l.baseURL+"/completion", "", data, &msg); err != nil {
 		return "", fmt.Errorf("failed to get llama server response: %w", err)
 	}
 	slog.Debug("llm", "prompt tok", msg.Timings.PromptN, "gen tok", msg.Timings.PredictedN, "prompt tok/ms", msg.Timings.PromptPerTokenMS, "gen tok/ms", msg.Timings.PredictedPerTokenMS)
@@ -608,13 +1160,15 @@ func (l *Session) llamaCPPPromptBlocking(ctx context.Context, msgs []Message, ma
 	return strings.ReplaceAll(msg.Content, "\u2581", " "), nil
 }
 
-func (l *Session) llamaCPPPromptStreaming(ctx context.Context, msgs []Message, maxtoks, seed int, temperature float64, words chan<- string) (string, error) {
+func (l *Session) llamaCPPPromptStreaming(ctx context.Context, msgs []Message, opts *PromptOptions, words chan<- string) (string, error) {
 	start := time.Now()
 	data := llamaCPPCompletionRequest{
 		Stream:      true,
-		Seed:        int64(seed),
-		Temperature: temperature,
-		NPredict:    int64(maxtoks),
+		Seed:        int64(opts.Seed),
+		Temperature: opts.Temperature,
+		TopP:        opts.TopP,
+		NPredict:    int64(opts.MaxTokens),
+		Stop:        opts.Stop,
 	}
 	// Doc mentions it causes non-determinism even if a non-zero seed is
 	// specified. Disable if it becomes a problem.
@@ -622,7 +1176,7 @@ func (l *Session) llamaCPPPromptStreaming(ctx context.Context, msgs []Message, m
 	if err := l.initPrompt(&data, msgs); err != nil {
 		return "", err
 	}
-	resp, err := internal.JSONPostRequest(ctx, l.baseURL+"/completion", data)
+	resp, err := internal.JSONPostRequest(ctx, l.baseURL+"/completion", "", data)
 	if err != nil {
 		return "", fmt.Errorf("failed to get llama server response: %w", err)
 	}
@@ -707,8 +1261,8 @@ func (l *Session) initPrompt(data *llamaCPPCompletionRequest, msgs []Message) er
 
 // ensureModel gets the model if missing.
 //
-// Currently hard-coded to GGUF files and Hugging Face. Doesn't support split
-// files.
+// Currently hard-coded to GGUF files and Hugging Face. Files split in shards
+// are supported, see huggingface.ShardOf.
 func (l *Session) ensureModel(ctx context.Context, model huggingface.PackedFileRef, k KnownLLM) (string, error) {
 	// TODO: This is very "meh".
 	// Designed to handle special case like Mistral-7B-Instruct-v0.3-Q3_K_M.
@@ -755,51 +1309,164 @@ func (l *Session) ensureModel(ctx context.Context, model huggingface.PackedFileR
 		l.modelFile = dst
 		return dst, nil
 	}
-	slog.Info("llm", "model", model, "state", "missing")
+	// A model split in shards is only usable if all the shards are present.
+	first, complete := cachedShards(l.HF.Cache, model.Basename())
+	if complete {
+		l.modelFile = first
+		return first, nil
+	}
+	if first == "" {
+		slog.Info("llm", "model", model, "state", "missing")
+	} else {
+		slog.Info("llm", "model", model, "state", "missing shards")
+	}
 	if k.Source.RepoID() == "" {
 		return "", fmt.Errorf("can't guess model %q huggingface repo", model)
 	}
 	// Hack: we assume everything is on HuggingFace.
 	switch k.PackagingType {
 	case "gguf":
-		if dst, err = l.HF.EnsureFile(ctx, model+".gguf", 0o644); err != nil {
-			// Get the list of files to help the user.
-			m := huggingface.Model{ModelRef: model.ModelRef()}
-			err = fmt.Errorf("can't find model %q at %s: %w", model, m.URL(), err)
-			if err2 := l.HF.GetModelInfo(ctx, &m); err2 != nil {
-				return dst, errors.Join(err, err2)
+		if first == "" {
+			if dst, err = l.HF.EnsureFile(ctx, model+".gguf", 0o644); err == nil {
+				l.modelFile = dst
+				return dst, nil
 			}
-			msg := "Supported quantizations: "
-			added := false
-			for _, f := range m.Files {
-				// TODO: Move this into a common function.
-				if !strings.HasPrefix(f, k.Source.Basename()) {
-					continue
-				}
-				if strings.Contains(f, "/") {
-					// Skip files in subdirectories for now.
-					continue
-				}
-				if strings.HasPrefix(filepath.Ext(f), ".cat") {
-					// TODO: Support split files. For now just hide them. They are large
-					// anyway so it's only for power users.
-					continue
-				}
-				if added {
-					msg += ", "
-				}
-				msg += strings.TrimSuffix(f[len(model.Basename()):], ".gguf")
-				added = true
+		}
+		// The file may be split in shards. Get the list of files to find out, or
+		// to help the user otherwise.
+		m := huggingface.Model{ModelRef: model.ModelRef()}
+		err = fmt.Errorf("can't find model %q at %s: %w", model, m.URL(), err)
+		if err2 := l.HF.GetModelInfo(ctx, &m); err2 != nil {
+			return dst, errors.Join(err, err2)
+		}
+		if shards := m.Shards[model.Basename()+".gguf"]; len(shards) != 0 {
+			if dst, err = l.HF.EnsureShardedFile(ctx, model+".gguf", shards, 0o644); err != nil {
+				return dst, err
 			}
-			return dst, fmt.Errorf("%w; %s", err, msg)
+			l.modelFile = dst
+			return dst, nil
 		}
-		l.modelFile = dst
-		return dst, nil
+		var names []string
+		for _, f := range k.QuantizationFiles(m.Files) {
+			names = append(names, k.QuantizationName(f))
+		}
+		return dst, fmt.Errorf("%w; Supported quantizations: %s", err, strings.Join(names, ", "))
 	default:
 		return dst, fmt.Errorf("internal error: implement packaging type %s", k.PackagingType)
 	}
 }
 
+// cachedShards returns the path to the first shard of a GGUF file split in
+// the "<name>-00001-of-00003.gguf" format, and whether all the shards are in
+// dir. The number of shards is read from the file name, so it works offline.
+// first is empty if the first shard is missing.
+func cachedShards(dir, name string) (first string, complete bool) {
+	const prefix = "-00001-of-"
+	m, _ := filepath.Glob(filepath.Join(dir, name+prefix+"*.gguf"))
+	if len(m) != 1 {
+		return "", false
+	}
+	count := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m[0]), name+prefix), ".gguf")
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return m[0], false
+	}
+	for i := 2; i <= n; i++ {
+		if _, err = os.Stat(filepath.Join(dir, fmt.Sprintf("%s-%0*d-of-%s.gguf", name, len(count), i, count))); err != nil {
+			return m[0], false
+		}
+	}
+	return m[0], true
+}
+
+// QuantizationFiles returns the files in a model repository that are
+// quantizations of the known model. A file split in shards is returned once
+// by its logical name, e.g. "model-q8_0.gguf".
+func (k *KnownLLM) QuantizationFiles(files []string) []string {
+	var out []string
+	for _, f := range files {
+		if !strings.HasPrefix(f, k.Source.Basename()) {
+			continue
+		}
+		if strings.Contains(f, "/") {
+			// Skip files in subdirectories for now.
+			continue
+		}
+		if logical, i, ok := huggingface.ShardOf(f); ok {
+			if i != 0 {
+				continue
+			}
+			f = logical
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// QuantizationName returns the quantization of a model file, e.g. "Q5_K_M".
+func (k *KnownLLM) QuantizationName(f string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(f, k.Source.Basename()), ".gguf")
+}
+
+// LargestQuantization returns the largest quantization file of the model
+// repository m, as filled by huggingface.Client.GetModelInfo, estimated to
+// fit in budget bytes of memory. A larger file has a better quality.
+func (k *KnownLLM) LargestQuantization(m *huggingface.Model, budget int64) (string, error) {
+	best := ""
+	smallest := ""
+	for _, f := range k.QuantizationFiles(m.Files) {
+		size := m.FileSizes[f]
+		if size == 0 {
+			continue
+		}
+		if smallest == "" || size < m.FileSizes[smallest] {
+			smallest = f
+		}
+		if EstimateVRAM(size) <= budget && (best == "" || size > m.FileSizes[best]) {
+			best = f
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+	if smallest == "" {
+		return "", fmt.Errorf("no quantization with a known size for model %q", k.Source)
+	}
+	return "", fmt.Errorf("no quantization of model %q fits in %.1fGiB; the smallest, %s, needs ~%.1fGiB", k.Source, float64(budget)/(1<<30), k.QuantizationName(smallest), float64(EstimateVRAM(m.FileSizes[smallest]))/(1<<30))
+}
+
+// EstimateVRAM returns a rough estimate of the memory needed to run a model
+// file. The weights are loaded as-is; add some room for the context and the
+// compute buffers.
+func EstimateVRAM(size int64) int64 {
+	return size + size/5
+}
+
+// SelectQuantization returns the model of the largest quantization of k
+// estimated to fit in Options.VRAMBudget. It returns "" when no budget is
+// configured.
+func (l *Session) SelectQuantization(ctx context.Context, k *KnownLLM) (huggingface.PackedFileRef, error) {
+	l.mu.RLock()
+	budget := l.opts.VRAMBudget
+	l.mu.RUnlock()
+	return l.selectQuantization(ctx, k, budget)
+}
+
+func (l *Session) selectQuantization(ctx context.Context, k *KnownLLM, budget float64) (huggingface.PackedFileRef, error) {
+	if budget == 0 {
+		return "", nil
+	}
+	m := huggingface.Model{ModelRef: k.Source.ModelRef()}
+	if err := l.HF.GetModelInfo(ctx, &m); err != nil {
+		return "", fmt.Errorf("failed to list the quantizations of model %q: %w", k.Source, err)
+	}
+	f, err := k.LargestQuantization(&m, int64(budget*(1<<30)))
+	if err != nil {
+		return "", err
+	}
+	return k.Source + huggingface.PackedFileRef(k.QuantizationName(f)), nil
+}
+
 // processMsgs process the system prompt.
 func (l *Session) processMsgs(msgs []Message) []Message {
 	if len(msgs) == 0 || msgs[0].Role != System {
@@ -850,17 +1517,17 @@ type llamaCPPCompletionRequest struct {
 	Grammar          string      `json:"grammar,omitempty"`
 	JSONSchema       interface{} `json:"json_schema,omitempty"`
 	Seed             int64       `json:"seed,omitempty"`
-	Temperature      float64     `json:"temperature,omitempty"`
+	Temperature      float64     `json:"temperature"`
 	DynaTempRange    float64     `json:"dynatemp_range,omitempty"`
 	DynaTempExponent float64     `json:"dynatemp_exponent,omitempty"`
 	CachePrompt      bool        `json:"cache_prompt,omitempty"`
 	Stream           bool        `json:"stream"`
 	// top_k             float64
-	// top_p             float64
+	TopP float64 `json:"top_p,omitempty"`
 	// min_p             float64
 	NPredict int64 `json:"n_predict,omitempty"` // Maximum number of tokens to predict
 	// n_keep            int64
-	// stop              []string
+	Stop []string `json:"stop,omitempty"`
 	// tfs_z             float64
 	// typical_p         float64
 	// repeat_penalty    float64
@@ -930,7 +1597,10 @@ type openAIChatCompletionRequest struct {
 	Stream      bool      `json:"stream"`
 	Messages    []Message `json:"messages"`
 	Seed        int       `json:"seed,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
+	Temperature float64   `json:"temperature"`
+	TopP        float64   `json:"top_p,omitempty"`
+	Stop        []string  `json:"stop,omitempty"`
+	Tools       []Tool    `json:"tools,omitempty"`
 }
 
 // Role is one of the LLM known roles.
@@ -945,12 +1615,104 @@ const (
 	AvailableTools Role = "available_tools"
 	ToolCall       Role = "tool_call"
 	ToolCallResult Role = "tool_call_result"
+	// ToolResult is the result of a call requested with Message.ToolCalls,
+	// with the OpenAI compatible API.
+	ToolResult Role = "tool"
 )
 
 // Message is a message to send to the LLM as part of the exchange.
 type Message struct {
 	Role    Role   `json:"role"`
 	Content string `json:"content"`
+	// Image is an optional image as a base64 data URL, e.g.
+	// "data:image/png;base64,...". Only supported when SupportsVision returns
+	// true.
+	Image string `json:"-"`
+	// ToolCalls are the tools the assistant requested to call.
+	ToolCalls []ToolCallRequest `json:"tool_calls,omitempty"`
+	// ToolCallID is the call this message is the result of, with the
+	// ToolResult role.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// Tool is the description of a function the LLM can call, as documented at
+// https://platform.openai.com/docs/guides/function-calling
+type Tool struct {
+	// Type must be "function".
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+
+	_ struct{}
+}
+
+// ToolFunction is an available function to call.
+type ToolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Parameters is the JSON schema of the arguments.
+	Parameters interface{} `json:"parameters"`
+
+	_ struct{}
+}
+
+// ToolCallRequest is a call to a tool requested by the LLM.
+type ToolCallRequest struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction is the function to call and its arguments.
+type ToolCallFunction struct {
+	Name string `json:"name"`
+	// Arguments is a JSON encoded object. The LLM may generate slightly
+	// malformed JSON, decode it with ParseJSON.
+	Arguments string `json:"arguments"`
+}
+
+// MarshalJSON encodes the message with an image as a list of content parts,
+// as documented at
+// https://platform.openai.com/docs/guides/vision
+func (m Message) MarshalJSON() ([]byte, error) {
+	if m.Image == "" {
+		type message Message
+		return json.Marshal(message(m))
+	}
+	type imageURL struct {
+		URL string `json:"url"`
+	}
+	type part struct {
+		Type     string    `json:"type"`
+		Text     string    `json:"text,omitempty"`
+		ImageURL *imageURL `json:"image_url,omitempty"`
+	}
+	parts := make([]part, 0, 2)
+	if m.Content != "" {
+		parts = append(parts, part{Type: "text", Text: m.Content})
+	}
+	parts = append(parts, part{Type: "image_url", ImageURL: &imageURL{URL: m.Image}})
+	return json.Marshal(struct {
+		Role    Role   `json:"role"`
+		Content []part `json:"content"`
+	}{m.Role, parts})
+}
+
+// LogValue implements slog.LogValuer to not log the image data.
+func (m Message) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("role", string(m.Role)), slog.String("content", m.Content)}
+	if m.Image != "" {
+		attrs = append(attrs, slog.Int("image_len", len(m.Image)))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func hasImage(msgs []Message) bool {
+	for i := range msgs {
+		if msgs[i].Image != "" {
+			return true
+		}
+	}
+	return false
 }
 
 // openAIChatCompletionsResponse is documented at
@@ -975,6 +1737,14 @@ type openAIChoices struct {
 	Message      Message `json:"message"`
 }
 
+// openAIModelsResponse is documented at
+// https://platform.openai.com/docs/api-reference/models/list
+type openAIModelsResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
 // openAIChatCompletionsStreamResponse is not documented?
 type openAIChatCompletionsStreamResponse struct {
 	Choices []openAIStreamChoices `json:"choices"`
@@ -998,7 +1768,40 @@ type openAIStreamChoices struct {
 }
 
 type openAIStreamDelta struct {
-	Content string `json:"content"`
+	Role      Role                  `json:"role"`
+	Content   string                `json:"content"`
+	ToolCalls []openAIToolCallDelta `json:"tool_calls"`
+}
+
+// openAIToolCallDelta is a fragment of a tool call. The first fragment of a
+// call has its ID and name, the arguments are then streamed in pieces.
+type openAIToolCallDelta struct {
+	Index    int              `json:"index"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// mergeToolCallDeltas accumulates the streamed fragments of the tool calls.
+func mergeToolCallDeltas(calls []ToolCallRequest, deltas []openAIToolCallDelta) []ToolCallRequest {
+	for _, d := range deltas {
+		if d.Index < 0 {
+			continue
+		}
+		for len(calls) <= d.Index {
+			calls = append(calls, ToolCallRequest{Type: "function"})
+		}
+		c := &calls[d.Index]
+		if d.ID != "" {
+			c.ID = d.ID
+		}
+		if d.Type != "" {
+			c.Type = d.Type
+		}
+		c.Function.Name += d.Function.Name
+		c.Function.Arguments += d.Function.Arguments
+	}
+	return calls
 }
 
 // Tools
@@ -1072,7 +1875,7 @@ func getLlama(ctx context.Context, cache string) (string, bool, error) {
 	zippath := filepath.Join(cache, zipname)
 	if _, err := os.Stat(zippath); err != nil {
 		slog.Info("llm", "retrieving", zipname)
-		if err := huggingface.DownloadFile(ctx, url+zipname, zippath, "", 0o644); err != nil {
+		if err := huggingface.DownloadFile(ctx, url+zipname, zippath, "", 0o644, nil); err != nil {
 			return "", false, fmt.Errorf("failed to download llamafile from github: %w", err)
 		}
 	} else {
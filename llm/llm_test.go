@@ -8,9 +8,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -21,8 +24,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/lmittmann/tint"
 	"github.com/maruel/sillybot/huggingface"
+	"github.com/maruel/sillybot/internal"
 	"github.com/maruel/sillybot/llm/tools"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
@@ -100,6 +105,317 @@ func TestGuessSize(t *testing.T) {
 	}
 }
 
+func TestMessage_MarshalJSON(t *testing.T) {
+	data := []struct {
+		msg  Message
+		want string
+	}{
+		{Message{Role: User, Content: "hi"}, `{"role":"user","content":"hi"}`},
+		{
+			Message{Role: User, Content: "what is it?", Image: "data:image/png;base64,AAAA"},
+			`{"role":"user","content":[{"type":"text","text":"what is it?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}`,
+		},
+		{
+			Message{Role: User, Image: "data:image/png;base64,AAAA"},
+			`{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}`,
+		},
+	}
+	for i, line := range data {
+		b, err := json.Marshal(line.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != line.want {
+			t.Fatalf("#%d: want %s\ngot  %s", i, line.want, got)
+		}
+	}
+}
+
+func TestKnownLLM_Validate(t *testing.T) {
+	hot := 2.5
+	data := []struct {
+		sampling Sampling
+		want     string
+	}{
+		{Sampling{}, ""},
+		{Sampling{Temperature: &hot}, "invalid sampling temperature 2.5; must be between 0 and 2"},
+		{Sampling{TopP: 1.5}, "invalid sampling top_p 1.5; must be between 0 and 1"},
+	}
+	for i, line := range data {
+		k := KnownLLM{Source: "hf:bartowski/gemma-2-9b-it-GGUF/HEAD/gemma-2-9b-it-", PackagingType: "gguf", Upstream: "hf:google/gemma-2-9b-it", Sampling: line.sampling}
+		got := ""
+		if err := k.Validate(); err != nil {
+			got = err.Error()
+		}
+		if got != line.want {
+			t.Fatalf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+}
+
+func TestCachedShards(t *testing.T) {
+	dir := t.TempDir()
+	if first, complete := cachedShards(dir, "model-Q8_0"); first != "" || complete {
+		t.Fatal(first, complete)
+	}
+	for _, n := range []string{"model-Q8_0-00001-of-00003.gguf", "model-Q8_0-00003-of-00003.gguf"} {
+		if err := os.WriteFile(filepath.Join(dir, n), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := filepath.Join(dir, "model-Q8_0-00001-of-00003.gguf")
+	if first, complete := cachedShards(dir, "model-Q8_0"); first != want || complete {
+		t.Fatal(first, complete)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "model-Q8_0-00002-of-00003.gguf"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if first, complete := cachedShards(dir, "model-Q8_0"); first != want || !complete {
+		t.Fatal(first, complete)
+	}
+}
+
+func TestKnownLLM_LargestQuantization(t *testing.T) {
+	const gib = 1 << 30
+	k := KnownLLM{Source: "hf:bartowski/gemma-2-9b-it-GGUF/HEAD/gemma-2-9b-it-"}
+	m := huggingface.Model{
+		Files: []string{"README.md", "gemma-2-9b-it-Q4_K_M.gguf", "gemma-2-9b-it-Q8_0.gguf", "gemma-2-9b-it-f32-00001-of-00002.gguf", "gemma-2-9b-it-f32-00002-of-00002.gguf"},
+		FileSizes: map[string]int64{
+			"gemma-2-9b-it-Q4_K_M.gguf": 5 * gib,
+			"gemma-2-9b-it-Q8_0.gguf":   9 * gib,
+			"gemma-2-9b-it-f32.gguf":    36 * gib,
+		},
+		Shards: map[string][]string{"gemma-2-9b-it-f32.gguf": {"gemma-2-9b-it-f32-00001-of-00002.gguf", "gemma-2-9b-it-f32-00002-of-00002.gguf"}},
+	}
+	data := []struct {
+		budget int64
+		want   string
+		err    string
+	}{
+		{64 * gib, "gemma-2-9b-it-f32.gguf", ""},
+		{12 * gib, "gemma-2-9b-it-Q8_0.gguf", ""},
+		{8 * gib, "gemma-2-9b-it-Q4_K_M.gguf", ""},
+		{4 * gib, "", "no quantization of model \"hf:bartowski/gemma-2-9b-it-GGUF/HEAD/gemma-2-9b-it-\" fits in 4.0GiB; the smallest, Q4_K_M, needs ~6.0GiB"},
+	}
+	for i, line := range data {
+		got, err := k.LargestQuantization(&m, line.budget)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if got != line.want || errMsg != line.err {
+			t.Fatalf("#%d: want %q, %q, got %q, %q", i, line.want, line.err, got, errMsg)
+		}
+	}
+}
+
+func TestSession_VisionUnsupported(t *testing.T) {
+	l := Session{}
+	msgs := []Message{{Role: User, Content: "what is it?", Image: "data:image/png;base64,AAAA"}}
+	if _, err := l.Prompt(context.Background(), msgs, &PromptOptions{Temperature: 1.0}); !errors.Is(err, ErrVisionUnsupported) {
+		t.Fatal(err)
+	}
+	if err := l.PromptStreaming(context.Background(), msgs, &PromptOptions{Temperature: 1.0}, nil); !errors.Is(err, ErrVisionUnsupported) {
+		t.Fatal(err)
+	}
+}
+
+func TestSession_UnloadIfIdle(t *testing.T) {
+	done := make(chan error, 1)
+	l := Session{backend: "python", done: done, cancel: func() error {
+		done <- nil
+		return nil
+	}}
+	l.touch()
+	if l.unloadIfIdle(time.Hour) {
+		t.Fatal("expected to stay loaded")
+	}
+	l.lastUsed.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if !l.unloadIfIdle(time.Hour) {
+		t.Fatal("expected to be unloaded")
+	}
+	if l.Loaded() {
+		t.Fatal("expected unloaded")
+	}
+	if l.unloadIfIdle(0) {
+		t.Fatal("already unloaded")
+	}
+	if status, err := l.GetHealth(context.Background()); err != nil || status != "unloaded while idle" {
+		t.Fatal(status, err)
+	}
+	// Close must not wait for the server again.
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A remote server is never unloaded.
+	r := Session{backend: "remote"}
+	if r.unloadIfIdle(0) || !r.Loaded() {
+		t.Fatal("remote server unloaded")
+	}
+	o := Options{IdleTimeout: -time.Second}
+	if err := o.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSession_PromptStop(t *testing.T) {
+	var got openAIChatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = openAIChatCompletionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"a cat"}}]}`))
+	}))
+	defer srv.Close()
+	l := Session{baseURL: srv.URL}
+	msgs := []Message{{Role: User, Content: "describe a cat"}}
+	if _, err := l.Prompt(context.Background(), msgs, &PromptOptions{MaxTokens: 125, Seed: 1, Temperature: 1.0, Stop: []string{"\n\n"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxTokens != 125 || len(got.Stop) != 1 || got.Stop[0] != "\n\n" {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	// No limit by default.
+	if _, err := l.Prompt(context.Background(), msgs, &PromptOptions{Seed: 1, Temperature: 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxTokens != 0 || got.Stop != nil {
+		t.Fatalf("unexpected request %+v", got)
+	}
+}
+
+func TestSession_PromptStreamingTools(t *testing.T) {
+	var got openAIChatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = openAIChatCompletionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		for _, l := range []string{
+			`{"choices":[{"delta":{"role":"assistant","content":"Sure!"}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call1","type":"function","function":{"name":"generate_image","arguments":""}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"prompt\":"}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"a cat\"}"}}]}}]}`,
+			`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		} {
+			_, _ = w.Write([]byte("data: " + l + "\n\n"))
+		}
+	}))
+	defer srv.Close()
+	l := Session{baseURL: srv.URL, backend: "remote"}
+	msgs := []Message{{Role: User, Content: "draw me a cat"}}
+	tools := []Tool{{Type: "function", Function: ToolFunction{Name: "generate_image", Description: "Draw an image."}}}
+	words := make(chan string, 10)
+	calls, err := l.PromptStreamingTools(context.Background(), msgs, tools, &PromptOptions{Seed: 1, Temperature: 1.0}, words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "generate_image" {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	if w := <-words; w != "Sure!" {
+		t.Fatal(w)
+	}
+	want := []ToolCallRequest{{ID: "call1", Type: "function", Function: ToolCallFunction{Name: "generate_image", Arguments: `{"prompt":"a cat"}`}}}
+	if diff := cmp.Diff(want, calls); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// The llama-server started locally doesn't support the tools.
+	l.backend = "llama-server"
+	if _, err = l.PromptStreamingTools(context.Background(), msgs, tools, &PromptOptions{Seed: 1, Temperature: 1.0}, words); !errors.Is(err, ErrToolsUnsupported) {
+		t.Fatal(err)
+	}
+	// The prompt encoded by hand doesn't support the tools.
+	l.backend = "remote"
+	l.Encoding = &PromptEncoding{}
+	if _, err = l.PromptStreamingTools(context.Background(), msgs, tools, &PromptOptions{Seed: 1, Temperature: 1.0}, words); !errors.Is(err, ErrToolsUnsupported) {
+		t.Fatal(err)
+	}
+}
+
+func TestSession_OpenAI(t *testing.T) {
+	var got openAIChatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":{"message":"invalid api key"}}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/models":
+			_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"llama3.1:8b","object":"model","owned_by":"library"}]}`))
+		case "/v1/chat/completions":
+			got = openAIChatCompletionRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Error(err)
+			}
+			if !got.Stream {
+				_, _ = w.Write([]byte(`{"id":"1","object":"chat.completion","system_fingerprint":"fp","choices":[{"index":0,"message":{"role":"assistant","content":"a cat","refusal":null},"logprobs":null,"finish_reason":"stop"}]}`))
+				return
+			}
+			for _, l := range []string{
+				": keep-alive",
+				`data: {"id":"1","object":"chat.completion.chunk","system_fingerprint":"fp","choices":[{"index":0,"delta":{"role":"assistant","content":"a "},"logprobs":null,"finish_reason":null}]}`,
+				`data: {"id":"1","object":"chat.completion.chunk","system_fingerprint":"fp","choices":[{"index":0,"delta":{"content":"cat"},"logprobs":null,"finish_reason":"stop"}]}`,
+				`data: {"id":"1","object":"chat.completion.chunk","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`,
+				"data: [DONE]",
+			} {
+				_, _ = w.Write([]byte(l + "\n\n"))
+			}
+		default:
+			t.Errorf("unexpected path %q", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	if _, err := New(ctx, t.TempDir(), &Options{Remote: srv.URL, APIKey: "wrong"}, nil); !internal.IsUnauthorized(err) {
+		t.Fatal(err)
+	}
+	l, err := New(ctx, t.TempDir(), &Options{Remote: srv.URL + "/v1/", APIKey: "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if status, err := l.GetHealth(ctx); err != nil || status != "ok" {
+		t.Fatal(status, err)
+	}
+	if !l.SupportsVision() {
+		t.Fatal("expected the server to decide")
+	}
+	msgs := []Message{{Role: System, Content: "You are a bot."}, {Role: User, Content: "describe a cat"}}
+	if reply, err := l.Prompt(ctx, msgs, &PromptOptions{Seed: 1, Temperature: 1.0}); err != nil || reply != "a cat" {
+		t.Fatal(reply, err)
+	}
+	// The first listed model is used by default.
+	if got.Model != "llama3.1:8b" {
+		t.Fatal(got.Model)
+	}
+	words := make(chan string, 10)
+	if err = l.PromptStreaming(ctx, msgs, &PromptOptions{Seed: 1, Temperature: 1.0}, words); err != nil {
+		t.Fatal(err)
+	}
+	close(words)
+	reply := ""
+	for w := range words {
+		reply += w
+	}
+	if reply != "a cat" {
+		t.Fatal(reply)
+	}
+	if err = l.SwitchModel(ctx, "python"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	o := Options{Remote: "ftp://localhost:8031"}
+	if err := o.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
 func TestLLM(t *testing.T) {
 	// Run with -v to list the model sizes.
 	const systemPrompt = "You are an AI assistant. You strictly follow orders. Reply exactly with what is asked of you."
@@ -220,7 +536,7 @@ func testModelInner(t *testing.T, l *Session, systemPrompt string) {
 	t.Run("Blocking", func(t *testing.T) {
 		t.Parallel()
 		msgs := []Message{{Role: System, Content: systemPrompt}, {Role: User, Content: prompt}}
-		got, err2 := l.Prompt(ctx, msgs, 10, 1, 0.0)
+		got, err2 := l.Prompt(ctx, msgs, &PromptOptions{MaxTokens: 10, Seed: 1})
 		if err2 != nil {
 			t.Fatal(err2)
 		}
@@ -239,7 +555,7 @@ func testModelInner(t *testing.T, l *Session, systemPrompt string) {
 			}
 			wg.Done()
 		}()
-		err2 := l.PromptStreaming(ctx, msgs, 10, 1, 0.0, words)
+		err2 := l.PromptStreaming(ctx, msgs, &PromptOptions{MaxTokens: 10, Seed: 1}, words)
 		close(words)
 		wg.Wait()
 		if err2 != nil {
@@ -319,7 +635,7 @@ func TestMistralTool(t *testing.T) {
 		t.Log(m)
 	}
 	msgsl := len(msgs)
-	s, err := l.llamaCPPPromptBlocking(ctx, msgs, 100, 1, 0)
+	s, err := l.llamaCPPPromptBlocking(ctx, msgs, &PromptOptions{MaxTokens: 100, Seed: 1})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -328,7 +644,7 @@ func TestMistralTool(t *testing.T) {
 		t.Log(m)
 	}
 	msgsl = len(msgs)
-	s, err = l.llamaCPPPromptBlocking(ctx, msgs, 100, 1, 0)
+	s, err = l.llamaCPPPromptBlocking(ctx, msgs, &PromptOptions{MaxTokens: 100, Seed: 1})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -347,7 +663,7 @@ func TestMistralTool(t *testing.T) {
 		t.Log(m)
 	}
 	msgsl = len(msgs)
-	if s, err = l.llamaCPPPromptBlocking(ctx, msgs, 100, 1, 0); err != nil {
+	if s, err = l.llamaCPPPromptBlocking(ctx, msgs, &PromptOptions{MaxTokens: 100, Seed: 1}); err != nil {
 		t.Fatal(err)
 	}
 	msgs = append(msgs, parseToolResponse(t, s, 1)...)
@@ -355,7 +671,7 @@ func TestMistralTool(t *testing.T) {
 		t.Log(m)
 	}
 	msgsl = len(msgs)
-	if s, err = l.llamaCPPPromptBlocking(ctx, msgs, 100, 1, 0); err != nil {
+	if s, err = l.llamaCPPPromptBlocking(ctx, msgs, &PromptOptions{MaxTokens: 100, Seed: 1}); err != nil {
 		t.Fatal(err)
 	}
 	msgs = append(msgs, Message{Role: Assistant, Content: s})
@@ -5,31 +5,211 @@
 package llm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Conversation is a conversation with one user.
 type Conversation struct {
-	User       string
-	Channel    string
+	User    string
+	Channel string
+	// Guild is the server the channel belongs to, if any. It is set by
+	// GetInGuild so the conversations of a guild can be forgotten at once.
+	Guild      string
 	Started    time.Time
 	LastUpdate time.Time
 	Messages   []Message
+	// MaxTurns is the number of recent turns to retain, a turn starting with a
+	// user message. 0 means no limit. The system prompt and the available tools
+	// are always kept.
+	MaxTurns int
+	// LongWarned is set once the user was told the conversation is getting
+	// long. The caller resets it when starting over.
+	LongWarned bool
+	// Persona is the name of the persona selected by the caller, whose prompt
+	// is the system prompt. Empty when using the default one.
+	Persona string
 
 	_ struct{}
 }
 
+// Trim forgets the oldest turns to respect MaxTurns. It returns the number of
+// messages forgotten.
+func (c *Conversation) Trim() int {
+	if c.MaxTurns <= 0 {
+		return 0
+	}
+	start := 0
+	for start < len(c.Messages) && (c.Messages[start].Role == System || c.Messages[start].Role == AvailableTools) {
+		start++
+	}
+	turns := 0
+	for i := len(c.Messages) - 1; i >= start; i-- {
+		if c.Messages[i].Role != User {
+			continue
+		}
+		if turns++; turns == c.MaxTurns {
+			// Forget everything between the preamble and this turn.
+			c.Messages = slices.Delete(c.Messages, start, i)
+			return i - start
+		}
+	}
+	return 0
+}
+
+// TrimTokens forgets the oldest turns until the estimated number of tokens of
+// the conversation fits maxTokens. 0 means no limit. The system prompt, the
+// available tools and the last turn are always kept, even if they don't fit.
+// It returns the number of messages forgotten.
+func (c *Conversation) TrimTokens(maxTokens int) int {
+	if maxTokens <= 0 {
+		return 0
+	}
+	start, end := c.oldestTurns(maxTokens)
+	c.Messages = slices.Delete(c.Messages, start, end)
+	return end - start
+}
+
+// summaryTokens is the maximum number of tokens of the summary generated by
+// Compact.
+const summaryTokens = 256
+
+// summaryRequest is the user message stored with the summary.
+const summaryRequest = "Summarize our conversation so far."
+
+// Compact replaces the oldest turns with a summary generated by the LLM until
+// the estimated number of tokens of the conversation fits maxTokens. 0 means
+// no limit. prompt is the system prompt used to request the summary. It
+// returns the number of messages replaced.
+//
+// The summary is stored as a turn where the user asks for it, so the roles
+// keep alternating as required by most chat templates. It is summarized
+// again with the next oldest turns when the conversation grows.
+//
+// The summary is requested out of the conversation, so it never triggers
+// another compaction. Use TrimTokens afterward to guarantee the budget, e.g.
+// when the last turn alone doesn't fit.
+func (c *Conversation) Compact(ctx context.Context, l *Session, prompt string, maxTokens int) (int, error) {
+	if maxTokens <= 0 {
+		return 0, nil
+	}
+	// Leave room for the summary turn.
+	start, end := c.oldestTurns(maxTokens - summaryTokens - EstimateTokens([]Message{{Content: summaryRequest}, {}}))
+	if start == end {
+		return 0, nil
+	}
+	transcript := formatTranscript(c.Messages[start:end])
+	// The summary request must fit the budget too. Forget the oldest part of
+	// the transcript if needed.
+	if m := 4 * (maxTokens - summaryTokens - EstimateTokens([]Message{{Content: prompt}, {}})); len(transcript) > m {
+		i := len(transcript) - max(m, 0)
+		for i < len(transcript) && !utf8.RuneStart(transcript[i]) {
+			i++
+		}
+		transcript = transcript[i:]
+	}
+	msgs := []Message{{Role: System, Content: prompt}, {Role: User, Content: transcript}}
+	summary, err := l.Prompt(ctx, msgs, &PromptOptions{MaxTokens: summaryTokens, Temperature: 1.0})
+	if err != nil {
+		return 0, fmt.Errorf("failed to summarize the conversation: %w", err)
+	}
+	if summary == "" {
+		return 0, errors.New("failed to summarize the conversation: empty summary")
+	}
+	c.Messages = slices.Replace(c.Messages, start, end, Message{Role: User, Content: summaryRequest}, Message{Role: Assistant, Content: summary})
+	return end - start, nil
+}
+
+// oldestTurns returns the range of the oldest turns to forget for the
+// conversation to fit maxTokens. The system prompt, the available tools and
+// the last turn are never included.
+func (c *Conversation) oldestTurns(maxTokens int) (int, int) {
+	start := 0
+	for start < len(c.Messages) && (c.Messages[start].Role == System || c.Messages[start].Role == AvailableTools) {
+		start++
+	}
+	total := EstimateTokens(c.Messages)
+	end := start
+	for total > maxTokens {
+		// Find the start of the next turn.
+		next := end + 1
+		for next < len(c.Messages) && c.Messages[next].Role != User {
+			next++
+		}
+		if next >= len(c.Messages) {
+			// Only the last turn is left.
+			break
+		}
+		total -= EstimateTokens(c.Messages[end:next])
+		end = next
+	}
+	return start, end
+}
+
+// formatTranscript returns the messages as plain text to be summarized.
+func formatTranscript(msgs []Message) string {
+	b := strings.Builder{}
+	for i := range msgs {
+		switch msgs[i].Role {
+		case User:
+			b.WriteString("User: ")
+		case Assistant:
+			b.WriteString("Assistant: ")
+		case ToolCall:
+			b.WriteString("Tool call: ")
+		case ToolCallResult, ToolResult:
+			b.WriteString("Tool result: ")
+		default:
+			continue
+		}
+		b.WriteString(msgs[i].Content)
+		if msgs[i].Image != "" {
+			b.WriteString(" [image]")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// EstimateTokens returns a rough estimate of the number of tokens used by the
+// messages.
+//
+// It assumes 4 bytes per token, which is typical of English text with the
+// common tokenizers, plus the chat template overhead. It is only meant to
+// keep the prompt within the context window with a safety margin.
+func EstimateTokens(msgs []Message) int {
+	total := 0
+	for i := range msgs {
+		total += (len(msgs[i].Content)+3)/4 + 4
+		if msgs[i].Image != "" {
+			// The vision encoders use a few hundred tokens per image.
+			total += 512
+		}
+	}
+	return total
+}
+
 // Memory holds the bot's conversations.
 type Memory struct {
+	// MaxConversations is the maximum number of conversations remembered, to
+	// bound the size of the saved memory. The least recently updated ones are
+	// forgotten first. 0 means no limit.
+	MaxConversations int
+
 	mu            sync.Mutex
 	conversations []*Conversation
+	preferences   map[string]map[string]string
 }
 
 // Load loads previous memory.
@@ -80,9 +260,51 @@ func (m *Memory) Save(w io.Writer) error {
 	return nil
 }
 
+// LoadFile loads previous memory from a file. A missing file is not an error.
+func (m *Memory) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		slog.Info("memory", "action", "load", "message", "no memory to load")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.Load(f)
+}
+
+// SaveFile saves the memory to a file.
+//
+// The file is replaced atomically so it is not corrupted if the process is
+// killed while saving.
+func (m *Memory) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = m.Save(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
 // Get gets a previous conversations or returns a new one if it's a new
 // conversation.
 func (m *Memory) Get(user, channel string) *Conversation {
+	return m.GetInGuild("", user, channel)
+}
+
+// GetInGuild is like Get and also records the guild of the conversation if
+// it was not known yet.
+func (m *Memory) GetInGuild(guild, user, channel string) *Conversation {
 	// TODO: Keep a map instead of a silly linear search once we get 100s of
 	// conversations, or just sort based on LRUs.
 	m.mu.Lock()
@@ -90,15 +312,80 @@ func (m *Memory) Get(user, channel string) *Conversation {
 	for _, c := range m.conversations {
 		if c.User == user && c.Channel == channel {
 			c.LastUpdate = time.Now()
+			if c.Guild == "" {
+				c.Guild = guild
+			}
 			return c
 		}
 	}
 	now := time.Now()
-	c := &Conversation{User: user, Channel: channel, Started: now, LastUpdate: now}
+	c := &Conversation{User: user, Channel: channel, Guild: guild, Started: now, LastUpdate: now}
 	m.conversations = append(m.conversations, c)
 	return c
 }
 
+// Count returns the number of conversations updated since the specified
+// time. Use the zero time to count all of them.
+func (m *Memory) Count(since time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, c := range m.conversations {
+		if !c.LastUpdate.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// ForgetGuild forgets all the conversations of a guild. It returns the number
+// of conversations forgotten.
+func (m *Memory) ForgetGuild(guild string) int {
+	if guild == "" {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := len(m.conversations)
+	m.conversations = slices.DeleteFunc(m.conversations, func(c *Conversation) bool {
+		return c.Guild == guild
+	})
+	return before - len(m.conversations)
+}
+
+// GetPreferences returns a copy of the user's preferences.
+//
+// The keys are defined by the caller, the memory only stores them. Contrary to
+// conversations, preferences are not forgotten over time.
+func (m *Memory) GetPreferences(user string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]string, len(m.preferences[user]))
+	for k, v := range m.preferences[user] {
+		out[k] = v
+	}
+	return out
+}
+
+// SetPreferences replaces the user's preferences. Use an empty map to reset
+// them.
+func (m *Memory) SetPreferences(user string, prefs map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(prefs) == 0 {
+		delete(m.preferences, user)
+		return
+	}
+	if m.preferences == nil {
+		m.preferences = map[string]map[string]string{}
+	}
+	p := make(map[string]string, len(prefs))
+	for k, v := range prefs {
+		p[k] = v
+	}
+	m.preferences[user] = p
+}
+
 // Forget forgets old conversations.
 func (m *Memory) Forget() {
 	m.mu.Lock()
@@ -116,6 +403,9 @@ func (m *Memory) Forget() {
 			break
 		}
 	}
+	if m.MaxConversations > 0 && len(m.conversations) > m.MaxConversations {
+		m.conversations = m.conversations[:m.MaxConversations]
+	}
 	after := len(m.conversations)
 	m.mu.Unlock()
 	slog.Info("memory", "action", "forget", "before", before, "after", after)
@@ -127,8 +417,9 @@ func (m *Memory) Forget() {
 //
 // It is quite inefficient. Should be fixed later.
 type serializedMemory struct {
-	Version       int                      `json:"v,omitempty"`
-	Conversations []serializedConversation `json:"c,omitempty"`
+	Version       int                          `json:"v,omitempty"`
+	Conversations []serializedConversation     `json:"c,omitempty"`
+	Preferences   map[string]map[string]string `json:"p,omitempty"`
 }
 
 func (s *serializedMemory) from(m *Memory) error {
@@ -139,6 +430,7 @@ func (s *serializedMemory) from(m *Memory) error {
 			return err
 		}
 	}
+	s.Preferences = m.preferences
 	return nil
 }
 
@@ -154,22 +446,31 @@ func (s *serializedMemory) to(m *Memory) error {
 		}
 		m.conversations[i] = c
 	}
+	m.preferences = s.Preferences
 	return nil
 }
 
 type serializedConversation struct {
 	User       string              `json:"u,omitempty"`
 	Channel    string              `json:"c,omitempty"`
+	Guild      string              `json:"g,omitempty"`
 	Started    time.Time           `json:"s,omitempty"`
 	LastUpdate time.Time           `json:"l,omitempty"`
 	Messages   []serializedMessage `json:"m,omitempty"`
+	MaxTurns   int                 `json:"t,omitempty"`
+	LongWarned bool                `json:"w,omitempty"`
+	Persona    string              `json:"p,omitempty"`
 }
 
 func (s *serializedConversation) from(c *Conversation) error {
 	s.User = c.User
 	s.Channel = c.Channel
+	s.Guild = c.Guild
 	s.Started = c.Started
 	s.LastUpdate = c.LastUpdate
+	s.MaxTurns = c.MaxTurns
+	s.LongWarned = c.LongWarned
+	s.Persona = c.Persona
 	s.Messages = make([]serializedMessage, len(c.Messages))
 	for i := range c.Messages {
 		if err := s.Messages[i].from(&c.Messages[i]); err != nil {
@@ -182,8 +483,12 @@ func (s *serializedConversation) from(c *Conversation) error {
 func (s *serializedConversation) to(c *Conversation) error {
 	c.User = s.User
 	c.Channel = s.Channel
+	c.Guild = s.Guild
 	c.Started = s.Started
 	c.LastUpdate = s.LastUpdate
+	c.MaxTurns = s.MaxTurns
+	c.LongWarned = s.LongWarned
+	c.Persona = s.Persona
 	c.Messages = make([]Message, len(s.Messages))
 	for i := range s.Messages {
 		if err := s.Messages[i].to(&c.Messages[i]); err != nil {
@@ -193,9 +498,12 @@ func (s *serializedConversation) to(c *Conversation) error {
 	return nil
 }
 
+// serializedMessage doesn't save the image, if any, to keep the memory small.
 type serializedMessage struct {
-	Role    int    `json:"r,omitempty"`
-	Content string `json:"c,omitempty"`
+	Role       int               `json:"r,omitempty"`
+	Content    string            `json:"c,omitempty"`
+	ToolCalls  []ToolCallRequest `json:"t,omitempty"`
+	ToolCallID string            `json:"i,omitempty"`
 }
 
 func (s *serializedMessage) from(m *Message) error {
@@ -212,10 +520,14 @@ func (s *serializedMessage) from(m *Message) error {
 		s.Role = 4
 	case ToolCallResult:
 		s.Role = 5
+	case ToolResult:
+		s.Role = 6
 	default:
 		return fmt.Errorf("unknown role %q", m.Role)
 	}
 	s.Content = m.Content
+	s.ToolCalls = m.ToolCalls
+	s.ToolCallID = m.ToolCallID
 	return nil
 }
 
@@ -233,9 +545,13 @@ func (s *serializedMessage) to(m *Message) error {
 		m.Role = ToolCall
 	case 5:
 		m.Role = ToolCallResult
+	case 6:
+		m.Role = ToolResult
 	default:
 		return fmt.Errorf("unknown role %q", s.Role)
 	}
 	m.Content = s.Content
+	m.ToolCalls = s.ToolCalls
+	m.ToolCallID = s.ToolCallID
 	return nil
 }
@@ -6,6 +6,14 @@ package llm
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +36,11 @@ func TestMemory_Forget(t *testing.T) {
 	c1.LastUpdate = now.Add(-time.Hour)
 	c2.LastUpdate = twodaysago
 	c4.LastUpdate = twodaysago
+	c4.Messages = []Message{
+		{Role: User, Content: "draw me a cat"},
+		{Role: Assistant, ToolCalls: []ToolCallRequest{{ID: "call1", Type: "function", Function: ToolCallFunction{Name: "generate_image", Arguments: `{"prompt":"a cat"}`}}}},
+		{Role: ToolResult, Content: "done", ToolCallID: "call1"},
+	}
 	m.Forget()
 	// LRU:
 	want := []*Conversation{c3, c1}
@@ -36,6 +49,56 @@ func TestMemory_Forget(t *testing.T) {
 	}
 }
 
+func TestMemory_MaxConversations(t *testing.T) {
+	m := Memory{MaxConversations: 2}
+	now := time.Now()
+	c1 := m.Get("user1", "channel1")
+	c2 := m.Get("user2", "channel1")
+	c3 := m.Get("user3", "channel1")
+	c1.LastUpdate = now.Add(-time.Minute)
+	c2.LastUpdate = now.Add(-time.Hour)
+	c3.LastUpdate = now
+	m.Forget()
+	want := []*Conversation{c3, c1}
+	if diff := cmp.Diff(want, m.conversations); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMemory_Count(t *testing.T) {
+	m := Memory{}
+	now := time.Now()
+	m.Get("user1", "channel1").LastUpdate = now.Add(-2 * time.Hour)
+	m.Get("user2", "channel1")
+	if got := m.Count(now.Add(-time.Hour)); got != 1 {
+		t.Fatal(got)
+	}
+	if got := m.Count(time.Time{}); got != 2 {
+		t.Fatal(got)
+	}
+}
+
+func TestMemory_ForgetGuild(t *testing.T) {
+	m := Memory{}
+	m.GetInGuild("guild1", "", "channel1")
+	m.GetInGuild("guild1", "", "channel2")
+	// The guild is recorded when it was not known yet.
+	c3 := m.Get("", "channel3")
+	if c := m.GetInGuild("guild2", "", "channel3"); c != c3 || c.Guild != "guild2" {
+		t.Fatal(c.Guild)
+	}
+	c4 := m.GetInGuild("", "", "dm")
+	if got := m.ForgetGuild("guild1"); got != 2 {
+		t.Fatal(got)
+	}
+	if got := m.ForgetGuild(""); got != 0 {
+		t.Fatal(got)
+	}
+	if diff := cmp.Diff([]*Conversation{c3, c4}, m.conversations); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
 func TestMemory_Serialize(t *testing.T) {
 	m1 := Memory{}
 	now := time.Now()
@@ -46,6 +109,10 @@ func TestMemory_Serialize(t *testing.T) {
 	c4 := m1.Get("user2", "channel2")
 	c2.LastUpdate = twodaysago
 	c4.LastUpdate = twodaysago
+	c4.LongWarned = true
+	c4.Persona = "pirate"
+
+	m1.SetPreferences("user1", map[string]string{"steps": "8"})
 
 	b := bytes.Buffer{}
 	if err := m1.Save(&b); err != nil {
@@ -60,4 +127,198 @@ func TestMemory_Serialize(t *testing.T) {
 	if diff := cmp.Diff(&m1, &m2, cmpopts.IgnoreUnexported(Memory{})); diff != "" {
 		t.Fatal(diff)
 	}
+	if diff := cmp.Diff(map[string]string{"steps": "8"}, m2.GetPreferences("user1")); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMemory_File(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "memory.json")
+	m1 := Memory{}
+	if err := m1.LoadFile(p); err != nil {
+		t.Fatal(err)
+	}
+	c := m1.Get("user", "channel")
+	c.Messages = append(c.Messages, Message{Role: User, Content: "hi"})
+	if err := m1.SaveFile(p); err != nil {
+		t.Fatal(err)
+	}
+	m2 := Memory{}
+	if err := m2.LoadFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(c.Messages, m2.Get("user", "channel").Messages); diff != "" {
+		t.Fatal(diff)
+	}
+	entries, err := os.ReadDir(filepath.Dir(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the memory file, got %d files", len(entries))
+	}
+}
+
+func TestMemory_Preferences(t *testing.T) {
+	m := Memory{}
+	if got := m.GetPreferences("user1"); len(got) != 0 {
+		t.Fatal(got)
+	}
+	p := map[string]string{"style": "anime"}
+	m.SetPreferences("user1", p)
+	// The memory must keep its own copy.
+	p["style"] = "realistic"
+	got := m.GetPreferences("user1")
+	if diff := cmp.Diff(map[string]string{"style": "anime"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	got["steps"] = "4"
+	if diff := cmp.Diff(map[string]string{"style": "anime"}, m.GetPreferences("user1")); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := m.GetPreferences("user2"); len(got) != 0 {
+		t.Fatal(got)
+	}
+	m.SetPreferences("user1", nil)
+	if got := m.GetPreferences("user1"); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestConversation_Trim(t *testing.T) {
+	c := Conversation{
+		Messages: []Message{
+			{Role: AvailableTools, Content: "tools"},
+			{Role: System, Content: "system"},
+			{Role: User, Content: "1"},
+			{Role: Assistant, Content: "a1"},
+			{Role: User, Content: "2"},
+			{Role: ToolCall, Content: "call"},
+			{Role: ToolCallResult, Content: "result"},
+			{Role: Assistant, Content: "a2"},
+			{Role: User, Content: "3"},
+		},
+	}
+	if n := c.Trim(); n != 0 || len(c.Messages) != 9 {
+		t.Fatal("no limit", n)
+	}
+	c.MaxTurns = 2
+	if n := c.Trim(); n != 2 {
+		t.Fatal(n)
+	}
+	want := []Message{
+		{Role: AvailableTools, Content: "tools"},
+		{Role: System, Content: "system"},
+		{Role: User, Content: "2"},
+		{Role: ToolCall, Content: "call"},
+		{Role: ToolCallResult, Content: "result"},
+		{Role: Assistant, Content: "a2"},
+		{Role: User, Content: "3"},
+	}
+	if diff := cmp.Diff(want, c.Messages); diff != "" {
+		t.Fatal(diff)
+	}
+	if n := c.Trim(); n != 0 {
+		t.Fatal(n)
+	}
+	c.MaxTurns = 1
+	if n := c.Trim(); n != 4 || len(c.Messages) != 3 {
+		t.Fatal(n, c.Messages)
+	}
+}
+
+func TestConversation_Compact(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		for _, m := range req.Messages {
+			got = append(got, m.Role+": "+m.Content)
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"We talked."}}]}`))
+	}))
+	defer srv.Close()
+	l := &Session{baseURL: srv.URL}
+	// Each turn is about 134 tokens.
+	long := strings.Repeat("word ", 100)
+	c := Conversation{Messages: []Message{{Role: System, Content: "system"}}}
+	for i := 1; i <= 10; i++ {
+		c.Messages = append(c.Messages, Message{Role: User, Content: strconv.Itoa(i)}, Message{Role: Assistant, Content: long})
+	}
+	ctx := context.Background()
+	if n, err := c.Compact(ctx, l, "Summarize.", 2000); n != 0 || err != nil {
+		t.Fatal("fits", n, err)
+	}
+	if len(got) != 0 {
+		t.Fatal(got)
+	}
+	n, err := c.Compact(ctx, l, "Summarize.", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 5 oldest turns are summarized.
+	if n != 10 {
+		t.Fatal(n)
+	}
+	if len(got) != 2 || got[0] != "system: Summarize." || !strings.HasPrefix(got[1], "user: User: 1\nAssistant: word") || !strings.Contains(got[1], "\nUser: 5\n") || strings.Contains(got[1], "User: 6") {
+		t.Fatalf("unexpected summary request: %q", got)
+	}
+	want := []Message{
+		{Role: System, Content: "system"},
+		{Role: User, Content: summaryRequest},
+		{Role: Assistant, Content: "We talked."},
+		{Role: User, Content: "6"},
+	}
+	if diff := cmp.Diff(want, c.Messages[:4]); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := EstimateTokens(c.Messages); got > 1000 {
+		t.Fatal(got)
+	}
+}
+
+func TestConversation_TrimTokens(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	c := Conversation{
+		Messages: []Message{
+			{Role: System, Content: long},
+			{Role: User, Content: long},
+			{Role: Assistant, Content: long},
+			{Role: User, Content: long},
+			{Role: ToolCall, Content: long},
+			{Role: ToolCallResult, Content: long},
+			{Role: Assistant, Content: long},
+			{Role: User, Content: long},
+		},
+	}
+	// Each message is 54 tokens.
+	if got := EstimateTokens(c.Messages[:1]); got != 54 {
+		t.Fatal(got)
+	}
+	if n := c.TrimTokens(0); n != 0 || len(c.Messages) != 8 {
+		t.Fatal("no limit", n)
+	}
+	if n := c.TrimTokens(8 * 54); n != 0 {
+		t.Fatal("fits", n)
+	}
+	// Forget the first turn.
+	if n := c.TrimTokens(7 * 54); n != 2 || len(c.Messages) != 6 {
+		t.Fatal(n, len(c.Messages))
+	}
+	// Forget everything but the system prompt and the last turn, even if it
+	// doesn't fit.
+	if n := c.TrimTokens(10); n != 4 {
+		t.Fatal(n)
+	}
+	want := []Message{{Role: System, Content: long}, {Role: User, Content: long}}
+	if diff := cmp.Diff(want, c.Messages); diff != "" {
+		t.Fatal(diff)
+	}
 }
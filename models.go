@@ -10,14 +10,19 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/maruel/sillybot/imagegen"
+	"github.com/maruel/sillybot/internal"
 	"github.com/maruel/sillybot/llm"
+	"github.com/maruel/sillybot/py"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
 )
@@ -32,6 +37,8 @@ type Config struct {
 	Bot struct {
 		LLM      llm.Options
 		ImageGen imagegen.Options `yaml:"image_gen"`
+		// Python limits the python backends processes.
+		Python   py.Limits
 		Settings Settings
 	}
 	KnownLLMs []llm.KnownLLM
@@ -44,6 +51,82 @@ func (c *Config) Validate() error {
 			return err
 		}
 	}
+	for id, w := range c.Bot.Settings.Watermarks {
+		if w.Disabled && w.Required {
+			return fmt.Errorf("watermark for guild %q can't be both disabled and required", id)
+		}
+	}
+	if err := c.Bot.Settings.Presence.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.Access.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.Goodbye.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.Queue.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.Welcome.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.LongConversation.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.Signature.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.Metrics.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bot.Settings.API.Validate(); err != nil {
+		return err
+	}
+	if t := c.Bot.Settings.TypingInterval; t < 0 || t > 10*time.Second {
+		return fmt.Errorf("invalid typing_interval %s; must be at most 10s", t)
+	}
+	if _, err := RenderSystemPrompt(c.Bot.Settings.PromptSystem, &PromptVars{}); err != nil {
+		return fmt.Errorf("invalid prompt_system: %w", err)
+	}
+	if err := c.Bot.Settings.ReplyFilters.Validate(); err != nil {
+		return fmt.Errorf("invalid reply_filters: %w", err)
+	}
+	if err := c.Bot.Settings.MemeLabels.Validate(); err != nil {
+		return fmt.Errorf("invalid meme_labels: %w", err)
+	}
+	// Out of range sampling values are not fatal.
+	c.Bot.Settings.Sampling.Chat.clamp()
+	c.Bot.Settings.Sampling.ImagePrompt.clamp()
+	c.Bot.Settings.Sampling.Labels.clamp()
+	if err := c.Bot.ImageGen.Output.Validate(); err != nil {
+		return err
+	}
+	names := map[string]struct{}{}
+	for i := range c.Bot.Settings.PromptTemplates {
+		p := &c.Bot.Settings.PromptTemplates[i]
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("duplicate prompt template %q", p.Name)
+		}
+		names[p.Name] = struct{}{}
+	}
+	personas := map[string]struct{}{}
+	for i := range c.Bot.Settings.Personas {
+		p := &c.Bot.Settings.Personas[i]
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if _, ok := personas[p.Name]; ok {
+			return fmt.Errorf("duplicate persona %q", p.Name)
+		}
+		personas[p.Name] = struct{}{}
+	}
 	return nil
 }
 
@@ -83,7 +166,12 @@ func (c *Config) LoadOrDefault(config string) error {
 // Settings is the bot settings.
 type Settings struct {
 	// PromptSystem is the default system prompt to use. Is a Go template as
-	// documented at https://pkg.go.dev/text/template. Values provided by LLM are:
+	// documented at https://pkg.go.dev/text/template. Values filled in when the
+	// conversation starts are:
+	// - UserName: display name of the user who started the conversation.
+	// - GuildName: name of the server, empty in direct messages.
+	// - Date: day the conversation started, e.g. 2024-07-21.
+	// Values provided by LLM at each prompt are:
 	// - Now: current time in ISO-8601, including the server's time zone.
 	// - Model: the model name.
 	PromptSystem string `yaml:"prompt_system"`
@@ -93,6 +181,622 @@ type Settings struct {
 	// PromptImage is the prompt used to generate an image via a short
 	// description.
 	PromptImage string `yaml:"prompt_image"`
+	// PromptSummary is the prompt used to summarize the oldest turns of a
+	// conversation exceeding MaxContextTokens. They are forgotten instead when
+	// empty.
+	PromptSummary string `yaml:"prompt_summary"`
+	// PromptTemplates are named reusable prompts that users can apply by name.
+	PromptTemplates []PromptTemplate `yaml:"prompt_templates"`
+	// Personas are named system prompts that users can switch to for their
+	// conversation.
+	Personas []Persona
+	// MaxBatchPixels limits the total number of pixels generated by a single
+	// image request, i.e. the number of images × width × height, to bound GPU
+	// memory usage. 0 means no limit.
+	MaxBatchPixels int `yaml:"max_batch_pixels"`
+	// ReplyInUserLocale asks the LLM to reply in the language of the user's
+	// Discord locale when a conversation starts. It can be overridden with
+	// /forget.
+	ReplyInUserLocale bool `yaml:"reply_in_user_locale"`
+	// ReplyFilters is the post-processing applied to the chat replies.
+	ReplyFilters llm.FilterOptions `yaml:"reply_filters"`
+	// MemeLabels is how the meme labels are drawn on the images, e.g. the
+	// outline color and thickness.
+	MemeLabels imagegen.LabelOptions `yaml:"meme_labels"`
+	// Watermarks are the per-guild watermark policies, keyed by the guild ID.
+	Watermarks map[string]WatermarkPolicy `yaml:"watermarks"`
+	// PromptLog logs the generated image prompts to a JSONL file.
+	PromptLog PromptLogOptions `yaml:"prompt_log"`
+	// ChatWebhook mirrors the chat replies to an outgoing webhook as they are
+	// streamed.
+	ChatWebhook WebhookOptions `yaml:"chat_webhook"`
+	// MaxConversations is the maximum number of conversations remembered
+	// across restarts. The least recently active ones are forgotten first. 0
+	// means no limit.
+	MaxConversations int `yaml:"max_conversations"`
+	// MaxContextTokens is the estimated number of tokens of a conversation
+	// sent to the LLM. The oldest turns are summarized or forgotten to stay
+	// within this budget, keeping the system prompt. Set it below the model's context
+	// length to leave room for the reply. 0 means no limit.
+	MaxContextTokens int `yaml:"max_context_tokens"`
+	// LongConversation is the note telling the users their conversation is
+	// getting close to MaxContextTokens.
+	LongConversation LongConversationOptions `yaml:"long_conversation"`
+	// Signature is added to the chat and image replies.
+	Signature SignatureOptions
+	// Presence is the bot's Discord presence.
+	Presence PresenceOptions
+	// DebugCommands registers commands meant to tune the bot, e.g. the meme
+	// renderer. They are restricted to the server administrators.
+	DebugCommands bool `yaml:"debug_commands"`
+	// Sampling is the LLM sampling used for each task.
+	Sampling SamplingSettings
+	// Access restricts the guilds, channels and users the bot replies to.
+	Access AccessOptions
+	// Goodbye is what the bot does when shutting down.
+	Goodbye GoodbyeOptions
+	// Welcome is the message posted when joining a guild or coming back
+	// online.
+	Welcome WelcomeOptions
+	// InlineReplies replies in the channel where the bot is mentioned instead
+	// of starting a thread off the message for the conversation.
+	InlineReplies bool `yaml:"inline_replies"`
+	// EditInPlace edits a single message as the chat reply streams instead of
+	// posting each chunk as a new message. A new message is only started when
+	// the current one is full.
+	EditInPlace bool `yaml:"edit_in_place"`
+	// TypingInterval is how often the typing indicator is refreshed while a
+	// chat request waits for the first word of the reply, e.g. while the model
+	// loads. Discord clears it after about 10 seconds. Defaults to 8s.
+	TypingInterval time.Duration `yaml:"typing_interval"`
+	// Queue configures the queues of pending requests.
+	Queue QueueOptions
+	// RateLimit limits the requests of each user, so a single user can't fill
+	// the queues.
+	RateLimit RateLimitOptions `yaml:"rate_limit"`
+	// ReactionTrigger is an emoji, e.g. "🤖", that makes the bot reply to the
+	// message it is added to as a reaction, as if the user who reacted had
+	// mentioned the bot. Use the name of a custom emoji. Disabled when empty.
+	ReactionTrigger string `yaml:"reaction_trigger"`
+	// ChatTools lets the LLM call the built-in tools while chatting, e.g. to
+	// generate an image when asked to draw something. The LLM backend must
+	// support function calling with the OpenAI compatible API.
+	ChatTools bool `yaml:"chat_tools"`
+	// Metrics exposes the operational metrics to Prometheus.
+	Metrics MetricsOptions
+	// API exposes the models and the bot's status as JSON to scripts and
+	// dashboards.
+	API APIOptions
+}
+
+// SamplingSettings is the LLM sampling used for each task.
+type SamplingSettings struct {
+	// Chat is used to reply to the users.
+	Chat SamplingOptions
+	// ImagePrompt is used to enhance the image generation prompts.
+	ImagePrompt SamplingOptions `yaml:"image_prompt"`
+	// Labels is used to generate the meme labels.
+	Labels SamplingOptions
+
+	_ struct{}
+}
+
+// SamplingOptions configures how the LLM selects the next token.
+type SamplingOptions struct {
+	// Temperature is between 0 (deterministic) and 2 (very creative). Defaults
+	// to 1.
+	Temperature *float64
+	// TopP limits the selection to the most probable tokens whose cumulative
+	// probability reaches it, between 0 and 1. 0 uses the server's default.
+	TopP float64 `yaml:"top_p"`
+
+	_ struct{}
+}
+
+// Values returns the temperature and top_p to use.
+func (s *SamplingOptions) Values() (float64, float64) {
+	t := 1.0
+	if s.Temperature != nil {
+		t = *s.Temperature
+	}
+	return t, s.TopP
+}
+
+// ClampSampling clamps the temperature between 0 and 2 and top_p between 0
+// and 1, logging a warning when a value is out of range.
+func ClampSampling(temperature, topP float64) (float64, float64) {
+	if t := min(max(temperature, 0), 2); t != temperature {
+		slog.Warn("sampling", "message", "temperature out of range, clamping", "temperature", temperature, "clamped", t)
+		temperature = t
+	}
+	if p := min(max(topP, 0), 1); p != topP {
+		slog.Warn("sampling", "message", "top_p out of range, clamping", "top_p", topP, "clamped", p)
+		topP = p
+	}
+	return temperature, topP
+}
+
+// clamp clamps the values to their valid range.
+func (s *SamplingOptions) clamp() {
+	t, p := ClampSampling(s.Values())
+	if s.Temperature != nil {
+		s.Temperature = &t
+	}
+	s.TopP = p
+}
+
+// PresenceOptions configures the activity shown under the bot's name.
+type PresenceOptions struct {
+	// Activity is one of "playing", "listening", "watching", "competing" or
+	// "custom". Defaults to "custom".
+	Activity string
+	// Text is the activity shown when idle, e.g. "/help". The presence is left
+	// untouched when empty, unless ShowLoad is set.
+	Text string
+	// ShowLoad shows the pending work instead of Text while busy, e.g.
+	// "Generating 2 images".
+	ShowLoad bool `yaml:"show_load"`
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (p *PresenceOptions) Validate() error {
+	switch p.Activity {
+	case "", "playing", "listening", "watching", "competing", "custom":
+		return nil
+	default:
+		return fmt.Errorf("invalid presence activity %q", p.Activity)
+	}
+}
+
+// QueueOptions configures the queues of the requests pending processing.
+type QueueOptions struct {
+	// Chat is the number of chat requests queued. Defaults to 5.
+	Chat int
+	// Image is the number of image requests queued. Defaults to 3.
+	Image int
+	// Workers is the number of image requests processed concurrently. Defaults
+	// to 1. Each worker calls the image backend independently. The local
+	// server generates one image at a time, so it is mostly useful with a
+	// remote server that handles concurrent requests.
+	Workers int
+	// Overflow is what happens to a request when its queue is full. "reject",
+	// the default, asks the user to retry later. "wait" keeps the request in
+	// line and tells the user their position. The waiting requests are kept in
+	// memory without bound, including the images uploaded to remix, so a burst
+	// of requests costs memory instead of being turned away.
+	Overflow string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (q *QueueOptions) Validate() error {
+	if q.Chat < 0 {
+		return fmt.Errorf("invalid queue chat %d", q.Chat)
+	}
+	if q.Image < 0 {
+		return fmt.Errorf("invalid queue image %d", q.Image)
+	}
+	if q.Workers < 0 {
+		return fmt.Errorf("invalid queue workers %d", q.Workers)
+	}
+	switch q.Overflow {
+	case "", "reject", "wait":
+		return nil
+	default:
+		return fmt.Errorf("invalid queue overflow %q; use reject or wait", q.Overflow)
+	}
+}
+
+// RateLimitOptions configures the number of requests each user can make,
+// chat messages and images combined. The queues still limit the requests of
+// all the users.
+type RateLimitOptions struct {
+	// PerMinute is the sustained number of requests per user per minute.
+	// Disabled when 0.
+	PerMinute float64 `yaml:"per_minute"`
+	// Burst is the number of requests a user can make in a row before being
+	// limited to PerMinute. Defaults to PerMinute, rounded up.
+	Burst int
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (r *RateLimitOptions) Validate() error {
+	if r.PerMinute < 0 {
+		return fmt.Errorf("invalid rate_limit per_minute %g", r.PerMinute)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("invalid rate_limit burst %d", r.Burst)
+	}
+	return nil
+}
+
+// GoodbyeOptions configures what the bot does when shutting down. The presence
+// is always set to idle.
+type GoodbyeOptions struct {
+	// Message is posted to the channels used recently before shutting down,
+	// e.g. "Going offline for maintenance, back soon!". Nothing is posted when
+	// empty, for quiet restarts.
+	Message string
+	// Recent is how recently a channel must have been used to receive
+	// Message. Defaults to 1h.
+	Recent time.Duration
+	// Timeout is the maximum duration to post the messages, so the shutdown
+	// doesn't hang. Defaults to 5s.
+	Timeout time.Duration
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (g *GoodbyeOptions) Validate() error {
+	if g.Recent < 0 {
+		return fmt.Errorf("invalid goodbye recent %s", g.Recent)
+	}
+	if g.Timeout < 0 {
+		return fmt.Errorf("invalid goodbye timeout %s", g.Timeout)
+	}
+	return nil
+}
+
+// WelcomeOptions configures the message posted to each guild when the bot
+// joins it or comes back online.
+type WelcomeOptions struct {
+	// Message is posted to a single channel per guild: the system channel when
+	// the bot can post there, otherwise the first text channel it can post to.
+	// It is not posted again when the bot posted recently in the channel.
+	// Nothing is posted when empty.
+	Message string
+	// Builtin posts the built-in message translated in the guild's preferred
+	// locale instead of Message.
+	Builtin bool
+	// Disabled lists the IDs of the guilds opting out of Message.
+	Disabled []string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (w *WelcomeOptions) Validate() error {
+	// Discord's limit for a message.
+	if len(w.Message) > 2000 {
+		return fmt.Errorf("welcome message is too long: %d bytes; the maximum is 2000", len(w.Message))
+	}
+	if w.Builtin && w.Message != "" {
+		return errors.New("welcome message and builtin are mutually exclusive")
+	}
+	return nil
+}
+
+// LongConversationOptions configures the note added once to a reply when the
+// conversation gets close to MaxContextTokens, before its oldest turns get
+// forgotten. It requires MaxContextTokens.
+type LongConversationOptions struct {
+	// Threshold is the fraction of MaxContextTokens above which the note is
+	// added, between 0 and 1. Defaults to 0.8.
+	Threshold float64
+	// Message is the note. Defaults to a message in the user's language.
+	Message string
+	// Disabled disables the note.
+	Disabled bool
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (l *LongConversationOptions) Validate() error {
+	if l.Threshold < 0 || l.Threshold > 1 {
+		return fmt.Errorf("invalid long_conversation threshold %g; must be between 0 and 1", l.Threshold)
+	}
+	// Keep room for the reply in Discord's limit for a message.
+	if len(l.Message) > 200 {
+		return fmt.Errorf("long_conversation message is too long: %d bytes; the maximum is 200", len(l.Message))
+	}
+	return nil
+}
+
+// Tokens returns the estimated number of tokens above which the note is
+// added, or 0 when disabled.
+func (l *LongConversationOptions) Tokens(maxContextTokens int) int {
+	if l.Disabled || maxContextTokens <= 0 {
+		return 0
+	}
+	t := l.Threshold
+	if t == 0 {
+		t = 0.8
+	}
+	return max(int(t*float64(maxContextTokens)), 1)
+}
+
+// SignatureOptions is the text added to every reply, e.g. a disclaimer that
+// the content is AI generated. It is Discord markdown, used as is.
+type SignatureOptions struct {
+	// Prefix starts the replies.
+	Prefix string
+	// Suffix ends the replies. Start it with a new line to put it on its own
+	// line, e.g. "\n-# AI generated".
+	Suffix string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (s *SignatureOptions) Validate() error {
+	// Keep room for the reply in Discord's limit for a message.
+	if l := len(s.Prefix) + len(s.Suffix); l > 200 {
+		return fmt.Errorf("signature is too long: %d bytes; the maximum is 200", l)
+	}
+	return nil
+}
+
+// MetricsOptions configures the HTTP endpoint serving the metrics in the
+// Prometheus text format.
+type MetricsOptions struct {
+	// Listen is the "host:port" to serve /metrics on, e.g. "localhost:9090".
+	// Disabled when empty.
+	Listen string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (m *MetricsOptions) Validate() error {
+	if m.Listen != "" && !internal.IsHostPort(m.Listen) {
+		return fmt.Errorf("invalid metrics listen %q; use form 'host:port'", m.Listen)
+	}
+	return nil
+}
+
+// APIOptions configures the HTTP endpoint serving the models and the bot's
+// status as JSON.
+type APIOptions struct {
+	// Listen is the "host:port" to serve the API on, e.g. "localhost:8080".
+	// Disabled when empty.
+	Listen string
+	// Token is required as "Authorization: Bearer <token>" when not empty.
+	Token string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (a *APIOptions) Validate() error {
+	if a.Listen != "" && !internal.IsHostPort(a.Listen) {
+		return fmt.Errorf("invalid api listen %q; use form 'host:port'", a.Listen)
+	}
+	return nil
+}
+
+// WebhookOptions configures an outgoing webhook.
+type WebhookOptions struct {
+	// URL receives the HTTP POST requests. The webhook is disabled when empty.
+	URL string
+	// Timeout is the maximum duration of each request. Defaults to 10s.
+	Timeout time.Duration
+
+	_ struct{}
+}
+
+// WatermarkPolicy is a guild's policy for the watermark added on the
+// generated images.
+type WatermarkPolicy struct {
+	// Disabled removes the watermark.
+	Disabled bool
+	// Required forces the watermark; users cannot opt out.
+	Required bool
+	// Text is added next to the watermark.
+	Text string
+
+	_ struct{}
+}
+
+// AccessOptions restricts the guilds, channels and users the bot replies to.
+// The bot silently ignores the requests that are not allowed by all three
+// lists.
+type AccessOptions struct {
+	// Guilds are the guild (server) IDs. Direct messages are matched as the
+	// guild "dm".
+	Guilds AccessList
+	// Channels are the channel IDs. Threads are matched as their parent
+	// channel.
+	Channels AccessList
+	// Users are the user IDs.
+	Users AccessList
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (a *AccessOptions) Validate() error {
+	if err := a.Guilds.Validate(); err != nil {
+		return fmt.Errorf("access guilds: %w", err)
+	}
+	if err := a.Channels.Validate(); err != nil {
+		return fmt.Errorf("access channels: %w", err)
+	}
+	if err := a.Users.Validate(); err != nil {
+		return fmt.Errorf("access users: %w", err)
+	}
+	return nil
+}
+
+// Allowed returns true if the user is allowed to use the bot in this channel.
+//
+// guildID is empty for a direct message.
+func (a *AccessOptions) Allowed(guildID, channelID, userID string) bool {
+	if guildID == "" {
+		guildID = "dm"
+	}
+	return a.Guilds.Allowed(guildID) && a.Channels.Allowed(channelID) && a.Users.Allowed(userID)
+}
+
+// AccessList is an allowlist and a denylist of IDs. "*" or "all" matches every
+// ID.
+type AccessList struct {
+	// Allow are the IDs allowed. Everything is allowed when empty.
+	Allow []string
+	// Deny are the IDs denied. It has priority over Allow.
+	Deny []string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (a *AccessList) Validate() error {
+	for _, l := range [][]string{a.Allow, a.Deny} {
+		for _, id := range l {
+			if strings.TrimSpace(id) == "" {
+				return errors.New("empty ID; use \"*\" to match everything")
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed returns true if the ID is allowed.
+func (a *AccessList) Allowed(id string) bool {
+	if matchID(a.Deny, id) {
+		return false
+	}
+	return len(a.Allow) == 0 || matchID(a.Allow, id)
+}
+
+func matchID(l []string, id string) bool {
+	for _, v := range l {
+		if v == id || v == "*" || v == "all" {
+			return true
+		}
+	}
+	return false
+}
+
+// PromptVars are the variables of the system prompt that are filled in when a
+// conversation starts.
+type PromptVars struct {
+	// UserName is the display name of the user who started the conversation.
+	UserName string
+	// GuildName is the name of the server. It is empty in direct messages.
+	GuildName string
+	// Date is the day the conversation started, e.g. "2024-07-21".
+	Date string
+
+	_ struct{}
+}
+
+// RenderSystemPrompt returns the system prompt with the variables substituted.
+//
+// {{.Now}} and {{.Model}} are kept as is, since they are filled in by the LLM
+// at each prompt.
+func RenderSystemPrompt(system string, v *PromptVars) (string, error) {
+	if !strings.Contains(system, "{{") {
+		return system, nil
+	}
+	t, err := template.New("").Parse(system)
+	if err != nil {
+		return "", err
+	}
+	keys := struct {
+		UserName  string
+		GuildName string
+		Date      string
+		Now       string
+		Model     string
+	}{v.UserName, v.GuildName, v.Date, "{{.Now}}", "{{.Model}}"}
+	b := strings.Builder{}
+	if err = t.Execute(&b, &keys); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Persona is a named system prompt.
+type Persona struct {
+	// Name is the name used to select the persona.
+	Name string
+	// Description is a short description shown when listing the personas.
+	Description string
+	// Prompt is the system prompt. It is a Go template with the same values as
+	// Settings.PromptSystem.
+	Prompt string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (p *Persona) Validate() error {
+	if p.Name == "" {
+		return errors.New("persona requires a name")
+	}
+	if _, err := RenderSystemPrompt(p.Prompt, &PromptVars{}); err != nil {
+		return fmt.Errorf("persona %q: %w", p.Name, err)
+	}
+	return nil
+}
+
+// PromptTemplate is a named reusable prompt.
+type PromptTemplate struct {
+	// Name is the name used to select the template.
+	Name string
+	// Kind is either "image" to generate an image or "chat" to send the prompt
+	// to the LLM.
+	Kind string
+	// Description is a short description shown when listing the templates.
+	Description string
+	// Template is a Go template as documented at
+	// https://pkg.go.dev/text/template. Parameters provided by the user are
+	// accessed by name, e.g. {{.subject}}.
+	Template string
+
+	_ struct{}
+}
+
+// Validate checks for obvious errors in the fields.
+func (p *PromptTemplate) Validate() error {
+	if p.Name == "" {
+		return errors.New("prompt template requires a name")
+	}
+	if p.Kind != "image" && p.Kind != "chat" {
+		return fmt.Errorf("prompt template %q: invalid kind %q; use \"image\" or \"chat\"", p.Name, p.Kind)
+	}
+	if _, err := template.New(p.Name).Parse(p.Template); err != nil {
+		return fmt.Errorf("prompt template %q: %w", p.Name, err)
+	}
+	return nil
+}
+
+// Apply returns the prompt with the parameters substituted.
+//
+// It is an error to not provide a parameter used by the template.
+func (p *PromptTemplate) Apply(params map[string]string) (string, error) {
+	t, err := template.New(p.Name).Option("missingkey=error").Parse(p.Template)
+	if err != nil {
+		return "", fmt.Errorf("prompt template %q: %w", p.Name, err)
+	}
+	b := strings.Builder{}
+	if err = t.Execute(&b, params); err != nil {
+		return "", fmt.Errorf("prompt template %q: %w", p.Name, err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// ParsePromptParams parses parameters in the form "key=value; key2=value2".
+func ParsePromptParams(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, kv := range strings.Split(s, ";") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("invalid parameter %q; use form 'key=value'", kv)
+		}
+		out[k] = strings.TrimSpace(v)
+	}
+	return out, nil
 }
 
 // LoadModels loads the LLM and ImageGen models.
@@ -102,6 +806,7 @@ func LoadModels(ctx context.Context, cache string, cfg *Config) (*llm.Session, *
 	start := time.Now()
 	slog.Info("models", "state", "initializing")
 
+	py.SetLimits(&cfg.Bot.Python)
 	// Hack, since both may create <cache>/py and it would be racy, create it here.
 	if cfg.Bot.LLM.Model == "python" || cfg.Bot.ImageGen.Model == "python" {
 		cachePy := filepath.Join(cache, "py")
@@ -114,7 +819,7 @@ func LoadModels(ctx context.Context, cache string, cfg *Config) (*llm.Session, *
 	var l *llm.Session
 	var s *imagegen.Session
 	eg.Go(func() error {
-		if cfg.Bot.LLM.Remote == "" && cfg.Bot.LLM.Model == "" {
+		if cfg.Bot.LLM.Remote == "" && cfg.Bot.LLM.Model == "" && len(cfg.Bot.LLM.Backends) == 0 {
 			slog.Info("models", "message", "no llm requested")
 			return nil
 		}
@@ -125,7 +830,7 @@ func LoadModels(ctx context.Context, cache string, cfg *Config) (*llm.Session, *
 		return err
 	})
 	eg.Go(func() error {
-		if cfg.Bot.ImageGen.Remote == "" && cfg.Bot.ImageGen.Model == "" {
+		if cfg.Bot.ImageGen.Remote == "" && cfg.Bot.ImageGen.Model == "" && len(cfg.Bot.ImageGen.Backends) == 0 {
 			slog.Info("models", "message", "no image_gen requested")
 			return nil
 		}
@@ -6,6 +6,7 @@ package sillybot
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -22,3 +23,176 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("Oh no, I forgot to disable the image generation in config.yml: %s", cfg.Bot.ImageGen.Model)
 	}
 }
+
+func TestSampling(t *testing.T) {
+	o := SamplingOptions{}
+	if temperature, topP := o.Values(); temperature != 1 || topP != 0 {
+		t.Fatal(temperature, topP)
+	}
+	temperature := 3.
+	o = SamplingOptions{Temperature: &temperature, TopP: -1}
+	o.clamp()
+	if temperature, topP := o.Values(); temperature != 2 || topP != 0 {
+		t.Fatal(temperature, topP)
+	}
+	if temperature, topP := ClampSampling(0, 0.9); temperature != 0 || topP != 0.9 {
+		t.Fatal(temperature, topP)
+	}
+}
+
+func TestLongConversation(t *testing.T) {
+	data := []struct {
+		o                LongConversationOptions
+		maxContextTokens int
+		want             int
+	}{
+		{LongConversationOptions{}, 0, 0},
+		{LongConversationOptions{}, 1000, 800},
+		{LongConversationOptions{Threshold: 0.5}, 1000, 500},
+		{LongConversationOptions{Disabled: true}, 1000, 0},
+	}
+	for i, line := range data {
+		if err := line.o.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if got := line.o.Tokens(line.maxContextTokens); got != line.want {
+			t.Fatalf("#%d: want %d, got %d", i, line.want, got)
+		}
+	}
+	o := LongConversationOptions{Threshold: 1.5}
+	if err := o.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSignatureOptions(t *testing.T) {
+	s := SignatureOptions{Prefix: "**Bot**: ", Suffix: "\n-# AI generated"}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.Suffix = strings.Repeat("a", 200)
+	if err := s.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMetricsOptions(t *testing.T) {
+	for i, listen := range []string{"", "localhost:9090", "0.0.0.0:9090"} {
+		o := MetricsOptions{Listen: listen}
+		if err := o.Validate(); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	for i, listen := range []string{"9090", "localhost", "http://localhost:9090"} {
+		o := MetricsOptions{Listen: listen}
+		if err := o.Validate(); err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestPromptTemplate(t *testing.T) {
+	p := PromptTemplate{Name: "cat", Kind: "image", Template: "a {{.mood}} cat, {{.style}}"}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	params, err := ParsePromptParams(" mood = happy ; style=oil painting, 4k;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Apply(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a happy cat, oil painting, 4k"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if _, err = p.Apply(map[string]string{"mood": "sad"}); err == nil {
+		t.Fatal("expected missing parameter error")
+	}
+	if _, err = ParsePromptParams("mood"); err == nil {
+		t.Fatal("expected invalid parameter error")
+	}
+	p.Kind = "video"
+	if err = p.Validate(); err == nil {
+		t.Fatal("expected invalid kind error")
+	}
+}
+
+func TestPersona(t *testing.T) {
+	c := Config{}
+	c.Bot.Settings.Personas = []Persona{{Name: "pirate", Prompt: "You are a pirate talking to {{.UserName}}."}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Bot.Settings.Personas = append(c.Bot.Settings.Personas, Persona{Name: "pirate"})
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected duplicate persona error")
+	}
+	for i, p := range []Persona{{Prompt: "You are helpful."}, {Name: "bad", Prompt: "{{.Unknown}}"}} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestRenderSystemPrompt(t *testing.T) {
+	v := PromptVars{UserName: "Joe", GuildName: "Ottawa", Date: "2024-07-21"}
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"You are an AI assistant.", "You are an AI assistant."},
+		{"You talk to {{.UserName}} on {{.GuildName}} on {{.Date}}.", "You talk to Joe on Ottawa on 2024-07-21."},
+		{"You are {{.Model}}, it is {{.Now}}.", "You are {{.Model}}, it is {{.Now}}."},
+	}
+	for i, line := range data {
+		got, err := RenderSystemPrompt(line.in, &v)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if got != line.want {
+			t.Errorf("#%d: want %q, got %q", i, line.want, got)
+		}
+	}
+	for i, in := range []string{"{{.UserName", "{{.Unknown}}"} {
+		if _, err := RenderSystemPrompt(in, &v); err == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestAccess(t *testing.T) {
+	a := AccessOptions{}
+	if !a.Allowed("", "c", "u") || !a.Allowed("g", "c", "u") {
+		t.Fatal("expected everything to be allowed by default")
+	}
+	a = AccessOptions{
+		Guilds:   AccessList{Allow: []string{"g1", "dm"}},
+		Channels: AccessList{Deny: []string{"noisy"}},
+		Users:    AccessList{Allow: []string{"all"}, Deny: []string{"troll"}},
+	}
+	data := []struct {
+		guild, channel, user string
+		want                 bool
+	}{
+		{"g1", "c", "u", true},
+		{"", "c", "u", true},
+		{"g2", "c", "u", false},
+		{"g1", "noisy", "u", false},
+		{"g1", "c", "troll", false},
+	}
+	for i, line := range data {
+		if got := a.Allowed(line.guild, line.channel, line.user); got != line.want {
+			t.Fatalf("#%d: want %t, got %t", i, line.want, got)
+		}
+	}
+	a = AccessOptions{Channels: AccessList{Deny: []string{"*"}}}
+	if a.Allowed("g1", "c", "u") {
+		t.Fatal("expected everything to be denied")
+	}
+	a = AccessOptions{Users: AccessList{Allow: []string{""}}}
+	if a.Validate() == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package sillybot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PromptLogOptions configures the log of the generated prompts.
+type PromptLogOptions struct {
+	// Path is the JSONL file to append to. Logging is disabled when empty.
+	Path string
+	// MaxSize rotates the file once it reaches this size in bytes. 0 disables
+	// rotation by size.
+	MaxSize int64 `yaml:"max_size"`
+	// Daily rotates the file when the date changes.
+	Daily bool
+
+	_ struct{}
+}
+
+// PromptLogEntry is one line in the prompt log.
+type PromptLogEntry struct {
+	Time           time.Time `json:"time"`
+	User           string    `json:"user,omitempty"`
+	Guild          string    `json:"guild,omitempty"`
+	Channel        string    `json:"channel,omitempty"`
+	Command        string    `json:"command,omitempty"`
+	Description    string    `json:"description,omitempty"`
+	ImagePrompt    string    `json:"image_prompt,omitempty"`
+	Labels         string    `json:"labels,omitempty"`
+	Seed           int       `json:"seed,omitempty"`
+	Steps          int       `json:"steps,omitempty"`
+	Width          int       `json:"width,omitempty"`
+	Height         int       `json:"height,omitempty"`
+	NegativePrompt string    `json:"negative_prompt,omitempty"`
+	Model          string    `json:"model,omitempty"`
+}
+
+// PromptLog appends the generated prompts to a JSONL file, so they can be
+// searched with grep or jq.
+//
+// It is distinct from slog, it is meant to build prompt libraries.
+type PromptLog struct {
+	mu   sync.Mutex
+	opts PromptLogOptions
+	f    *os.File
+	size int64
+	day  string
+
+	// now is mocked in test.
+	now func() time.Time
+}
+
+// NewPromptLog opens the prompt log for appending.
+func NewPromptLog(opts *PromptLogOptions) (*PromptLog, error) {
+	p := &PromptLog{opts: *opts, now: time.Now}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write appends an entry to the log, rotating the file if needed.
+func (p *PromptLog) Write(e *PromptLogEntry) error {
+	if e.Time.IsZero() {
+		e.Time = p.now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return os.ErrClosed
+	}
+	if p.size != 0 && ((p.opts.MaxSize > 0 && p.size+int64(len(b)) > p.opts.MaxSize) || (p.opts.Daily && p.day != day(p.now()))) {
+		if err = p.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := p.f.Write(b)
+	p.size += int64(n)
+	return err
+}
+
+// Close closes the log.
+func (p *PromptLog) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return nil
+	}
+	err := p.f.Close()
+	p.f = nil
+	return err
+}
+
+func (p *PromptLog) open() error {
+	f, err := os.OpenFile(p.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open prompt log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to open prompt log: %w", err)
+	}
+	p.f = f
+	p.size = fi.Size()
+	p.day = day(p.now())
+	if p.size != 0 {
+		p.day = day(fi.ModTime())
+	}
+	return nil
+}
+
+// rotate renames the current file with the date of its last entry and opens
+// a new one.
+//
+// On failure, the current file is kept open so the following entries are not
+// lost.
+func (p *PromptLog) rotate() error {
+	fi, err := p.f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to rotate prompt log: %w", err)
+	}
+	dst, err := rotatedName(p.opts.Path, fi.ModTime())
+	if err != nil {
+		return fmt.Errorf("failed to rotate prompt log: %w", err)
+	}
+	// The file must be closed to be renamed on Windows.
+	if err = p.f.Close(); err != nil {
+		return fmt.Errorf("failed to rotate prompt log: %w", err)
+	}
+	p.f = nil
+	if err = os.Rename(p.opts.Path, dst); err == nil {
+		if err = p.open(); err == nil {
+			return nil
+		}
+		// Put it back.
+		_ = os.Rename(dst, p.opts.Path)
+	}
+	if err2 := p.open(); err2 != nil {
+		return fmt.Errorf("failed to rotate prompt log: %w; %w", err, err2)
+	}
+	return fmt.Errorf("failed to rotate prompt log: %w", err)
+}
+
+// rotatedName returns the name to rename the log at p to, suffixed with t. A
+// counter is added when a file with the same name already exists, e.g. when
+// the file was rotated twice in the same millisecond.
+func rotatedName(p string, t time.Time) (string, error) {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext) + "-" + t.Format("2006-01-02T15-04-05.000")
+	dst := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); errors.Is(err, fs.ErrNotExist) {
+			return dst, nil
+		} else if err != nil {
+			return "", err
+		}
+		dst = base + "-" + strconv.Itoa(i) + ext
+	}
+}
+
+func day(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
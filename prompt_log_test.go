@@ -0,0 +1,143 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package sillybot
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPromptLog(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPromptLog(&PromptLogOptions{Path: filepath.Join(dir, "prompts.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Write(&PromptLogEntry{User: "joe", Description: "a cat", ImagePrompt: "a cute cat", Seed: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Write(&PromptLogEntry{User: "jane", Description: "a dog"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries := readPromptLog(t, filepath.Join(dir, "prompts.jsonl"))
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.User != "joe" || e.ImagePrompt != "a cute cat" || e.Seed != 42 || e.Time.IsZero() {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if err = p.Write(&PromptLogEntry{}); err == nil {
+		t.Fatal("expected error after Close")
+	}
+}
+
+func TestPromptLog_RotateSize(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPromptLog(&PromptLogOptions{Path: filepath.Join(dir, "prompts.jsonl"), MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for range 2 {
+		if err = p.Write(&PromptLogEntry{Description: "a fairly long description to fill the file"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countFiles(t, dir); got != 2 {
+		t.Fatalf("expected 2 files, got %d", got)
+	}
+	if entries := readPromptLog(t, filepath.Join(dir, "prompts.jsonl")); len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+}
+
+func TestPromptLog_RotateSameTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prompts.jsonl")
+	p, err := NewPromptLog(&PromptLogOptions{Path: path, MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// The rotated files would have the same name without a counter.
+	last := time.Date(2024, 7, 15, 12, 0, 0, 0, time.UTC)
+	for range 4 {
+		if err = p.Write(&PromptLogEntry{Description: "a fairly long description to fill the file"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path, last, last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countFiles(t, dir); got != 4 {
+		t.Fatalf("expected 4 files, got %d", got)
+	}
+	for _, name := range []string{"prompts-2024-07-15T12-00-00.000.jsonl", "prompts-2024-07-15T12-00-00.000-1.jsonl", "prompts-2024-07-15T12-00-00.000-2.jsonl"} {
+		if entries := readPromptLog(t, filepath.Join(dir, name)); len(entries) != 1 {
+			t.Fatalf("%s: expected 1 entry, got %d", name, len(entries))
+		}
+	}
+}
+
+func TestPromptLog_RotateDaily(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPromptLog(&PromptLogOptions{Path: filepath.Join(dir, "prompts.jsonl"), Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	now := time.Date(2024, 7, 15, 23, 59, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	p.day = day(now)
+	if err = p.Write(&PromptLogEntry{Description: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Write(&PromptLogEntry{Description: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := countFiles(t, dir); got != 1 {
+		t.Fatalf("expected 1 file, got %d", got)
+	}
+	now = now.Add(time.Hour)
+	if err = p.Write(&PromptLogEntry{Description: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := countFiles(t, dir); got != 2 {
+		t.Fatalf("expected 2 files, got %d", got)
+	}
+}
+
+func readPromptLog(t *testing.T, p string) []PromptLogEntry {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []PromptLogEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := PromptLogEntry{}
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func countFiles(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
@@ -8,6 +8,7 @@
 import argparse
 import base64
 import datetime
+import hmac
 import http.server
 import io
 import json
@@ -17,6 +18,7 @@ import signal
 import sys
 import time
 
+import PIL.Image
 import diffusers
 import huggingface_hub
 import torch
@@ -25,6 +27,16 @@ DEVICE = "cuda" if torch.cuda.is_available() else "mps" if torch.backends.mps.is
 DTYPE = torch.float16 if DEVICE in ("cuda", "mps") else torch.float32
 
 
+def device_info():
+  """Returns the compute device and its memory in bytes, when known."""
+  info = {"device": DEVICE}
+  if DEVICE == "cuda":
+    props = torch.cuda.get_device_properties(0)
+    info["device_name"] = props.name
+    info["vram"] = props.total_memory
+  return info
+
+
 def get_generator(seed):
   """Returns a deterministic random number generator."""
   if DEVICE in ("cuda", "mps"):
@@ -50,7 +62,7 @@ def load_sdxl_lcm_lora():
 def load_segmind_ssd_1b_lcm_lora():
   """Returns Segmind SSD 1B with LCM LoRa."""
   pipe = diffusers.DiffusionPipeline.from_pretrained("segmind/SSD-1B")
-  pipe.load_lora_weights("latent-consistency/lcm-lora-ssd-1b")
+  pipe.load_lora_weights("latent-consistency/lcm-lora-ssd-1b", adapter_name="lcm")
   pipe.scheduler = diffusers.LCMScheduler.from_config(pipe.scheduler.config)
   return pipe
 
@@ -62,6 +74,30 @@ def load_segmind_moe():
 
 class Handler(http.server.BaseHTTPRequestHandler):
   _pipe = None
+  # Bearer token required on all requests, if set.
+  _auth_token = None
+  # Created on first use from _pipe, sharing its weights.
+  _img2img = None
+  # Loaded on first use, it is a separate model.
+  _upscaler = None
+  # Adapters always active, loaded with the model.
+  _base_adapters = ["lcm"]
+  # Additional LoRAs users can select, name to Hugging Face repository. They
+  # are loaded on first use.
+  _loras = {}
+  _loaded_loras = set()
+  # Samplers users can select, name to the diffusers scheduler class and its
+  # options. The default is the scheduler the pipeline was loaded with.
+  _samplers = {
+      "ddim": ("DDIMScheduler", {}),
+      "dpmpp_2m": ("DPMSolverMultistepScheduler", {}),
+      "dpmpp_2m_karras": ("DPMSolverMultistepScheduler", {"use_karras_sigmas": True}),
+      "euler": ("EulerDiscreteScheduler", {}),
+      "euler_a": ("EulerAncestralDiscreteScheduler", {}),
+      "lcm": ("LCMScheduler", {}),
+  }
+  # Created on first use from the default scheduler's config.
+  _schedulers = {}
   #_neg = "out of frame, lowers, text, error, cropped, worst quality, low quality, jpeg artifacts, ugly, duplicate, morbid, mutilated, out of frame, extra fingers, mutated hands, poorly drawn hands, poorly drawn face, mutation, deformed, blurry, dehydrated, bad anatomy, bad proportions, extra limbs, cloned face"
   # , disfigured, gross proportions, malformed limbs, missing arms, missing legs, extra arms, extra legs, fused fingers, too many fingers, long neck, username, watermark, signature"
   #_neg = "bad quality, worse quality"
@@ -80,8 +116,20 @@ class Handler(http.server.BaseHTTPRequestHandler):
   #_width = 1344
   #_height = 768
 
+  def check_auth(self):
+    """Returns True if the request is authorized, otherwise replies 401."""
+    if not Handler._auth_token:
+      return True
+    got = self.headers.get("Authorization", "").encode("utf-8")
+    if hmac.compare_digest(got, ("Bearer " + Handler._auth_token).encode("utf-8")):
+      return True
+    self.send_error(401)
+    return False
+
   def do_GET(self):
     try:
+      if not self.check_auth():
+        return
       if self.path == "/health":
         self.on_health()
       else:
@@ -94,8 +142,14 @@ class Handler(http.server.BaseHTTPRequestHandler):
   def do_POST(self):
     try:
       logging.info("Got request %s", self.path)
+      if not self.check_auth():
+        return
       if self.path == "/api/generate":
         self.on_generate()
+      elif self.path == "/api/generate_stream":
+        self.on_generate_stream()
+      elif self.path == "/api/upscale":
+        self.on_upscale()
       elif self.path == "/api/quit":
         self.on_quit()
       else:
@@ -105,55 +159,250 @@ class Handler(http.server.BaseHTTPRequestHandler):
       print(str(e), file=sys.stderr)
       sys.exit(1)
 
-  def reply_json(self, data):
-    self.send_response(200)
+  def reply_json(self, data, code=200):
+    self.send_response(code)
     self.send_header("Content-Type", "application/json")
     self.end_headers()
     self.wfile.write(json.dumps(data).encode("ascii"))
 
+  def reply_error(self, e, code=500):
+    """Logs the traceback and replies the error so the client can surface it.
+
+    The server keeps running.
+    """
+    data = gen_error(e)
+    logging.exception("Request failed: %s", data["kind"])
+    self.reply_json(data, code)
+
   def on_health(self):
-    self.reply_json({"status": "ok"})
+    self.reply_json(dict(status="ok", loras=sorted(Handler._loras), samplers=sorted(Handler._samplers), **device_info()))
 
   def on_quit(self):
     self.reply_json({"quitting": True})
     self.server.server_close()
 
-  def on_generate(self):
-    start = time.time()
+  def read_request(self):
     content_length = int(self.headers['Content-Length'])
     post_data = self.rfile.read(content_length)
     data = json.loads(post_data)
+    lora = data.get("lora") or None
+    if lora and lora not in Handler._loras:
+      raise ValueError(f"unknown lora {lora!r}")
+    sampler = data.get("sampler") or None
+    if sampler and sampler not in Handler._samplers:
+      raise ValueError(f"unknown sampler {sampler!r}")
     # TODO: Structured format and verifications.
-    prompt = data["message"]
-    # Use 8 for Segmind + LCM Lora, 25 to 40 otherwise.
-    steps = data["steps"]
-    seed = data["seed"]
-    img = self.gen_image(prompt, steps, seed)
-    d = io.BytesIO()
-    img.save(d, format="png")
-    resp = {
-        "image": base64.b64encode(d.getvalue()).decode(),
+    return {
+        "prompt": data["message"],
+        # Use 8 for Segmind + LCM Lora, 25 to 40 otherwise.
+        "steps": data["steps"],
+        "seed": data["seed"],
+        "width": data.get("width") or self._width,
+        "height": data.get("height") or self._height,
+        "neg": data.get("negative_prompt") or None,
+        "base_image": decode_image(data.get("base_image")),
+        # Only used with base_image.
+        "strength": data.get("strength") or 0.6,
+        "lora": lora,
+        # 0 is a valid weight.
+        "lora_weight": 1.0 if data.get("lora_weight") is None else data["lora_weight"],
+        "sampler": sampler,
     }
-    self.reply_json(resp)
-    name = datetime.datetime.now().strftime("%Y-%m-%dT%H-%M-%S") + ".png"
-    logging.info(f"Generated image for {prompt} in {time.time()-start:.1f}s; saving as {name}")
-    img.save(name)
+
+  def on_generate(self):
+    start = time.time()
+    try:
+      req = self.read_request()
+    except (KeyError, TypeError, ValueError) as e:
+      self.reply_error(e, 400)
+      return
+    try:
+      img = self.gen_image(**req)
+    except Exception as e:
+      self.reply_error(e)
+      return
+    self.reply_json({"image": encode_png(img)})
+    save_image(req["prompt"], img, start)
+
+  def on_generate_stream(self):
+    """Same as on_generate but streams the progress after each step as server
+    sent events, with the image in the last event.
+    """
+    start = time.time()
+    try:
+      req = self.read_request()
+    except (KeyError, TypeError, ValueError) as e:
+      self.reply_error(e, 400)
+      return
+    self.send_response(200)
+    self.send_header("Content-Type", "text/event-stream")
+    self.end_headers()
+
+    def send(data):
+      self.wfile.write(b"data: " + json.dumps(data).encode("ascii") + b"\n\n")
+      self.wfile.flush()
+
+    # img2img skips the first steps, depending on the strength.
+    steps = req["steps"]
+    if req["base_image"]:
+      steps = max(int(steps * req["strength"]), 1)
+
+    def on_step_end(pipe, step, timestep, callback_kwargs):
+      send({"step": step + 1, "steps": steps})
+      return callback_kwargs
+
+    try:
+      img = self.gen_image(callback=on_step_end, **req)
+    except Exception as e:
+      # The status was already sent, report the error as the last event.
+      data = gen_error(e)
+      logging.exception("Request failed: %s", data["kind"])
+      send(data)
+      return
+    send({"image": encode_png(img)})
+    save_image(req["prompt"], img, start)
+
+  def on_upscale(self):
+    start = time.time()
+    try:
+      content_length = int(self.headers['Content-Length'])
+      data = json.loads(self.rfile.read(content_length))
+      prompt = data.get("message") or ""
+      img = decode_image(data["image"])
+      if not img:
+        raise ValueError("image is required")
+    except (KeyError, TypeError, ValueError) as e:
+      self.reply_error(e, 400)
+      return
+    try:
+      img = self.upscale(prompt, img)
+    except Exception as e:
+      self.reply_error(e)
+      return
+    self.reply_json({"image": encode_png(img)})
+    save_image(prompt, img, start)
 
   @classmethod
-  def gen_image(cls, prompt, steps, seed):
-    img = cls._pipe(
+  def upscale(cls, prompt, img):
+    """Returns the image twice as large."""
+    if not cls._upscaler:
+      logging.info("Loading the upscaler")
+      cls._upscaler = diffusers.StableDiffusionLatentUpscalePipeline.from_pretrained(
+          "stabilityai/sd-x2-latent-upscaler", torch_dtype=DTYPE).to(DEVICE)
+    return cls._upscaler(
         prompt=prompt,
-        # Ned is not used when guidance_scale is 1.0.
-        #negative_prompt=cls._neg,
-        num_inference_steps=steps,
-        generator=get_generator(seed),
-        # Use 1.0 when using Segmind + LCM LoRA, 9.0 for Segmind raw, 7.0 for SD3.
-        guidance_scale=1.0,
-        width=cls._width,
-        height=cls._height,
+        image=img.convert("RGB"),
+        num_inference_steps=20,
+        guidance_scale=0,
+        generator=get_generator(0),
     ).images[0]
+
+  @classmethod
+  def gen_image(cls, prompt, steps, seed, width=None, height=None, neg=None, base_image=None, strength=None, lora=None, lora_weight=None, sampler=None, callback=None):
+    width = width or cls._width
+    height = height or cls._height
+    cls.set_lora(lora, lora_weight)
+    kwargs = {}
+    pipe = cls._pipe
+    if base_image:
+      if not cls._img2img:
+        cls._img2img = diffusers.AutoPipelineForImage2Image.from_pipe(cls._pipe)
+      pipe = cls._img2img
+      kwargs["image"] = base_image.convert("RGB").resize((width, height))
+      kwargs["strength"] = strength
+    default = pipe.scheduler
+    if sampler:
+      pipe.scheduler = cls.get_scheduler(sampler, default)
+    # Use 1.0 when using Segmind + LCM LoRA, 9.0 for Segmind raw, 7.0 for SD3.
+    # Neg is not used when guidance_scale is 1.0, so raise it a bit when
+    # provided; LCM degrades quickly above 2.
+    guidance = 1.5 if neg else 1.0
+    try:
+      img = pipe(
+          prompt=prompt,
+          negative_prompt=neg,
+          num_inference_steps=steps,
+          generator=get_generator(seed),
+          guidance_scale=guidance,
+          width=width,
+          height=height,
+          callback_on_step_end=callback,
+          **kwargs,
+      ).images[0]
+    finally:
+      # The other requests use the default sampler.
+      pipe.scheduler = default
     return img
 
+  @classmethod
+  def get_scheduler(cls, sampler, default):
+    """Returns the scheduler for the sampler, sharing the configuration of the
+    default one.
+    """
+    if sampler not in cls._schedulers:
+      name, options = cls._samplers[sampler]
+      cls._schedulers[sampler] = getattr(diffusers, name).from_config(default.config, **options)
+    return cls._schedulers[sampler]
+
+  @classmethod
+  def set_lora(cls, lora, weight):
+    """Activates the LoRA on top of the base adapters, or only the base
+    adapters when lora is None.
+
+    The img2img pipeline shares the weights so it is affected too.
+    """
+    if not cls._loras:
+      return
+    if lora and lora not in cls._loaded_loras:
+      logging.info("Loading LoRA %s from %s", lora, cls._loras[lora])
+      cls._pipe.load_lora_weights(cls._loras[lora], adapter_name=lora)
+      cls._loaded_loras.add(lora)
+    names = list(cls._base_adapters)
+    weights = [1.0] * len(names)
+    if lora:
+      names.append(lora)
+      weights.append(weight or 1.0)
+    cls._pipe.set_adapters(names, adapter_weights=weights)
+
+
+def gen_error(e):
+  """Returns the error to reply to the client for an exception.
+
+  The kind is "out_of_memory" when the device ran out of memory, common on
+  small GPUs, so the client can suggest smaller dimensions. The cache is
+  released so the next request has a chance to succeed.
+  """
+  msg = str(e).strip().splitlines()
+  msg = msg[0] if msg else type(e).__name__
+  kind = "internal"
+  if isinstance(e, torch.cuda.OutOfMemoryError) or "out of memory" in str(e).lower():
+    kind = "out_of_memory"
+    if DEVICE == "cuda":
+      torch.cuda.empty_cache()
+  elif isinstance(e, (KeyError, TypeError, ValueError)):
+    kind = "bad_request"
+  return {"error": msg, "kind": kind}
+
+
+def decode_image(data):
+  """Returns the base64 encoded image as a PIL image, or None."""
+  if not data:
+    return None
+  return PIL.Image.open(io.BytesIO(base64.b64decode(data)))
+
+
+def encode_png(img):
+  """Returns the image as a base64 encoded PNG."""
+  d = io.BytesIO()
+  img.save(d, format="png")
+  return base64.b64encode(d.getvalue()).decode()
+
+
+def save_image(prompt, img, start):
+  name = datetime.datetime.now().strftime("%Y-%m-%dT%H-%M-%S") + ".png"
+  logging.info(f"Generated image for {prompt} in {time.time()-start:.1f}s; saving as {name}")
+  img.save(name)
+
 
 def main():
   parser = argparse.ArgumentParser(description=sys.modules[__name__].__doc__)
@@ -162,10 +411,20 @@ def main():
   parser.add_argument("--host", default="localhost",
                       help="Host to listen to. Use 0.0.0.0 to listen on all IPs")
   parser.add_argument("--port", default=8032, type=int)
+  parser.add_argument("--auth-token", default=os.environ.get("IMAGE_GEN_AUTH_TOKEN"),
+                      help="Bearer token required on all requests. Defaults to $IMAGE_GEN_AUTH_TOKEN")
+  parser.add_argument("--lora", action="append", default=[], metavar="NAME=REPO",
+                      help="LoRA users can select by name, loaded from the Hugging Face repository on first use. Can be specified multiple times")
   parser.add_argument("--prompt", help="Run once and exit")
   args = parser.parse_args()
   logging.basicConfig(level=logging.DEBUG)
 
+  for l in args.lora:
+    name, sep, repo = l.partition("=")
+    if not name or not sep or not repo:
+      parser.error(f"invalid --lora {l!r}; expected NAME=REPO")
+    Handler._loras[name] = repo
+
   if args.token:
     # Needed to retrieve SD3.
     huggingface_hub.login(token=args.token)
@@ -174,6 +433,8 @@ def main():
   Handler._pipe = load_segmind_ssd_1b_lcm_lora().to(DEVICE, dtype=DTYPE)
   #Handler._pipe = load_segmind_moe()
   logging.info("Model loaded using %s", DEVICE)
+  if DEVICE == "cpu":
+    logging.warning("No GPU detected; image generation will be very slow")
 
   if args.prompt:
     start = time.time()
@@ -184,6 +445,7 @@ def main():
     img.save(name)
     return 0
 
+  Handler._auth_token = args.auth_token
   httpd = http.server.HTTPServer((args.host, args.port), Handler)
   logging.info(f"Started server on port {args.host}:{args.port}")
 
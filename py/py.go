@@ -12,14 +12,43 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 )
 
+// ErrTooManyProcesses is returned by Run when Limits.MaxProcesses python
+// processes are already running.
+var ErrTooManyProcesses = errors.New("too many python processes running")
+
+// Limits bounds the python processes started by Run.
+//
+// Each python backend loads a model in memory, so running too many at once,
+// e.g. while switching models, can exhaust the memory.
+type Limits struct {
+	// MaxProcesses is the maximum number of python processes running
+	// concurrently. 0 means no limit.
+	MaxProcesses int `yaml:"max_processes"`
+	// Wait is how long Run waits for another process to terminate when the
+	// limit is reached before failing. 0 means failing immediately.
+	Wait time.Duration
+
+	_ struct{}
+}
+
+// SetLimits sets the limits applied to the next calls to Run.
+func SetLimits(l *Limits) {
+	procs.mu.Lock()
+	defer procs.mu.Unlock()
+	procs.limits = *l
+}
+
 // RecreateVirtualEnvIfNeeded recreates the virtualenv if needed.
 func RecreateVirtualEnvIfNeeded(ctx context.Context, cache string) error {
 	if needRecreate(cache) {
@@ -29,7 +58,19 @@ func RecreateVirtualEnvIfNeeded(ctx context.Context, cache string) error {
 }
 
 // Run runs a python subprocess inside a virtualenv.
+//
+// It waits for a slot if the limits set with SetLimits are reached.
 func Run(ctx context.Context, venv string, cmd []string, cwd, log string) (<-chan error, func() error, error) {
+	if err := acquire(ctx); err != nil {
+		slog.Error("exec", "message", "failed to start", "cmd", cmd, "error", err)
+		return nil, nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			release()
+		}
+	}()
 	l, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
 	if err != nil {
 		return nil, nil, err
@@ -83,15 +124,66 @@ func Run(ctx context.Context, venv string, cmd []string, cwd, log string) (<-cha
 		slog.Error("exec", "message", "failed to start", "cmd", cmd, "cwd", cwd, "error", err)
 		return nil, nil, err
 	}
+	started = true
 	slog.Info("exec", "state", "started", "cmd", cmd, "cwd", cwd, "pid", "log", log, c.Process.Pid, "duration", time.Since(start).Round(time.Millisecond))
 	go func() {
-		doneErr <- c.Wait()
+		err := c.Wait()
+		release()
+		doneErr <- err
 		isDone <- struct{}{}
 		slog.Info("exec", "state", "terminated", "pid", c.Process.Pid, "duration", time.Since(start).Round(time.Millisecond))
 	}()
 	return doneErr, c.Cancel, nil
 }
 
+// procs tracks the running python processes to enforce Limits.
+var procs = struct {
+	mu       sync.Mutex
+	limits   Limits
+	running  int
+	released chan struct{}
+}{released: make(chan struct{})}
+
+// acquire reserves a slot for a new process.
+func acquire(ctx context.Context) error {
+	var timeout <-chan time.Time
+	for {
+		procs.mu.Lock()
+		limits := procs.limits
+		running := procs.running
+		released := procs.released
+		if limits.MaxProcesses <= 0 || running < limits.MaxProcesses {
+			procs.running++
+			procs.mu.Unlock()
+			return nil
+		}
+		procs.mu.Unlock()
+		if timeout == nil {
+			if limits.Wait <= 0 {
+				return fmt.Errorf("%w: %d running, the limit is %d", ErrTooManyProcesses, running, limits.MaxProcesses)
+			}
+			slog.Info("exec", "state", "waiting", "running", running, "max", limits.MaxProcesses, "wait", limits.Wait)
+			timeout = time.After(limits.Wait)
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return fmt.Errorf("%w: %d running, the limit is %d; waited %s", ErrTooManyProcesses, running, limits.MaxProcesses, limits.Wait)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot and wakes up the waiters.
+func release() {
+	procs.mu.Lock()
+	defer procs.mu.Unlock()
+	procs.running--
+	close(procs.released)
+	procs.released = make(chan struct{})
+}
+
 //
 
 var (
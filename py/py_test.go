@@ -0,0 +1,41 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package py
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	SetLimits(&Limits{MaxProcesses: 1})
+	t.Cleanup(func() { SetLimits(&Limits{}) })
+	ctx := context.Background()
+	if err := acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := acquire(ctx); !errors.Is(err, ErrTooManyProcesses) {
+		t.Fatalf("expected ErrTooManyProcesses, got %v", err)
+	}
+
+	// Waits for the slot to be released.
+	SetLimits(&Limits{MaxProcesses: 1, Wait: time.Minute})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	if err := acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Times out.
+	SetLimits(&Limits{MaxProcesses: 1, Wait: time.Millisecond})
+	if err := acquire(ctx); !errors.Is(err, ErrTooManyProcesses) {
+		t.Fatalf("expected ErrTooManyProcesses, got %v", err)
+	}
+	release()
+}